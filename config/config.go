@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strconv"
 )
 
 // Config holds the application configuration
@@ -17,6 +18,27 @@ type Config struct {
 	APIPort string
 	APIKey  string
 
+	// Seconds between reloads of the go_api_keys table
+	APIKeyRefreshSeconds int
+
+	// Authentication mode: api_key, vicidial or both
+	AuthMode string
+
+	// Seconds a successful vicidial_users login is cached
+	AuthCacheSeconds int
+
+	// Secret keying the hashes of identifiers in proofs of erasure
+	PrivacyHashSecret string
+
+	// Background jobs: worker count, seconds between polls of go_api_jobs,
+	// seconds without a heartbeat before a running job is recovered, days
+	// finished jobs are kept, and this process's unique instance ID
+	JobWorkers       int
+	JobPollSeconds   int
+	JobStaleSeconds  int
+	JobRetentionDays int
+	JobInstanceID    string
+
 	// Timezone
 	Timezone string
 
@@ -27,15 +49,24 @@ type Config struct {
 // LoadConfig loads configuration from environment variables
 func LoadConfig() *Config {
 	return &Config{
-		DBHost:     getEnv("DB_HOST", "localhost"),
-		DBPort:     getEnv("DB_PORT", "3306"),
-		DBUser:     getEnv("DB_USER", "root"),
-		DBPassword: getEnv("DB_PASSWORD", ""),
-		DBName:     getEnv("DB_NAME", "asterisk"),
-		APIPort:    getEnv("API_PORT", "8080"),
-		APIKey:     getEnv("API_KEY", ""),
-		Timezone:   getEnv("TIMEZONE", "America/New_York"),
-		LogLevel:   getEnv("LOG_LEVEL", "info"),
+		DBHost:               getEnv("DB_HOST", "localhost"),
+		DBPort:               getEnv("DB_PORT", "3306"),
+		DBUser:               getEnv("DB_USER", "root"),
+		DBPassword:           getEnv("DB_PASSWORD", ""),
+		DBName:               getEnv("DB_NAME", "asterisk"),
+		APIPort:              getEnv("API_PORT", "8080"),
+		APIKey:               getEnv("API_KEY", ""),
+		APIKeyRefreshSeconds: getEnvInt("API_KEY_REFRESH_SECONDS", 30),
+		AuthMode:             getEnv("AUTH_MODE", "api_key"),
+		AuthCacheSeconds:     getEnvInt("AUTH_CACHE_SECONDS", 60),
+		PrivacyHashSecret:    getEnv("PRIVACY_HASH_SECRET", ""),
+		JobWorkers:           getEnvInt("JOB_WORKERS", 4),
+		JobPollSeconds:       getEnvInt("JOB_POLL_SECONDS", 2),
+		JobStaleSeconds:      getEnvInt("JOB_STALE_SECONDS", 120),
+		JobRetentionDays:     getEnvInt("JOB_RETENTION_DAYS", 30),
+		JobInstanceID:        getEnv("JOB_INSTANCE_ID", ""),
+		Timezone:             getEnv("TIMEZONE", "America/New_York"),
+		LogLevel:             getEnv("LOG_LEVEL", "info"),
 	}
 }
 
@@ -47,3 +78,12 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// getEnvInt gets an integer environment variable with a default fallback
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
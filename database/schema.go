@@ -0,0 +1,84 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaStatements holds the DDL for tables owned by this API.
+// VICIdial's own tables are never created or altered here.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS go_api_keys (
+		key_id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		client_name VARCHAR(100) NOT NULL,
+		key_prefix VARCHAR(16) NOT NULL,
+		key_hash CHAR(64) NOT NULL,
+		scopes TEXT NOT NULL,
+		active ENUM('Y','N') NOT NULL DEFAULT 'Y',
+		expires_at DATETIME NULL,
+		created_at DATETIME NOT NULL,
+		revoked_at DATETIME NULL,
+		UNIQUE KEY key_hash (key_hash),
+		KEY client_name (client_name)
+	) ENGINE=InnoDB`,
+	`CREATE TABLE IF NOT EXISTS go_api_jobs (
+		job_id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		job_type VARCHAR(50) NOT NULL,
+		status ENUM('QUEUED','RUNNING','DONE','FAILED','CANCELLED') NOT NULL DEFAULT 'QUEUED',
+		params MEDIUMTEXT NOT NULL,
+		progress INT UNSIGNED NOT NULL DEFAULT 0,
+		total INT UNSIGNED NOT NULL DEFAULT 0,
+		checkpoint MEDIUMTEXT NULL,
+		result MEDIUMTEXT NULL,
+		error TEXT NULL,
+		user VARCHAR(100) NOT NULL DEFAULT '',
+		user_group VARCHAR(20) NOT NULL DEFAULT '',
+		api_client VARCHAR(100) NOT NULL DEFAULT '',
+		on_behalf_of VARCHAR(100) NOT NULL DEFAULT '',
+		ip_address VARCHAR(45) NOT NULL DEFAULT '',
+		owner VARCHAR(100) NULL,
+		attempts INT UNSIGNED NOT NULL DEFAULT 0,
+		cancel_requested ENUM('Y','N') NOT NULL DEFAULT 'N',
+		created_at DATETIME NOT NULL,
+		started_at DATETIME NULL,
+		heartbeat_at DATETIME NULL,
+		finished_at DATETIME NULL,
+		KEY status (status, job_id),
+		KEY user (user),
+		KEY api_client (api_client)
+	) ENGINE=InnoDB`,
+	`CREATE TABLE IF NOT EXISTS go_api_custom_archive (
+		lead_id INT(9) UNSIGNED NOT NULL PRIMARY KEY,
+		list_id BIGINT(14) UNSIGNED NOT NULL,
+		fields MEDIUMTEXT NOT NULL,
+		archived_at DATETIME NOT NULL,
+		KEY list_id (list_id)
+	) ENGINE=InnoDB`,
+	`CREATE TABLE IF NOT EXISTS go_api_privacy_erasures (
+		erasure_id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		identifier_type VARCHAR(20) NOT NULL,
+		identifier_hash CHAR(64) NOT NULL,
+		mode ENUM('ANONYMIZE','DELETE') NOT NULL,
+		reference VARCHAR(100) NOT NULL DEFAULT '',
+		lead_ids MEDIUMTEXT NOT NULL,
+		recording_ids MEDIUMTEXT NOT NULL,
+		counts TEXT NOT NULL,
+		user VARCHAR(100) NOT NULL DEFAULT '',
+		user_group VARCHAR(20) NOT NULL DEFAULT '',
+		api_client VARCHAR(100) NOT NULL DEFAULT '',
+		on_behalf_of VARCHAR(100) NOT NULL DEFAULT '',
+		ip_address VARCHAR(45) NOT NULL DEFAULT '',
+		erased_at DATETIME NOT NULL,
+		KEY identifier_hash (identifier_hash)
+	) ENGINE=InnoDB`,
+}
+
+// EnsureSchema creates the API-owned tables if they do not exist yet
+func EnsureSchema(db *sql.DB) error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("error creating API schema: %w", err)
+		}
+	}
+	return nil
+}
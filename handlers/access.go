@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/vicidb/non-agent-api/middleware"
+)
+
+// Campaign and list restrictions follow the PHP non_agent_api: a user group's
+// allowed_campaigns limits campaign-level functions, and users with
+// api_list_restrict='Y' may only touch lists that belong to those campaigns.
+// API key callers are not restricted.
+
+// allowedCampaigns returns the caller's campaign allow list and whether it applies
+func allowedCampaigns(r *http.Request) ([]string, bool) {
+	apiUser, ok := middleware.GetAPIUserFromContext(r.Context())
+	if !ok || apiUser.AllowedCampaigns == nil {
+		return nil, false
+	}
+	return apiUser.AllowedCampaigns, true
+}
+
+// listRestricted reports whether the caller is limited to lists of allowed campaigns
+func listRestricted(r *http.Request) bool {
+	apiUser, ok := middleware.GetAPIUserFromContext(r.Context())
+	return ok && apiUser.ListRestrict && apiUser.AllowedCampaigns != nil
+}
+
+// canAccessCampaign reports whether the caller may use the campaign
+func canAccessCampaign(r *http.Request, campaignID string) bool {
+	campaigns, restricted := allowedCampaigns(r)
+	if !restricted {
+		return true
+	}
+	for _, campaign := range campaigns {
+		if campaign == campaignID {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessList reports whether the caller may use the list
+func (h *Handler) canAccessList(r *http.Request, listID interface{}) (bool, error) {
+	if !listRestricted(r) {
+		return true, nil
+	}
+	var campaignID string
+	err := h.DB.QueryRow("SELECT campaign_id FROM vicidial_lists WHERE list_id = ?", listID).Scan(&campaignID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return canAccessCampaign(r, campaignID), nil
+}
+
+// canAccessLead reports whether the caller may use the lead's list
+func (h *Handler) canAccessLead(r *http.Request, leadID interface{}) (bool, error) {
+	if !listRestricted(r) {
+		return true, nil
+	}
+	var listID int64
+	err := h.DB.QueryRow("SELECT list_id FROM vicidial_list WHERE lead_id = ?", leadID).Scan(&listID)
+	if err == sql.ErrNoRows {
+		// Let the handler report the missing lead
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return h.canAccessList(r, listID)
+}
+
+// campaignFilter returns an " AND column IN (...)" clause limiting rows to the
+// caller's allowed campaigns, or an empty clause when unrestricted
+func campaignFilter(r *http.Request, column string) (string, []interface{}) {
+	campaigns, restricted := allowedCampaigns(r)
+	if !restricted {
+		return "", nil
+	}
+	return campaignsClause(campaigns, column)
+}
+
+// campaignsClause returns an " AND column IN (...)" clause for the campaigns;
+// an empty allow list matches nothing
+func campaignsClause(campaigns []string, column string) (string, []interface{}) {
+	if len(campaigns) == 0 {
+		return " AND 1=0", nil
+	}
+	args := make([]interface{}, len(campaigns))
+	for i, campaign := range campaigns {
+		args[i] = campaign
+	}
+	return " AND " + column + " IN (" + placeholders(len(campaigns)) + ")", args
+}
+
+// listFilter returns an " AND column IN (...)" clause limiting rows to lists
+// of the caller's allowed campaigns when api_list_restrict is on
+func listFilter(r *http.Request, column string) (string, []interface{}) {
+	return callerListRestriction(r).filter(column)
+}
+
+// listRestriction is the caller's list restriction, kept in job params so a
+// job limits itself the way the request did
+type listRestriction struct {
+	ListRestrict  bool     `json:"list_restrict,omitempty"`
+	ListCampaigns []string `json:"list_campaigns,omitempty"`
+}
+
+// callerListRestriction returns the caller's list restriction
+func callerListRestriction(r *http.Request) listRestriction {
+	if !listRestricted(r) {
+		return listRestriction{}
+	}
+	campaigns, _ := allowedCampaigns(r)
+	return listRestriction{ListRestrict: true, ListCampaigns: campaigns}
+}
+
+// filter returns the restriction as an " AND column IN (...)" clause, or an
+// empty clause when unrestricted
+func (l listRestriction) filter(column string) (string, []interface{}) {
+	if !l.ListRestrict {
+		return "", nil
+	}
+	clause, args := campaignsClause(l.ListCampaigns, "campaign_id")
+	return " AND " + column + " IN (SELECT list_id FROM vicidial_lists WHERE 1=1" + clause + ")", args
+}
+
+// placeholders returns n comma separated SQL placeholders
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?,", n-1) + "?"
+}
+
+// requireCampaignAccess responds with 403 and returns false when the caller may not use the campaign
+func requireCampaignAccess(w http.ResponseWriter, r *http.Request, campaignID string) bool {
+	if !canAccessCampaign(r, campaignID) {
+		respondWithError(w, http.StatusForbidden, "Campaign not allowed for this user group")
+		return false
+	}
+	return true
+}
+
+// requireListAccess responds with an error and returns false when the caller may not use the list
+func (h *Handler) requireListAccess(w http.ResponseWriter, r *http.Request, listID interface{}) bool {
+	ok, err := h.canAccessList(r, listID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check list permissions: "+err.Error())
+		return false
+	}
+	if !ok {
+		respondWithError(w, http.StatusForbidden, "List not allowed for this user")
+		return false
+	}
+	return true
+}
+
+// requireLeadAccess responds with an error and returns false when the caller may not use the lead
+func (h *Handler) requireLeadAccess(w http.ResponseWriter, r *http.Request, leadID interface{}) bool {
+	ok, err := h.canAccessLead(r, leadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check lead permissions: "+err.Error())
+		return false
+	}
+	if !ok {
+		respondWithError(w, http.StatusForbidden, "Lead not allowed for this user")
+		return false
+	}
+	return true
+}
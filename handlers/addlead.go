@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Results reported by add_lead
+const (
+	leadAdded    = "ADDED"
+	leadMerged   = "MERGED"
+	leadRejected = "REJECTED"
+)
+
+// leadAddOptions are the add_lead options from the PHP non_agent_api
+type leadAddOptions struct {
+	DuplicateCheck   string                 `json:"duplicate_check"`
+	DuplicateAction  string                 `json:"duplicate_action"`
+	DNCCheck         string                 `json:"dnc_check"`
+	CampaignDNCCheck string                 `json:"campaign_dnc_check"`
+	AddToHopper      string                 `json:"add_to_hopper"`
+	HopperPriority   int                    `json:"hopper_priority"`
+	GMTLookupMethod  string                 `json:"gmt_lookup_method"`
+	CustomFields     map[string]interface{} `json:"custom_fields"`
+}
+
+// duplicateChecks maps each duplicate_check mode to the lead fields compared
+// and the scope searched: the lead's list, its campaign's lists, or all leads.
+// The first column is the most selective and is used for batch lookups.
+var duplicateChecks = map[string]struct {
+	Columns []string
+	Scope   string
+}{
+	"DUPLIST":              {[]string{"phone_number"}, "LIST"},
+	"DUPCAMP":              {[]string{"phone_number"}, "CAMP"},
+	"DUPSYS":               {[]string{"phone_number"}, "SYS"},
+	"DUPTITLEALTPHONELIST": {[]string{"alt_phone", "title"}, "LIST"},
+	"DUPTITLEALTPHONECAMP": {[]string{"alt_phone", "title"}, "CAMP"},
+	"DUPTITLEALTPHONESYS":  {[]string{"alt_phone", "title"}, "SYS"},
+	"DUPNAMEPHONELIST":     {[]string{"phone_number", "first_name", "last_name"}, "LIST"},
+	"DUPNAMEPHONECAMP":     {[]string{"phone_number", "first_name", "last_name"}, "CAMP"},
+	"DUPNAMEPHONESYS":      {[]string{"phone_number", "first_name", "last_name"}, "SYS"},
+}
+
+// validate normalizes the options and rejects unknown modes
+func (o *leadAddOptions) validate() error {
+	o.DuplicateCheck = strings.ToUpper(o.DuplicateCheck)
+	o.DuplicateAction = strings.ToUpper(o.DuplicateAction)
+	o.DNCCheck = strings.ToUpper(o.DNCCheck)
+	o.CampaignDNCCheck = strings.ToUpper(o.CampaignDNCCheck)
+	o.AddToHopper = strings.ToUpper(o.AddToHopper)
+	o.GMTLookupMethod = strings.ToUpper(o.GMTLookupMethod)
+
+	if _, ok := duplicateChecks[o.DuplicateCheck]; o.DuplicateCheck != "" && !ok {
+		return fmt.Errorf("Invalid duplicate_check %s", o.DuplicateCheck)
+	}
+	switch o.DuplicateAction {
+	case "":
+		o.DuplicateAction = "REJECT"
+	case "REJECT", "UPDATE":
+	default:
+		return fmt.Errorf("duplicate_action must be REJECT or UPDATE")
+	}
+	for name, value := range map[string]string{"dnc_check": o.DNCCheck, "campaign_dnc_check": o.CampaignDNCCheck} {
+		if value != "" && value != "Y" && value != "N" && value != "AREACODE" {
+			return fmt.Errorf("%s must be Y, N or AREACODE", name)
+		}
+	}
+	if o.AddToHopper != "" && o.AddToHopper != "Y" && o.AddToHopper != "N" {
+		return fmt.Errorf("add_to_hopper must be Y or N")
+	}
+	if !validGMTLookupMethod(o.GMTLookupMethod) {
+		return fmt.Errorf("gmt_lookup_method must be AREACODE, POSTAL or TZCODE")
+	}
+	return nil
+}
+
+// findDuplicateLead returns the ID of an existing lead matching the
+// duplicate_check mode, or 0 when there is none
+func (h *Handler) findDuplicateLead(mode string, lead *models.Lead, campaignID string) (int, error) {
+	check := duplicateChecks[mode]
+	values := duplicateValues(mode, lead)
+
+	query := "SELECT lead_id FROM vicidial_list WHERE 1=1"
+	args := []interface{}{}
+	for i, column := range check.Columns {
+		query += " AND " + column + " = ?"
+		args = append(args, values[i])
+	}
+
+	switch check.Scope {
+	case "LIST":
+		query += " AND list_id = ?"
+		args = append(args, lead.ListID)
+	case "CAMP":
+		query += " AND list_id IN (SELECT list_id FROM vicidial_lists WHERE campaign_id = ?)"
+		args = append(args, campaignID)
+	}
+
+	query += " ORDER BY lead_id LIMIT 1"
+
+	var leadID int
+	err := h.DB.QueryRow(query, args...).Scan(&leadID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return leadID, err
+}
+
+// duplicateValues returns the lead's values for the mode's columns, in order
+func duplicateValues(mode string, lead *models.Lead) []string {
+	byColumn := map[string]string{
+		"phone_number": lead.PhoneNumber,
+		"title":        lead.Title,
+		"alt_phone":    lead.AltPhone,
+		"first_name":   lead.FirstName,
+		"last_name":    lead.LastName,
+	}
+
+	columns := duplicateChecks[mode].Columns
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i] = byColumn[column]
+	}
+	return values
+}
+
+// checkLeadDNC returns the name of the DNC check that blocks the lead, if any
+func (h *Handler) checkLeadDNC(opts leadAddOptions, phoneNumber, campaignID string) (string, error) {
+	if opts.DNCCheck == "Y" || opts.DNCCheck == "AREACODE" {
+		found, err := h.dncMatch(phoneNumber, "---ALL---", opts.DNCCheck == "AREACODE")
+		if err != nil || found {
+			return "DNC", err
+		}
+	}
+	if (opts.CampaignDNCCheck == "Y" || opts.CampaignDNCCheck == "AREACODE") && campaignID != "" {
+		found, err := h.dncMatch(phoneNumber, campaignID, opts.CampaignDNCCheck == "AREACODE")
+		if err != nil || found {
+			return "CAMPDNC", err
+		}
+	}
+	return "", nil
+}
+
+// dncListed checks many phone numbers against the DNC lists opts enables
+// with one query, and returns the reason checkLeadDNC would give for each
+// number that is listed
+func (h *Handler) dncListed(opts leadAddOptions, campaignID string, phoneNumbers []string) (map[string]string, error) {
+	checkSystem := opts.DNCCheck == "Y" || opts.DNCCheck == "AREACODE"
+	checkCampaign := (opts.CampaignDNCCheck == "Y" || opts.CampaignDNCCheck == "AREACODE") && campaignID != ""
+	reasons := map[string]string{}
+	if (!checkSystem && !checkCampaign) || len(phoneNumbers) == 0 {
+		return reasons, nil
+	}
+
+	numbers := map[string]bool{}
+	for _, phone := range phoneNumbers {
+		numbers[phone] = true
+		if len(phone) >= 3 {
+			numbers[phone[:3]+"XXXXXXX"] = true
+		}
+	}
+	args := []interface{}{"---ALL---", campaignID}
+	for number := range numbers {
+		args = append(args, number)
+	}
+
+	rows, err := h.DB.Query("SELECT phone_number, campaign_id FROM vicidial_dnc WHERE campaign_id IN (?, ?) AND phone_number IN ("+
+		placeholders(len(numbers))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	listed := map[string]bool{}
+	for rows.Next() {
+		var number, listCampaignID string
+		if err := rows.Scan(&number, &listCampaignID); err != nil {
+			return nil, err
+		}
+		listed[listCampaignID+"\x00"+number] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matches := func(listCampaignID, mode, phone string) bool {
+		if listed[listCampaignID+"\x00"+phone] {
+			return true
+		}
+		return mode == "AREACODE" && len(phone) >= 3 && listed[listCampaignID+"\x00"+phone[:3]+"XXXXXXX"]
+	}
+	for _, phone := range phoneNumbers {
+		switch {
+		case checkSystem && matches("---ALL---", opts.DNCCheck, phone):
+			reasons[phone] = "DNC"
+		case checkCampaign && matches(campaignID, opts.CampaignDNCCheck, phone):
+			reasons[phone] = "CAMPDNC"
+		}
+	}
+	return reasons, nil
+}
+
+// leadInsertColumns are the vicidial_list columns written when adding leads
+const leadInsertColumns = `list_id, vendor_lead_code, source_id, gmt_offset_now, phone_code,
+	phone_number, title, first_name, last_name, middle_initial,
+	address1, address2, address3, city, state, province, postal_code,
+	country_code, gender, date_of_birth, alt_phone, email, security,
+	comments, status, entry_date, modify_date, rank, owner`
+
+// leadInsertRow is the VALUES tuple matching leadInsertColumns
+const leadInsertRow = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW(), ?, ?)"
+
+// leadInsertArgs returns the arguments for one leadInsertRow
+func leadInsertArgs(lead *models.Lead) []interface{} {
+	return []interface{}{
+		lead.ListID, lead.VendorLeadCode, lead.SourceID, lead.GmtOffsetNow, lead.PhoneCode,
+		lead.PhoneNumber, lead.Title, lead.FirstName, lead.LastName, lead.MiddleInitial,
+		lead.Address1, lead.Address2, lead.Address3, lead.City, lead.State, lead.Province,
+		lead.PostalCode, lead.CountryCode, lead.Gender, lead.DateOfBirth, lead.AltPhone,
+		lead.Email, lead.Security, lead.Comments, lead.Status, lead.Rank, lead.Owner,
+	}
+}
+
+// insertLead adds the lead to vicidial_list and returns its ID
+func insertLead(db execer, lead *models.Lead) (int, string, []interface{}, error) {
+	query := "INSERT INTO vicidial_list (" + leadInsertColumns + ") VALUES " + leadInsertRow
+	args := leadInsertArgs(lead)
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, query, args, err
+	}
+	leadID, _ := result.LastInsertId()
+	return int(leadID), query, args, nil
+}
+
+// leadMergeExcluded are lead fields a duplicate merge never overwrites
+var leadMergeExcluded = map[string]bool{
+	"list_id": true, "status": true, "called_count": true,
+	"called_since_last_reset": true, "last_local_call_time": true,
+}
+
+// leadMergeFields returns the posted fields that should overwrite the
+// existing lead when duplicate_action is UPDATE. Empty fields are skipped.
+func leadMergeFields(lead *models.Lead) []patchField {
+	fields := []patchField{}
+	v := reflect.ValueOf(*lead)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if leadPatchSpec.ReadOnly[name] || leadMergeExcluded[name] {
+			continue
+		}
+		value := v.Field(i)
+		if value.Kind() != reflect.String && value.Kind() != reflect.Int {
+			continue
+		}
+		if value.IsZero() {
+			continue
+		}
+		fields = append(fields, patchField{Name: name, Column: name, Value: value.Interface()})
+	}
+	return fields
+}
+
+// customFieldLabelPattern guards the custom field labels used as column names
+var customFieldLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,50}$`)
+
+// writeCustomFields inserts or replaces the lead's row in custom_<list_id>
+// with values already checked by customFieldSet.normalize
+func writeCustomFields(db execer, listID, leadID int, values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	columns := []string{"lead_id"}
+	updates := []string{}
+	args := []interface{}{leadID}
+	for label, value := range values {
+		columns = append(columns, "`"+label+"`")
+		updates = append(updates, "`"+label+"` = VALUES(`"+label+"`)")
+		args = append(args, value)
+	}
+
+	query := "INSERT INTO custom_" + strconv.Itoa(listID) + " (" + strings.Join(columns, ", ") + ") VALUES (" +
+		placeholders(len(columns)) + ") ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+// addLeadToHopper queues the lead for its list's campaign the way add_lead
+// does with add_to_hopper=Y. It returns ADDED or the reason it was skipped.
+func (h *Handler) addLeadToHopper(db execer, lead *models.Lead, campaignID string, priority int) (string, error) {
+	if campaignID == "" {
+		return "NO CAMPAIGN", nil
+	}
+
+	var active string
+	err := h.DB.QueryRow("SELECT active FROM vicidial_campaigns WHERE campaign_id = ?", campaignID).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && active != "Y") {
+		return "CAMPAIGN NOT ACTIVE", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var queued int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_hopper WHERE lead_id = ?", lead.LeadID).Scan(&queued); err != nil {
+		return "", err
+	}
+	if queued > 0 {
+		return "ALREADY IN HOPPER", nil
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO vicidial_hopper
+		(lead_id, campaign_id, status, user, list_id, gmt_offset_now, state, alt_dial, priority, source, vendor_lead_code)
+		VALUES (?, ?, 'READY', '', ?, ?, ?, 'NONE', ?, 'A', ?)
+	`, lead.LeadID, campaignID, lead.ListID, lead.GmtOffsetNow, lead.State, priority, lead.VendorLeadCode)
+	if err != nil {
+		return "", err
+	}
+	return "ADDED", nil
+}
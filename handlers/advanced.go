@@ -37,6 +37,16 @@ func (h *Handler) AddGroupAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "GROUPALIASES",
+		Type:     "ADD",
+		RecordID: req.GroupAliasID,
+		Code:     "ADMIN API ADD GROUP ALIAS",
+		SQL:      query,
+		Args:     []interface{}{req.GroupAliasID, req.GroupAliasName, req.CallerIDGroup, req.Active},
+		After:    h.snapshotRow("vicidial_group_aliases", "group_alias_id", req.GroupAliasID),
+	})
+
 	respondWithSuccess(w, "Group alias added successfully", map[string]string{
 		"group_alias_id": req.GroupAliasID,
 	})
@@ -63,6 +73,8 @@ func (h *Handler) UpdateLogEntry(w http.ResponseWriter, r *http.Request) {
 		WHERE uniqueid = ?
 	`
 
+	before := h.snapshotRow("vicidial_log", "uniqueid", entryID)
+
 	result, err := h.DB.Exec(query, req.Status, req.Comments, req.UserGroup, entryID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update log entry: "+err.Error())
@@ -75,6 +87,17 @@ func (h *Handler) UpdateLogEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: entryID,
+		Code:     "ADMIN API UPDATE LOG ENTRY",
+		SQL:      query,
+		Args:     []interface{}{req.Status, req.Comments, req.UserGroup, entryID},
+		Before:   before,
+		After:    h.snapshotRow("vicidial_log", "uniqueid", entryID),
+	})
+
 	respondWithSuccess(w, "Log entry updated successfully", nil)
 }
 
@@ -100,12 +123,25 @@ func (h *Handler) UpdateCIDGroupEntry(w http.ResponseWriter, r *http.Request) {
 		WHERE cid_id = ?
 	`
 
+	before := h.snapshotRow("vicidial_inbound_group_cid", "cid_id", entryID)
+
 	_, err := h.DB.Exec(query, req.CallerIDNumber, req.CallerIDName, req.Active, entryID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update CID group entry: "+err.Error())
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "CIDGROUPS",
+		Type:     "MODIFY",
+		RecordID: entryID,
+		Code:     "ADMIN API UPDATE CID GROUP ENTRY",
+		SQL:      query,
+		Args:     []interface{}{req.CallerIDNumber, req.CallerIDName, req.Active, entryID},
+		Before:   before,
+		After:    h.snapshotRow("vicidial_inbound_group_cid", "cid_id", entryID),
+	})
+
 	respondWithSuccess(w, "CID group entry updated successfully", nil)
 }
 
@@ -131,12 +167,25 @@ func (h *Handler) UpdateAltURL(w http.ResponseWriter, r *http.Request) {
 		WHERE url_id = ?
 	`
 
+	before := h.snapshotRow("vicidial_url_multi", "url_id", urlID)
+
 	_, err := h.DB.Exec(query, req.URL, req.URLType, req.URLRank, req.Active, urlID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update alternate URL: "+err.Error())
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "URLMULTI",
+		Type:     "MODIFY",
+		RecordID: urlID,
+		Code:     "ADMIN API UPDATE ALT URL",
+		SQL:      query,
+		Args:     []interface{}{req.URL, req.URLType, req.URLRank, req.Active, urlID},
+		Before:   before,
+		After:    h.snapshotRow("vicidial_url_multi", "url_id", urlID),
+	})
+
 	respondWithSuccess(w, "Alternate URL updated successfully", nil)
 }
 
@@ -161,12 +210,25 @@ func (h *Handler) UpdatePresets(w http.ResponseWriter, r *http.Request) {
 		WHERE field_id = ? AND field_name = ?
 	`
 
+	before := h.snapshotRow("vicidial_lists_fields", "field_id", presetID)
+
 	_, err := h.DB.Exec(query, req.PresetValue, presetID, req.PresetName)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update preset: "+err.Error())
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "CUSTOM_FIELDS",
+		Type:     "MODIFY",
+		RecordID: presetID,
+		Code:     "ADMIN API UPDATE PRESET",
+		SQL:      query,
+		Args:     []interface{}{req.PresetValue, presetID, req.PresetName},
+		Before:   before,
+		After:    h.snapshotRow("vicidial_lists_fields", "field_id", presetID),
+	})
+
 	respondWithSuccess(w, "Preset updated successfully", nil)
 }
 
@@ -208,7 +270,9 @@ func (h *Handler) CallidInfo(w http.ResponseWriter, r *http.Request) {
 		&callInfo.Processed, &callInfo.UserGroup, &callInfo.TermReason,
 	)
 
+	inbound := false
 	if err == sql.ErrNoRows {
+		inbound = true
 		// Try vicidial_closer_log
 		query = `
 			SELECT closecallid as uniqueid, lead_id, list_id, campaign_id, call_date,
@@ -234,6 +298,11 @@ func (h *Handler) CallidInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Closer log entries carry an in-group rather than a campaign
+	if !inbound && !requireCampaignAccess(w, r, callInfo.CampaignID) {
+		return
+	}
+
 	respondWithSuccess(w, "Call information retrieved", callInfo)
 }
 
@@ -242,6 +311,10 @@ func (h *Handler) CCCLeadInfo(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	leadID := vars["lead_id"]
 
+	if !h.requireLeadAccess(w, r, leadID) {
+		return
+	}
+
 	query := `
 		SELECT l.lead_id, l.list_id, l.phone_number, l.first_name, l.last_name,
 			   l.status, l.called_count,
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/middleware"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// ListAPIKeys lists the API client keys (secrets are never returned)
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	clientName := r.URL.Query().Get("client_name")
+
+	query := `
+		SELECT key_id, client_name, key_prefix, scopes, active, expires_at, created_at, revoked_at
+		FROM go_api_keys WHERE 1=1
+	`
+	args := []interface{}{}
+
+	if clientName != "" {
+		query += " AND client_name = ?"
+		args = append(args, clientName)
+	}
+
+	query += " ORDER BY client_name, key_id"
+
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve API keys: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read API key: "+err.Error())
+			return
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve API keys: "+err.Error())
+		return
+	}
+
+	respondWithSuccess(w, "API keys retrieved", keys)
+}
+
+// CreateAPIKey issues a new key for a named client
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientName string     `json:"client_name"`
+		Scopes     []string   `json:"scopes"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	req.ClientName = strings.TrimSpace(req.ClientName)
+	if req.ClientName == "" || len(req.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "client_name and scopes are required")
+		return
+	}
+	for _, scope := range middleware.ParseScopes(strings.Join(req.Scopes, ",")) {
+		if !middleware.ValidScope(scope) {
+			respondWithError(w, http.StatusBadRequest, "Unknown scope "+scope)
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	key, err := h.insertAPIKey(h.DB, req.ClientName, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create API key: "+err.Error())
+		return
+	}
+
+	h.reloadKeys()
+	h.audit(r, auditEvent{
+		Section:  "APIKEYS",
+		Type:     "ADD",
+		RecordID: strconv.Itoa(key.KeyID),
+		Code:     "ADMIN API ADD API KEY " + key.ClientName,
+		After:    h.snapshotRow("go_api_keys", "key_id", key.KeyID),
+	})
+
+	respondWithSuccess(w, "API key created; store the key now, it will not be shown again", key)
+}
+
+// RotateAPIKey issues a replacement key with the same client and scopes.
+// The old key stays valid for grace_seconds (default 0) and is then rejected.
+func (h *Handler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	keyID := vars["key_id"]
+
+	var req struct {
+		GraceSeconds int        `json:"grace_seconds"`
+		ExpiresAt    *time.Time `json:"expires_at"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	if req.GraceSeconds < 0 {
+		respondWithError(w, http.StatusBadRequest, "grace_seconds cannot be negative")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	row := h.DB.QueryRow(`
+		SELECT key_id, client_name, key_prefix, scopes, active, expires_at, created_at, revoked_at
+		FROM go_api_keys WHERE key_id = ? AND active = 'Y'
+	`, keyID)
+	old, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Active API key not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve API key: "+err.Error())
+		return
+	}
+
+	expiresAt := req.ExpiresAt
+	if expiresAt == nil {
+		expiresAt = old.ExpiresAt
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+
+	key, err := h.insertAPIKey(tx, old.ClientName, old.Scopes, expiresAt)
+	if err != nil {
+		tx.Rollback()
+		respondWithError(w, http.StatusInternalServerError, "Failed to create replacement key: "+err.Error())
+		return
+	}
+
+	graceUntil := time.Now().Add(time.Duration(req.GraceSeconds) * time.Second)
+	if _, err := tx.Exec("UPDATE go_api_keys SET expires_at = ? WHERE key_id = ?", graceUntil, old.KeyID); err != nil {
+		tx.Rollback()
+		respondWithError(w, http.StatusInternalServerError, "Failed to expire old key: "+err.Error())
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to rotate API key: "+err.Error())
+		return
+	}
+
+	h.reloadKeys()
+	h.audit(r, auditEvent{
+		Section:  "APIKEYS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(old.KeyID),
+		Code:     "ADMIN API ROTATE API KEY " + old.ClientName,
+		Before:   old,
+		After:    h.snapshotRow("go_api_keys", "key_id", key.KeyID),
+	})
+
+	respondWithSuccess(w, "API key rotated; store the new key now, it will not be shown again", map[string]interface{}{
+		"new_key":            key,
+		"old_key_id":         old.KeyID,
+		"old_key_expires_at": graceUntil,
+	})
+}
+
+// RevokeAPIKey disables a key immediately
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	keyID := vars["key_id"]
+
+	result, err := h.DB.Exec("UPDATE go_api_keys SET active = 'N', revoked_at = NOW() WHERE key_id = ? AND active = 'Y'", keyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke API key: "+err.Error())
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Active API key not found")
+		return
+	}
+
+	h.reloadKeys()
+	h.audit(r, auditEvent{
+		Section:  "APIKEYS",
+		Type:     "DELETE",
+		RecordID: keyID,
+		Code:     "ADMIN API REVOKE API KEY",
+		After:    h.snapshotRow("go_api_keys", "key_id", keyID),
+	})
+
+	respondWithSuccess(w, "API key revoked", map[string]string{"key_id": keyID})
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertAPIKey generates and stores a new key, returning it with the plaintext secret
+func (h *Handler) insertAPIKey(db execer, clientName string, scopes []string, expiresAt *time.Time) (models.APIKey, error) {
+	raw, prefix, err := middleware.GenerateKey()
+	if err != nil {
+		return models.APIKey{}, err
+	}
+
+	cleaned := middleware.ParseScopes(strings.Join(scopes, ","))
+	now := time.Now()
+
+	result, err := db.Exec(`
+		INSERT INTO go_api_keys (client_name, key_prefix, key_hash, scopes, active, expires_at, created_at)
+		VALUES (?, ?, ?, ?, 'Y', ?, ?)
+	`, clientName, prefix, middleware.HashKey(raw), strings.Join(cleaned, ","), expiresAt, now)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+
+	keyID, _ := result.LastInsertId()
+	return models.APIKey{
+		KeyID:      int(keyID),
+		ClientName: clientName,
+		KeyPrefix:  prefix,
+		Scopes:     cleaned,
+		Active:     "Y",
+		ExpiresAt:  expiresAt,
+		CreatedAt:  now,
+		Key:        raw,
+	}, nil
+}
+
+// reloadKeys refreshes the in-memory key store after a change
+func (h *Handler) reloadKeys() {
+	if h.Keys == nil {
+		return
+	}
+	if err := h.Keys.Reload(); err != nil {
+		log.Printf("Failed to reload API keys: %v", err)
+	}
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&key.KeyID, &key.ClientName, &key.KeyPrefix, &scopes,
+		&key.Active, &expiresAt, &key.CreatedAt, &revokedAt)
+	if err != nil {
+		return key, err
+	}
+	key.Scopes = middleware.ParseScopes(scopes)
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
@@ -0,0 +1,682 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Archive chunking: the default and largest number of leads moved per
+// transaction, and the most lead_ids moved without a job
+const (
+	leadArchiveChunkSize    = 500
+	leadArchiveMaxChunkSize = 5000
+	leadArchiveMaxIDs       = 1000
+)
+
+// leadMoveParams are the parameters of a lead_archive or lead_dearchive job.
+// The conditions they compile to are not stored, as other callers can see
+// job params; compileLeadMove rebuilds them.
+type leadMoveParams struct {
+	Filter    string `json:"filter,omitempty"`
+	LeadIDs   []int  `json:"lead_ids,omitempty"`
+	ListID    int    `json:"list_id,omitempty"`
+	ChunkSize int    `json:"chunk_size"`
+	Matched   int    `json:"matched"`
+	listRestriction
+
+	Where     string        `json:"-"`
+	WhereArgs []interface{} `json:"-"`
+}
+
+// leadArchiveResult counts what an archive moved
+type leadArchiveResult struct {
+	Matched       int `json:"matched"`
+	Archived      int `json:"archived"`
+	CustomRows    int `json:"custom_rows"`
+	HopperRemoved int `json:"hopper_removed"`
+	Chunks        int `json:"chunks"`
+}
+
+// leadRestoreResult counts what a dearchive restored. Leads already back in
+// vicidial_list are skipped, and custom rows with columns the list no longer
+// has stay archived.
+type leadRestoreResult struct {
+	Matched          int `json:"matched"`
+	Restored         int `json:"restored"`
+	Skipped          int `json:"skipped"`
+	CustomRows       int `json:"custom_rows"`
+	CustomIncomplete int `json:"custom_incomplete"`
+	Chunks           int `json:"chunks"`
+}
+
+// leadMoveCheckpoint is where an archive or dearchive job has got to
+type leadMoveCheckpoint struct {
+	LastLeadID int             `json:"last_lead_id"`
+	Done       int             `json:"done"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// readLeadMove reads an archive or dearchive request for leads in table and
+// counts the leads it matches. A dry run, or an expected_count that does
+// not match, is answered here with a preview.
+func (h *Handler) readLeadMove(w http.ResponseWriter, r *http.Request, table string) (leadMoveParams, bool) {
+	var req struct {
+		LeadIDs       []int  `json:"lead_ids"`
+		Filter        string `json:"filter"`
+		ListID        int    `json:"list_id"`
+		ChunkSize     int    `json:"chunk_size"`
+		ExpectedCount *int   `json:"expected_count"`
+	}
+	var params leadMoveParams
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return params, false
+	}
+
+	hasFilter := strings.TrimSpace(req.Filter) != ""
+	if (len(req.LeadIDs) == 0) == !hasFilter {
+		respondWithError(w, http.StatusBadRequest, "Provide either lead_ids or filter")
+		return params, false
+	}
+	if len(req.LeadIDs) > leadArchiveMaxIDs {
+		respondWithError(w, http.StatusBadRequest, "At most "+strconv.Itoa(leadArchiveMaxIDs)+" lead_ids per request; use a filter for more")
+		return params, false
+	}
+
+	if req.ChunkSize == 0 {
+		req.ChunkSize = leadArchiveChunkSize
+	}
+	if req.ChunkSize < 1 || req.ChunkSize > leadArchiveMaxChunkSize {
+		respondWithError(w, http.StatusBadRequest, "chunk_size must be between 1 and "+strconv.Itoa(leadArchiveMaxChunkSize))
+		return params, false
+	}
+	params.ChunkSize = req.ChunkSize
+	params.listRestriction = callerListRestriction(r)
+
+	if hasFilter {
+		filter, err := h.parseLeadFilter([]string{req.Filter}, req.ListID)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return params, false
+		}
+		if filter.Custom && table == "vicidial_list_archive" {
+			respondWithError(w, http.StatusBadRequest, "Archived leads cannot be filtered on custom fields")
+			return params, false
+		}
+		if filter.ListID != 0 && !h.requireListAccess(w, r, filter.ListID) {
+			return params, false
+		}
+		params.Filter = req.Filter
+		params.ListID = req.ListID
+		params.Where = filter.Where
+		params.WhereArgs = filter.Args
+	} else {
+		params.LeadIDs = req.LeadIDs
+		params.Where, params.WhereArgs = leadIDsClause(req.LeadIDs)
+	}
+
+	restrictSQL, restrictArgs := params.filter("list_id")
+	params.Where += restrictSQL
+	params.WhereArgs = append(params.WhereArgs, restrictArgs...)
+
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE 1=1"+params.Where, params.WhereArgs...).Scan(&params.Matched); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to count leads: "+err.Error())
+		return params, false
+	}
+
+	dryRun, _ := schemaFlags(r)
+	if dryRun || (req.ExpectedCount != nil && *req.ExpectedCount != params.Matched) {
+		sample := h.snapshotRows("SELECT lead_id, list_id, status, modify_date FROM "+table+" WHERE 1=1"+params.Where+
+			" ORDER BY lead_id LIMIT "+strconv.Itoa(leadBulkSampleSize), params.WhereArgs...)
+		if sample == nil {
+			sample = []map[string]interface{}{}
+		}
+		preview := map[string]interface{}{
+			"matched":    params.Matched,
+			"chunk_size": params.ChunkSize,
+			"chunks":     (params.Matched + params.ChunkSize - 1) / params.ChunkSize,
+			"sample":     sample,
+		}
+		if hasFilter {
+			preview["filter"] = req.Filter
+		}
+
+		if !dryRun {
+			respondWithJSON(w, http.StatusConflict, models.APIResponse{
+				Success: false,
+				Error:   "Request matches " + strconv.Itoa(params.Matched) + " leads, not the expected " + strconv.Itoa(*req.ExpectedCount),
+				Data:    preview,
+			})
+			return params, false
+		}
+		respondWithSuccess(w, "Preview", preview)
+		return params, false
+	}
+	return params, true
+}
+
+// compileLeadMove sets the conditions of decoded job params from their
+// filter or lead IDs and the caller's list restriction
+func (h *Handler) compileLeadMove(params *leadMoveParams) error {
+	if params.Filter != "" {
+		filter, err := h.parseLeadFilter([]string{params.Filter}, params.ListID)
+		if err != nil {
+			return err
+		}
+		params.Where, params.WhereArgs = filter.Where, filter.Args
+	} else {
+		params.Where, params.WhereArgs = leadIDsClause(params.LeadIDs)
+	}
+	restrictSQL, restrictArgs := params.filter("list_id")
+	params.Where += restrictSQL
+	params.WhereArgs = append(params.WhereArgs, restrictArgs...)
+	return nil
+}
+
+// leadIDsClause returns an " AND lead_id IN (...)" clause for the IDs
+func leadIDsClause(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return " AND lead_id IN (" + placeholders(len(ids)) + ")", args
+}
+
+// ArchiveLeads moves leads, with their custom field rows and without their
+// hopper entries, into vicidial_list_archive. Up to 1000 lead_ids are moved
+// straight away; a filter is queued as a job.
+func (h *Handler) ArchiveLeads(w http.ResponseWriter, r *http.Request) {
+	params, ok := h.readLeadMove(w, r, "vicidial_list")
+	if !ok {
+		return
+	}
+
+	if params.Filter != "" {
+		if params.Matched == 0 {
+			respondWithSuccess(w, "No leads match the filter", leadArchiveResult{})
+			return
+		}
+		h.submitJob(w, r, jobTypeLeadArchive, params, "Lead archive queued")
+		return
+	}
+
+	ids := make([]interface{}, len(params.LeadIDs))
+	for i, id := range params.LeadIDs {
+		ids[i] = id
+	}
+	result, err := h.archiveLeadChunk(r.Context(), ids, params.Where, params.WhereArgs)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to archive leads: "+err.Error())
+		return
+	}
+	result.Matched = params.Matched
+	result.Chunks = 1
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(result.Archived) + " leads",
+		Code:     "ADMIN API ARCHIVE LEADS",
+		SQL:      "INSERT INTO vicidial_list_archive SELECT * FROM vicidial_list WHERE 1=1" + params.Where,
+		Args:     params.WhereArgs,
+		After:    result,
+	})
+	respondWithSuccess(w, "Leads archived", result)
+}
+
+// DearchiveLeads restores archived leads and their custom field rows. Up to
+// 1000 lead_ids are restored straight away; a filter is queued as a job.
+func (h *Handler) DearchiveLeads(w http.ResponseWriter, r *http.Request) {
+	params, ok := h.readLeadMove(w, r, "vicidial_list_archive")
+	if !ok {
+		return
+	}
+
+	if params.Filter != "" {
+		if params.Matched == 0 {
+			respondWithSuccess(w, "No archived leads match the filter", leadRestoreResult{})
+			return
+		}
+		h.submitJob(w, r, jobTypeLeadDearchive, params, "Lead restore queued")
+		return
+	}
+
+	ids := make([]interface{}, len(params.LeadIDs))
+	for i, id := range params.LeadIDs {
+		ids[i] = id
+	}
+	result, err := h.restoreLeadChunk(r.Context(), ids, params.Where, params.WhereArgs)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to restore leads: "+err.Error())
+		return
+	}
+	result.Matched = params.Matched
+	result.Chunks = 1
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(result.Restored) + " leads",
+		Code:     "ADMIN API DEARCHIVE LEADS",
+		SQL:      "INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive WHERE 1=1" + params.Where,
+		Args:     params.WhereArgs,
+		After:    result,
+	})
+	respondWithSuccess(w, "Leads restored", result)
+}
+
+// archiveLeadChunk archives the given leads that still match the conditions.
+// vicidial_list rows are copied before they are deleted, and custom_<list_id>
+// tables, which are MyISAM and outside the transaction, are only cleared once
+// the copies are committed, so a failure part way never loses a lead.
+func (h *Handler) archiveLeadChunk(ctx context.Context, ids []interface{}, where string, whereArgs []interface{}) (leadArchiveResult, error) {
+	var result leadArchiveResult
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	byList, matched, err := leadsByList(ctx, tx, "vicidial_list", ids, where, whereArgs)
+	if err != nil || len(matched) == 0 {
+		return result, err
+	}
+
+	customTables := map[int]*customTable{}
+	for listID, listLeads := range byList {
+		table, err := h.loadCustomTable(listID)
+		if err != nil {
+			return result, err
+		}
+		if !table.Exists {
+			continue
+		}
+		customTables[listID] = table
+		n, err := archiveCustomRows(ctx, tx, table, listLeads)
+		if err != nil {
+			return result, err
+		}
+		result.CustomRows += n
+	}
+
+	in := " WHERE lead_id IN (" + placeholders(len(matched)) + ")"
+	if _, err := tx.ExecContext(ctx, "REPLACE INTO vicidial_list_archive SELECT * FROM vicidial_list"+in, matched...); err != nil {
+		return result, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM vicidial_hopper"+in, matched...)
+	if err != nil {
+		return result, err
+	}
+	n, _ := res.RowsAffected()
+	result.HopperRemoved = int(n)
+	res, err = tx.ExecContext(ctx, "DELETE FROM vicidial_list"+in, matched...)
+	if err != nil {
+		return result, err
+	}
+	n, _ = res.RowsAffected()
+	result.Archived = int(n)
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+
+	for listID, table := range customTables {
+		listLeads := byList[listID]
+		if _, err := h.DB.ExecContext(ctx, "DELETE FROM "+table.name()+" WHERE lead_id IN ("+placeholders(len(listLeads))+")", listLeads...); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// leadsByList locks the given leads in table that match the conditions and
+// groups their IDs by list
+func leadsByList(ctx context.Context, tx *sql.Tx, table string, ids []interface{}, where string, whereArgs []interface{}) (map[int][]interface{}, []interface{}, error) {
+	args := append(append([]interface{}{}, ids...), whereArgs...)
+	rows, err := tx.QueryContext(ctx, "SELECT lead_id, list_id FROM "+table+
+		" WHERE lead_id IN ("+placeholders(len(ids))+")"+where+" FOR UPDATE", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	byList := map[int][]interface{}{}
+	matched := []interface{}{}
+	for rows.Next() {
+		var leadID, listID int
+		if err := rows.Scan(&leadID, &listID); err != nil {
+			return nil, nil, err
+		}
+		byList[listID] = append(byList[listID], leadID)
+		matched = append(matched, leadID)
+	}
+	return byList, matched, rows.Err()
+}
+
+// archiveCustomRows copies the leads' custom field rows into
+// go_api_custom_archive as JSON, so they survive later changes to the
+// list's custom fields
+func archiveCustomRows(ctx context.Context, tx *sql.Tx, table *customTable, ids []interface{}) (int, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT * FROM "+table.name()+" WHERE lead_id IN ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return 0, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return 0, err
+	}
+
+	args := []interface{}{}
+	count := 0
+	for rows.Next() {
+		raw := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range raw {
+			dest[i] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		var leadID string
+		fields := map[string]interface{}{}
+		for i, column := range columns {
+			switch {
+			case column == "lead_id":
+				leadID = raw[i].String
+			case raw[i].Valid:
+				fields[column] = raw[i].String
+			default:
+				fields[column] = nil
+			}
+		}
+		encoded, _ := json.Marshal(fields)
+		args = append(args, leadID, table.ListID, string(encoded))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+	if count == 0 {
+		return 0, nil
+	}
+
+	values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, NOW()),", count), ",")
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO go_api_custom_archive (lead_id, list_id, fields, archived_at) VALUES `+values+`
+		ON DUPLICATE KEY UPDATE list_id = VALUES(list_id), fields = VALUES(fields), archived_at = VALUES(archived_at)
+	`, args...)
+	return count, err
+}
+
+// restoreLeadChunk restores the given archived leads that match the
+// conditions, skipping any that are already in vicidial_list, then writes back
+// their custom field rows
+func (h *Handler) restoreLeadChunk(ctx context.Context, ids []interface{}, where string, whereArgs []interface{}) (leadRestoreResult, error) {
+	var result leadRestoreResult
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	byList, matched, err := leadsByList(ctx, tx, "vicidial_list_archive", ids, where, whereArgs)
+	if err != nil || len(matched) == 0 {
+		return result, err
+	}
+
+	existing := map[int]bool{}
+	rows, err := tx.QueryContext(ctx, "SELECT lead_id FROM vicidial_list WHERE lead_id IN ("+placeholders(len(matched))+")", matched...)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var leadID int
+		if err := rows.Scan(&leadID); err != nil {
+			rows.Close()
+			return result, err
+		}
+		existing[leadID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	listOf := map[int]int{}
+	restore := []interface{}{}
+	for listID, listLeads := range byList {
+		for _, id := range listLeads {
+			if existing[id.(int)] {
+				result.Skipped++
+				continue
+			}
+			listOf[id.(int)] = listID
+			restore = append(restore, id)
+		}
+	}
+	if len(restore) == 0 {
+		return result, tx.Commit()
+	}
+
+	in := " WHERE lead_id IN (" + placeholders(len(restore)) + ")"
+	res, err := tx.ExecContext(ctx, "INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive"+in, restore...)
+	if err != nil {
+		return result, err
+	}
+	n, _ := res.RowsAffected()
+	result.Restored = int(n)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM vicidial_list_archive"+in, restore...); err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+
+	restored, incomplete, err := h.restoreCustomRows(ctx, restore, listOf)
+	result.CustomRows = restored
+	result.CustomIncomplete = incomplete
+	return result, err
+}
+
+// restoreCustomRows writes archived custom field rows back to the custom
+// table of each lead's list. A row is kept in the archive when the list no
+// longer has a column for one of its values.
+func (h *Handler) restoreCustomRows(ctx context.Context, ids []interface{}, listOf map[int]int) (int, int, error) {
+	rows, err := h.DB.QueryContext(ctx, "SELECT lead_id, fields FROM go_api_custom_archive WHERE lead_id IN ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return 0, 0, err
+	}
+	archived := map[int]string{}
+	for rows.Next() {
+		var leadID int
+		var fields string
+		if err := rows.Scan(&leadID, &fields); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		archived[leadID] = fields
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	tables := map[int]*customTable{}
+	restored, incomplete := 0, 0
+	for leadID, encoded := range archived {
+		listID := listOf[leadID]
+		table, ok := tables[listID]
+		if !ok {
+			if table, err = h.loadCustomTable(listID); err != nil {
+				return restored, incomplete, err
+			}
+			tables[listID] = table
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(encoded), &fields); err != nil {
+			return restored, incomplete, err
+		}
+		values := map[string]interface{}{}
+		complete := true
+		for column, value := range fields {
+			if _, ok := table.Columns[column]; ok {
+				values[column] = value
+			} else if value != nil {
+				complete = false
+			}
+		}
+
+		if len(values) > 0 {
+			if err := writeCustomFields(h.DB, listID, leadID, values); err != nil {
+				return restored, incomplete, err
+			}
+		}
+		if !complete {
+			incomplete++
+			continue
+		}
+		if _, err := h.DB.ExecContext(ctx, "DELETE FROM go_api_custom_archive WHERE lead_id = ?", leadID); err != nil {
+			return restored, incomplete, err
+		}
+		restored++
+	}
+	return restored, incomplete, nil
+}
+
+// runLeadArchive archives the leads matching a filter, one transaction per chunk
+func (h *Handler) runLeadArchive(ctx context.Context, task *jobs.Task) (interface{}, error) {
+	var result leadArchiveResult
+	err := h.runLeadMove(ctx, task, "vicidial_list", &result, func(params leadMoveParams, ids []interface{}) (int, error) {
+		chunk, err := h.archiveLeadChunk(ctx, ids, params.Where, params.WhereArgs)
+		result.Matched = params.Matched
+		result.Archived += chunk.Archived
+		result.CustomRows += chunk.CustomRows
+		result.HopperRemoved += chunk.HopperRemoved
+		result.Chunks++
+		return chunk.Archived, err
+	})
+	return result, err
+}
+
+// runLeadDearchive restores the archived leads matching a filter
+func (h *Handler) runLeadDearchive(ctx context.Context, task *jobs.Task) (interface{}, error) {
+	var result leadRestoreResult
+	err := h.runLeadMove(ctx, task, "vicidial_list_archive", &result, func(params leadMoveParams, ids []interface{}) (int, error) {
+		chunk, err := h.restoreLeadChunk(ctx, ids, params.Where, params.WhereArgs)
+		result.Matched = params.Matched
+		result.Restored += chunk.Restored
+		result.Skipped += chunk.Skipped
+		result.CustomRows += chunk.CustomRows
+		result.CustomIncomplete += chunk.CustomIncomplete
+		result.Chunks++
+		return chunk.Restored + chunk.Skipped, err
+	})
+	return result, err
+}
+
+// runLeadMove walks the leads in table matching the job's conditions in
+// lead_id order, passing each chunk to move and checkpointing result after
+// it. Moved leads leave table, so a repeated chunk finds nothing to redo.
+func (h *Handler) runLeadMove(ctx context.Context, task *jobs.Task, table string, result interface{}, move func(leadMoveParams, []interface{}) (int, error)) error {
+	var params leadMoveParams
+	if err := task.Decode(&params); err != nil {
+		return err
+	}
+	if err := h.compileLeadMove(&params); err != nil {
+		return err
+	}
+
+	var cp leadMoveCheckpoint
+	resumed, err := task.LoadCheckpoint(&cp)
+	if err != nil {
+		return err
+	}
+	if resumed {
+		if err := json.Unmarshal(cp.Result, result); err != nil {
+			return err
+		}
+	}
+	task.SetTotal(params.Matched)
+	task.SetProgress(cp.Done)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ids, err := h.nextLeadChunk(ctx, table, params.Where, params.WhereArgs, cp.LastLeadID, params.ChunkSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		n, err := move(params, ids)
+		if err != nil {
+			return err
+		}
+		cp.Done += n
+		task.SetProgress(cp.Done)
+
+		cp.LastLeadID = ids[len(ids)-1].(int)
+		if cp.Result, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if err := task.SaveCheckpoint(cp); err != nil {
+			return err
+		}
+
+		if len(ids) < params.ChunkSize {
+			return nil
+		}
+	}
+}
+
+// leadArchiveFinished audits a finished archive job as its requester
+func (h *Handler) leadArchiveFinished(job models.Job) {
+	h.leadMoveFinished(job, "ADMIN API ARCHIVE LEADS", "INSERT INTO vicidial_list_archive SELECT * FROM vicidial_list WHERE 1=1")
+}
+
+// leadDearchiveFinished audits a finished dearchive job as its requester
+func (h *Handler) leadDearchiveFinished(job models.Job) {
+	h.leadMoveFinished(job, "ADMIN API DEARCHIVE LEADS", "INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive WHERE 1=1")
+}
+
+func (h *Handler) leadMoveFinished(job models.Job, code, statement string) {
+	var params leadMoveParams
+	json.Unmarshal(job.Params, &params)
+
+	after := jobAuditResult(job)
+	after["filter"] = params.Filter
+	if err := h.compileLeadMove(&params); err == nil {
+		statement += params.Where
+	} else {
+		statement = ""
+	}
+
+	h.auditAs(jobActor(job), auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(params.Matched) + " leads",
+		Code:     code,
+		SQL:      statement,
+		Args:     params.WhereArgs,
+		After:    after,
+	})
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newMockHandler(t *testing.T) (*Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Handler{DB: db}, mock
+}
+
+func TestArchiveLeadChunk(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id, list_id FROM vicidial_list WHERE lead_id IN (?,?) AND `status` = ? FOR UPDATE")).
+		WithArgs(1, 2, "NEW").
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id", "list_id"}).AddRow(1, 101).AddRow(2, 101))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+		WithArgs("custom_101").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}).AddRow("lead_id", "int").AddRow("color", "varchar"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM custom_101 WHERE lead_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id", "color"}).AddRow("1", "red"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO go_api_custom_archive (lead_id, list_id, fields, archived_at) VALUES (?, ?, ?, NOW())")).
+		WithArgs("1", 101, `{"color":"red"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("REPLACE INTO vicidial_list_archive SELECT * FROM vicidial_list WHERE lead_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_hopper WHERE lead_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_list WHERE lead_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	// The MyISAM custom rows are only removed once the archive is committed
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM custom_101 WHERE lead_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	result, err := h.archiveLeadChunk(context.Background(), []interface{}{1, 2}, " AND `status` = ?", []interface{}{"NEW"})
+	if err != nil {
+		t.Fatalf("archiveLeadChunk: %v", err)
+	}
+	want := leadArchiveResult{Archived: 2, CustomRows: 1, HopperRemoved: 1}
+	if result != want {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArchiveLeadChunkRollsBackOnFailure(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id, list_id FROM vicidial_list WHERE lead_id IN (?) FOR UPDATE")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id", "list_id"}).AddRow(1, 101))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+		WithArgs("custom_101").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}))
+	mock.ExpectExec(regexp.QuoteMeta("REPLACE INTO vicidial_list_archive SELECT * FROM vicidial_list WHERE lead_id IN (?)")).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_hopper WHERE lead_id IN (?)")).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_list WHERE lead_id IN (?)")).
+		WithArgs(1).
+		WillReturnError(errors.New("lock wait timeout"))
+	// The copy into the archive is undone, so the lead stays in vicidial_list only
+	mock.ExpectRollback()
+
+	_, err := h.archiveLeadChunk(context.Background(), []interface{}{1}, "", nil)
+	if err == nil || err.Error() != "lock wait timeout" {
+		t.Errorf("archiveLeadChunk error = %v, want lock wait timeout", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreLeadChunkSkipsLeadsAlreadyRestored(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id, list_id FROM vicidial_list_archive WHERE lead_id IN (?,?) FOR UPDATE")).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id", "list_id"}).AddRow(1, 101).AddRow(2, 101))
+	// Lead 1 is back in vicidial_list already, so only lead 2 is restored
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id FROM vicidial_list WHERE lead_id IN (?,?)")).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive WHERE lead_id IN (?)")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_list_archive WHERE lead_id IN (?)")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id, fields FROM go_api_custom_archive WHERE lead_id IN (?)")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id", "fields"}))
+
+	result, err := h.restoreLeadChunk(context.Background(), []interface{}{1, 2}, "", nil)
+	if err != nil {
+		t.Fatalf("restoreLeadChunk: %v", err)
+	}
+	want := leadRestoreResult{Restored: 1, Skipped: 1}
+	if result != want {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreLeadChunkRollsBackOnFailure(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id, list_id FROM vicidial_list_archive WHERE lead_id IN (?) FOR UPDATE")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id", "list_id"}).AddRow(3, 101))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id FROM vicidial_list WHERE lead_id IN (?)")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id"}))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive WHERE lead_id IN (?)")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_list_archive WHERE lead_id IN (?)")).
+		WithArgs(3).
+		WillReturnError(errors.New("lock wait timeout"))
+	mock.ExpectRollback()
+
+	_, err := h.restoreLeadChunk(context.Background(), []interface{}{3}, "", nil)
+	if err == nil || err.Error() != "lock wait timeout" {
+		t.Errorf("restoreLeadChunk error = %v, want lock wait timeout", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeadMoveParamsKeepConditionsOutOfJobs(t *testing.T) {
+	params := leadMoveParams{
+		Filter:          "status=NEW",
+		ChunkSize:       500,
+		listRestriction: listRestriction{ListRestrict: true, ListCampaigns: []string{"SALES"}},
+		Where:           " AND `status` = ?",
+		WhereArgs:       []interface{}{"NEW"},
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if strings.Contains(string(encoded), "where") {
+		t.Errorf("job params %s include the compiled conditions", encoded)
+	}
+
+	var decoded leadMoveParams
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	h := &Handler{}
+	if err := h.compileLeadMove(&decoded); err != nil {
+		t.Fatalf("compileLeadMove: %v", err)
+	}
+	wantWhere := " AND `status` = ? AND list_id IN (SELECT list_id FROM vicidial_lists WHERE 1=1 AND campaign_id IN (?))"
+	if decoded.Where != wantWhere {
+		t.Errorf("Where = %q, want %q", decoded.Where, wantWhere)
+	}
+	if !reflect.DeepEqual(decoded.WhereArgs, []interface{}{"NEW", "SALES"}) {
+		t.Errorf("WhereArgs = %#v", decoded.WhereArgs)
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vicidb/non-agent-api/middleware"
+)
+
+// auditEvent describes one change recorded in vicidial_admin_log, using the
+// same event_section/event_type values as VICIdial's admin screens
+type auditEvent struct {
+	Section  string
+	Type     string
+	RecordID string
+	Code     string
+	SQL      string
+	Args     []interface{}
+	Before   interface{}
+	After    interface{}
+}
+
+// auditRedactedColumns are never copied into the audit trail
+var auditRedactedColumns = map[string]bool{
+	"pass":        true,
+	"pass_hash":   true,
+	"phone_pass":  true,
+	"conf_secret": true,
+	"key_hash":    true,
+}
+
+// auditActor identifies who made a change. OnBehalfOf is the user an API
+// key caller says it acts for; it is never verified.
+type auditActor struct {
+	User       string
+	UserGroup  string
+	APIClient  string
+	OnBehalfOf string
+	IPAddress  string
+}
+
+// requestActor returns the caller of a request
+func requestActor(r *http.Request) auditActor {
+	actor := auditActor{
+		User:       middleware.GetUserFromContext(r.Context()),
+		OnBehalfOf: middleware.GetOnBehalfOfFromContext(r.Context()),
+		IPAddress:  clientIP(r),
+	}
+	if apiUser, ok := middleware.GetAPIUserFromContext(r.Context()); ok {
+		actor.UserGroup = apiUser.UserGroup
+	}
+	if apiKey, ok := middleware.GetAPIKeyFromContext(r.Context()); ok {
+		actor.APIClient = apiKey.ClientName
+	}
+	return actor
+}
+
+// audit writes a change to vicidial_admin_log. A failed audit write is logged
+// but does not fail the request, since the change itself already happened.
+func (h *Handler) audit(r *http.Request, ev auditEvent) {
+	h.auditAs(requestActor(r), ev)
+}
+
+// auditAs writes a change made outside a request, such as by a background job
+func (h *Handler) auditAs(actor auditActor, ev auditEvent) {
+	notes := map[string]interface{}{}
+	if actor.APIClient != "" {
+		notes["api_client"] = actor.APIClient
+	}
+	if actor.OnBehalfOf != "" {
+		notes["on_behalf_of"] = map[string]interface{}{"user": actor.OnBehalfOf, "verified": false}
+	}
+	if ev.Before != nil {
+		notes["before"] = ev.Before
+	}
+	if ev.After != nil {
+		notes["after"] = ev.After
+	}
+	notesJSON, _ := json.Marshal(notes)
+
+	query := `
+		INSERT INTO vicidial_admin_log
+		(event_date, user, ip_address, event_section, event_type, record_id,
+		 event_code, event_sql, event_notes, user_group)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := h.DB.Exec(query, time.Now().Format("2006-01-02 15:04:05"), actor.User, actor.IPAddress,
+		ev.Section, ev.Type, ev.RecordID, ev.Code, renderSQL(ev.SQL, ev.Args), string(notesJSON), actor.UserGroup)
+	if err != nil {
+		log.Printf("Warning: Failed to write admin log for %s %s %s: %v", ev.Section, ev.Type, ev.RecordID, err)
+	}
+}
+
+// snapshotRow returns the columns of a single row as strings for the audit
+// trail, or nil when the row does not exist. Sensitive columns are redacted.
+func (h *Handler) snapshotRow(table, keyColumn string, keyValue interface{}) map[string]interface{} {
+	rows := h.snapshotRows("SELECT * FROM "+table+" WHERE "+keyColumn+" = ? LIMIT 1", keyValue)
+	if len(rows) == 0 {
+		return nil
+	}
+	return rows[0]
+}
+
+// snapshotRows runs a SELECT and returns every row as strings for the audit trail
+func (h *Handler) snapshotRows(query string, args ...interface{}) []map[string]interface{} {
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil
+	}
+
+	snapshots := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil
+		}
+
+		snapshot := map[string]interface{}{}
+		for i, column := range columns {
+			switch {
+			case auditRedactedColumns[column]:
+				snapshot[column] = "********"
+			case values[i].Valid:
+				snapshot[column] = values[i].String
+			default:
+				snapshot[column] = nil
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+// renderSQL inlines arguments into a query for the event_sql column the way
+// VICIdial logs its own statements. It is only ever used for logging.
+func renderSQL(query string, args []interface{}) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(args) == 0 {
+		return query
+	}
+
+	var b strings.Builder
+	argIndex := 0
+	for _, ch := range query {
+		if ch == '?' && argIndex < len(args) {
+			b.WriteString(sqlLiteral(args[argIndex]))
+			argIndex++
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+func sqlLiteral(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case int, int64, int32, float64, float32, bool:
+		return fmt.Sprint(val)
+	case time.Time:
+		return "'" + val.Format("2006-01-02 15:04:05") + "'"
+	case *time.Time:
+		if val == nil {
+			return "NULL"
+		}
+		return "'" + val.Format("2006-01-02 15:04:05") + "'"
+	default:
+		s := strings.ReplaceAll(fmt.Sprint(val), "'", "\\'")
+		return "'" + s + "'"
+	}
+}
+
+// clientIP returns the caller's address without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// leadBulkFields are the vicidial_list columns a bulk update may assign
+type leadBulkFields struct {
+	Status               string `json:"status"`
+	ListID               int    `json:"list_id"`
+	Rank                 int    `json:"rank"`
+	User                 string `json:"user"`
+	Owner                string `json:"owner"`
+	CalledSinceLastReset string `json:"called_since_last_reset"`
+	CalledCount          int    `json:"called_count"`
+	SourceID             string `json:"source_id"`
+}
+
+var leadBulkSpec = patchSpec{
+	Table:     "vicidial_list",
+	Model:     leadBulkFields{},
+	KeyColumn: "lead_id",
+	Validators: map[string]fieldValidator{
+		"status":                  validateStatus,
+		"list_id":                 validateIntRange(1, 2147483647),
+		"rank":                    validateIntRange(-9999, 9999),
+		"user":                    validateMaxLen(20),
+		"owner":                   validateMaxLen(20),
+		"called_since_last_reset": leadPatchSpec.Validators["called_since_last_reset"],
+		"called_count":            validateIntRange(0, 65535),
+		"source_id":               validateMaxLen(50),
+	},
+	Touch: "modify_date = NOW()",
+}
+
+// Bulk update chunking: the default and largest number of leads per UPDATE
+const (
+	leadBulkChunkSize    = 1000
+	leadBulkMaxChunkSize = 10000
+	leadBulkSampleSize   = 20
+)
+
+// leadBulkUpdateParams are the parameters of a lead_bulk_update job. Job
+// params are visible to other callers, so the job keeps the caller's filter
+// expression and list restriction and compiles them again when it runs.
+type leadBulkUpdateParams struct {
+	Filter    string       `json:"filter"`
+	ListID    int          `json:"list_id,omitempty"`
+	Set       []patchField `json:"set"`
+	ChunkSize int          `json:"chunk_size"`
+	Matched   int          `json:"matched"`
+	listRestriction
+}
+
+// leadBulkUpdateResult summarizes a bulk update
+type leadBulkUpdateResult struct {
+	Matched int `json:"matched"`
+	Scanned int `json:"scanned"`
+	Updated int `json:"updated"`
+	Chunks  int `json:"chunks"`
+}
+
+// leadBulkUpdateCheckpoint is where a bulk update job has got to
+type leadBulkUpdateCheckpoint struct {
+	LastLeadID int                  `json:"last_lead_id"`
+	Result     leadBulkUpdateResult `json:"result"`
+}
+
+// sets returns the SET clause and its arguments
+func (p leadBulkUpdateParams) sets() (string, []interface{}) {
+	sets := make([]string, 0, len(p.Set)+1)
+	args := make([]interface{}, 0, len(p.Set))
+	for _, field := range p.Set {
+		sets = append(sets, "`"+field.Column+"` = ?")
+		args = append(args, field.Value)
+	}
+	sets = append(sets, leadBulkSpec.Touch)
+	return strings.Join(sets, ", "), args
+}
+
+// statement is the whole update as one statement, for previews and the audit trail
+func (p leadBulkUpdateParams) statement(where string, whereArgs []interface{}) (string, []interface{}) {
+	sets, args := p.sets()
+	return "UPDATE vicidial_list SET " + sets + " WHERE 1=1" + where, append(args, whereArgs...)
+}
+
+// leadBulkUpdateWhere compiles the filter and the caller's list restriction
+// into conditions on vicidial_list
+func (h *Handler) leadBulkUpdateWhere(p leadBulkUpdateParams) (string, []interface{}, error) {
+	filter, err := h.parseLeadFilter([]string{p.Filter}, p.ListID)
+	if err != nil {
+		return "", nil, err
+	}
+	restrictSQL, restrictArgs := p.filter("list_id")
+	return filter.Where + restrictSQL, append(filter.Args, restrictArgs...), nil
+}
+
+// BulkUpdateLeads assigns fields on every lead matching a filter. With
+// dry_run=Y it only counts the leads and shows a sample; otherwise the update
+// is queued as a job that works through the leads in chunks.
+func (h *Handler) BulkUpdateLeads(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Filter        string          `json:"filter"`
+		ListID        int             `json:"list_id"`
+		Set           json.RawMessage `json:"set"`
+		ChunkSize     int             `json:"chunk_size"`
+		ExpectedCount *int            `json:"expected_count"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if strings.TrimSpace(req.Filter) == "" {
+		respondWithError(w, http.StatusBadRequest, "filter is required; use lead_id>0 to update every lead")
+		return
+	}
+	if len(req.Set) == 0 {
+		respondWithError(w, http.StatusBadRequest, "set is required")
+		return
+	}
+	fields, err := decodePatch(leadBulkSpec, req.Set)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.ChunkSize == 0 {
+		req.ChunkSize = leadBulkChunkSize
+	}
+	if req.ChunkSize < 1 || req.ChunkSize > leadBulkMaxChunkSize {
+		respondWithError(w, http.StatusBadRequest, "chunk_size must be between 1 and "+strconv.Itoa(leadBulkMaxChunkSize))
+		return
+	}
+
+	params := leadBulkUpdateParams{
+		Filter:          req.Filter,
+		ListID:          req.ListID,
+		Set:             fields,
+		ChunkSize:       req.ChunkSize,
+		listRestriction: callerListRestriction(r),
+	}
+
+	filter, err := h.parseLeadFilter([]string{req.Filter}, req.ListID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.ListID != 0 && !h.requireListAccess(w, r, filter.ListID) {
+		return
+	}
+
+	// Moving leads requires the target list to exist and be allowed
+	if newListID, ok := patchValue(fields, "list_id"); ok {
+		var exists int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists WHERE list_id = ?", newListID).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up list: "+err.Error())
+			return
+		}
+		if exists == 0 {
+			respondWithError(w, http.StatusBadRequest, "Target list "+strconv.Itoa(newListID.(int))+" does not exist")
+			return
+		}
+		if !h.requireListAccess(w, r, newListID) {
+			return
+		}
+	}
+
+	restrictSQL, restrictArgs := params.filter("list_id")
+	where := filter.Where + restrictSQL
+	whereArgs := append(filter.Args, restrictArgs...)
+
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_list WHERE 1=1"+where, whereArgs...).Scan(&params.Matched); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to count leads: "+err.Error())
+		return
+	}
+
+	statement, statementArgs := params.statement(where, whereArgs)
+	preview := map[string]interface{}{
+		"filter":     req.Filter,
+		"set":        patchFieldNames(fields),
+		"matched":    params.Matched,
+		"chunk_size": params.ChunkSize,
+		"chunks":     (params.Matched + params.ChunkSize - 1) / params.ChunkSize,
+		"sql":        renderSQL(statement, statementArgs),
+	}
+
+	dryRun, _ := schemaFlags(r)
+	if dryRun || (req.ExpectedCount != nil && *req.ExpectedCount != params.Matched) {
+		columns := []string{"lead_id", "list_id", "status"}
+		for _, field := range fields {
+			if field.Column != "list_id" && field.Column != "status" {
+				columns = append(columns, "`"+field.Column+"`")
+			}
+		}
+		sample := h.snapshotRows("SELECT "+strings.Join(columns, ", ")+" FROM vicidial_list WHERE 1=1"+where+
+			" ORDER BY lead_id LIMIT "+strconv.Itoa(leadBulkSampleSize), whereArgs...)
+		if sample == nil {
+			sample = []map[string]interface{}{}
+		}
+		preview["sample"] = sample
+
+		if !dryRun {
+			respondWithJSON(w, http.StatusConflict, models.APIResponse{
+				Success: false,
+				Error:   "Filter matches " + strconv.Itoa(params.Matched) + " leads, not the expected " + strconv.Itoa(*req.ExpectedCount),
+				Data:    preview,
+			})
+			return
+		}
+		respondWithSuccess(w, "Bulk update preview", preview)
+		return
+	}
+
+	if params.Matched == 0 {
+		respondWithSuccess(w, "No leads match the filter", preview)
+		return
+	}
+
+	h.submitJob(w, r, jobTypeLeadBulkUpdate, params, "Bulk lead update queued")
+}
+
+// runLeadBulkUpdate works through the matching leads in lead_id order. Each
+// chunk re-applies the filter, so leads changed since the preview are left
+// alone, and repeating a chunk after a restart is harmless.
+func (h *Handler) runLeadBulkUpdate(ctx context.Context, task *jobs.Task) (interface{}, error) {
+	var params leadBulkUpdateParams
+	if err := task.Decode(&params); err != nil {
+		return nil, err
+	}
+
+	var cp leadBulkUpdateCheckpoint
+	resumed, err := task.LoadCheckpoint(&cp)
+	if err != nil {
+		return nil, err
+	}
+	if !resumed {
+		cp.Result.Matched = params.Matched
+	}
+	task.SetTotal(params.Matched)
+	task.SetProgress(cp.Result.Scanned)
+
+	where, whereArgs, err := h.leadBulkUpdateWhere(params)
+	if err != nil {
+		return cp.Result, err
+	}
+	sets, setArgs := params.sets()
+	for {
+		if err := ctx.Err(); err != nil {
+			return cp.Result, err
+		}
+
+		ids, err := h.nextLeadChunk(ctx, "vicidial_list", where, whereArgs, cp.LastLeadID, params.ChunkSize)
+		if err != nil {
+			return cp.Result, err
+		}
+		if len(ids) == 0 {
+			return cp.Result, nil
+		}
+
+		args := append([]interface{}{}, setArgs...)
+		args = append(args, ids...)
+		args = append(args, whereArgs...)
+		res, err := h.DB.ExecContext(ctx, "UPDATE vicidial_list SET "+sets+
+			" WHERE lead_id IN ("+placeholders(len(ids))+")"+where, args...)
+		if err != nil {
+			return cp.Result, err
+		}
+		n, _ := res.RowsAffected()
+
+		cp.LastLeadID = ids[len(ids)-1].(int)
+		cp.Result.Scanned += len(ids)
+		cp.Result.Updated += int(n)
+		cp.Result.Chunks++
+		task.SetProgress(cp.Result.Scanned)
+		if err := task.SaveCheckpoint(cp); err != nil {
+			return cp.Result, err
+		}
+
+		if len(ids) < params.ChunkSize {
+			return cp.Result, nil
+		}
+	}
+}
+
+// nextLeadChunk returns the IDs of up to size leads in table, vicidial_list
+// or vicidial_list_archive, after afterID that match the conditions, in
+// lead_id order
+func (h *Handler) nextLeadChunk(ctx context.Context, table, where string, whereArgs []interface{}, afterID, size int) ([]interface{}, error) {
+	args := append([]interface{}{afterID}, whereArgs...)
+	args = append(args, size)
+	rows, err := h.DB.QueryContext(ctx, "SELECT lead_id FROM "+table+" WHERE lead_id > ?"+where+
+		" ORDER BY lead_id LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []interface{}{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// leadBulkUpdateFinished audits a finished bulk update as its requester
+func (h *Handler) leadBulkUpdateFinished(job models.Job) {
+	var params leadBulkUpdateParams
+	json.Unmarshal(job.Params, &params)
+
+	after := jobAuditResult(job)
+	after["filter"] = params.Filter
+
+	var statement string
+	var args []interface{}
+	if where, whereArgs, err := h.leadBulkUpdateWhere(params); err == nil {
+		statement, args = params.statement(where, whereArgs)
+	}
+
+	h.auditAs(jobActor(job), auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(params.Matched) + " leads",
+		Code:     "ADMIN API BULK UPDATE LEADS",
+		SQL:      statement,
+		Args:     args,
+		After:    after,
+	})
+}
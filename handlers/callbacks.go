@@ -0,0 +1,668 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Callback statuses in vicidial_callbacks. ACTIVE callbacks wait for their
+// time, when AST_VDhopper makes them LIVE; INACTIVE ones are done or cancelled.
+const (
+	callbackActive   = "ACTIVE"
+	callbackLive     = "LIVE"
+	callbackInactive = "INACTIVE"
+)
+
+// Callback recipients: the agent who set the callback, or any agent in the campaign
+const (
+	callbackUserOnly = "USERONLY"
+	callbackAnyone   = "ANYONE"
+)
+
+// callbackHoldStatus is the lead status VICIdial holds a lead in while its
+// callback is pending, so the dialer leaves it alone. When an ANYONE callback
+// goes LIVE the lead gets the callback's lead_status, CALLBK by default, and
+// is dialed like any other lead.
+const (
+	callbackHoldStatus    = "CBHOLD"
+	callbackDefaultStatus = "CALLBK"
+)
+
+// callbackColumns selects a vicidial_callbacks row aliased c for scanCallback
+const callbackColumns = `c.callback_id, c.lead_id, c.list_id, c.campaign_id, c.status,
+	c.entry_time, c.callback_time, c.modify_date, c.user, c.recipient,
+	COALESCE(c.comments, ''), COALESCE(c.user_group, ''), c.lead_status`
+
+// scanCallback reads a row selected with callbackColumns, followed by any
+// extra columns
+func scanCallback(row rowScanner, extra ...interface{}) (models.Callback, error) {
+	var cb models.Callback
+	var modifyDate sql.NullTime
+	dest := []interface{}{&cb.CallbackID, &cb.LeadID, &cb.ListID, &cb.CampaignID, &cb.Status,
+		&cb.EntryTime, &cb.CallbackTime, &modifyDate, &cb.User, &cb.Recipient,
+		&cb.Comments, &cb.UserGroup, &cb.LeadStatus}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return cb, err
+	}
+	if modifyDate.Valid {
+		cb.ModifyDate = &modifyDate.Time
+	}
+	return cb, nil
+}
+
+// callbackFields are the callback settings an update request may set. The
+// callback time is a string so an RFC 3339 offset survives decoding.
+type callbackFields struct {
+	CallbackTime string `json:"callback_time"`
+	User         string `json:"user"`
+	Recipient    string `json:"recipient"`
+	Comments     string `json:"comments"`
+	LeadStatus   string `json:"lead_status"`
+}
+
+var callbackPatchSpec = patchSpec{
+	Table:     "vicidial_callbacks",
+	Model:     callbackFields{},
+	KeyColumn: "callback_id",
+	Validators: map[string]fieldValidator{
+		"user":        validateMaxLen(20),
+		"recipient":   validateEnum(callbackUserOnly, callbackAnyone),
+		"comments":    validateMaxLen(255),
+		"lead_status": validateCallbackLeadStatus,
+	},
+	Touch: "modify_date = NOW()",
+}
+
+// validateCallbackLeadStatus rejects the hold status, which would leave the
+// lead held once the callback is due
+func validateCallbackLeadStatus(value interface{}) error {
+	if err := validateStatus(value); err != nil {
+		return err
+	}
+	if fmt.Sprint(value) == callbackHoldStatus {
+		return fmt.Errorf("cannot be %s", callbackHoldStatus)
+	}
+	return nil
+}
+
+// serverLocation is the time zone the database stores local times in
+func (h *Handler) serverLocation() *time.Location {
+	if h.Config != nil && h.Config.Timezone != "" {
+		if loc, err := time.LoadLocation(h.Config.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// parseCallbackTime reads a callback time in server time, or with an offset
+// in RFC 3339 format, and requires it to be in the future. It is returned in
+// server time, as vicidial_callbacks stores it.
+func (h *Handler) parseCallbackTime(value string) (string, error) {
+	loc := h.serverLocation()
+	for _, layout := range patchTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			continue
+		}
+		if !t.After(time.Now()) {
+			return "", fmt.Errorf("Invalid value for callback_time: must be in the future")
+		}
+		return t.In(loc).Format("2006-01-02 15:04:05"), nil
+	}
+	return "", fmt.Errorf("Invalid value for callback_time: use YYYY-MM-DD HH:MM:SS or RFC 3339")
+}
+
+// callbackUserGroup returns the user group of the agent a callback is
+// assigned to, responding with 400 when the user does not exist
+func (h *Handler) callbackUserGroup(w http.ResponseWriter, user string) (string, bool) {
+	var userGroup string
+	err := h.DB.QueryRow("SELECT user_group FROM vicidial_users WHERE user = ?", user).Scan(&userGroup)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusBadRequest, "User "+user+" does not exist")
+		return "", false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up user: "+err.Error())
+		return "", false
+	}
+	return userGroup, true
+}
+
+// callbackLeadStatus is the status a lead should have for its callback: held
+// until the callback is due, then released to the callback's lead_status
+// unless it is reserved for one agent
+func callbackLeadStatus(status, recipient, leadStatus string) string {
+	if status == callbackLive && recipient == callbackAnyone {
+		return leadStatus
+	}
+	return callbackHoldStatus
+}
+
+// syncCallbackLead gives the lead the status its callback calls for. Leads
+// whose status has moved on, because an agent or another update disposed
+// them, are left alone. Held leads are taken out of the hopper so they are
+// not dialed before the callback is due.
+func syncCallbackLead(tx *sql.Tx, leadID int, status string, ownStatuses ...string) (int64, error) {
+	args := append([]interface{}{status, leadID}, stringArgs(ownStatuses)...)
+	res, err := tx.Exec("UPDATE vicidial_list SET status = ?, modify_date = NOW() WHERE lead_id = ? AND status IN ("+
+		placeholders(len(ownStatuses))+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+
+	if status == callbackHoldStatus {
+		if _, err := tx.Exec("DELETE FROM vicidial_hopper WHERE lead_id = ? AND status = 'READY'", leadID); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// stringArgs converts strings to query arguments
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+// callbackPageSpec pages ListCallbacks results, by default soonest first
+var callbackPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"callback_id":   {Column: "c.callback_id"},
+		"callback_time": {Column: "c.callback_time", Time: true},
+		"entry_time":    {Column: "c.entry_time", Time: true},
+		"lead_id":       {Column: "c.lead_id"},
+		"user":          {Column: "c.user"},
+	},
+	Key:          "callback_id",
+	DefaultSort:  "callback_time",
+	DefaultLimit: 100,
+	MaxLimit:     1000,
+}
+
+// callbackEntry is a callback listed with the lead it belongs to
+type callbackEntry struct {
+	models.Callback
+	PhoneNumber       string `json:"phone_number"`
+	FirstName         string `json:"first_name"`
+	LastName          string `json:"last_name"`
+	CurrentLeadStatus string `json:"current_lead_status"`
+}
+
+// ListCallbacks lists callbacks by campaign, user, user group, list or lead.
+// due=upcoming returns pending callbacks that are not yet due and
+// due=overdue those whose time has passed without being handled.
+func (h *Handler) ListCallbacks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	page, ok := readPage(w, r, callbackPageSpec)
+	if !ok {
+		return
+	}
+
+	from := "FROM vicidial_callbacks c LEFT JOIN vicidial_list l ON c.lead_id = l.lead_id WHERE 1=1"
+	args := []interface{}{}
+
+	for _, filter := range []struct{ param, column string }{
+		{"campaign_id", "c.campaign_id"},
+		{"user", "c.user"},
+		{"user_group", "c.user_group"},
+		{"list_id", "c.list_id"},
+		{"lead_id", "c.lead_id"},
+		{"recipient", "c.recipient"},
+	} {
+		if value := q.Get(filter.param); value != "" {
+			from += " AND " + filter.column + " = ?"
+			args = append(args, value)
+		}
+	}
+
+	if status := q.Get("status"); status != "" {
+		statuses := strings.Split(strings.ToUpper(status), ",")
+		for _, s := range statuses {
+			if s != callbackActive && s != callbackLive && s != callbackInactive {
+				respondWithError(w, http.StatusBadRequest, "Invalid status "+s+", use ACTIVE, LIVE or INACTIVE")
+				return
+			}
+		}
+		from += " AND c.status IN (" + placeholders(len(statuses)) + ")"
+		args = append(args, stringArgs(statuses)...)
+	}
+
+	switch due := q.Get("due"); due {
+	case "":
+	case "upcoming":
+		from += " AND c.status = 'ACTIVE' AND c.callback_time >= NOW()"
+	case "overdue":
+		from += " AND c.status IN ('ACTIVE','LIVE') AND c.callback_time < NOW()"
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid due "+due+", use upcoming or overdue")
+		return
+	}
+
+	for _, bound := range []struct {
+		param string
+		end   bool
+		op    string
+	}{{"start_date", false, ">="}, {"end_date", true, "<="}} {
+		value := q.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, ok := parseTimelineTime(value, bound.end)
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, "Invalid "+bound.param+", use YYYY-MM-DD or YYYY-MM-DD HH:MM:SS")
+			return
+		}
+		from += " AND c.callback_time " + bound.op + " ?"
+		args = append(args, t)
+	}
+
+	restrictSQL, restrictArgs := campaignFilter(r, "c.campaign_id")
+	from += restrictSQL
+	args = append(args, restrictArgs...)
+	restrictSQL, restrictArgs = listFilter(r, "c.list_id")
+	from += restrictSQL
+	args = append(args, restrictArgs...)
+
+	rows, err := page.query(h.DB, "SELECT "+callbackColumns+`,
+		COALESCE(l.phone_number, ''), COALESCE(l.first_name, ''), COALESCE(l.last_name, ''), COALESCE(l.status, '')`,
+		from, args)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve callbacks: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	callbacks := []callbackEntry{}
+	for rows.Next() {
+		var entry callbackEntry
+		cb, err := scanCallback(rows, page.dest(&entry.PhoneNumber, &entry.FirstName, &entry.LastName, &entry.CurrentLeadStatus)...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read callback: "+err.Error())
+			return
+		}
+		if page.more() {
+			break
+		}
+		entry.Callback = cb
+		callbacks = append(callbacks, entry)
+	}
+
+	respondWithPage(w, r, "Callbacks retrieved", callbacks, page)
+}
+
+// callbackFromRequest loads the callback named in the path, responding with
+// an error when it does not exist or the caller may not use it
+func (h *Handler) callbackFromRequest(w http.ResponseWriter, r *http.Request) (models.Callback, bool) {
+	callbackID := mux.Vars(r)["callback_id"]
+
+	cb, err := scanCallback(h.DB.QueryRow("SELECT "+callbackColumns+" FROM vicidial_callbacks c WHERE c.callback_id = ?", callbackID))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Callback not found")
+		return cb, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve callback: "+err.Error())
+		return cb, false
+	}
+
+	if !requireCampaignAccess(w, r, cb.CampaignID) || !h.requireListAccess(w, r, cb.ListID) {
+		return cb, false
+	}
+	return cb, true
+}
+
+// GetCallback retrieves a callback
+func (h *Handler) GetCallback(w http.ResponseWriter, r *http.Request) {
+	cb, ok := h.callbackFromRequest(w, r)
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "Callback retrieved", cb)
+}
+
+// ScheduleCallback schedules a callback for a lead. As when an agent sets a
+// callback, the lead's other pending callbacks are made inactive and the lead
+// is held in CBHOLD until the callback is due.
+func (h *Handler) ScheduleCallback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		LeadID       int    `json:"lead_id"`
+		CampaignID   string `json:"campaign_id"`
+		CallbackTime string `json:"callback_time"`
+		User         string `json:"user"`
+		Recipient    string `json:"recipient"`
+		Comments     string `json:"comments"`
+		LeadStatus   string `json:"lead_status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if req.LeadID == 0 || req.CallbackTime == "" {
+		respondWithError(w, http.StatusBadRequest, "lead_id and callback_time are required")
+		return
+	}
+	callbackTime, err := h.parseCallbackTime(req.CallbackTime)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Recipient == "" {
+		req.Recipient = callbackAnyone
+		if req.User != "" {
+			req.Recipient = callbackUserOnly
+		}
+	}
+	if req.LeadStatus == "" {
+		req.LeadStatus = callbackDefaultStatus
+	}
+	for name, value := range map[string]string{"user": req.User, "recipient": req.Recipient, "comments": req.Comments, "lead_status": req.LeadStatus} {
+		if err := callbackPatchSpec.Validators[name](value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid value for "+name+": "+err.Error())
+			return
+		}
+	}
+	if req.Recipient == callbackUserOnly && req.User == "" {
+		respondWithError(w, http.StatusBadRequest, "user is required for USERONLY callbacks")
+		return
+	}
+
+	if !h.requireLeadAccess(w, r, req.LeadID) {
+		return
+	}
+	var listID int
+	var listCampaignID string
+	err = h.DB.QueryRow(`
+		SELECT l.list_id, COALESCE(li.campaign_id, '')
+		FROM vicidial_list l LEFT JOIN vicidial_lists li ON l.list_id = li.list_id
+		WHERE l.lead_id = ?`, req.LeadID).Scan(&listID, &listCampaignID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Lead not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lead: "+err.Error())
+		return
+	}
+
+	if req.CampaignID == "" {
+		req.CampaignID = listCampaignID
+	}
+	if req.CampaignID == "" {
+		respondWithError(w, http.StatusBadRequest, "campaign_id is required for leads in lists without a campaign")
+		return
+	}
+	if !requireCampaignAccess(w, r, req.CampaignID) {
+		return
+	}
+	var campaigns int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_campaigns WHERE campaign_id = ?", req.CampaignID).Scan(&campaigns); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up campaign: "+err.Error())
+		return
+	}
+	if campaigns == 0 {
+		respondWithError(w, http.StatusBadRequest, "Campaign "+req.CampaignID+" does not exist")
+		return
+	}
+
+	userGroup := ""
+	if req.User != "" {
+		var ok bool
+		if userGroup, ok = h.callbackUserGroup(w, req.User); !ok {
+			return
+		}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE vicidial_callbacks SET status = 'INACTIVE', modify_date = NOW() WHERE lead_id = ? AND status IN ('ACTIVE','LIVE')", req.LeadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to replace callbacks: "+err.Error())
+		return
+	}
+	replaced, _ := res.RowsAffected()
+
+	query := `
+		INSERT INTO vicidial_callbacks
+		(lead_id, list_id, campaign_id, status, entry_time, callback_time, modify_date,
+		 user, recipient, comments, user_group, lead_status)
+		VALUES (?, ?, ?, 'ACTIVE', NOW(), ?, NOW(), ?, ?, ?, ?, ?)
+	`
+	args := []interface{}{req.LeadID, listID, req.CampaignID, callbackTime,
+		req.User, req.Recipient, req.Comments, userGroup, req.LeadStatus}
+	res, err = tx.Exec(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to schedule callback: "+err.Error())
+		return
+	}
+	callbackID, _ := res.LastInsertId()
+
+	// Any status but the callback's own is replaced: scheduling is a disposition
+	if _, err := tx.Exec("UPDATE vicidial_list SET status = ?, modify_date = NOW() WHERE lead_id = ?", callbackHoldStatus, req.LeadID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to hold lead: "+err.Error())
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM vicidial_hopper WHERE lead_id = ? AND status = 'READY'", req.LeadID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove lead from hopper: "+err.Error())
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to schedule callback: "+err.Error())
+		return
+	}
+
+	after := h.snapshotRow("vicidial_callbacks", "callback_id", callbackID)
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "ADD",
+		RecordID: strconv.Itoa(req.LeadID),
+		Code:     "ADMIN API SCHEDULE CALLBACK",
+		SQL:      query,
+		Args:     args,
+		After:    after,
+	})
+
+	respondWithSuccess(w, "Callback scheduled successfully", map[string]interface{}{
+		"callback_id":   callbackID,
+		"lead_id":       req.LeadID,
+		"campaign_id":   req.CampaignID,
+		"callback_time": callbackTime,
+		"recipient":     req.Recipient,
+		"replaced":      replaced,
+	})
+}
+
+// UpdateCallback reschedules, reassigns or comments on a pending callback.
+// A new callback_time makes a LIVE callback ACTIVE again and holds the lead;
+// moving a LIVE callback between USERONLY and ANYONE holds or releases it.
+func (h *Handler) UpdateCallback(w http.ResponseWriter, r *http.Request) {
+	cb, ok := h.callbackFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if cb.Status == callbackInactive {
+		respondWithError(w, http.StatusConflict, "Callback is no longer active")
+		return
+	}
+
+	fields, ok := readPatch(w, r, callbackPatchSpec)
+	if !ok {
+		return
+	}
+
+	status, recipient, user, leadStatus := cb.Status, cb.Recipient, cb.User, cb.LeadStatus
+	if value, ok := patchValue(fields, "callback_time"); ok {
+		callbackTime, err := h.parseCallbackTime(value.(string))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for i := range fields {
+			if fields[i].Name == "callback_time" {
+				fields[i].Value = callbackTime
+			}
+		}
+		status = callbackActive
+		fields = append(fields, patchField{Name: "status", Column: "status", Value: status})
+	}
+	if value, ok := patchValue(fields, "recipient"); ok {
+		recipient = value.(string)
+	}
+	if value, ok := patchValue(fields, "lead_status"); ok {
+		leadStatus = value.(string)
+	}
+	if value, ok := patchValue(fields, "user"); ok {
+		user = value.(string)
+		userGroup := ""
+		if user != "" {
+			if userGroup, ok = h.callbackUserGroup(w, user); !ok {
+				return
+			}
+		}
+		fields = append(fields, patchField{Name: "user_group", Column: "user_group", Value: userGroup})
+	}
+	if recipient == callbackUserOnly && user == "" {
+		respondWithError(w, http.StatusBadRequest, "user is required for USERONLY callbacks")
+		return
+	}
+
+	before := h.snapshotRow("vicidial_callbacks", "callback_id", cb.CallbackID)
+	query, args := buildPatchQuery(callbackPatchSpec, fields, cb.CallbackID)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query, args...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update callback: "+err.Error())
+		return
+	}
+	newLeadStatus := callbackLeadStatus(status, recipient, leadStatus)
+	leadUpdated, err := syncCallbackLead(tx, cb.LeadID, newLeadStatus, callbackHoldStatus, cb.LeadStatus, leadStatus)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update lead status: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update callback: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(cb.LeadID),
+		Code:     "ADMIN API UPDATE CALLBACK",
+		SQL:      query,
+		Args:     args,
+		Before:   before,
+		After:    h.snapshotRow("vicidial_callbacks", "callback_id", cb.CallbackID),
+	})
+
+	respondWithSuccess(w, "Callback updated successfully", map[string]interface{}{
+		"callback_id":    cb.CallbackID,
+		"lead_id":        cb.LeadID,
+		"status":         status,
+		"updated_fields": patchFieldNames(fields),
+		"lead_status":    newLeadStatus,
+		"lead_updated":   leadUpdated > 0,
+	})
+}
+
+// CancelCallback makes a pending callback inactive. The lead, if still held
+// for the callback, is given lead_status. A callback that is not due yet
+// needs one, since the callback's own lead_status would release the lead to
+// be called back anyway; a LIVE callback defaults to its own.
+func (h *Handler) CancelCallback(w http.ResponseWriter, r *http.Request) {
+	cb, ok := h.callbackFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if cb.Status == callbackInactive {
+		respondWithError(w, http.StatusConflict, "Callback is no longer active")
+		return
+	}
+
+	leadStatus := r.URL.Query().Get("lead_status")
+	if leadStatus == "" && cb.Status != callbackLive {
+		respondWithError(w, http.StatusBadRequest, "lead_status is required to cancel a callback that is not due yet")
+		return
+	}
+	if leadStatus == "" {
+		leadStatus = cb.LeadStatus
+	}
+	if err := validateCallbackLeadStatus(leadStatus); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid value for lead_status: "+err.Error())
+		return
+	}
+
+	before := h.snapshotRow("vicidial_callbacks", "callback_id", cb.CallbackID)
+	query := "UPDATE vicidial_callbacks SET status = 'INACTIVE', modify_date = NOW() WHERE callback_id = ?"
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query, cb.CallbackID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel callback: "+err.Error())
+		return
+	}
+	leadUpdated, err := syncCallbackLead(tx, cb.LeadID, leadStatus, callbackHoldStatus, cb.LeadStatus)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update lead status: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel callback: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(cb.LeadID),
+		Code:     "ADMIN API CANCEL CALLBACK",
+		SQL:      query,
+		Args:     []interface{}{cb.CallbackID},
+		Before:   before,
+		After: map[string]interface{}{
+			"status":       callbackInactive,
+			"lead_status":  leadStatus,
+			"lead_updated": leadUpdated > 0,
+		},
+	})
+
+	respondWithSuccess(w, "Callback cancelled successfully", map[string]interface{}{
+		"callback_id":  cb.CallbackID,
+		"lead_id":      cb.LeadID,
+		"lead_status":  leadStatus,
+		"lead_updated": leadUpdated > 0,
+	})
+}
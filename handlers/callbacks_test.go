@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// callbackRow is callback 7 for lead 12 in campaign SALES as selected by callbackFromRequest
+func callbackRow(status, recipient, leadStatus string) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows([]string{"callback_id", "lead_id", "list_id", "campaign_id", "status", "entry_time",
+		"callback_time", "modify_date", "user", "recipient", "comments", "user_group", "lead_status"}).
+		AddRow(7, 12, 101, "SALES", status, now, now, nil, "6001", recipient, "", "AGENTS", leadStatus)
+}
+
+// callbackRequest is a request for callback_id as routed by mux
+func callbackRequest(method, callbackID, body string) *http.Request {
+	r := httptest.NewRequest(method, "/callbacks/"+callbackID, strings.NewReader(body))
+	return mux.SetURLVars(r, map[string]string{"callback_id": callbackID})
+}
+
+var (
+	callbackSelect   = regexp.QuoteMeta("FROM vicidial_callbacks c WHERE c.callback_id = ?")
+	callbackSnapshot = regexp.QuoteMeta("SELECT * FROM vicidial_callbacks WHERE callback_id = ? LIMIT 1")
+)
+
+func TestUpdateCallbackHoldsLeadWithCallback(t *testing.T) {
+	h, mock := newMockHandler(t)
+	callbackTime := time.Now().Add(48 * time.Hour).Format("2006-01-02 15:04:05")
+
+	// A LIVE callback for anyone has released its lead as CALLBK; moving it
+	// to a later time makes it ACTIVE and holds the lead again
+	mock.ExpectQuery(callbackSelect).WithArgs("7").WillReturnRows(callbackRow(callbackLive, callbackAnyone, "CALLBK"))
+	mock.ExpectQuery(callbackSnapshot).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"callback_id"}).AddRow(7))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_callbacks SET `callback_time` = ?, `status` = ?, modify_date = NOW() WHERE callback_id = ?")).
+		WithArgs(callbackTime, callbackActive, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_list SET status = ?, modify_date = NOW() WHERE lead_id = ? AND status IN (?,?,?)")).
+		WithArgs(callbackHoldStatus, 12, callbackHoldStatus, "CALLBK", "CALLBK").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_hopper WHERE lead_id = ? AND status = 'READY'")).
+		WithArgs(12).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(callbackSnapshot).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"callback_id"}).AddRow(7))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_admin_log")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	w := httptest.NewRecorder()
+	h.UpdateCallback(w, callbackRequest("PATCH", "7", `{"callback_time":"`+callbackTime+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"lead_status":"CBHOLD"`) || !strings.Contains(w.Body.String(), `"lead_updated":true`) {
+		t.Errorf("body = %s, want the lead held", w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelCallbackReleasesLead(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	mock.ExpectQuery(callbackSelect).WithArgs("7").WillReturnRows(callbackRow(callbackActive, callbackUserOnly, "CALLBK"))
+	mock.ExpectQuery(callbackSnapshot).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"callback_id"}).AddRow(7))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_callbacks SET status = 'INACTIVE', modify_date = NOW() WHERE callback_id = ?")).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_list SET status = ?, modify_date = NOW() WHERE lead_id = ? AND status IN (?,?)")).
+		WithArgs("NI", 12, callbackHoldStatus, "CALLBK").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_admin_log")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	w := httptest.NewRecorder()
+	r := callbackRequest("DELETE", "7", "")
+	r.URL.RawQuery = "lead_status=NI"
+	h.CancelCallback(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelCallbackRollsBackWhenLeadUpdateFails(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	mock.ExpectQuery(callbackSelect).WithArgs("7").WillReturnRows(callbackRow(callbackLive, callbackAnyone, "CALLBK"))
+	mock.ExpectQuery(callbackSnapshot).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"callback_id"}).AddRow(7))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_callbacks SET status = 'INACTIVE'")).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_list SET status = ?")).
+		WithArgs("CALLBK", 12, callbackHoldStatus, "CALLBK").
+		WillReturnError(errors.New("lock wait timeout"))
+	// The callback stays pending, and nothing is audited
+	mock.ExpectRollback()
+
+	w := httptest.NewRecorder()
+	h.CancelCallback(w, callbackRequest("DELETE", "7", ""))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnknownCallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*Handler) http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{"get", func(h *Handler) http.HandlerFunc { return h.GetCallback }, "GET", ""},
+		{"update", func(h *Handler) http.HandlerFunc { return h.UpdateCallback }, "PATCH", `{"comments":"x"}`},
+		{"cancel", func(h *Handler) http.HandlerFunc { return h.CancelCallback }, "DELETE", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			mock.ExpectQuery(callbackSelect).WithArgs("404").
+				WillReturnRows(sqlmock.NewRows([]string{"callback_id"}))
+
+			w := httptest.NewRecorder()
+			tt.handler(h)(w, callbackRequest(tt.method, "404", tt.body))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// callWindow is a start and stop time of day as HHMM numbers, such as 900
+// and 2100. A zero window means the default window applies.
+type callWindow struct {
+	Start int
+	Stop  int
+}
+
+// open reports whether hhmm is inside the window. The stop time is excluded.
+func (cw callWindow) open(hhmm int) bool {
+	return hhmm >= cw.Start && hhmm < cw.Stop
+}
+
+// callSchedule is a default window with optional per-weekday overrides,
+// indexed by time.Weekday
+type callSchedule struct {
+	Default callWindow
+	Days    [7]callWindow
+}
+
+// window returns the window that applies on a weekday. As in VICIdial a day
+// whose start and stop are both 0 uses the default window.
+func (cs callSchedule) window(day time.Weekday) callWindow {
+	if w := cs.Days[day]; w.Start != 0 || w.Stop != 0 {
+		return w
+	}
+	return cs.Default
+}
+
+// callTime is a vicidial_call_times definition with the state call times it
+// references in ct_state_call_times. Leads in one of those states are dialed
+// within the state's schedule instead of the default one.
+type callTime struct {
+	ID       string
+	Schedule callSchedule
+	States   map[string]callSchedule
+}
+
+// callTimeOffsets are the gmt_offset_now values VICIdial checks call times
+// for, from +13.00 down to -12.75 in quarter hours
+func callTimeOffsets() []float64 {
+	var offsets []float64
+	for p := 13.0; p > -13; p -= 0.25 {
+		offsets = append(offsets, p)
+	}
+	return offsets
+}
+
+// localHHMM returns the weekday and HHMM time at a GMT offset
+func localHHMM(now time.Time, offset float64) (time.Weekday, int) {
+	local := now.UTC().Add(time.Duration(offset * float64(time.Hour)))
+	return local.Weekday(), local.Hour()*100 + local.Minute()
+}
+
+// allows reports whether a lead at the offset in the state may be called now
+func (ct *callTime) allows(offset float64, state string, now time.Time) bool {
+	schedule := ct.Schedule
+	if stateSchedule, ok := ct.States[state]; ok {
+		schedule = stateSchedule
+	}
+	day, hhmm := localHHMM(now, offset)
+	return schedule.window(day).open(hhmm)
+}
+
+// openOffsets returns the offsets at which a schedule is open now, formatted
+// as gmt_offset_now values
+func openOffsets(schedule callSchedule, now time.Time) []interface{} {
+	offsets := []interface{}{}
+	for _, offset := range callTimeOffsets() {
+		day, hhmm := localHHMM(now, offset)
+		if schedule.window(day).open(hhmm) {
+			offsets = append(offsets, formatGMTOffset(offset))
+		}
+	}
+	return offsets
+}
+
+// condition returns SQL on gmt_offset_now and state matching the leads that
+// may be called now, built the way AST_VDhopper builds its call time clause
+func (ct *callTime) condition(now time.Time) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+
+	offsetIn := func(offsets []interface{}) string {
+		if len(offsets) == 0 {
+			return "1=0"
+		}
+		args = append(args, offsets...)
+		return "gmt_offset_now IN (" + placeholders(len(offsets)) + ")"
+	}
+
+	defaultSQL := offsetIn(openOffsets(ct.Schedule, now))
+	if len(ct.States) > 0 {
+		states := make([]interface{}, 0, len(ct.States))
+		for state := range ct.States {
+			states = append(states, state)
+		}
+		defaultSQL += " AND state NOT IN (" + placeholders(len(states)) + ")"
+		args = append(args, states...)
+	}
+	parts = append(parts, "("+defaultSQL+")")
+
+	for state, schedule := range ct.States {
+		args = append(args, state)
+		parts = append(parts, "(state = ? AND "+offsetIn(openOffsets(schedule, now))+")")
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", args
+}
+
+// scanCallSchedule reads the default and weekday start and stop columns of
+// vicidial_call_times or vicidial_state_call_times, in that order
+func scanCallSchedule(row rowScanner, extra ...interface{}) (callSchedule, error) {
+	var cs callSchedule
+	dest := append(extra, &cs.Default.Start, &cs.Default.Stop)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		dest = append(dest, &cs.Days[day].Start, &cs.Days[day].Stop)
+	}
+	return cs, row.Scan(dest...)
+}
+
+// loadCallTime reads a call time and its state call times. It returns
+// sql.ErrNoRows when the call time does not exist.
+func (h *Handler) loadCallTime(callTimeID string) (*callTime, error) {
+	ct := &callTime{ID: callTimeID, States: map[string]callSchedule{}}
+	var stateIDs string
+	schedule, err := scanCallSchedule(h.DB.QueryRow(`
+		SELECT COALESCE(ct_state_call_times, ''), ct_default_start, ct_default_stop,
+			   ct_sunday_start, ct_sunday_stop, ct_monday_start, ct_monday_stop,
+			   ct_tuesday_start, ct_tuesday_stop, ct_wednesday_start, ct_wednesday_stop,
+			   ct_thursday_start, ct_thursday_stop, ct_friday_start, ct_friday_stop,
+			   ct_saturday_start, ct_saturday_stop
+		FROM vicidial_call_times WHERE call_time_id = ?
+	`, callTimeID), &stateIDs)
+	if err != nil {
+		return nil, err
+	}
+	ct.Schedule = schedule
+
+	// ct_state_call_times is a pipe separated list such as |ca_rules|tx_rules|
+	var ids []string
+	for _, id := range strings.Split(stateIDs, "|") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ct, nil
+	}
+
+	rows, err := h.DB.Query(`
+		SELECT state_call_time_state, sct_default_start, sct_default_stop,
+			   sct_sunday_start, sct_sunday_stop, sct_monday_start, sct_monday_stop,
+			   sct_tuesday_start, sct_tuesday_stop, sct_wednesday_start, sct_wednesday_stop,
+			   sct_thursday_start, sct_thursday_stop, sct_friday_start, sct_friday_stop,
+			   sct_saturday_start, sct_saturday_stop
+		FROM vicidial_state_call_times WHERE state_call_time_id IN (`+placeholders(len(ids))+`)
+	`, stringArgs(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state string
+		schedule, err := scanCallSchedule(rows, &state)
+		if err != nil {
+			return nil, err
+		}
+		ct.States[state] = schedule
+	}
+	return ct, rows.Err()
+}
+
+// callTimeCache loads each call time once for a report or batch
+type callTimeCache struct {
+	h     *Handler
+	times map[string]*callTime
+}
+
+func newCallTimeCache(h *Handler) *callTimeCache {
+	return &callTimeCache{h: h, times: map[string]*callTime{}}
+}
+
+// get returns a call time, or nil when it does not exist, in which case
+// VICIdial's hopper dials nothing
+func (c *callTimeCache) get(callTimeID string) (*callTime, error) {
+	if ct, ok := c.times[callTimeID]; ok {
+		return ct, nil
+	}
+	ct, err := c.h.loadCallTime(callTimeID)
+	if err == sql.ErrNoRows {
+		ct, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.times[callTimeID] = ct
+	return ct, nil
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// campaignTable is a table of per-campaign rows keyed by campaign_id
+type campaignTable struct {
+	Name    string
+	Option  string // copy option that includes the table, empty when never copied
+	AutoKey string // AUTO_INCREMENT column left to its default on copy
+}
+
+// campaignTables are the tables holding a campaign's settings outside
+// vicidial_campaigns. Copies include the optional ones on request, and
+// deleting a campaign deletes its rows in all of them.
+var campaignTables = []campaignTable{
+	{Name: "vicidial_campaign_statuses", Option: "statuses"},
+	{Name: "vicidial_pause_codes", Option: "pause_codes"},
+	{Name: "vicidial_campaign_hotkeys", Option: "hotkeys"},
+	{Name: "vicidial_lead_recycle", Option: "recycle_rules", AutoKey: "recycle_id"},
+	{Name: "vicidial_campaign_stats"},
+	{Name: "vicidial_campaign_agents"},
+	{Name: "vicidial_campaigns_list_mix"},
+}
+
+// CopyCampaign copies a campaign's settings into a new campaign_id, as the
+// campaign admin's copy does. Statuses, pause codes, hotkeys, recycle rules
+// and in-group settings are copied when asked for. A list belongs to one
+// campaign, so lists are linked by cloning them, without leads, into new
+// list IDs given in lists.
+func (h *Handler) CopyCampaign(w http.ResponseWriter, r *http.Request) {
+	sourceID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, sourceID) {
+		return
+	}
+
+	var req struct {
+		NewCampaignID string         `json:"new_campaign_id"`
+		CampaignName  string         `json:"campaign_name"`
+		Active        string         `json:"active"`
+		Statuses      string         `json:"copy_statuses"`
+		PauseCodes    string         `json:"copy_pause_codes"`
+		Hotkeys       string         `json:"copy_hotkeys"`
+		RecycleRules  string         `json:"copy_recycle_rules"`
+		InGroups      string         `json:"copy_ingroups"`
+		Lists         map[string]int `json:"lists"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := validateCampaignID(req.NewCampaignID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid value for new_campaign_id: "+err.Error())
+		return
+	}
+	if req.CampaignName != "" && (len(req.CampaignName) < 6 || len(req.CampaignName) > 40) {
+		respondWithError(w, http.StatusBadRequest, "Invalid value for campaign_name: must be 6 to 40 characters")
+		return
+	}
+	if req.Active == "" {
+		req.Active = "N"
+	}
+	options := map[string]*string{
+		"active":             &req.Active,
+		"copy_statuses":      &req.Statuses,
+		"copy_pause_codes":   &req.PauseCodes,
+		"copy_hotkeys":       &req.Hotkeys,
+		"copy_recycle_rules": &req.RecycleRules,
+		"copy_ingroups":      &req.InGroups,
+	}
+	for name, value := range options {
+		if *value == "" {
+			*value = "N"
+		}
+		if err := validateYN(*value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid value for "+name+": "+err.Error())
+			return
+		}
+	}
+	copyTables := map[string]bool{
+		"statuses":      req.Statuses == "Y",
+		"pause_codes":   req.PauseCodes == "Y",
+		"hotkeys":       req.Hotkeys == "Y",
+		"recycle_rules": req.RecycleRules == "Y",
+	}
+
+	if !requireCampaignAccess(w, r, req.NewCampaignID) {
+		return
+	}
+	var sourceName string
+	err := h.DB.QueryRow("SELECT campaign_name FROM vicidial_campaigns WHERE campaign_id = ?", sourceID).Scan(&sourceName)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+	if req.CampaignName == "" {
+		req.CampaignName = sourceName
+	}
+	exists, err := h.campaignExists(req.NewCampaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up campaign: "+err.Error())
+		return
+	}
+	if exists {
+		respondWithError(w, http.StatusConflict, "Campaign "+req.NewCampaignID+" already exists")
+		return
+	}
+
+	// Lists are checked and cloned in source list order
+	type listLink struct {
+		SourceListID int  `json:"source_list_id"`
+		ListID       int  `json:"list_id"`
+		CustomTable  bool `json:"custom_table"`
+	}
+	links := []listLink{}
+	for source, target := range req.Lists {
+		sourceListID, err := strconv.Atoi(source)
+		if err != nil || target <= 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid list mapping %q: %d", source, target))
+			return
+		}
+		links = append(links, listLink{SourceListID: sourceListID, ListID: target})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].SourceListID < links[j].SourceListID })
+	seen := map[int]bool{}
+	for i, link := range links {
+		if seen[link.ListID] {
+			respondWithError(w, http.StatusBadRequest, "List "+strconv.Itoa(link.ListID)+" is named more than once")
+			return
+		}
+		seen[link.ListID] = true
+
+		if !h.requireListAccess(w, r, link.SourceListID) {
+			return
+		}
+		var campaignID string
+		err := h.DB.QueryRow("SELECT COALESCE(campaign_id, '') FROM vicidial_lists WHERE list_id = ?", link.SourceListID).Scan(&campaignID)
+		if err != nil && err != sql.ErrNoRows {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up list: "+err.Error())
+			return
+		}
+		if campaignID != sourceID {
+			respondWithError(w, http.StatusBadRequest, "List "+strconv.Itoa(link.SourceListID)+" is not a list of campaign "+sourceID)
+			return
+		}
+		var taken int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists WHERE list_id = ?", link.ListID).Scan(&taken); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up list: "+err.Error())
+			return
+		}
+		if taken > 0 {
+			respondWithError(w, http.StatusConflict, "List "+strconv.Itoa(link.ListID)+" already exists")
+			return
+		}
+		source, err := h.loadCustomTable(link.SourceListID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+			return
+		}
+		target, err := h.loadCustomTable(link.ListID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+			return
+		}
+		if source.Exists && target.Exists {
+			respondWithError(w, http.StatusConflict, "Table "+target.name()+" already exists")
+			return
+		}
+		links[i].CustomTable = source.Exists
+	}
+
+	campaignColumns, err := h.tableColumns(r.Context(), "vicidial_campaigns")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read campaign columns: "+err.Error())
+		return
+	}
+	set := map[string]interface{}{
+		"campaign_id":         req.NewCampaignID,
+		"campaign_name":       req.CampaignName,
+		"active":              req.Active,
+		"campaign_changedate": sqlExpr("NOW()"),
+		"campaign_logindate":  nil,
+		"campaign_calldate":   nil,
+	}
+	if req.InGroups != "Y" {
+		set["closer_campaigns"] = sqlExpr("''")
+		set["xfer_groups"] = sqlExpr("''")
+	}
+	query, args := copyRowsQuery("vicidial_campaigns", "", campaignColumns, set)
+	query += " WHERE campaign_id = ?"
+	args = append(args, sourceID)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query, args...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to copy campaign: "+err.Error())
+		return
+	}
+	if _, err := tx.Exec("INSERT IGNORE INTO vicidial_campaign_stats (campaign_id) VALUES (?)", req.NewCampaignID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create campaign stats: "+err.Error())
+		return
+	}
+
+	copied := map[string]int{}
+	for _, table := range campaignTables {
+		if !copyTables[table.Option] {
+			continue
+		}
+		columns, err := h.tableColumns(r.Context(), table.Name)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read "+table.Name+" columns: "+err.Error())
+			return
+		}
+		tableSet := map[string]interface{}{"campaign_id": req.NewCampaignID}
+		if table.AutoKey != "" {
+			tableSet[table.AutoKey] = nil
+		}
+		tableQuery, tableArgs := copyRowsQuery(table.Name, "", columns, tableSet)
+		res, err := tx.Exec(tableQuery+" WHERE campaign_id = ?", append(tableArgs, sourceID)...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to copy "+table.Option+": "+err.Error())
+			return
+		}
+		n, _ := res.RowsAffected()
+		copied[table.Option] = int(n)
+	}
+
+	for _, link := range links {
+		_, _, err := h.cloneListRows(r.Context(), tx, link.SourceListID, link.ListID, map[string]interface{}{
+			"campaign_id": req.NewCampaignID,
+		}, true)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to clone list "+strconv.Itoa(link.SourceListID)+": "+err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to copy campaign: "+err.Error())
+		return
+	}
+
+	// DDL commits implicitly, so custom tables are created after the rows
+	for _, link := range links {
+		if !link.CustomTable {
+			continue
+		}
+		if _, err := h.DB.Exec("CREATE TABLE custom_" + strconv.Itoa(link.ListID) + " LIKE custom_" + strconv.Itoa(link.SourceListID)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Campaign copied, but failed to create custom_"+strconv.Itoa(link.ListID)+": "+err.Error())
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"source_campaign_id": sourceID,
+		"campaign_id":        req.NewCampaignID,
+		"campaign_name":      req.CampaignName,
+		"active":             req.Active,
+		"ingroups":           req.InGroups == "Y",
+		"copied":             copied,
+		"lists":              links,
+	}
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "COPY",
+		RecordID: req.NewCampaignID,
+		Code:     "ADMIN API COPY CAMPAIGN",
+		SQL:      query,
+		Args:     args,
+		After: map[string]interface{}{
+			"source_campaign_id": sourceID,
+			"campaign":           h.snapshotRow("vicidial_campaigns", "campaign_id", req.NewCampaignID),
+			"copied":             copied,
+			"lists":              links,
+		},
+	})
+
+	respondWithSuccess(w, "Campaign copied successfully", data)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// DeleteCampaign deletes a campaign with its statuses, pause codes, hotkeys,
+// recycle rules, stats and hopper, and makes its pending callbacks
+// inactive. A campaign with agents logged in is never deleted. One that is
+// active or still has lists is refused with 409 unless force=Y, in which
+// case its lists are deactivated and kept. dry_run=Y only reports the
+// dependencies.
+func (h *Handler) DeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+	dryRun, force := schemaFlags(r)
+
+	var active string
+	err := h.DB.QueryRow("SELECT active FROM vicidial_campaigns WHERE campaign_id = ?", campaignID).Scan(&active)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+
+	counts := map[string]int{}
+	for name, query := range map[string]string{
+		"live_agents": "SELECT COUNT(*) FROM vicidial_live_agents WHERE campaign_id = ?",
+		"lists":       "SELECT COUNT(*) FROM vicidial_lists WHERE campaign_id = ?",
+		"hopper":      "SELECT COUNT(*) FROM vicidial_hopper WHERE campaign_id = ?",
+		"callbacks":   "SELECT COUNT(*) FROM vicidial_callbacks WHERE campaign_id = ? AND status IN ('ACTIVE','LIVE')",
+	} {
+		var n int
+		if err := h.DB.QueryRow(query, campaignID).Scan(&n); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to count "+name+": "+err.Error())
+			return
+		}
+		counts[name] = n
+	}
+
+	data := map[string]interface{}{
+		"campaign_id": campaignID,
+		"active":      active,
+		"live_agents": counts["live_agents"],
+		"lists":       counts["lists"],
+		"hopper":      counts["hopper"],
+		"callbacks":   counts["callbacks"],
+	}
+	if dryRun {
+		respondWithSuccess(w, "Dry run, nothing was changed", data)
+		return
+	}
+	refuse := func(message string) {
+		respondWithJSON(w, http.StatusConflict, models.APIResponse{Success: false, Error: message, Data: data})
+	}
+	if counts["live_agents"] > 0 {
+		refuse("Agents are logged in to campaign " + campaignID)
+		return
+	}
+	if active == "Y" && !force {
+		refuse("Campaign " + campaignID + " is active; repeat with force=Y to delete it")
+		return
+	}
+	if counts["lists"] > 0 && !force {
+		refuse("Campaign " + campaignID + " still has lists; repeat with force=Y to delete it and deactivate them")
+		return
+	}
+
+	before := h.snapshotRow("vicidial_campaigns", "campaign_id", campaignID)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	deleted := map[string]int64{}
+	exec := func(name, query string) bool {
+		res, err := tx.Exec(query, campaignID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to delete campaign "+name+": "+err.Error())
+			return false
+		}
+		deleted[name], _ = res.RowsAffected()
+		return true
+	}
+	for _, table := range campaignTables {
+		if !exec(table.Name, "DELETE FROM "+table.Name+" WHERE campaign_id = ?") {
+			return
+		}
+	}
+	if !exec("vicidial_hopper", "DELETE FROM vicidial_hopper WHERE campaign_id = ?") ||
+		!exec("callbacks_inactivated", "UPDATE vicidial_callbacks SET status = 'INACTIVE', modify_date = NOW() WHERE campaign_id = ? AND status IN ('ACTIVE','LIVE')") ||
+		!exec("lists_deactivated", "UPDATE vicidial_lists SET active = 'N', list_changedate = NOW() WHERE campaign_id = ? AND active = 'Y'") ||
+		!exec("vicidial_campaigns", "DELETE FROM vicidial_campaigns WHERE campaign_id = ?") {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete campaign: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "DELETE",
+		RecordID: campaignID,
+		Code:     "ADMIN API DELETE CAMPAIGN",
+		SQL:      "DELETE FROM vicidial_campaigns WHERE campaign_id = ?",
+		Args:     []interface{}{campaignID},
+		Before:   before,
+		After: map[string]interface{}{
+			"forced":  force && (active == "Y" || counts["lists"] > 0),
+			"deleted": deleted,
+		},
+	})
+
+	data["deleted"] = deleted
+	respondWithSuccess(w, "Campaign deleted successfully", data)
+}
@@ -1,57 +1,384 @@
 package handlers
 
 import (
-	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/vicidb/non-agent-api/models"
 )
 
-// UpdateCampaign updates campaign settings
+// campaignSettings are the campaign columns that can be set when a campaign
+// is created. Columns left out keep their VICIdial defaults.
+type campaignSettings struct {
+	CampaignID          string   `json:"campaign_id"`
+	CampaignName        string   `json:"campaign_name"`
+	CampaignDescription string   `json:"campaign_description"`
+	Active              string   `json:"active"`
+	DialMethod          string   `json:"dial_method"`
+	AutoDialLevel       string   `json:"auto_dial_level"`
+	DialStatuses        []string `json:"dial_statuses"`
+	LeadOrder           string   `json:"lead_order"`
+	LeadFilterID        string   `json:"lead_filter_id"`
+	LocalCallTime       string   `json:"local_call_time"`
+	CallCountLimit      int      `json:"call_count_limit"`
+	DropLockoutTime     string   `json:"drop_lockout_time"`
+	HopperLevel         int      `json:"hopper_level"`
+	DialTimeout         int      `json:"dial_timeout"`
+	DialPrefix          string   `json:"dial_prefix"`
+	ManualDialPrefix    string   `json:"manual_dial_prefix"`
+	CampaignCID         string   `json:"campaign_cid"`
+	CampaignCIDOverride string   `json:"campaign_cid_override"`
+	CampaignVDADExten   string   `json:"campaign_vdad_exten"`
+	CampaignRecording   string   `json:"campaign_recording"`
+	Script              string   `json:"campaign_script"`
+	GetCallLaunch       string   `json:"get_call_launch"`
+	AllowClosers        string   `json:"allow_closers"`
+	UserGroup           string   `json:"user_group"`
+}
+
+// campaignUpdate is what PATCH /campaigns accepts: the settings a campaign
+// is created with, plus the older names dial_status and script, and
+// recording_transfer
+type campaignUpdate struct {
+	campaignSettings
+	DialStatus        string `json:"dial_status"`
+	Script            string `json:"script"`
+	RecordingTransfer string `json:"recording_transfer"`
+}
+
+var (
+	campaignIDPattern    = regexp.MustCompile(`^[A-Za-z0-9_]{2,8}$`)
+	autoDialLevelPattern = regexp.MustCompile(`^[0-9]{1,2}(\.[0-9]{1,3})?$`)
+	dropLockoutPattern   = regexp.MustCompile(`^[0-9]{1,3}(\.[0-9]{1,2})?$`)
+	leadOrderPattern     = regexp.MustCompile(`^(` + strings.Join(campaignLeadOrders, "|") + `)(?: (2nd|3rd|4th|5th|6th) NEW)?$`)
+)
+
+// campaignLeadOrders are the lead_order values of VICIdial's hopper, each of
+// which may be followed by " 2nd NEW" through " 6th NEW"
+var campaignLeadOrders = []string{
+	"DOWN", "UP", "DOWN PHONE", "UP PHONE", "DOWN LAST NAME", "UP LAST NAME",
+	"DOWN COUNT", "UP COUNT", "DOWN LAST CALL TIME", "UP LAST CALL TIME",
+	"DOWN RANK", "UP RANK", "DOWN OWNER", "UP OWNER", "DOWN TIMEZONE", "UP TIMEZONE",
+	"RANDOM",
+}
+
+func validateCampaignID(value interface{}) error {
+	if !campaignIDPattern.MatchString(fmt.Sprint(value)) {
+		return fmt.Errorf("must be 2 to 8 letters, digits or underscores")
+	}
+	return nil
+}
+
+func validateLeadOrder(value interface{}) error {
+	if leadOrderPattern.MatchString(fmt.Sprint(value)) {
+		return nil
+	}
+	return fmt.Errorf("must be one of %s, optionally followed by 2nd NEW to 6th NEW", strings.Join(campaignLeadOrders, ", "))
+}
+
+// validateDialMethod checks a dial_method against VICIdial's dial methods
+var validateDialMethod = validateEnum("MANUAL", "RATIO", "ADAPT_HARD_LIMIT", "ADAPT_TAPERED", "ADAPT_AVERAGE", "INBOUND_MAN")
+
+func validateCampaignName(value interface{}) error {
+	if n := len(fmt.Sprint(value)); n < 6 || n > 40 {
+		return fmt.Errorf("must be 6 to 40 characters")
+	}
+	return nil
+}
+
+// validateDialStatuses checks a list of statuses, or a space separated
+// dial_statuses string such as " NEW NA -"
+func validateDialStatuses(value interface{}) error {
+	statuses, ok := value.([]string)
+	if !ok {
+		statuses = parseDialStatuses(fmt.Sprint(value))
+	}
+	for _, status := range statuses {
+		if err := validateStatus(status); err != nil {
+			return fmt.Errorf("%q %v", status, err)
+		}
+	}
+	return nil
+}
+
+// parseDialStatuses reads a dial_statuses value, which is space separated
+// and ends with a dash, as in " NEW NA B -"
+func parseDialStatuses(value string) []string {
+	statuses := []string{}
+	for _, status := range strings.Fields(value) {
+		if status != "-" {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// formatDialStatuses stores statuses the way VICIdial does, as " NEW NA -"
+func formatDialStatuses(statuses []string) string {
+	if len(statuses) == 0 {
+		return " -"
+	}
+	return " " + strings.Join(statuses, " ") + " -"
+}
+
+var campaignCreateSpec = patchSpec{
+	Table:     "vicidial_campaigns",
+	Model:     campaignSettings{},
+	KeyColumn: "campaign_id",
+	Validators: map[string]fieldValidator{
+		"campaign_id":          validateCampaignID,
+		"campaign_name":        validateCampaignName,
+		"campaign_description": validateMaxLen(255),
+		"active":               validateYN,
+		"dial_method":          validateDialMethod,
+		"auto_dial_level": func(value interface{}) error {
+			return matchPattern(autoDialLevelPattern, value, "must be a number such as 1.5")
+		},
+		"dial_statuses":    validateDialStatuses,
+		"lead_order":       validateLeadOrder,
+		"lead_filter_id":   validateMaxLen(20),
+		"local_call_time":  validateMaxLen(10),
+		"call_count_limit": validateIntRange(0, 99999),
+		"drop_lockout_time": func(value interface{}) error {
+			return matchPattern(dropLockoutPattern, value, "must be a number of hours")
+		},
+		"hopper_level":          validateIntRange(1, 20000),
+		"dial_timeout":          validateIntRange(1, 120),
+		"dial_prefix":           validateMaxLen(20),
+		"manual_dial_prefix":    validateMaxLen(20),
+		"campaign_cid":          validateDigits(0, 20),
+		"campaign_cid_override": validateDigits(0, 20),
+		"campaign_vdad_exten":   validateMaxLen(20),
+		"campaign_recording":    validateEnum("NEVER", "ONDEMAND", "ALLCALLS", "ALLFORCE"),
+		"campaign_script":       validateMaxLen(20),
+		"get_call_launch":       validateMaxLen(12),
+		"allow_closers":         validateYN,
+		"user_group":            validateMaxLen(20),
+	},
+}
+
+// campaignUpdateValidators are the create validators, less campaign_id,
+// plus those of the names only updates accept
+func campaignUpdateValidators() map[string]fieldValidator {
+	validators := map[string]fieldValidator{
+		"dial_status":        validateDialStatuses,
+		"script":             validateMaxLen(20),
+		"recording_transfer": validateMaxLen(20),
+	}
+	for name, validate := range campaignCreateSpec.Validators {
+		if name != "campaign_id" {
+			validators[name] = validate
+		}
+	}
+	return validators
+}
+
+// formatCampaignFields converts dial statuses to the stored dial_statuses
+// format
+func formatCampaignFields(fields []patchField) {
+	for i, field := range fields {
+		switch value := field.Value.(type) {
+		case []string:
+			fields[i].Value = formatDialStatuses(value)
+		case string:
+			if field.Name == "dial_status" {
+				fields[i].Value = formatDialStatuses(parseDialStatuses(value))
+			}
+		}
+	}
+}
+
+// matchPattern checks a value against a pattern
+func matchPattern(pattern *regexp.Regexp, value interface{}, message string) error {
+	if !pattern.MatchString(fmt.Sprint(value)) {
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+// checkCampaignReferences responds with 400 when a campaign column names a
+// call time, lead filter, script or user group that does not exist
+func (h *Handler) checkCampaignReferences(w http.ResponseWriter, fields []patchField) bool {
+	references := []struct {
+		Field, Query string
+		Unchecked    []string // values that name nothing, such as NONE
+	}{
+		{"local_call_time", "SELECT COUNT(*) FROM vicidial_call_times WHERE call_time_id = ?", nil},
+		{"lead_filter_id", "SELECT COUNT(*) FROM vicidial_lead_filters WHERE lead_filter_id = ?", []string{"", "NONE"}},
+		{"campaign_script", "SELECT COUNT(*) FROM vicidial_scripts WHERE script_id = ?", []string{""}},
+		{"user_group", "SELECT COUNT(*) FROM vicidial_user_groups WHERE user_group = ?", []string{"---ALL---"}},
+	}
+	for _, ref := range references {
+		var value interface{}
+		for _, field := range fields {
+			if field.Column == ref.Field {
+				value = field.Value
+			}
+		}
+		if value == nil {
+			continue
+		}
+		name := fmt.Sprint(value)
+		unchecked := false
+		for _, none := range ref.Unchecked {
+			unchecked = unchecked || name == none
+		}
+		if unchecked {
+			continue
+		}
+		var count int
+		if err := h.DB.QueryRow(ref.Query, name).Scan(&count); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check "+ref.Field+": "+err.Error())
+			return false
+		}
+		if count == 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid value for %s: %s does not exist", ref.Field, name))
+			return false
+		}
+	}
+	return true
+}
+
+// campaignExists reports whether a campaign_id is taken
+func (h *Handler) campaignExists(campaignID string) (bool, error) {
+	var count int
+	err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_campaigns WHERE campaign_id = ?", campaignID).Scan(&count)
+	return count > 0, err
+}
+
+// CreateCampaign adds a campaign with the settings in the request body, as
+// the campaign admin screen does. campaign_id and campaign_name are
+// required; the campaign starts inactive unless active is given.
+func (h *Handler) CreateCampaign(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	fields, err := decodePatch(campaignCreateSpec, body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	campaignID, _ := patchValue(fields, "campaign_id")
+	campaignName, _ := patchValue(fields, "campaign_name")
+	if campaignID == nil || campaignName == nil {
+		respondWithError(w, http.StatusBadRequest, "campaign_id and campaign_name are required")
+		return
+	}
+	id := campaignID.(string)
+	if !requireCampaignAccess(w, r, id) {
+		return
+	}
+	if !h.checkCampaignReferences(w, fields) {
+		return
+	}
+
+	exists, err := h.campaignExists(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up campaign: "+err.Error())
+		return
+	}
+	if exists {
+		respondWithError(w, http.StatusConflict, "Campaign "+id+" already exists")
+		return
+	}
+
+	if _, ok := patchValue(fields, "active"); !ok {
+		fields = append(fields, patchField{Name: "active", Column: "active", Value: "N"})
+	}
+	formatCampaignFields(fields)
+	query, args := buildInsertQuery("vicidial_campaigns", fields, map[string]string{"campaign_changedate": "NOW()"})
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query, args...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create campaign: "+err.Error())
+		return
+	}
+	if _, err := tx.Exec("INSERT IGNORE INTO vicidial_campaign_stats (campaign_id) VALUES (?)", id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create campaign stats: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create campaign: "+err.Error())
+		return
+	}
+
+	after := h.snapshotRow("vicidial_campaigns", "campaign_id", id)
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "ADD",
+		RecordID: id,
+		Code:     "ADMIN API ADD CAMPAIGN",
+		SQL:      query,
+		Args:     args,
+		After:    after,
+	})
+
+	respondWithSuccess(w, "Campaign created successfully", after)
+}
+
+// UpdateCampaign updates the campaign settings present in the request body
 func (h *Handler) UpdateCampaign(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	campaignID := vars["campaign_id"]
 
-	var campaign models.Campaign
-	if err := json.NewDecoder(r.Body).Decode(&campaign); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !requireCampaignAccess(w, r, campaignID) {
 		return
 	}
 
-	query := `
-		UPDATE vicidial_campaigns SET
-			campaign_name = ?, active = ?, dial_status = ?,
-			lead_order = ?, dial_method = ?, auto_dial_level = ?,
-			local_call_time = ?, dial_prefix = ?
-		WHERE campaign_id = ?
-	`
-
-	_, err := h.DB.Exec(query,
-		campaign.CampaignName, campaign.Active, campaign.DialStatus,
-		campaign.LeadOrder, campaign.DialMethod, campaign.AutoDialLevel,
-		campaign.LocalCallTime, campaign.DialPrefix, campaignID)
+	fields, ok := readPatch(w, r, campaignPatchSpec)
+	if !ok {
+		return
+	}
+	if !h.checkCampaignReferences(w, fields) {
+		return
+	}
+	formatCampaignFields(fields)
 
+	found, err := h.applyPatch(r, campaignPatchSpec, campaignID, fields, "CAMPAIGNS", "ADMIN API UPDATE CAMPAIGN")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update campaign: "+err.Error())
 		return
 	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
 
-	respondWithSuccess(w, "Campaign updated successfully", map[string]string{"campaign_id": campaignID})
+	respondWithSuccess(w, "Campaign updated successfully", map[string]interface{}{
+		"campaign_id":    campaignID,
+		"updated_fields": patchFieldNames(fields),
+	})
 }
 
 // CampaignsList retrieves all campaigns
 func (h *Handler) CampaignsList(w http.ResponseWriter, r *http.Request) {
 	active := r.URL.Query().Get("active")
 
-	query := "SELECT campaign_id, campaign_name, active, dial_status, dial_method, auto_dial_level FROM vicidial_campaigns"
+	query := "SELECT campaign_id, campaign_name, active, dial_statuses, dial_method, auto_dial_level FROM vicidial_campaigns WHERE 1=1"
 	args := []interface{}{}
 
 	if active != "" {
-		query += " WHERE active = ?"
+		query += " AND active = ?"
 		args = append(args, active)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	query += " ORDER BY campaign_name"
 
 	rows, err := h.DB.Query(query, args...)
@@ -72,22 +399,44 @@ func (h *Handler) CampaignsList(w http.ResponseWriter, r *http.Request) {
 	respondWithSuccess(w, "Campaigns retrieved", campaigns)
 }
 
+// hopperPageSpec pages HopperList results, by default in the order the
+// dialer takes leads from the hopper
+var hopperPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"hopper_id": {Column: "h.hopper_id"},
+		"priority":  {Column: "h.priority"},
+		"lead_id":   {Column: "h.lead_id"},
+		"list_id":   {Column: "h.list_id"},
+		"status":    {Column: "h.status"},
+	},
+	Key:          "hopper_id",
+	DefaultSort:  "-priority,hopper_id",
+	DefaultLimit: 100,
+	MaxLimit:     1000,
+}
+
 // HopperList retrieves leads in campaign hopper
 func (h *Handler) HopperList(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	campaignID := vars["campaign_id"]
 
-	query := `
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	page, ok := readPage(w, r, hopperPageSpec)
+	if !ok {
+		return
+	}
+
+	rows, err := page.query(h.DB, `
 		SELECT h.hopper_id, h.lead_id, h.campaign_id, h.status, h.user,
-			   h.list_id, h.priority, l.phone_number, l.first_name, l.last_name
+			   h.list_id, h.priority, COALESCE(h.gmt_offset_now, ''), COALESCE(h.state, ''),
+			   COALESCE(h.alt_dial, ''), COALESCE(h.source, ''),
+			   l.phone_number, l.first_name, l.last_name`, `
 		FROM vicidial_hopper h
 		LEFT JOIN vicidial_list l ON h.lead_id = l.lead_id
-		WHERE h.campaign_id = ?
-		ORDER BY h.priority DESC, h.hopper_id
-		LIMIT 100
-	`
-
-	rows, err := h.DB.Query(query, campaignID)
+		WHERE h.campaign_id = ?`, []interface{}{campaignID})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve hopper: "+err.Error())
 		return
@@ -102,6 +451,10 @@ func (h *Handler) HopperList(w http.ResponseWriter, r *http.Request) {
 		User        string `json:"user"`
 		ListID      int    `json:"list_id"`
 		Priority    int    `json:"priority"`
+		GMTOffset   string `json:"gmt_offset_now"`
+		State       string `json:"state"`
+		AltDial     string `json:"alt_dial"`
+		Source      string `json:"source"`
 		PhoneNumber string `json:"phone_number"`
 		FirstName   string `json:"first_name"`
 		LastName    string `json:"last_name"`
@@ -110,68 +463,17 @@ func (h *Handler) HopperList(w http.ResponseWriter, r *http.Request) {
 	hopperEntries := []HopperEntry{}
 	for rows.Next() {
 		var entry HopperEntry
-		rows.Scan(&entry.HopperID, &entry.LeadID, &entry.CampaignID, &entry.Status,
-			&entry.User, &entry.ListID, &entry.Priority, &entry.PhoneNumber,
-			&entry.FirstName, &entry.LastName)
-		hopperEntries = append(hopperEntries, entry)
-	}
-
-	respondWithSuccess(w, "Hopper entries retrieved", hopperEntries)
-}
-
-// HopperBulkInsert inserts multiple leads into hopper
-func (h *Handler) HopperBulkInsert(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	campaignID := vars["campaign_id"]
-
-	var req struct {
-		LeadIDs  []int  `json:"lead_ids"`
-		Priority int    `json:"priority"`
-		Source   string `json:"source"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
-		return
-	}
-
-	if len(req.LeadIDs) == 0 {
-		respondWithError(w, http.StatusBadRequest, "No lead IDs provided")
-		return
-	}
-
-	if req.Source == "" {
-		req.Source = "API"
-	}
-
-	tx, err := h.DB.Begin()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
-		return
-	}
-
-	insertStmt := `
-		INSERT IGNORE INTO vicidial_hopper (lead_id, campaign_id, status, priority, source, list_id)
-		SELECT lead_id, ?, 'READY', ?, ?, list_id FROM vicidial_list WHERE lead_id = ?
-	`
-
-	insertCount := 0
-	for _, leadID := range req.LeadIDs {
-		result, err := tx.Exec(insertStmt, campaignID, req.Priority, req.Source, leadID)
-		if err != nil {
-			tx.Rollback()
-			respondWithError(w, http.StatusInternalServerError, "Failed to insert lead: "+err.Error())
-			return
+		rows.Scan(page.dest(&entry.HopperID, &entry.LeadID, &entry.CampaignID, &entry.Status,
+			&entry.User, &entry.ListID, &entry.Priority, &entry.GMTOffset, &entry.State,
+			&entry.AltDial, &entry.Source, &entry.PhoneNumber,
+			&entry.FirstName, &entry.LastName)...)
+		if page.more() {
+			break
 		}
-		rows, _ := result.RowsAffected()
-		insertCount += int(rows)
+		hopperEntries = append(hopperEntries, entry)
 	}
 
-	tx.Commit()
-	respondWithSuccess(w, "Leads inserted to hopper", map[string]int{
-		"requested": len(req.LeadIDs),
-		"inserted":  insertCount,
-	})
+	respondWithPage(w, r, "Hopper entries retrieved", hopperEntries, page)
 }
 
 // GetCampaignsWithLists retrieves all campaigns with their associated lists in JSON format
@@ -181,7 +483,7 @@ func (h *Handler) GetCampaignsWithLists(w http.ResponseWriter, r *http.Request)
 
 	// Query to get campaigns
 	campaignQuery := `
-		SELECT campaign_id, campaign_name, active, dial_status, dial_method,
+		SELECT campaign_id, campaign_name, active, dial_statuses, dial_method,
 			   auto_dial_level, lead_order, local_call_time
 		FROM vicidial_campaigns
 		WHERE 1=1
@@ -197,6 +499,10 @@ func (h *Handler) GetCampaignsWithLists(w http.ResponseWriter, r *http.Request)
 		campaignArgs = append(campaignArgs, campaignID)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	campaignQuery += restrictSQL
+	campaignArgs = append(campaignArgs, restrictArgs...)
+
 	campaignQuery += " ORDER BY campaign_name"
 
 	campaignRows, err := h.DB.Query(campaignQuery, campaignArgs...)
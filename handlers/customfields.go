@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// customFieldNoStorage are field types shown on the agent screen that have
+// no column in custom_<list_id>
+var customFieldNoStorage = map[string]bool{
+	"DISPLAY": true,
+	"SCRIPT":  true,
+	"BUTTON":  true,
+	"SWITCH":  true,
+}
+
+// customField is a vicidial_lists_fields definition together with the
+// column that stores its values
+type customField struct {
+	Label     string
+	Type      string
+	Options   []string
+	Max       int
+	DataType  string // column type in custom_<list_id>, empty when there is no column
+	ColumnMax int
+}
+
+// customFieldSet is a list's custom fields keyed by label
+type customFieldSet struct {
+	ListID int
+	Fields map[string]*customField
+	Labels []string // stored fields in field_rank order
+}
+
+// table returns the list's custom field table name
+func (s *customFieldSet) table() string {
+	return "custom_" + strconv.Itoa(s.ListID)
+}
+
+// loadCustomFields reads the list's custom field definitions and the columns
+// of its custom_<list_id> table. Labels matching standard lead columns are
+// stored in vicidial_list and skipped.
+func (h *Handler) loadCustomFields(listID int) (*customFieldSet, error) {
+	set := &customFieldSet{ListID: listID, Fields: map[string]*customField{}}
+
+	rows, err := h.DB.Query(`
+		SELECT field_label, field_type, COALESCE(field_options, ''), field_max
+		FROM vicidial_lists_fields WHERE list_id = ? ORDER BY field_rank, field_id
+	`, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	standard := modelFieldTypes(models.Lead{})
+	order := []string{}
+	for rows.Next() {
+		var field customField
+		var options string
+		if err := rows.Scan(&field.Label, &field.Type, &options, &field.Max); err != nil {
+			return nil, err
+		}
+		if _, ok := standard[field.Label]; ok || !customFieldLabelPattern.MatchString(field.Label) {
+			continue
+		}
+		field.Type = strings.ToUpper(field.Type)
+		field.Options = parseFieldOptions(options)
+		set.Fields[field.Label] = &field
+		order = append(order, field.Label)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(set.Fields) == 0 {
+		return set, nil
+	}
+
+	columns, err := h.DB.Query(`
+		SELECT COLUMN_NAME, DATA_TYPE, COALESCE(CHARACTER_MAXIMUM_LENGTH, 0)
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+	`, set.table())
+	if err != nil {
+		return nil, err
+	}
+	defer columns.Close()
+
+	for columns.Next() {
+		var name, dataType string
+		var maxLength int64
+		if err := columns.Scan(&name, &dataType, &maxLength); err != nil {
+			return nil, err
+		}
+		if field, ok := set.Fields[name]; ok {
+			field.DataType = strings.ToLower(dataType)
+			field.ColumnMax = int(maxLength)
+		}
+	}
+	if err := columns.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, label := range order {
+		if set.Fields[label].stored() {
+			set.Labels = append(set.Labels, label)
+		}
+	}
+	return set, nil
+}
+
+// parseFieldOptions returns the option values of a SELECT, MULTI, RADIO or
+// CHECKBOX field. VICIdial stores one "value,label" option per line; a
+// single line is read as a comma separated list of values.
+func parseFieldOptions(options string) []string {
+	options = strings.ReplaceAll(options, "\r", "")
+	values := []string{}
+	if strings.Contains(strings.TrimSpace(options), "\n") {
+		for _, line := range strings.Split(options, "\n") {
+			value := strings.TrimSpace(strings.SplitN(line, ",", 2)[0])
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	for _, value := range strings.Split(options, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// stored reports whether the field has a column to hold its value
+func (f *customField) stored() bool {
+	return f.DataType != "" && !customFieldNoStorage[f.Type]
+}
+
+// numeric reports whether the field's column holds numbers
+func (f *customField) numeric() bool {
+	switch f.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "bigint", "decimal", "float", "double":
+		return true
+	}
+	return false
+}
+
+// check validates a value against the field definition and its column and
+// returns the value to store. Empty dates, times and numbers are stored as NULL.
+func (f *customField) check(value string) (interface{}, error) {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case f.Type == "DATE" || f.DataType == "date":
+		if value == "" {
+			return nil, nil
+		}
+		for _, layout := range patchTimeLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.Format("2006-01-02"), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q, use YYYY-MM-DD", value)
+	case f.Type == "TIME" || f.DataType == "time":
+		if value == "" {
+			return nil, nil
+		}
+		for _, layout := range []string{"15:04:05", "15:04"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.Format("15:04:05"), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid time %q, use HH:MM:SS", value)
+	case f.numeric():
+		if value == "" {
+			return nil, nil
+		}
+		switch f.DataType {
+		case "decimal", "float", "double":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("%q is not a number", value)
+			}
+		default:
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("%q is not a whole number", value)
+			}
+		}
+		return value, nil
+	}
+
+	// Option fields are bounded by their options rather than field_max
+	switch f.Type {
+	case "SELECT", "RADIO":
+		if value != "" && !f.hasOption(value) {
+			return nil, fmt.Errorf("%q is not one of the field's options", value)
+		}
+	case "MULTI", "CHECKBOX":
+		if value != "" {
+			for _, part := range strings.Split(value, ",") {
+				if !f.hasOption(strings.TrimSpace(part)) {
+					return nil, fmt.Errorf("%q is not one of the field's options", part)
+				}
+			}
+		}
+	default:
+		if f.Max > 0 && len(value) > f.Max {
+			return nil, fmt.Errorf("longer than %d characters", f.Max)
+		}
+	}
+	if f.ColumnMax > 0 && len(value) > f.ColumnMax {
+		return nil, fmt.Errorf("longer than the column's %d characters", f.ColumnMax)
+	}
+	return value, nil
+}
+
+func (f *customField) hasOption(value string) bool {
+	for _, option := range f.Options {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
+
+// customFieldString converts a JSON decoded custom field value to text
+func customFieldString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		// MULTI and CHECKBOX fields may be posted as an array of options
+		parts := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("options must be strings")
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("must be a string or number")
+}
+
+// normalize validates posted custom field values and returns them ready to store
+func (s *customFieldSet) normalize(values map[string]interface{}) (map[string]interface{}, error) {
+	normalized := make(map[string]interface{}, len(values))
+	for label, raw := range values {
+		field, ok := s.Fields[label]
+		if !ok {
+			return nil, fmt.Errorf("Unknown custom field %s", label)
+		}
+		if !field.stored() {
+			return nil, fmt.Errorf("Custom field %s has no column in %s", label, s.table())
+		}
+		text, err := customFieldString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for custom field %s: %v", label, err)
+		}
+		value, err := field.check(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for custom field %s: %v", label, err)
+		}
+		normalized[label] = value
+	}
+	return normalized, nil
+}
+
+// readValues returns the custom field values of the given leads, keyed by
+// lead ID. Leads without a custom row get every field as null.
+func (s *customFieldSet) readValues(db *sql.DB, leadIDs []int) (map[int]map[string]interface{}, error) {
+	values := map[int]map[string]interface{}{}
+	if len(s.Labels) == 0 || len(leadIDs) == 0 {
+		return values, nil
+	}
+
+	for _, leadID := range leadIDs {
+		empty := make(map[string]interface{}, len(s.Labels))
+		for _, label := range s.Labels {
+			empty[label] = nil
+		}
+		values[leadID] = empty
+	}
+
+	columns := make([]string, len(s.Labels))
+	for i, label := range s.Labels {
+		columns[i] = "`" + label + "`"
+	}
+	args := make([]interface{}, len(leadIDs))
+	for i, leadID := range leadIDs {
+		args[i] = leadID
+	}
+
+	rows, err := db.Query("SELECT lead_id, "+strings.Join(columns, ", ")+" FROM "+s.table()+
+		" WHERE lead_id IN ("+placeholders(len(leadIDs))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var leadID int
+		raw := make([]sql.NullString, len(s.Labels))
+		dest := make([]interface{}, len(s.Labels)+1)
+		dest[0] = &leadID
+		for i := range raw {
+			dest[i+1] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, label := range s.Labels {
+			if raw[i].Valid {
+				values[leadID][label] = raw[i].String
+			}
+		}
+	}
+	return values, rows.Err()
+}
+
+// withCustomFields attaches custom field values to leads, loading each
+// list's field definitions once
+func (h *Handler) withCustomFields(leads []models.Lead) ([]models.LeadWithCustomFields, error) {
+	byList := map[int][]int{}
+	for _, lead := range leads {
+		byList[lead.ListID] = append(byList[lead.ListID], lead.LeadID)
+	}
+
+	values := map[int]map[string]interface{}{}
+	for listID, leadIDs := range byList {
+		set, err := h.loadCustomFields(listID)
+		if err != nil {
+			return nil, err
+		}
+		listValues, err := set.readValues(h.DB, leadIDs)
+		if err != nil {
+			return nil, err
+		}
+		for leadID, v := range listValues {
+			values[leadID] = v
+		}
+	}
+
+	result := make([]models.LeadWithCustomFields, len(leads))
+	for i, lead := range leads {
+		result[i] = models.LeadWithCustomFields{Lead: lead, CustomFields: values[lead.LeadID]}
+	}
+	return result, nil
+}
+
+// readLeadPatch decodes a lead update body. Standard fields become patch
+// fields and the custom_fields object is returned separately, unchecked.
+// Phone numbers are normalized for phoneCode, the lead's current phone_code,
+// unless the body sets a new one.
+func readLeadPatch(w http.ResponseWriter, r *http.Request, phoneCode string) ([]patchField, map[string]interface{}, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, nil, false
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, nil, false
+	}
+
+	var custom map[string]interface{}
+	if encoded, ok := raw["custom_fields"]; ok {
+		if err := json.Unmarshal(encoded, &custom); err != nil || custom == nil {
+			respondWithError(w, http.StatusBadRequest, "custom_fields must be an object")
+			return nil, nil, false
+		}
+		delete(raw, "custom_fields")
+		if len(raw) == 0 {
+			if len(custom) == 0 {
+				respondWithError(w, http.StatusBadRequest, "No fields to update")
+				return nil, nil, false
+			}
+			return nil, custom, true
+		}
+	}
+
+	if err := normalizePatchPhones(raw, phoneCode); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	body, _ = json.Marshal(raw)
+
+	fields, err := decodePatch(leadPatchSpec, body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	return fields, custom, true
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCustomFieldCheck(t *testing.T) {
+	text := &customField{Label: "notes", Type: "TEXT", Max: 5, DataType: "varchar", ColumnMax: 10}
+	narrowColumn := &customField{Label: "code", Type: "TEXT", Max: 20, DataType: "varchar", ColumnMax: 3}
+	selectField := &customField{Label: "color", Type: "SELECT", Options: []string{"red", "blue"}, Max: 2, DataType: "varchar", ColumnMax: 4}
+	multi := &customField{Label: "tags", Type: "MULTI", Options: []string{"a", "b", "c"}, DataType: "varchar", ColumnMax: 20}
+	date := &customField{Label: "renewal", Type: "DATE", DataType: "date"}
+	timeField := &customField{Label: "best_time", Type: "TIME", DataType: "time"}
+	whole := &customField{Label: "seats", Type: "TEXT", DataType: "int"}
+	decimal := &customField{Label: "amount", Type: "TEXT", DataType: "decimal"}
+
+	tests := []struct {
+		name    string
+		field   *customField
+		value   string
+		want    interface{}
+		wantErr string
+	}{
+		{"text", text, " abc ", "abc", ""},
+		{"text at field_max", text, "abcde", "abcde", ""},
+		{"text over field_max", text, "abcdef", nil, "longer than 5 characters"},
+		{"text over column", narrowColumn, "abcd", nil, "longer than the column's 3 characters"},
+		{"empty text", text, "", "", ""},
+		{"option", selectField, "blue", "blue", ""},
+		{"option longer than field_max", selectField, "blue", "blue", ""},
+		{"not an option", selectField, "green", nil, `"green" is not one of the field's options`},
+		{"empty option", selectField, "", "", ""},
+		{"options", multi, "a, c", "a, c", ""},
+		{"not among options", multi, "a,d", nil, `"d" is not one of the field's options`},
+		{"date", date, "2025-03-04", "2025-03-04", ""},
+		{"date with time", date, "2025-03-04 10:30:00", "2025-03-04", ""},
+		{"empty date", date, "", nil, ""},
+		{"bad date", date, "03/04/2025", nil, "invalid date"},
+		{"time", timeField, "09:15", "09:15:00", ""},
+		{"bad time", timeField, "9am", nil, "invalid time"},
+		{"whole number", whole, "12", "12", ""},
+		{"empty number", whole, " ", nil, ""},
+		{"fraction in int column", whole, "1.5", nil, `"1.5" is not a whole number`},
+		{"decimal", decimal, "1.5", "1.5", ""},
+		{"not a number", decimal, "lots", nil, `"lots" is not a number`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.field.check(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("check(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("check(%q) error = %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("check(%q) = %#v, want %#v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    []string
+	}{
+		{"red,blue, green", []string{"red", "blue", "green"}},
+		{"R,Red\r\nB,Blue\r\n\r\nG", []string{"R", "B", "G"}},
+		{"", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := parseFieldOptions(tt.options); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFieldOptions(%q) = %q, want %q", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCustomFields(t *testing.T) {
+	h, mock := newCustomFieldsHandler(t, 101,
+		testCustomField{Label: "region", Type: "text", Max: 30, DataType: "VARCHAR", ColumnMax: 30},
+		testCustomField{Label: "first_name", Type: "TEXT", Max: 30},
+		testCustomField{Label: "intro", Type: "SCRIPT", DataType: "text"},
+		testCustomField{Label: "orphan", Type: "TEXT", Max: 30},
+		testCustomField{Label: "size", Type: "SELECT", Options: "S,M,L", Max: 1, DataType: "varchar", ColumnMax: 1},
+	)
+
+	set, err := h.loadCustomFields(101)
+	if err != nil {
+		t.Fatalf("loadCustomFields: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// Standard lead columns are skipped; fields without a column are kept
+	// but not stored
+	if _, ok := set.Fields["first_name"]; ok {
+		t.Error("first_name loaded as a custom field")
+	}
+	if want := []string{"region", "size"}; !reflect.DeepEqual(set.Labels, want) {
+		t.Errorf("Labels = %q, want %q", set.Labels, want)
+	}
+	region := set.Fields["region"]
+	if region == nil || region.Type != "TEXT" || region.DataType != "varchar" || region.ColumnMax != 30 {
+		t.Errorf("region = %+v, want TEXT in a varchar(30) column", region)
+	}
+	if orphan := set.Fields["orphan"]; orphan == nil || orphan.stored() {
+		t.Errorf("orphan = %+v, want a field without a column", orphan)
+	}
+	if size := set.Fields["size"]; size == nil || !reflect.DeepEqual(size.Options, []string{"S", "M", "L"}) {
+		t.Errorf("size = %+v, want options S, M, L", size)
+	}
+}
+
+func TestCustomFieldSetNormalize(t *testing.T) {
+	set := &customFieldSet{ListID: 101, Fields: map[string]*customField{
+		"seats": {Label: "seats", Type: "TEXT", DataType: "int"},
+		"tags":  {Label: "tags", Type: "CHECKBOX", Options: []string{"a", "b"}, DataType: "varchar", ColumnMax: 10},
+		"intro": {Label: "intro", Type: "SCRIPT", DataType: "text"},
+	}}
+
+	got, err := set.normalize(map[string]interface{}{"seats": float64(3), "tags": []interface{}{"a", "b"}})
+	if err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if want := map[string]interface{}{"seats": "3", "tags": "a,b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normalize = %v, want %v", got, want)
+	}
+
+	errors := []struct {
+		values  map[string]interface{}
+		wantErr string
+	}{
+		{map[string]interface{}{"color": "red"}, "Unknown custom field color"},
+		{map[string]interface{}{"intro": "hi"}, "Custom field intro has no column in custom_101"},
+		{map[string]interface{}{"seats": true}, "Invalid value for custom field seats: must be a string or number"},
+		{map[string]interface{}{"tags": []interface{}{"a", 1.0}}, "Invalid value for custom field tags: options must be strings"},
+		{map[string]interface{}{"seats": "many"}, `Invalid value for custom field seats: "many" is not a whole number`},
+	}
+	for _, tt := range errors {
+		if _, err := set.normalize(tt.values); err == nil || err.Error() != tt.wantErr {
+			t.Errorf("normalize(%v) error = %v, want %q", tt.values, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,694 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// customFieldTypes are the field types VICIdial's custom field admin offers
+var customFieldTypes = map[string]bool{
+	"TEXT": true, "AREA": true, "SELECT": true, "MULTI": true, "RADIO": true,
+	"CHECKBOX": true, "DATE": true, "TIME": true, "DISPLAY": true, "SCRIPT": true,
+	"HIDDEN": true, "READONLY": true, "HIDEBLOB": true, "SWITCH": true, "BUTTON": true,
+}
+
+// customFieldDef is a vicidial_lists_fields row as sent to and returned by
+// the custom field endpoints
+type customFieldDef struct {
+	FieldID       int    `json:"field_id"`
+	FieldLabel    string `json:"field_label"`
+	FieldName     string `json:"field_name"`
+	FieldType     string `json:"field_type"`
+	FieldOptions  string `json:"field_options"`
+	FieldSize     int    `json:"field_size"`
+	FieldMax      int    `json:"field_max"`
+	FieldDefault  string `json:"field_default"`
+	FieldRequired string `json:"field_required"`
+}
+
+// customFieldDefColumns is the column list read by scanCustomFieldDef
+const customFieldDefColumns = `field_id, field_label, field_name, field_type, COALESCE(field_options, ''),
+	field_size, field_max, COALESCE(field_default, ''), field_required`
+
+func scanCustomFieldDef(row rowScanner) (customFieldDef, error) {
+	var def customFieldDef
+	err := row.Scan(&def.FieldID, &def.FieldLabel, &def.FieldName, &def.FieldType, &def.FieldOptions,
+		&def.FieldSize, &def.FieldMax, &def.FieldDefault, &def.FieldRequired)
+	return def, err
+}
+
+// validate normalizes a definition and rejects labels that cannot be column
+// names, unknown types and defaults the field itself would not accept
+func (d *customFieldDef) validate() error {
+	d.FieldLabel = strings.TrimSpace(d.FieldLabel)
+	d.FieldType = strings.ToUpper(strings.TrimSpace(d.FieldType))
+	d.FieldRequired = strings.ToUpper(d.FieldRequired)
+
+	if !customFieldLabelPattern.MatchString(d.FieldLabel) || strings.EqualFold(d.FieldLabel, "lead_id") {
+		return fmt.Errorf("field_label must be 1-50 letters, digits or underscores and not lead_id")
+	}
+	if d.FieldName == "" {
+		d.FieldName = d.FieldLabel
+	}
+	if d.FieldType == "" {
+		d.FieldType = "TEXT"
+	}
+	if !customFieldTypes[d.FieldType] {
+		return fmt.Errorf("Unknown field_type %s", d.FieldType)
+	}
+	if d.FieldRequired == "" {
+		d.FieldRequired = "N"
+	}
+	if d.FieldRequired != "Y" && d.FieldRequired != "N" {
+		return fmt.Errorf("field_required must be Y or N")
+	}
+	// A missing field_max decodes as 0 and takes VICIdial's default of 100
+	if d.FieldMax < 0 || d.FieldMax > 65535 {
+		return fmt.Errorf("field_max must be between 1 and 65535, or 0 for the default of 100")
+	}
+	if d.FieldMax == 0 {
+		d.FieldMax = 100
+	}
+	if d.FieldSize <= 0 {
+		d.FieldSize = d.FieldMax
+	}
+
+	switch d.FieldType {
+	case "SELECT", "MULTI", "RADIO", "CHECKBOX":
+		if len(parseFieldOptions(d.FieldOptions)) == 0 {
+			return fmt.Errorf("field_options is required for %s fields", d.FieldType)
+		}
+	}
+
+	if columnType, ok := d.columnType(); ok && d.hasDefault() {
+		field := d.field(columnType)
+		if _, err := field.check(d.FieldDefault); err != nil {
+			return fmt.Errorf("Invalid field_default: %v", err)
+		}
+	}
+	return nil
+}
+
+// standard reports whether the label is a vicidial_list column, in which
+// case VICIdial shows the lead's own value and no custom column is needed
+func (d *customFieldDef) standard() bool {
+	_, ok := modelFieldTypes(models.Lead{})[d.FieldLabel]
+	return ok
+}
+
+// columnType returns the custom_<list_id> column type for the field, sized
+// like VICIdial's admin does, or false when the field stores no value
+func (d *customFieldDef) columnType() (string, bool) {
+	if customFieldNoStorage[d.FieldType] || d.standard() {
+		return "", false
+	}
+
+	size := d.FieldMax
+	switch d.FieldType {
+	case "AREA":
+		return "TEXT", true
+	case "DATE":
+		return "DATE", true
+	case "TIME":
+		return "TIME", true
+	case "SELECT", "RADIO":
+		for _, option := range parseFieldOptions(d.FieldOptions) {
+			if len(option) > size {
+				size = len(option)
+			}
+		}
+	case "MULTI", "CHECKBOX":
+		if n := len(strings.Join(parseFieldOptions(d.FieldOptions), ",")); n > size {
+			size = n
+		}
+	}
+	if size > 255 {
+		return "TEXT", true
+	}
+	return "VARCHAR(" + strconv.Itoa(size) + ")", true
+}
+
+// dataType returns the lower case base type of the field's column, as
+// information_schema reports it
+func (d *customFieldDef) dataType() string {
+	columnType, _ := d.columnType()
+	return strings.ToLower(strings.SplitN(columnType, "(", 2)[0])
+}
+
+// hasDefault reports whether the field sets a column default. VICIdial
+// stores "NULL" for fields without one.
+func (d *customFieldDef) hasDefault() bool {
+	return d.FieldDefault != "" && !strings.EqualFold(d.FieldDefault, "NULL")
+}
+
+// columnDefinition returns the full column definition including the default
+func (d *customFieldDef) columnDefinition() (string, bool) {
+	columnType, ok := d.columnType()
+	if !ok {
+		return "", false
+	}
+	definition := "`" + d.FieldLabel + "` " + columnType
+	if d.hasDefault() && columnType != "TEXT" {
+		definition += " DEFAULT " + quoteDDLString(d.FieldDefault)
+	}
+	return definition, true
+}
+
+// field returns the value checker for the definition stored in the given column type
+func (d *customFieldDef) field(columnType string) *customField {
+	dataType := strings.ToLower(columnType)
+	maxLength := 0
+	if i := strings.Index(dataType, "("); i >= 0 {
+		maxLength, _ = strconv.Atoi(strings.TrimSuffix(dataType[i+1:], ")"))
+		dataType = dataType[:i]
+	}
+	return &customField{
+		Label:     d.FieldLabel,
+		Type:      d.FieldType,
+		Options:   parseFieldOptions(d.FieldOptions),
+		Max:       d.FieldMax,
+		DataType:  dataType,
+		ColumnMax: maxLength,
+	}
+}
+
+// quoteDDLString quotes a validated default for a DDL statement, which
+// cannot take placeholders
+func quoteDDLString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// customSchemaPlan is the DDL needed to bring custom_<list_id> in line with
+// a definition change, and what it would do to existing values
+type customSchemaPlan struct {
+	Table    string   `json:"table"`
+	DDL      []string `json:"ddl"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// customTable describes an existing custom_<list_id> table
+type customTable struct {
+	ListID  int
+	Exists  bool
+	Columns map[string]string // column name to lower case DATA_TYPE
+}
+
+func (t *customTable) name() string {
+	return "custom_" + strconv.Itoa(t.ListID)
+}
+
+// loadCustomTable reads which columns custom_<list_id> has
+func (h *Handler) loadCustomTable(listID int) (*customTable, error) {
+	table := &customTable{ListID: listID, Columns: map[string]string{}}
+
+	rows, err := h.DB.Query(`
+		SELECT COLUMN_NAME, DATA_TYPE FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+	`, table.name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		table.Exists = true
+		table.Columns[name] = strings.ToLower(dataType)
+	}
+	return table, rows.Err()
+}
+
+// countValues counts the table's rows matching the condition
+func (h *Handler) countValues(table *customTable, condition string, args ...interface{}) (int, error) {
+	var count int
+	err := h.DB.QueryRow("SELECT COUNT(*) FROM "+table.name()+" WHERE "+condition, args...).Scan(&count)
+	return count, err
+}
+
+// planAdd plans the column for a new field, creating the table the way
+// VICIdial's admin does when the list has no custom fields yet
+func (h *Handler) planAdd(table *customTable, def customFieldDef) (customSchemaPlan, error) {
+	plan := customSchemaPlan{Table: table.name(), DDL: []string{}}
+	definition, ok := def.columnDefinition()
+	if !ok {
+		return plan, nil
+	}
+
+	if !table.Exists {
+		plan.DDL = append(plan.DDL, "CREATE TABLE "+table.name()+" (lead_id INT(9) UNSIGNED PRIMARY KEY NOT NULL) ENGINE=MyISAM")
+		table.Exists = true
+	}
+	if _, exists := table.Columns[def.FieldLabel]; exists {
+		// A column left behind by an earlier field is reused and retyped
+		plan.DDL = append(plan.DDL, "ALTER TABLE "+table.name()+" MODIFY "+definition)
+		if err := h.warnConversion(table, &plan, def.FieldLabel, def); err != nil {
+			return plan, err
+		}
+	} else {
+		plan.DDL = append(plan.DDL, "ALTER TABLE "+table.name()+" ADD "+definition)
+	}
+	table.Columns[def.FieldLabel] = def.dataType()
+	return plan, nil
+}
+
+// planUpdate plans renaming, retyping, adding or dropping the field's column
+func (h *Handler) planUpdate(table *customTable, old, def customFieldDef) (customSchemaPlan, error) {
+	plan := customSchemaPlan{Table: table.name(), DDL: []string{}}
+	oldDefinition, oldStored := old.columnDefinition()
+	newDefinition, newStored := def.columnDefinition()
+	_, hasColumn := table.Columns[old.FieldLabel]
+
+	switch {
+	case newStored && (!oldStored || !hasColumn):
+		return h.planAdd(table, def)
+	case !newStored && oldStored && hasColumn:
+		return h.planDrop(table, old)
+	case !newStored:
+		return plan, nil
+	}
+
+	if def.FieldLabel != old.FieldLabel {
+		if _, exists := table.Columns[def.FieldLabel]; exists {
+			return plan, fmt.Errorf("Column %s already exists in %s", def.FieldLabel, table.name())
+		}
+		plan.DDL = append(plan.DDL, "ALTER TABLE "+table.name()+" CHANGE `"+old.FieldLabel+"` "+newDefinition)
+	} else if newDefinition != oldDefinition || table.Columns[old.FieldLabel] != def.dataType() {
+		plan.DDL = append(plan.DDL, "ALTER TABLE "+table.name()+" MODIFY "+newDefinition)
+	} else {
+		return plan, nil
+	}
+
+	if err := h.warnConversion(table, &plan, old.FieldLabel, def); err != nil {
+		return plan, err
+	}
+	delete(table.Columns, old.FieldLabel)
+	table.Columns[def.FieldLabel] = def.dataType()
+	return plan, nil
+}
+
+// planDrop plans dropping the field's column
+func (h *Handler) planDrop(table *customTable, def customFieldDef) (customSchemaPlan, error) {
+	plan := customSchemaPlan{Table: table.name(), DDL: []string{}}
+	if _, ok := table.Columns[def.FieldLabel]; !ok || def.standard() {
+		return plan, nil
+	}
+
+	plan.DDL = append(plan.DDL, "ALTER TABLE "+table.name()+" DROP `"+def.FieldLabel+"`")
+	count, err := h.countValues(table, "CHAR_LENGTH(`"+def.FieldLabel+"`) > 0")
+	if err != nil {
+		return plan, err
+	}
+	if count > 0 {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("%d leads have a %s value that will be deleted", count, def.FieldLabel))
+	}
+	delete(table.Columns, def.FieldLabel)
+	return plan, nil
+}
+
+// warnConversion warns about existing values that a column change would
+// truncate or could not convert
+func (h *Handler) warnConversion(table *customTable, plan *customSchemaPlan, column string, def customFieldDef) error {
+	oldType := table.Columns[column]
+	columnType, _ := def.columnType()
+	newType := def.dataType()
+
+	if (newType == "date" || newType == "time") && oldType != newType {
+		count, err := h.countValues(table, "CHAR_LENGTH(`"+column+"`) > 0")
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%d leads have a %s value that may not convert to %s", count, column, columnType))
+		}
+		return nil
+	}
+
+	if newType == "varchar" {
+		size := def.field(columnType).ColumnMax
+		count, err := h.countValues(table, "CHAR_LENGTH(`"+column+"`) > ?", size)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%d leads have a %s value longer than %d characters that will be truncated", count, column, size))
+		}
+	}
+	return nil
+}
+
+// applyCustomSchema runs the planned DDL. DDL commits implicitly, so a
+// failure part way leaves the statements before it applied.
+func (h *Handler) applyCustomSchema(plan customSchemaPlan) error {
+	for i, stmt := range plan.DDL {
+		if _, err := h.DB.Exec(stmt); err != nil {
+			if i > 0 {
+				return fmt.Errorf("%v (after applying %s)", err, strings.Join(plan.DDL[:i], "; "))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaFlags reads the dry_run and force query parameters
+func schemaFlags(r *http.Request) (dryRun, force bool) {
+	q := r.URL.Query()
+	return strings.EqualFold(q.Get("dry_run"), "Y"), strings.EqualFold(q.Get("force"), "Y")
+}
+
+// respondWithPlan answers a dry run with the planned DDL, or refuses a change
+// that would lose data unless forced. It returns true when the caller should
+// go on to apply the change.
+func respondWithPlan(w http.ResponseWriter, dryRun, force bool, data map[string]interface{}, warnings []string) bool {
+	if dryRun {
+		respondWithSuccess(w, "Dry run, nothing was changed", data)
+		return false
+	}
+	if len(warnings) > 0 && !force {
+		respondWithJSON(w, http.StatusConflict, models.APIResponse{
+			Success: false,
+			Error:   "Change would alter existing custom field values; repeat with force=Y to apply",
+			Data:    data,
+		})
+		return false
+	}
+	return true
+}
+
+// listCustomFieldDefs returns the list's field definitions in field_rank order
+func (h *Handler) listCustomFieldDefs(listID int) ([]customFieldDef, error) {
+	rows, err := h.DB.Query("SELECT "+customFieldDefColumns+" FROM vicidial_lists_fields WHERE list_id = ? ORDER BY field_rank, field_id", listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	defs := []customFieldDef{}
+	for rows.Next() {
+		def, err := scanCustomFieldDef(rows)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+	return defs, rows.Err()
+}
+
+// customFieldListID parses the list ID and checks the list exists
+func (h *Handler) customFieldListID(w http.ResponseWriter, listID string) (int, bool) {
+	id, err := strconv.Atoi(listID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid list ID")
+		return 0, false
+	}
+	var count int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists WHERE list_id = ?", id).Scan(&count); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up list: "+err.Error())
+		return 0, false
+	}
+	if count == 0 {
+		respondWithError(w, http.StatusNotFound, "List not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// DeleteListCustomField deletes a field definition and drops its column
+func (h *Handler) DeleteListCustomField(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !h.requireListAccess(w, r, vars["list_id"]) {
+		return
+	}
+	listID, ok := h.customFieldListID(w, vars["list_id"])
+	if !ok {
+		return
+	}
+	dryRun, force := schemaFlags(r)
+
+	def, err := scanCustomFieldDef(h.DB.QueryRow("SELECT "+customFieldDefColumns+" FROM vicidial_lists_fields WHERE field_id = ? AND list_id = ?", vars["field_id"], listID))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Field not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve field: "+err.Error())
+		return
+	}
+
+	table, err := h.loadCustomTable(listID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+	plan, err := h.planDrop(table, def)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to plan custom field change: "+err.Error())
+		return
+	}
+
+	if !respondWithPlan(w, dryRun, force, map[string]interface{}{"field": def, "schema": plan}, plan.Warnings) {
+		return
+	}
+
+	before := h.snapshotRow("vicidial_lists_fields", "field_id", def.FieldID)
+	if err := h.applyCustomSchema(plan); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to alter custom field table: "+err.Error())
+		return
+	}
+	query := "DELETE FROM vicidial_lists_fields WHERE field_id = ? AND list_id = ?"
+	if _, err := h.DB.Exec(query, def.FieldID, listID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete field: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CUSTOM_FIELDS",
+		Type:     "DELETE",
+		RecordID: strconv.Itoa(listID),
+		Code:     "ADMIN API DELETE CUSTOM FIELD",
+		SQL:      query,
+		Args:     []interface{}{def.FieldID, listID},
+		Before:   before,
+		After:    map[string]interface{}{"ddl": plan.DDL},
+	})
+
+	respondWithSuccess(w, "Field deleted successfully", map[string]interface{}{"field": def, "schema": plan})
+}
+
+// customFieldCopyAction is what a copy does with one field
+type customFieldCopyAction struct {
+	FieldLabel string `json:"field_label"`
+	Action     string `json:"action"`
+}
+
+// CopyListCustomFields copies the custom field definitions of one list to
+// another, with VICIdial's copy options: APPEND adds the fields the target
+// lacks, UPDATE changes the target fields with matching labels, and
+// REPLACE deletes the target's fields before copying
+func (h *Handler) CopyListCustomFields(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !h.requireListAccess(w, r, vars["list_id"]) {
+		return
+	}
+	listID, ok := h.customFieldListID(w, vars["list_id"])
+	if !ok {
+		return
+	}
+	dryRun, force := schemaFlags(r)
+
+	var req struct {
+		SourceListID int    `json:"source_list_id"`
+		CopyOption   string `json:"copy_option"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	req.CopyOption = strings.ToUpper(req.CopyOption)
+	if req.CopyOption == "" {
+		req.CopyOption = "APPEND"
+	}
+	if req.CopyOption != "APPEND" && req.CopyOption != "UPDATE" && req.CopyOption != "REPLACE" {
+		respondWithError(w, http.StatusBadRequest, "copy_option must be APPEND, UPDATE or REPLACE")
+		return
+	}
+	if req.SourceListID == 0 || req.SourceListID == listID {
+		respondWithError(w, http.StatusBadRequest, "source_list_id must be another list")
+		return
+	}
+	if !h.requireListAccess(w, r, req.SourceListID) {
+		return
+	}
+
+	source, err := h.listCustomFieldDefs(req.SourceListID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve source fields: "+err.Error())
+		return
+	}
+	if len(source) == 0 {
+		respondWithError(w, http.StatusNotFound, "Source list has no custom fields")
+		return
+	}
+	target, err := h.listCustomFieldDefs(listID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve fields: "+err.Error())
+		return
+	}
+	table, err := h.loadCustomTable(listID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+
+	existing := map[string]customFieldDef{}
+	for _, def := range target {
+		existing[def.FieldLabel] = def
+	}
+
+	plan := customSchemaPlan{Table: table.name(), DDL: []string{}}
+	actions := []customFieldCopyAction{}
+	copyActions := make([]string, len(source))
+	merge := func(step customSchemaPlan, err error) bool {
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Failed to plan custom field change: "+err.Error())
+			return false
+		}
+		plan.DDL = append(plan.DDL, step.DDL...)
+		plan.Warnings = append(plan.Warnings, step.Warnings...)
+		return true
+	}
+
+	if req.CopyOption == "REPLACE" {
+		for _, def := range target {
+			if !merge(h.planDrop(table, def)) {
+				return
+			}
+			actions = append(actions, customFieldCopyAction{def.FieldLabel, "DELETE"})
+		}
+		existing = map[string]customFieldDef{}
+	}
+
+	for i := range source {
+		def := &source[i]
+		if err := def.validate(); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Source field "+def.FieldLabel+": "+err.Error())
+			return
+		}
+		old, exists := existing[def.FieldLabel]
+		switch {
+		case exists && req.CopyOption == "UPDATE":
+			if !merge(h.planUpdate(table, old, *def)) {
+				return
+			}
+			copyActions[i] = "UPDATE"
+		case exists || req.CopyOption == "UPDATE":
+			copyActions[i] = "SKIP"
+		default:
+			if !merge(h.planAdd(table, *def)) {
+				return
+			}
+			copyActions[i] = "ADD"
+		}
+		actions = append(actions, customFieldCopyAction{def.FieldLabel, copyActions[i]})
+	}
+
+	data := map[string]interface{}{
+		"source_list_id": req.SourceListID,
+		"list_id":        listID,
+		"copy_option":    req.CopyOption,
+		"fields":         actions,
+		"schema":         plan,
+	}
+	if !respondWithPlan(w, dryRun, force, data, plan.Warnings) {
+		return
+	}
+
+	before := h.snapshotRows("SELECT * FROM vicidial_lists_fields WHERE list_id = ?", listID)
+	if err := h.applyCustomSchema(plan); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to alter custom field table: "+err.Error())
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	if req.CopyOption == "REPLACE" {
+		if _, err := tx.Exec("DELETE FROM vicidial_lists_fields WHERE list_id = ?", listID); err != nil {
+			tx.Rollback()
+			respondWithError(w, http.StatusInternalServerError, "Failed to delete fields: "+err.Error())
+			return
+		}
+	}
+	for i, def := range source {
+		switch copyActions[i] {
+		case "ADD":
+			_, err = insertCustomFieldDef(tx, listID, def)
+		case "UPDATE":
+			def.FieldID = existing[def.FieldLabel].FieldID
+			_, err = updateCustomFieldDef(tx, listID, def)
+		}
+		if err != nil {
+			tx.Rollback()
+			respondWithError(w, http.StatusInternalServerError, "Failed to copy field "+def.FieldLabel+": "+err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to copy fields: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CUSTOM_FIELDS",
+		Type:     "COPY",
+		RecordID: strconv.Itoa(listID),
+		Code:     "ADMIN API COPY CUSTOM FIELDS " + req.CopyOption,
+		Before:   before,
+		After: map[string]interface{}{
+			"source_list_id": req.SourceListID,
+			"ddl":            plan.DDL,
+			"fields":         h.snapshotRows("SELECT * FROM vicidial_lists_fields WHERE list_id = ?", listID),
+		},
+	})
+
+	respondWithSuccess(w, "Custom fields copied", data)
+}
+
+// insertCustomFieldDef adds a field definition, ranked after the list's other fields
+func insertCustomFieldDef(db execer, listID int, def customFieldDef) (string, error) {
+	query := `
+		INSERT INTO vicidial_lists_fields (list_id, field_label, field_name, field_type, field_options,
+			field_size, field_max, field_default, field_required, field_rank)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(MAX(field_rank), 0) + 1
+		FROM vicidial_lists_fields WHERE list_id = ?
+	`
+	_, err := db.Exec(query, listID, def.FieldLabel, def.FieldName, def.FieldType, def.FieldOptions,
+		def.FieldSize, def.FieldMax, def.FieldDefault, def.FieldRequired, listID)
+	return query, err
+}
+
+// updateCustomFieldDef replaces a field definition
+func updateCustomFieldDef(db execer, listID int, def customFieldDef) (string, error) {
+	query := `
+		UPDATE vicidial_lists_fields SET
+			field_label = ?, field_name = ?, field_type = ?, field_options = ?,
+			field_size = ?, field_max = ?, field_default = ?, field_required = ?
+		WHERE field_id = ? AND list_id = ?
+	`
+	_, err := db.Exec(query, def.FieldLabel, def.FieldName, def.FieldType, def.FieldOptions,
+		def.FieldSize, def.FieldMax, def.FieldDefault, def.FieldRequired, def.FieldID, listID)
+	return query, err
+}
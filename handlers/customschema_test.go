@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// countQuery is a countValues query a plan is expected to run
+type countQuery struct {
+	condition string
+	args      []driver.Value
+	count     int
+}
+
+func TestPlanUpdate(t *testing.T) {
+	region := customFieldDef{FieldLabel: "region", FieldType: "TEXT", FieldMax: 30}
+	with := func(change func(*customFieldDef)) customFieldDef {
+		def := region
+		change(&def)
+		return def
+	}
+
+	tests := []struct {
+		name         string
+		columns      map[string]string // existing columns, nil when the table does not exist
+		old, def     customFieldDef
+		queries      []countQuery
+		wantDDL      []string
+		wantWarnings []string
+		wantErr      string
+		wantColumns  map[string]string
+	}{
+		{
+			name:        "unchanged",
+			columns:     map[string]string{"lead_id": "int", "region": "varchar"},
+			old:         region,
+			def:         with(func(d *customFieldDef) { d.FieldName = "Sales region" }),
+			wantDDL:     []string{},
+			wantColumns: map[string]string{"lead_id": "int", "region": "varchar"},
+		},
+		{
+			name:        "rename",
+			columns:     map[string]string{"lead_id": "int", "region": "varchar"},
+			old:         region,
+			def:         with(func(d *customFieldDef) { d.FieldLabel = "area" }),
+			queries:     []countQuery{{"CHAR_LENGTH(`region`) > ?", []driver.Value{30}, 0}},
+			wantDDL:     []string{"ALTER TABLE custom_101 CHANGE `region` `area` VARCHAR(30)"},
+			wantColumns: map[string]string{"lead_id": "int", "area": "varchar"},
+		},
+		{
+			name:    "rename onto an existing column",
+			columns: map[string]string{"lead_id": "int", "region": "varchar", "area": "varchar"},
+			old:     region,
+			def:     with(func(d *customFieldDef) { d.FieldLabel = "area" }),
+			wantErr: "Column area already exists in custom_101",
+		},
+		{
+			name:         "shrink truncates",
+			columns:      map[string]string{"lead_id": "int", "region": "varchar"},
+			old:          region,
+			def:          with(func(d *customFieldDef) { d.FieldMax = 10 }),
+			queries:      []countQuery{{"CHAR_LENGTH(`region`) > ?", []driver.Value{10}, 4}},
+			wantDDL:      []string{"ALTER TABLE custom_101 MODIFY `region` VARCHAR(10)"},
+			wantWarnings: []string{"4 leads have a region value longer than 10 characters that will be truncated"},
+			wantColumns:  map[string]string{"lead_id": "int", "region": "varchar"},
+		},
+		{
+			name:        "default",
+			columns:     map[string]string{"lead_id": "int", "region": "varchar"},
+			old:         region,
+			def:         with(func(d *customFieldDef) { d.FieldDefault = "O'Hare" }),
+			queries:     []countQuery{{"CHAR_LENGTH(`region`) > ?", []driver.Value{30}, 0}},
+			wantDDL:     []string{"ALTER TABLE custom_101 MODIFY `region` VARCHAR(30) DEFAULT 'O''Hare'"},
+			wantColumns: map[string]string{"lead_id": "int", "region": "varchar"},
+		},
+		{
+			name:         "text to date",
+			columns:      map[string]string{"lead_id": "int", "region": "varchar"},
+			old:          region,
+			def:          with(func(d *customFieldDef) { d.FieldType = "DATE" }),
+			queries:      []countQuery{{"CHAR_LENGTH(`region`) > 0", nil, 2}},
+			wantDDL:      []string{"ALTER TABLE custom_101 MODIFY `region` DATE"},
+			wantWarnings: []string{"2 leads have a region value that may not convert to DATE"},
+			wantColumns:  map[string]string{"lead_id": "int", "region": "date"},
+		},
+		{
+			name:         "to a type without storage drops the column",
+			columns:      map[string]string{"lead_id": "int", "region": "varchar"},
+			old:          region,
+			def:          with(func(d *customFieldDef) { d.FieldType = "DISPLAY" }),
+			queries:      []countQuery{{"CHAR_LENGTH(`region`) > 0", nil, 5}},
+			wantDDL:      []string{"ALTER TABLE custom_101 DROP `region`"},
+			wantWarnings: []string{"5 leads have a region value that will be deleted"},
+			wantColumns:  map[string]string{"lead_id": "int"},
+		},
+		{
+			name:        "from a type without storage adds the column",
+			columns:     map[string]string{"lead_id": "int"},
+			old:         with(func(d *customFieldDef) { d.FieldType = "SCRIPT" }),
+			def:         region,
+			wantDDL:     []string{"ALTER TABLE custom_101 ADD `region` VARCHAR(30)"},
+			wantColumns: map[string]string{"lead_id": "int", "region": "varchar"},
+		},
+		{
+			name:        "missing column is added",
+			columns:     map[string]string{"lead_id": "int"},
+			old:         region,
+			def:         with(func(d *customFieldDef) { d.FieldType = "AREA" }),
+			wantDDL:     []string{"ALTER TABLE custom_101 ADD `region` TEXT"},
+			wantColumns: map[string]string{"lead_id": "int", "region": "text"},
+		},
+		{
+			name: "missing table is created",
+			old:  region,
+			def:  with(func(d *customFieldDef) { d.FieldMax = 40 }),
+			wantDDL: []string{
+				"CREATE TABLE custom_101 (lead_id INT(9) UNSIGNED PRIMARY KEY NOT NULL) ENGINE=MyISAM",
+				"ALTER TABLE custom_101 ADD `region` VARCHAR(40)",
+			},
+			wantColumns: map[string]string{"region": "varchar"},
+		},
+		{
+			name:        "without storage either way",
+			columns:     map[string]string{"lead_id": "int"},
+			old:         with(func(d *customFieldDef) { d.FieldType = "DISPLAY" }),
+			def:         with(func(d *customFieldDef) { d.FieldType = "BUTTON" }),
+			wantDDL:     []string{},
+			wantColumns: map[string]string{"lead_id": "int"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+			h := &Handler{DB: db}
+
+			table := &customTable{ListID: 101, Exists: tt.columns != nil, Columns: map[string]string{}}
+			for column, dataType := range tt.columns {
+				table.Columns[column] = dataType
+			}
+			for _, q := range tt.queries {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM custom_101 WHERE " + q.condition)).
+					WithArgs(q.args...).
+					WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(q.count))
+			}
+
+			plan, err := h.planUpdate(table, tt.old, tt.def)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("planUpdate error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planUpdate: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+
+			if !reflect.DeepEqual(plan.DDL, tt.wantDDL) {
+				t.Errorf("DDL = %q, want %q", plan.DDL, tt.wantDDL)
+			}
+			if !reflect.DeepEqual(plan.Warnings, tt.wantWarnings) {
+				t.Errorf("Warnings = %q, want %q", plan.Warnings, tt.wantWarnings)
+			}
+			if !reflect.DeepEqual(table.Columns, tt.wantColumns) {
+				t.Errorf("table columns = %v, want %v", table.Columns, tt.wantColumns)
+			}
+		})
+	}
+}
+
+func TestCustomFieldDefColumnType(t *testing.T) {
+	tests := []struct {
+		def  customFieldDef
+		want string
+	}{
+		{customFieldDef{FieldLabel: "notes", FieldType: "TEXT", FieldMax: 50}, "VARCHAR(50)"},
+		{customFieldDef{FieldLabel: "notes", FieldType: "TEXT", FieldMax: 300}, "TEXT"},
+		{customFieldDef{FieldLabel: "notes", FieldType: "AREA", FieldMax: 50}, "TEXT"},
+		{customFieldDef{FieldLabel: "color", FieldType: "SELECT", FieldMax: 2, FieldOptions: "red,blue"}, "VARCHAR(4)"},
+		{customFieldDef{FieldLabel: "tags", FieldType: "MULTI", FieldMax: 2, FieldOptions: "a,b,c"}, "VARCHAR(5)"},
+		{customFieldDef{FieldLabel: "renewal", FieldType: "DATE", FieldMax: 10}, "DATE"},
+		{customFieldDef{FieldLabel: "intro", FieldType: "SCRIPT", FieldMax: 10}, ""},
+		{customFieldDef{FieldLabel: "city", FieldType: "TEXT", FieldMax: 50}, ""},
+	}
+
+	for _, tt := range tests {
+		got, _ := tt.def.columnType()
+		if got != tt.want {
+			t.Errorf("columnType of %s %s = %q, want %q", tt.def.FieldType, tt.def.FieldLabel, got, tt.want)
+		}
+	}
+}
+
+func TestCustomFieldDefValidateFieldMax(t *testing.T) {
+	tests := []struct {
+		fieldMax int
+		want     int
+		wantErr  bool
+	}{
+		{0, 100, false},
+		{1, 1, false},
+		{65535, 65535, false},
+		{-1, 0, true},
+		{65536, 0, true},
+	}
+
+	for _, tt := range tests {
+		def := customFieldDef{FieldLabel: "notes", FieldType: "TEXT", FieldMax: tt.fieldMax}
+		err := def.validate()
+		if tt.wantErr {
+			if err == nil || err.Error() != "field_max must be between 1 and 65535, or 0 for the default of 100" {
+				t.Errorf("validate field_max %d error = %v", tt.fieldMax, err)
+			}
+			continue
+		}
+		if err != nil || def.FieldMax != tt.want {
+			t.Errorf("validate field_max %d = %d, %v, want %d", tt.fieldMax, def.FieldMax, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// campaignDialing holds the campaign settings that decide which leads the
+// hopper may load
+type campaignDialing struct {
+	CampaignID      string   `json:"campaign_id"`
+	Active          string   `json:"active"`
+	DialStatuses    []string `json:"dial_statuses"`
+	LeadOrder       string   `json:"lead_order"`
+	LeadFilterID    string   `json:"lead_filter_id"`
+	LeadFilterSQL   string   `json:"-"`
+	LocalCallTime   string   `json:"local_call_time"`
+	CallCountLimit  int      `json:"call_count_limit"`
+	DropLockoutTime float64  `json:"drop_lockout_time"`
+}
+
+// loadCampaignDialing reads a campaign's dialing settings and its lead
+// filter. It returns sql.ErrNoRows when the campaign does not exist.
+func (h *Handler) loadCampaignDialing(campaignID string) (*campaignDialing, error) {
+	d := &campaignDialing{CampaignID: campaignID}
+	var dialStatuses, dropLockout string
+	err := h.DB.QueryRow(`
+		SELECT active, COALESCE(dial_statuses, ''), COALESCE(lead_order, ''), COALESCE(lead_filter_id, ''),
+			   COALESCE(local_call_time, ''), call_count_limit, COALESCE(drop_lockout_time, '0')
+		FROM vicidial_campaigns WHERE campaign_id = ?
+	`, campaignID).Scan(&d.Active, &dialStatuses, &d.LeadOrder, &d.LeadFilterID,
+		&d.LocalCallTime, &d.CallCountLimit, &dropLockout)
+	if err != nil {
+		return nil, err
+	}
+
+	d.DialStatuses = parseDialStatuses(dialStatuses)
+	d.DropLockoutTime, _ = strconv.ParseFloat(strings.TrimSpace(dropLockout), 64)
+
+	if d.LeadFilterID != "" && d.LeadFilterID != "NONE" {
+		err := h.DB.QueryRow("SELECT COALESCE(lead_filter_sql, '') FROM vicidial_lead_filters WHERE lead_filter_id = ?",
+			d.LeadFilterID).Scan(&d.LeadFilterSQL)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		d.LeadFilterSQL = strings.TrimSpace(d.LeadFilterSQL)
+	}
+	return d, nil
+}
+
+// dialCriterion is one condition a lead must meet to be dialable
+type dialCriterion struct {
+	Name  string
+	Where string
+	Args  []interface{}
+}
+
+// criteria returns the dialable lead conditions of VICIdial's hopper, in the
+// order it applies them, for leads dialed under call time ct. A nil call
+// time matches no leads.
+func (d *campaignDialing) criteria(ct *callTime, now time.Time) []dialCriterion {
+	criteria := []dialCriterion{
+		{Name: "called_since_last_reset", Where: "called_since_last_reset = 'N'"},
+	}
+
+	if len(d.DialStatuses) == 0 {
+		criteria = append(criteria, dialCriterion{Name: "dial_statuses", Where: "1=0"})
+	} else {
+		criteria = append(criteria, dialCriterion{
+			Name:  "dial_statuses",
+			Where: "status IN (" + placeholders(len(d.DialStatuses)) + ")",
+			Args:  stringArgs(d.DialStatuses),
+		})
+	}
+
+	if d.CallCountLimit > 0 {
+		criteria = append(criteria, dialCriterion{
+			Name:  "call_count_limit",
+			Where: "called_count < ?",
+			Args:  []interface{}{d.CallCountLimit},
+		})
+	}
+
+	if d.DropLockoutTime > 0 {
+		criteria = append(criteria, dialCriterion{
+			Name:  "drop_lockout_time",
+			Where: "(status NOT IN ('DROP', 'XDROP') OR last_local_call_time < ?)",
+			Args:  []interface{}{now.Add(-time.Duration(d.DropLockoutTime * float64(time.Hour))).Format("2006-01-02 15:04:05")},
+		})
+	}
+
+	if d.LeadFilterSQL != "" {
+		criteria = append(criteria, dialCriterion{Name: "lead_filter", Where: "(" + d.LeadFilterSQL + ")"})
+	}
+
+	if ct == nil {
+		criteria = append(criteria, dialCriterion{Name: "local_call_time", Where: "1=0"})
+	} else {
+		where, args := ct.condition(now)
+		criteria = append(criteria, dialCriterion{Name: "local_call_time", Where: where, Args: args})
+	}
+	return criteria
+}
+
+// criteriaWhere joins criteria into " AND ..." conditions
+func criteriaWhere(criteria []dialCriterion) (string, []interface{}) {
+	var where strings.Builder
+	var args []interface{}
+	for _, c := range criteria {
+		where.WriteString(" AND " + c.Where)
+		args = append(args, c.Args...)
+	}
+	return where.String(), args
+}
+
+// dialingList is a list as the hopper sees it. A list's local_call_time
+// overrides the campaign's unless it is "campaign".
+type dialingList struct {
+	ListID        int    `json:"list_id"`
+	ListName      string `json:"list_name"`
+	Active        string `json:"active"`
+	Expired       bool   `json:"expired"`
+	LocalCallTime string `json:"local_call_time"`
+}
+
+// dialed reports whether the hopper loads leads from the list
+func (l dialingList) dialed() bool {
+	return l.Active == "Y" && !l.Expired
+}
+
+// loadDialingLists reads the campaign's lists, or only listID when it is not 0
+func (h *Handler) loadDialingLists(d *campaignDialing, listID int, now time.Time) ([]dialingList, error) {
+	query := `
+		SELECT list_id, list_name, active, expiration_date, COALESCE(local_call_time, 'campaign')
+		FROM vicidial_lists WHERE campaign_id = ?`
+	args := []interface{}{d.CampaignID}
+	if listID != 0 {
+		query += " AND list_id = ?"
+		args = append(args, listID)
+	}
+	rows, err := h.DB.Query(query+" ORDER BY list_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	today := now.Format("2006-01-02")
+	lists := []dialingList{}
+	for rows.Next() {
+		var list dialingList
+		var expirationDate sql.NullTime
+		if err := rows.Scan(&list.ListID, &list.ListName, &list.Active, &expirationDate, &list.LocalCallTime); err != nil {
+			return nil, err
+		}
+		list.Expired = expirationDate.Valid && expirationDate.Time.Format("2006-01-02") < today
+		if list.LocalCallTime == "" || list.LocalCallTime == "campaign" {
+			list.LocalCallTime = d.LocalCallTime
+		}
+		lists = append(lists, list)
+	}
+	return lists, rows.Err()
+}
+
+// listIDsByCallTime groups lists by the call time they are dialed under
+func listIDsByCallTime(lists []dialingList) map[string][]interface{} {
+	groups := map[string][]interface{}{}
+	for _, list := range lists {
+		groups[list.LocalCallTime] = append(groups[list.LocalCallTime], list.ListID)
+	}
+	return groups
+}
+
+// penetrationCounts are the lead counts of a list or campaign. Exhausted
+// leads have been called since the last reset and are not dialed again
+// until the list is reset.
+type penetrationCounts struct {
+	Total       int            `json:"total"`
+	Dialable    int            `json:"dialable"`
+	Exhausted   int            `json:"exhausted"`
+	Penetration float64        `json:"penetration"`
+	ByStatus    map[string]int `json:"by_status"`
+}
+
+func newPenetrationCounts() penetrationCounts {
+	return penetrationCounts{ByStatus: map[string]int{}}
+}
+
+// setPenetration works out the share of leads exhausted, as a percentage
+func (c *penetrationCounts) setPenetration() {
+	if c.Total > 0 {
+		c.Penetration = math.Round(float64(c.Exhausted)*10000/float64(c.Total)) / 100
+	}
+}
+
+// listPenetration is one list's line in a penetration report
+type listPenetration struct {
+	dialingList
+	penetrationCounts
+}
+
+// penetrationReport counts a campaign's leads as VICIdial's dialable leads
+// count does. The campaign's dialable total only includes lists the hopper
+// loads from; each list's dialable count is what it would have when active.
+type penetrationReport struct {
+	campaignDialing
+	EvaluatedAt time.Time         `json:"evaluated_at"`
+	Totals      penetrationCounts `json:"totals"`
+	Lists       []listPenetration `json:"lists"`
+}
+
+// penetration builds the report for the campaign, or for one of its lists
+// when listID is not 0
+func (h *Handler) penetration(d *campaignDialing, listID int) (*penetrationReport, error) {
+	now := time.Now().In(h.serverLocation())
+	lists, err := h.loadDialingLists(d, listID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &penetrationReport{
+		campaignDialing: *d,
+		EvaluatedAt:     now,
+		Totals:          newPenetrationCounts(),
+		Lists:           []listPenetration{},
+	}
+	if len(lists) == 0 {
+		return report, nil
+	}
+
+	counts := map[int]*penetrationCounts{}
+	ids := make([]interface{}, len(lists))
+	for i, list := range lists {
+		c := newPenetrationCounts()
+		counts[list.ListID] = &c
+		ids[i] = list.ListID
+	}
+
+	rows, err := h.DB.Query(`
+		SELECT list_id, status, COUNT(*), SUM(called_since_last_reset != 'N')
+		FROM vicidial_list WHERE list_id IN (`+placeholders(len(ids))+`)
+		GROUP BY list_id, status
+	`, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, total, exhausted int
+		var status string
+		if err := rows.Scan(&id, &status, &total, &exhausted); err != nil {
+			return nil, err
+		}
+		c := counts[id]
+		c.Total += total
+		c.Exhausted += exhausted
+		c.ByStatus[status] += total
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	callTimes := newCallTimeCache(h)
+	for callTimeID, groupIDs := range listIDsByCallTime(lists) {
+		ct, err := callTimes.get(callTimeID)
+		if err != nil {
+			return nil, err
+		}
+		where, args := criteriaWhere(d.criteria(ct, now))
+		args = append(append([]interface{}{}, groupIDs...), args...)
+		dialable, err := h.DB.Query("SELECT list_id, COUNT(*) FROM vicidial_list WHERE list_id IN ("+
+			placeholders(len(groupIDs))+")"+where+" GROUP BY list_id", args...)
+		if err != nil {
+			return nil, err
+		}
+		for dialable.Next() {
+			var id, n int
+			if err := dialable.Scan(&id, &n); err != nil {
+				dialable.Close()
+				return nil, err
+			}
+			counts[id].Dialable = n
+		}
+		err = dialable.Err()
+		dialable.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, list := range lists {
+		c := counts[list.ListID]
+		c.setPenetration()
+		report.Lists = append(report.Lists, listPenetration{dialingList: list, penetrationCounts: *c})
+
+		report.Totals.Total += c.Total
+		report.Totals.Exhausted += c.Exhausted
+		if list.dialed() {
+			report.Totals.Dialable += c.Dialable
+		}
+		for status, n := range c.ByStatus {
+			report.Totals.ByStatus[status] += n
+		}
+	}
+	report.Totals.setPenetration()
+	return report, nil
+}
+
+// respondWithPenetration loads a campaign and responds with its report
+func (h *Handler) respondWithPenetration(w http.ResponseWriter, campaignID string, listID int) {
+	d, err := h.loadCampaignDialing(campaignID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+
+	report, err := h.penetration(d, listID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to count leads: "+err.Error())
+		return
+	}
+	respondWithSuccess(w, "Penetration report retrieved", report)
+}
+
+// CampaignPenetration reports total, dialable and exhausted leads and leads
+// by status for each list of a campaign
+func (h *Handler) CampaignPenetration(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	h.respondWithPenetration(w, campaignID, 0)
+}
+
+// ListPenetration reports a list's leads against its campaign's dialing
+// settings
+func (h *Handler) ListPenetration(w http.ResponseWriter, r *http.Request) {
+	listID, err := strconv.Atoi(mux.Vars(r)["list_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid list ID")
+		return
+	}
+
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	var campaignID string
+	err = h.DB.QueryRow("SELECT COALESCE(campaign_id, '') FROM vicidial_lists WHERE list_id = ?", listID).Scan(&campaignID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "List not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve list: "+err.Error())
+		return
+	}
+	if campaignID == "" {
+		respondWithError(w, http.StatusConflict, "List is not assigned to a campaign")
+		return
+	}
+
+	h.respondWithPenetration(w, campaignID, listID)
+}
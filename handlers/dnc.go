@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -11,6 +12,7 @@ import (
 func (h *Handler) AddDNCPhone(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		PhoneNumber string `json:"phone_number"`
+		PhoneCode   string `json:"phone_code"`
 		CampaignID  string `json:"campaign_id"`
 	}
 
@@ -23,6 +25,10 @@ func (h *Handler) AddDNCPhone(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Phone number is required")
 		return
 	}
+	var ok bool
+	if req.PhoneNumber, ok = readDNCPhoneNumber(w, req.PhoneNumber, req.PhoneCode); !ok {
+		return
+	}
 
 	if req.CampaignID == "" {
 		req.CampaignID = "---ALL---" // Default campaign ID for global DNC
@@ -45,6 +51,15 @@ func (h *Handler) AddDNCPhone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "LISTS",
+		Type:     "ADD",
+		RecordID: req.PhoneNumber,
+		Code:     "ADMIN API ADD NUMBER TO DNC " + req.CampaignID,
+		SQL:      query,
+		Args:     []interface{}{req.PhoneNumber, req.CampaignID},
+	})
+
 	respondWithSuccess(w, "Phone number added to DNC list", map[string]string{
 		"phone_number": req.PhoneNumber,
 		"campaign_id":  req.CampaignID,
@@ -61,6 +76,10 @@ func (h *Handler) DeleteDNCPhone(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Phone number is required")
 		return
 	}
+	phoneNumber, ok := readDNCPhoneNumber(w, phoneNumber, r.URL.Query().Get("phone_code"))
+	if !ok {
+		return
+	}
 
 	var query string
 	var args []interface{}
@@ -73,6 +92,8 @@ func (h *Handler) DeleteDNCPhone(w http.ResponseWriter, r *http.Request) {
 		args = []interface{}{phoneNumber}
 	}
 
+	before := h.snapshotRows(strings.Replace(query, "DELETE", "SELECT *", 1), args...)
+
 	result, err := h.DB.Exec(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete DNC entry: "+err.Error())
@@ -80,6 +101,18 @@ func (h *Handler) DeleteDNCPhone(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rowsAffected, _ := result.RowsAffected()
+
+	if rowsAffected > 0 {
+		h.audit(r, auditEvent{
+			Section:  "LISTS",
+			Type:     "DELETE",
+			RecordID: phoneNumber,
+			Code:     "ADMIN API DELETE NUMBER FROM DNC",
+			SQL:      query,
+			Args:     args,
+			Before:   before,
+		})
+	}
 	respondWithSuccess(w, "DNC entry deleted", map[string]int64{
 		"rows_deleted": rowsAffected,
 	})
@@ -89,6 +122,7 @@ func (h *Handler) DeleteDNCPhone(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) AddFPGPhone(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		PhoneNumber    string `json:"phone_number"`
+		PhoneCode      string `json:"phone_code"`
 		FilterPhoneGroupID string `json:"filter_phone_group_id"`
 	}
 
@@ -101,6 +135,10 @@ func (h *Handler) AddFPGPhone(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Phone number and filter group ID are required")
 		return
 	}
+	var ok bool
+	if req.PhoneNumber, ok = readDNCPhoneNumber(w, req.PhoneNumber, req.PhoneCode); !ok {
+		return
+	}
 
 	query := `
 		INSERT IGNORE INTO vicidial_filter_phone_groups (phone_number, filter_phone_group_id, entry_date)
@@ -119,6 +157,15 @@ func (h *Handler) AddFPGPhone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "FILTERPHONEGROUPS",
+		Type:     "ADD",
+		RecordID: req.PhoneNumber,
+		Code:     "ADMIN API ADD NUMBER TO FPG " + req.FilterPhoneGroupID,
+		SQL:      query,
+		Args:     []interface{}{req.PhoneNumber, req.FilterPhoneGroupID},
+	})
+
 	respondWithSuccess(w, "Phone number added to filter group", map[string]string{
 		"phone_number":           req.PhoneNumber,
 		"filter_phone_group_id": req.FilterPhoneGroupID,
@@ -135,6 +182,10 @@ func (h *Handler) DeleteFPGPhone(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Phone number is required")
 		return
 	}
+	phoneNumber, ok := readDNCPhoneNumber(w, phoneNumber, r.URL.Query().Get("phone_code"))
+	if !ok {
+		return
+	}
 
 	var query string
 	var args []interface{}
@@ -147,6 +198,8 @@ func (h *Handler) DeleteFPGPhone(w http.ResponseWriter, r *http.Request) {
 		args = []interface{}{phoneNumber}
 	}
 
+	before := h.snapshotRows(strings.Replace(query, "DELETE", "SELECT *", 1), args...)
+
 	result, err := h.DB.Exec(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete filter group entry: "+err.Error())
@@ -154,7 +207,39 @@ func (h *Handler) DeleteFPGPhone(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rowsAffected, _ := result.RowsAffected()
+
+	if rowsAffected > 0 {
+		h.audit(r, auditEvent{
+			Section:  "FILTERPHONEGROUPS",
+			Type:     "DELETE",
+			RecordID: phoneNumber,
+			Code:     "ADMIN API DELETE NUMBER FROM FPG",
+			SQL:      query,
+			Args:     args,
+			Before:   before,
+		})
+	}
 	respondWithSuccess(w, "Filter group entry deleted", map[string]int64{
 		"rows_deleted": rowsAffected,
 	})
 }
+
+// dncMatch reports whether the phone number is on the DNC list for the
+// campaign ("---ALL---" for the system list). With areaCode set, entries
+// blocking the whole area code (e.g. 201XXXXXXX) also match.
+func (h *Handler) dncMatch(phoneNumber, campaignID string, areaCode bool) (bool, error) {
+	query := "SELECT COUNT(*) FROM vicidial_dnc WHERE campaign_id = ? AND (phone_number = ?"
+	args := []interface{}{campaignID, phoneNumber}
+
+	if areaCode && len(phoneNumber) >= 3 {
+		query += " OR phone_number = ?"
+		args = append(args, phoneNumber[:3]+"XXXXXXX")
+	}
+	query += ")"
+
+	var count int
+	if err := h.DB.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
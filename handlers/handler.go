@@ -6,6 +6,8 @@ import (
 	"net/http"
 
 	"github.com/vicidb/non-agent-api/config"
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/middleware"
 	"github.com/vicidb/non-agent-api/models"
 )
 
@@ -13,14 +15,21 @@ import (
 type Handler struct {
 	DB     *sql.DB
 	Config *config.Config
+	Keys   *middleware.KeyStore
+	Jobs   *jobs.Manager
 }
 
-// NewHandler creates a new Handler instance
-func NewHandler(db *sql.DB, cfg *config.Config) *Handler {
-	return &Handler{
+// NewHandler creates a new Handler instance and registers its job types
+// with the job manager
+func NewHandler(db *sql.DB, cfg *config.Config, keys *middleware.KeyStore, jobManager *jobs.Manager) *Handler {
+	h := &Handler{
 		DB:     db,
 		Config: cfg,
+		Keys:   keys,
+		Jobs:   jobManager,
 	}
+	h.registerJobs()
+	return h
 }
 
 // respondWithJSON sends a JSON response
@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// hopperInsertChunkSize is the number of rows in each multi-row hopper INSERT
+	hopperInsertChunkSize = 500
+	// hopperBulkMaxLeads caps the lead IDs of one bulk insert
+	hopperBulkMaxLeads = 10000
+)
+
+// hopperRemovable matches hopper entries the dialer has not taken yet.
+// QUEUE and INCALL entries are being dialed and are left for the dialer to
+// remove.
+const hopperRemovable = "status NOT IN ('QUEUE', 'INCALL')"
+
+// hopperSkip is a lead left out of a bulk insert and the reason why
+type hopperSkip struct {
+	LeadID int    `json:"lead_id"`
+	Reason string `json:"reason"`
+}
+
+// hopperLead is a lead with the vicidial_hopper columns AST_VDhopper copies
+// from it
+type hopperLead struct {
+	LeadID         int
+	ListID         int
+	PhoneNumber    string
+	GMTOffsetNow   string
+	State          string
+	VendorLeadCode string
+	User           string
+}
+
+// leadIDArgs parses a comma separated lead_ids query parameter
+func leadIDArgs(value string) ([]interface{}, error) {
+	ids := []interface{}{}
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid lead ID %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// hopperScope returns the WHERE clause selecting a campaign's hopper entries
+// on lists the caller may use, narrowed to leadIDs and listID when given
+func hopperScope(r *http.Request, campaignID string, leadIDs []interface{}, listID int) (string, []interface{}) {
+	where := " WHERE campaign_id = ?"
+	args := []interface{}{campaignID}
+	if len(leadIDs) > 0 {
+		where += " AND lead_id IN (" + placeholders(len(leadIDs)) + ")"
+		args = append(args, leadIDs...)
+	}
+	if listID != 0 {
+		where += " AND list_id = ?"
+		args = append(args, listID)
+	}
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	return where + restrictSQL, append(args, restrictArgs...)
+}
+
+// loadHopperLeads reads the leads to insert, keyed by lead_id. Leads the
+// caller may not access are left out.
+func (h *Handler) loadHopperLeads(r *http.Request, ids []interface{}) (map[int]*hopperLead, error) {
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	rows, err := h.DB.Query(`
+		SELECT lead_id, list_id, phone_number, COALESCE(gmt_offset_now, '0'), COALESCE(state, ''),
+			   COALESCE(vendor_lead_code, '')
+		FROM vicidial_list WHERE lead_id IN (`+placeholders(len(ids))+`)`+restrictSQL,
+		append(append([]interface{}{}, ids...), restrictArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leads := map[int]*hopperLead{}
+	for rows.Next() {
+		lead := &hopperLead{}
+		if err := rows.Scan(&lead.LeadID, &lead.ListID, &lead.PhoneNumber, &lead.GMTOffsetNow,
+			&lead.State, &lead.VendorLeadCode); err != nil {
+			return nil, err
+		}
+		leads[lead.LeadID] = lead
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// A pending USERONLY callback keeps the lead for its agent, as the
+	// hopper's user column does for the dialer
+	callbacks, err := h.DB.Query(`
+		SELECT lead_id, user FROM vicidial_callbacks
+		WHERE lead_id IN (`+placeholders(len(ids))+`) AND recipient = 'USERONLY' AND status IN ('ACTIVE', 'LIVE')
+	`, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer callbacks.Close()
+	for callbacks.Next() {
+		var leadID int
+		var user string
+		if err := callbacks.Scan(&leadID, &user); err != nil {
+			return nil, err
+		}
+		if lead, ok := leads[leadID]; ok {
+			lead.User = user
+		}
+	}
+	return leads, callbacks.Err()
+}
+
+// queuedLeads returns which of the leads are already in any hopper
+func (h *Handler) queuedLeads(ids []interface{}) (map[int]bool, error) {
+	rows, err := h.DB.Query("SELECT lead_id FROM vicidial_hopper WHERE lead_id IN ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queued := map[int]bool{}
+	for rows.Next() {
+		var leadID int
+		if err := rows.Scan(&leadID); err != nil {
+			return nil, err
+		}
+		queued[leadID] = true
+	}
+	return queued, rows.Err()
+}
+
+// HopperBulkInsert loads leads into a campaign's hopper the way AST_VDhopper
+// does, copying gmt_offset_now, state and vendor_lead_code from the lead.
+// Leads already in a hopper, in a list of another campaign, on a DNC list the
+// campaign checks or outside their call time right now are skipped, with the
+// reason reported.
+func (h *Handler) HopperBulkInsert(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	campaignID := vars["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	var req struct {
+		LeadIDs  []int  `json:"lead_ids"`
+		Priority int    `json:"priority"`
+		Source   string `json:"source"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if len(req.LeadIDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No lead IDs provided")
+		return
+	}
+	if len(req.LeadIDs) > hopperBulkMaxLeads {
+		respondWithError(w, http.StatusBadRequest, "At most "+strconv.Itoa(hopperBulkMaxLeads)+" lead IDs can be inserted at once")
+		return
+	}
+	if req.Priority < -99 || req.Priority > 99 {
+		respondWithError(w, http.StatusBadRequest, "priority must be between -99 and 99")
+		return
+	}
+
+	// vicidial_hopper.source is one character; A marks leads added by the API
+	if req.Source == "" {
+		req.Source = "A"
+	}
+	if len(req.Source) != 1 {
+		respondWithError(w, http.StatusBadRequest, "source must be a single character")
+		return
+	}
+
+	d, err := h.loadCampaignDialing(campaignID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+	var dnc leadAddOptions
+	err = h.DB.QueryRow("SELECT COALESCE(use_internal_dnc, 'N'), COALESCE(use_campaign_dnc, 'N') FROM vicidial_campaigns WHERE campaign_id = ?",
+		campaignID).Scan(&dnc.DNCCheck, &dnc.CampaignDNCCheck)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+
+	now := time.Now().In(h.serverLocation())
+	lists, err := h.loadDialingLists(d, 0, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lists: "+err.Error())
+		return
+	}
+	listCallTimes := map[int]string{}
+	for _, list := range lists {
+		listCallTimes[list.ListID] = list.LocalCallTime
+	}
+
+	ids := []interface{}{}
+	seen := map[int]bool{}
+	skipped := []hopperSkip{}
+	for _, leadID := range req.LeadIDs {
+		if seen[leadID] {
+			skipped = append(skipped, hopperSkip{LeadID: leadID, Reason: "DUPLICATE"})
+			continue
+		}
+		seen[leadID] = true
+		ids = append(ids, leadID)
+	}
+
+	leads, err := h.loadHopperLeads(r, ids)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve leads: "+err.Error())
+		return
+	}
+	queued, err := h.queuedLeads(ids)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check hopper: "+err.Error())
+		return
+	}
+
+	candidates := []*hopperLead{}
+	for _, id := range ids {
+		leadID := id.(int)
+		lead, ok := leads[leadID]
+		switch {
+		case !ok:
+			skipped = append(skipped, hopperSkip{LeadID: leadID, Reason: "NOT FOUND"})
+		case queued[leadID]:
+			skipped = append(skipped, hopperSkip{LeadID: leadID, Reason: "ALREADY IN HOPPER"})
+		default:
+			if _, inCampaign := listCallTimes[lead.ListID]; !inCampaign {
+				skipped = append(skipped, hopperSkip{LeadID: leadID, Reason: "NOT IN CAMPAIGN"})
+				continue
+			}
+			candidates = append(candidates, lead)
+		}
+	}
+
+	dncReasons := map[string]string{}
+	for start := 0; start < len(candidates); start += hopperInsertChunkSize {
+		end := start + hopperInsertChunkSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		phones := make([]string, 0, end-start)
+		for _, lead := range candidates[start:end] {
+			phones = append(phones, lead.PhoneNumber)
+		}
+		listed, err := h.dncListed(dnc, campaignID, phones)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check DNC: "+err.Error())
+			return
+		}
+		for phone, reason := range listed {
+			dncReasons[phone] = reason
+		}
+	}
+
+	callTimes := newCallTimeCache(h)
+	eligible := []*hopperLead{}
+	for _, lead := range candidates {
+		if reason := dncReasons[lead.PhoneNumber]; reason != "" {
+			skipped = append(skipped, hopperSkip{LeadID: lead.LeadID, Reason: reason})
+			continue
+		}
+
+		ct, err := callTimes.get(listCallTimes[lead.ListID])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve call time: "+err.Error())
+			return
+		}
+		offset, err := strconv.ParseFloat(lead.GMTOffsetNow, 64)
+		if ct == nil || err != nil || !ct.allows(offset, lead.State, now) {
+			skipped = append(skipped, hopperSkip{LeadID: lead.LeadID, Reason: "OUTSIDE CALL TIME"})
+			continue
+		}
+		eligible = append(eligible, lead)
+	}
+
+	const insertRow = "(?, ?, 'READY', ?, ?, ?, ?, 'NONE', ?, ?, ?)"
+	insertStmt := `INSERT IGNORE INTO vicidial_hopper
+		(lead_id, campaign_id, status, user, list_id, gmt_offset_now, state, alt_dial, priority, source, vendor_lead_code)
+		VALUES `
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	insertCount := 0
+	for start := 0; start < len(eligible); start += hopperInsertChunkSize {
+		end := start + hopperInsertChunkSize
+		if end > len(eligible) {
+			end = len(eligible)
+		}
+		rows := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*9)
+		for _, lead := range eligible[start:end] {
+			rows = append(rows, insertRow)
+			args = append(args, lead.LeadID, campaignID, lead.User, lead.ListID, lead.GMTOffsetNow,
+				lead.State, req.Priority, req.Source, lead.VendorLeadCode)
+		}
+		result, err := tx.Exec(insertStmt+strings.Join(rows, ", "), args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to insert leads: "+err.Error())
+			return
+		}
+		n, _ := result.RowsAffected()
+		insertCount += int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to insert leads: "+err.Error())
+		return
+	}
+
+	skippedByReason := map[string]int{}
+	for _, skip := range skipped {
+		skippedByReason[skip.Reason]++
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "LOAD",
+		RecordID: campaignID,
+		Code:     "ADMIN API HOPPER BULK INSERT",
+		SQL:      insertStmt + insertRow,
+		Args:     []interface{}{len(req.LeadIDs), campaignID, req.Priority, req.Source},
+		After: map[string]interface{}{
+			"requested": len(req.LeadIDs),
+			"inserted":  insertCount,
+			"skipped":   skippedByReason,
+		},
+	})
+
+	respondWithSuccess(w, "Leads inserted to hopper", map[string]interface{}{
+		"requested":         len(req.LeadIDs),
+		"inserted":          insertCount,
+		"skipped":           skipped,
+		"skipped_by_reason": skippedByReason,
+	})
+}
+
+// HopperRemove removes a campaign's hopper entries, all of them or those of
+// the lead_ids or list_id given. Entries being dialed are kept.
+func (h *Handler) HopperRemove(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	q := r.URL.Query()
+	leadIDs, err := leadIDArgs(q.Get("lead_ids"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid lead_ids")
+		return
+	}
+	listID := 0
+	if value := q.Get("list_id"); value != "" {
+		if listID, err = strconv.Atoi(value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid list ID")
+			return
+		}
+	}
+
+	where, args := hopperScope(r, campaignID, leadIDs, listID)
+	var matched int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_hopper"+where, args...).Scan(&matched); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read hopper: "+err.Error())
+		return
+	}
+
+	query := "DELETE FROM vicidial_hopper" + where + " AND " + hopperRemovable
+	result, err := h.DB.Exec(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove hopper entries: "+err.Error())
+		return
+	}
+	removed, _ := result.RowsAffected()
+
+	code := "ADMIN API HOPPER REMOVE"
+	if len(leadIDs) == 0 && listID == 0 && !listRestricted(r) {
+		code = "ADMIN API HOPPER CLEAR"
+	}
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "DELETE",
+		RecordID: campaignID,
+		Code:     code,
+		SQL:      query,
+		Args:     args,
+		After:    map[string]interface{}{"removed": removed},
+	})
+
+	respondWithSuccess(w, "Hopper entries removed", map[string]interface{}{
+		"campaign_id": campaignID,
+		"removed":     removed,
+		"in_progress": matched - int(removed),
+	})
+}
+
+// HopperPriority changes the priority of a campaign's hopper entries, all of
+// them or those of the lead_ids or list_id given. The dialer takes entries
+// with the highest priority first.
+func (h *Handler) HopperPriority(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	var req struct {
+		LeadIDs  []int `json:"lead_ids"`
+		ListID   int   `json:"list_id"`
+		Priority *int  `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.Priority == nil {
+		respondWithError(w, http.StatusBadRequest, "priority is required")
+		return
+	}
+	if *req.Priority < -99 || *req.Priority > 99 {
+		respondWithError(w, http.StatusBadRequest, "priority must be between -99 and 99")
+		return
+	}
+
+	leadIDs := make([]interface{}, len(req.LeadIDs))
+	for i, id := range req.LeadIDs {
+		leadIDs[i] = id
+	}
+	where, args := hopperScope(r, campaignID, leadIDs, req.ListID)
+	query := "UPDATE vicidial_hopper SET priority = ?" + where + " AND status = 'READY'"
+	args = append([]interface{}{*req.Priority}, args...)
+	result, err := h.DB.Exec(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update hopper: "+err.Error())
+		return
+	}
+	updated, _ := result.RowsAffected()
+
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "MODIFY",
+		RecordID: campaignID,
+		Code:     "ADMIN API HOPPER PRIORITY",
+		SQL:      query,
+		Args:     args,
+		After:    map[string]interface{}{"updated": updated},
+	})
+
+	respondWithSuccess(w, "Hopper priority updated", map[string]interface{}{
+		"campaign_id": campaignID,
+		"priority":    *req.Priority,
+		"updated":     updated,
+	})
+}
+
+// hopperCount is the number of hopper entries with one value of a column
+type hopperCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// sortedHopperCounts orders counts by descending count, then value
+func sortedHopperCounts(counts map[string]int) []hopperCount {
+	sorted := make([]hopperCount, 0, len(counts))
+	for value, n := range counts {
+		sorted = append(sorted, hopperCount{Value: value, Count: n})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+// HopperStats counts a campaign's hopper entries by status, list, state,
+// GMT offset, priority and source, against the campaign's hopper_level.
+// List-restricted callers only see entries of their lists.
+func (h *Handler) HopperStats(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	var hopperLevel int
+	err := h.DB.QueryRow("SELECT hopper_level FROM vicidial_campaigns WHERE campaign_id = ?", campaignID).Scan(&hopperLevel)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+
+	where, args := hopperScope(r, campaignID, nil, 0)
+	rows, err := h.DB.Query(`
+		SELECT status, list_id, COALESCE(state, ''), COALESCE(gmt_offset_now, ''), priority, COALESCE(source, ''), COUNT(*)
+		FROM vicidial_hopper`+where+`
+		GROUP BY status, list_id, state, gmt_offset_now, priority, source
+	`, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read hopper: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	columns := []string{"status", "list_id", "state", "gmt_offset_now", "priority", "source"}
+	counts := map[string]map[string]int{}
+	for _, column := range columns {
+		counts[column] = map[string]int{}
+	}
+	total := 0
+	for rows.Next() {
+		values := make([]string, len(columns))
+		var n int
+		if err := rows.Scan(&values[0], &values[1], &values[2], &values[3], &values[4], &values[5], &n); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read hopper: "+err.Error())
+			return
+		}
+		for i, column := range columns {
+			counts[column][values[i]] += n
+		}
+		total += n
+	}
+
+	data := map[string]interface{}{
+		"campaign_id":  campaignID,
+		"hopper_level": hopperLevel,
+		"total":        total,
+		"ready":        counts["status"]["READY"],
+	}
+	for _, column := range columns {
+		data["by_"+column] = sortedHopperCounts(counts[column])
+	}
+	respondWithSuccess(w, "Hopper stats retrieved", data)
+}
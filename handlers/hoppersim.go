@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// hopperSimulationMaxLimit caps the leads a simulation lists
+const hopperSimulationMaxLimit = 1000
+
+// leadOrderColumns maps a lead_order, without its UP or DOWN, to the column
+// AST_VDhopper sorts on
+var leadOrderColumns = map[string]string{
+	"":               "lead_id",
+	"PHONE":          "phone_number",
+	"LAST NAME":      "last_name",
+	"COUNT":          "called_count",
+	"LAST CALL TIME": "last_local_call_time",
+	"RANK":           "`rank`",
+	"OWNER":          "owner",
+	"TIMEZONE":       "gmt_offset_now",
+}
+
+// leadOrderBy returns the ORDER BY clause of a lead_order and, for orders
+// such as "DOWN 3rd NEW", how often a NEW lead is taken. Unknown orders sort
+// as DOWN and take no NEW leads first.
+func leadOrderBy(order string) (string, int) {
+	every := 0
+	m := leadOrderPattern.FindStringSubmatch(order)
+	if m == nil {
+		return " ORDER BY lead_id", 0
+	}
+	if m[2] != "" {
+		every = int(m[2][0] - '0')
+	}
+	if m[1] == "RANDOM" {
+		return " ORDER BY RAND()", every
+	}
+
+	direction, column := "", ""
+	switch {
+	case m[1] == "UP" || strings.HasPrefix(m[1], "UP "):
+		direction, column = " DESC", strings.TrimPrefix(strings.TrimPrefix(m[1], "UP"), " ")
+	case m[1] == "DOWN" || strings.HasPrefix(m[1], "DOWN "):
+		column = strings.TrimPrefix(strings.TrimPrefix(m[1], "DOWN"), " ")
+	}
+	sortColumn := leadOrderColumns[column]
+	if sortColumn == "lead_id" {
+		return " ORDER BY lead_id" + direction, every
+	}
+	return " ORDER BY " + sortColumn + direction + ", lead_id", every
+}
+
+// funnelStep is the number of leads left after one hopper criterion and the
+// number it removed
+type funnelStep struct {
+	Criterion string `json:"criterion"`
+	Removed   int    `json:"removed"`
+	Remaining int    `json:"remaining"`
+}
+
+// simulatedLead is a lead the hopper would load, in load order
+type simulatedLead struct {
+	LeadID            int    `json:"lead_id"`
+	ListID            int    `json:"list_id"`
+	Status            string `json:"status"`
+	PhoneNumber       string `json:"phone_number"`
+	State             string `json:"state"`
+	GMTOffsetNow      string `json:"gmt_offset_now"`
+	CalledCount       int    `json:"called_count"`
+	LastLocalCallTime string `json:"last_local_call_time"`
+	Rank              int    `json:"rank"`
+	Owner             string `json:"owner"`
+}
+
+// hopperSimulation is what a hopper fill would do for a campaign right now
+type hopperSimulation struct {
+	campaignDialing
+	EvaluatedAt time.Time       `json:"evaluated_at"`
+	HopperLevel int             `json:"hopper_level"`
+	HopperReady int             `json:"hopper_ready"`
+	WouldLoad   int             `json:"would_load"`
+	Lists       []dialingList   `json:"lists"`
+	Funnel      []funnelStep    `json:"funnel"`
+	Dialable    int             `json:"dialable"`
+	Leads       []simulatedLead `json:"leads"`
+}
+
+// dialableGroup is the lists dialed under one call time and the hopper
+// criteria for them
+type dialableGroup struct {
+	ListIDs  []interface{}
+	Criteria []dialCriterion
+}
+
+// where returns the group's condition using its first n criteria
+func (g dialableGroup) where(n int) (string, []interface{}) {
+	where, args := criteriaWhere(g.Criteria[:n])
+	return "(list_id IN (" + placeholders(len(g.ListIDs)) + ")" + where + ")",
+		append(append([]interface{}{}, g.ListIDs...), args...)
+}
+
+// notInHopper excludes leads already in a hopper, as AST_VDhopper does
+const notInHopper = "lead_id NOT IN (SELECT lead_id FROM vicidial_hopper)"
+
+// HopperSimulate reproduces a hopper fill for a campaign without writing
+// anything. It lists the leads the hopper would load next, in order, and a
+// funnel of how many of the campaign's leads each criterion removed.
+func (h *Handler) HopperSimulate(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > hopperSimulationMaxLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(hopperSimulationMaxLimit))
+			return
+		}
+		limit = n
+	}
+
+	d, err := h.loadCampaignDialing(campaignID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve campaign: "+err.Error())
+		return
+	}
+
+	sim, err := h.simulateHopper(d, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to simulate hopper: "+err.Error())
+		return
+	}
+	respondWithSuccess(w, "Hopper simulation complete", sim)
+}
+
+// simulateHopper counts the funnel and selects up to limit leads
+func (h *Handler) simulateHopper(d *campaignDialing, limit int) (*hopperSimulation, error) {
+	now := time.Now().In(h.serverLocation())
+	sim := &hopperSimulation{
+		campaignDialing: *d,
+		EvaluatedAt:     now,
+		Funnel:          []funnelStep{},
+		Leads:           []simulatedLead{},
+	}
+
+	err := h.DB.QueryRow(`
+		SELECT c.hopper_level, (SELECT COUNT(*) FROM vicidial_hopper WHERE campaign_id = c.campaign_id AND status = 'READY')
+		FROM vicidial_campaigns c WHERE c.campaign_id = ?
+	`, d.CampaignID).Scan(&sim.HopperLevel, &sim.HopperReady)
+	if err != nil {
+		return nil, err
+	}
+
+	sim.Lists, err = h.loadDialingLists(d, 0, now)
+	if err != nil {
+		return nil, err
+	}
+
+	count := func(where string, args ...interface{}) (int, error) {
+		var n int
+		err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_list WHERE "+where, args...).Scan(&n)
+		return n, err
+	}
+	step := func(name string, remaining int) {
+		removed := 0
+		if len(sim.Funnel) > 0 {
+			removed = sim.Funnel[len(sim.Funnel)-1].Remaining - remaining
+		}
+		sim.Funnel = append(sim.Funnel, funnelStep{Criterion: name, Removed: removed, Remaining: remaining})
+	}
+
+	allIDs := []interface{}{}
+	dialed := []dialingList{}
+	for _, list := range sim.Lists {
+		allIDs = append(allIDs, list.ListID)
+		if list.dialed() {
+			dialed = append(dialed, list)
+		}
+	}
+	if len(allIDs) == 0 {
+		step("campaign_lists", 0)
+		return sim, nil
+	}
+	total, err := count("list_id IN ("+placeholders(len(allIDs))+")", allIDs...)
+	if err != nil {
+		return nil, err
+	}
+	step("campaign_lists", total)
+
+	callTimes := newCallTimeCache(h)
+	groups := []dialableGroup{}
+	activeIDs := []interface{}{}
+	for callTimeID, ids := range listIDsByCallTime(dialed) {
+		ct, err := callTimes.get(callTimeID)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, dialableGroup{ListIDs: ids, Criteria: d.criteria(ct, now)})
+		activeIDs = append(activeIDs, ids...)
+	}
+	if len(groups) == 0 {
+		step("active_lists", 0)
+		return sim, nil
+	}
+	active, err := count("list_id IN ("+placeholders(len(activeIDs))+")", activeIDs...)
+	if err != nil {
+		return nil, err
+	}
+	step("active_lists", active)
+
+	// Every group has the same criteria in the same order; only the call
+	// time condition differs
+	for i, criterion := range groups[0].Criteria {
+		remaining := 0
+		for _, group := range groups {
+			where, args := group.where(i + 1)
+			n, err := count(where, args...)
+			if err != nil {
+				return nil, err
+			}
+			remaining += n
+		}
+		step(criterion.Name, remaining)
+	}
+
+	var parts []string
+	var args []interface{}
+	for _, group := range groups {
+		where, groupArgs := group.where(len(group.Criteria))
+		parts = append(parts, where)
+		args = append(args, groupArgs...)
+	}
+	where := "(" + strings.Join(parts, " OR ") + ") AND " + notInHopper
+	sim.Dialable, err = count(where, args...)
+	if err != nil {
+		return nil, err
+	}
+	step("not_in_hopper", sim.Dialable)
+
+	if room := sim.HopperLevel - sim.HopperReady; room > 0 {
+		sim.WouldLoad = room
+		if sim.Dialable < room {
+			sim.WouldLoad = sim.Dialable
+		}
+	}
+
+	orderBy, every := leadOrderBy(d.LeadOrder)
+	if every == 0 {
+		sim.Leads, err = h.simulatedLeads(where, args, orderBy, limit)
+		return sim, err
+	}
+
+	// With "Nth NEW" orders every Nth lead loaded is a NEW lead, taken
+	// from NEW and other leads sorted separately
+	newLeads, err := h.simulatedLeads(where+" AND status = 'NEW'", args, orderBy, limit)
+	if err != nil {
+		return nil, err
+	}
+	otherLeads, err := h.simulatedLeads(where+" AND status != 'NEW'", args, orderBy, limit)
+	if err != nil {
+		return nil, err
+	}
+	for len(sim.Leads) < limit && (len(newLeads) > 0 || len(otherLeads) > 0) {
+		takeNew := (len(sim.Leads)+1)%every == 0
+		if (takeNew && len(newLeads) > 0) || len(otherLeads) == 0 {
+			sim.Leads, newLeads = append(sim.Leads, newLeads[0]), newLeads[1:]
+		} else {
+			sim.Leads, otherLeads = append(sim.Leads, otherLeads[0]), otherLeads[1:]
+		}
+	}
+	return sim, nil
+}
+
+// simulatedLeads selects leads matching where in hopper order
+func (h *Handler) simulatedLeads(where string, args []interface{}, orderBy string, limit int) ([]simulatedLead, error) {
+	rows, err := h.DB.Query(`
+		SELECT lead_id, list_id, status, phone_number, COALESCE(state, ''), COALESCE(gmt_offset_now, ''),
+			   called_count, COALESCE(CAST(last_local_call_time AS CHAR), ''), `+"`rank`"+`, COALESCE(owner, '')
+		FROM vicidial_list WHERE `+where+orderBy+" LIMIT ?", append(append([]interface{}{}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leads := []simulatedLead{}
+	for rows.Next() {
+		var lead simulatedLead
+		if err := rows.Scan(&lead.LeadID, &lead.ListID, &lead.Status, &lead.PhoneNumber, &lead.State,
+			&lead.GMTOffsetNow, &lead.CalledCount, &lead.LastLocalCallTime, &lead.Rank, &lead.Owner); err != nil {
+			return nil, err
+		}
+		leads = append(leads, lead)
+	}
+	return leads, rows.Err()
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import "testing"
+
+func TestLeadOrderBy(t *testing.T) {
+	tests := []struct {
+		order     string
+		wantOrder string
+		wantEvery int
+	}{
+		{"DOWN", " ORDER BY lead_id", 0},
+		{"UP", " ORDER BY lead_id DESC", 0},
+		{"DOWN PHONE", " ORDER BY phone_number, lead_id", 0},
+		{"UP LAST NAME", " ORDER BY last_name DESC, lead_id", 0},
+		{"DOWN COUNT", " ORDER BY called_count, lead_id", 0},
+		{"UP LAST CALL TIME", " ORDER BY last_local_call_time DESC, lead_id", 0},
+		{"DOWN RANK", " ORDER BY `rank`, lead_id", 0},
+		{"UP OWNER", " ORDER BY owner DESC, lead_id", 0},
+		{"DOWN TIMEZONE", " ORDER BY gmt_offset_now, lead_id", 0},
+		{"RANDOM", " ORDER BY RAND()", 0},
+		{"DOWN 2nd NEW", " ORDER BY lead_id", 2},
+		{"UP COUNT 3rd NEW", " ORDER BY called_count DESC, lead_id", 3},
+		{"UP LAST CALL TIME 6th NEW", " ORDER BY last_local_call_time DESC, lead_id", 6},
+		{"RANDOM 4th NEW", " ORDER BY RAND()", 4},
+		{"DOWN SECURITY", " ORDER BY lead_id", 0},
+		{"SIDEWAYS 5th NEW", " ORDER BY lead_id", 0},
+		{"DOWN 7th NEW", " ORDER BY lead_id", 0},
+		{"", " ORDER BY lead_id", 0},
+	}
+
+	for _, tt := range tests {
+		gotOrder, gotEvery := leadOrderBy(tt.order)
+		if gotOrder != tt.wantOrder || gotEvery != tt.wantEvery {
+			t.Errorf("leadOrderBy(%q) = %q, %d, want %q, %d", tt.order, gotOrder, gotEvery, tt.wantOrder, tt.wantEvery)
+		}
+	}
+}
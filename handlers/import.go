@@ -0,0 +1,735 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Import defaults and limits
+const (
+	importDefaultBatch = 500
+	importMaxBatch     = 2000
+	importDefaultErrs  = 1000
+)
+
+// importOptions configure a lead file import. The add_lead duplicate, DNC,
+// hopper and GMT options apply to every row.
+type importOptions struct {
+	leadAddOptions
+	Format    string                     `json:"format"`
+	Header    *bool                      `json:"header"`
+	Mapping   map[string]json.RawMessage `json:"mapping"`
+	Defaults  map[string]string          `json:"defaults"`
+	BatchSize int                        `json:"batch_size"`
+	MaxErrors int                        `json:"max_errors"`
+}
+
+// importError is one rejected row in the import report
+type importError struct {
+	Line  int    `json:"line"`
+	Check string `json:"check,omitempty"`
+	Error string `json:"error"`
+}
+
+// importResult is the import report
+type importResult struct {
+	ListID          int            `json:"list_id"`
+	RowsRead        int            `json:"rows_read"`
+	Inserted        int            `json:"inserted"`
+	Rejected        int            `json:"rejected"`
+	RejectedBy      map[string]int `json:"rejected_by"`
+	AddedToHopper   int            `json:"added_to_hopper"`
+	GMTUnresolved   int            `json:"gmt_unresolved"`
+	Errors          []importError  `json:"errors"`
+	ErrorsTruncated bool           `json:"errors_truncated"`
+	Cancelled       bool           `json:"cancelled,omitempty"`
+}
+
+// importRow is a parsed row waiting for its batch to be written
+type importRow struct {
+	line   int
+	lead   models.Lead
+	custom map[string]interface{}
+}
+
+// importColumn maps a file column to a standard or custom lead field
+type importColumn struct {
+	index  int
+	field  string
+	custom bool
+}
+
+// leadImporter streams rows from a file into vicidial_list in batches
+type leadImporter struct {
+	h            *Handler
+	opts         importOptions
+	listID       int
+	campaignID   string
+	hopper       bool
+	columns      []importColumn
+	fieldTypes   map[string]reflect.Type
+	resolver     *timezoneResolver
+	customFields *customFieldSet
+	result       importResult
+}
+
+// importReadOnly are lead fields an import cannot set
+var importReadOnly = map[string]bool{
+	"lead_id": true, "list_id": true, "entry_date": true, "modify_date": true,
+	"last_local_call_time": true,
+}
+
+// ImportLeads streams a CSV or TSV file into a list. The file is sent either
+// as the "file" part of a multipart upload, after an "options" JSON part, or
+// as the raw request body with the options JSON in the options parameter.
+func (h *Handler) ImportLeads(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listID, err := strconv.Atoi(vars["list_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid list ID")
+		return
+	}
+
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	var opts importOptions
+	var file io.Reader
+
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "multipart/") {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid multipart upload")
+			return
+		}
+		for file == nil {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid multipart upload")
+				return
+			}
+			switch part.FormName() {
+			case "options":
+				if err := json.NewDecoder(part).Decode(&opts); err != nil {
+					respondWithError(w, http.StatusBadRequest, "Invalid import options")
+					return
+				}
+			case "file":
+				file = part
+				name := strings.ToLower(part.FileName())
+				if opts.Format == "" && (strings.HasSuffix(name, ".tsv") || strings.HasSuffix(name, ".txt")) {
+					opts.Format = "tsv"
+				}
+			}
+		}
+	} else {
+		if raw := r.URL.Query().Get("options"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid import options")
+				return
+			}
+		}
+		file = r.Body
+		if opts.Format == "" && strings.Contains(contentType, "tab-separated") {
+			opts.Format = "tsv"
+		}
+	}
+
+	if file == nil {
+		respondWithError(w, http.StatusBadRequest, "No file uploaded")
+		return
+	}
+
+	imp, err := h.newLeadImporter(listID, opts)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := imp.run(r, file); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Import stopped: " + err.Error(),
+			Data:    imp.result,
+		})
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "LOAD",
+		RecordID: strconv.Itoa(listID),
+		Code:     "ADMIN API IMPORT LEADS",
+		After: map[string]interface{}{
+			"rows_read":   imp.result.RowsRead,
+			"inserted":    imp.result.Inserted,
+			"rejected_by": imp.result.RejectedBy,
+		},
+	})
+
+	respondWithSuccess(w, "Import complete", imp.result)
+}
+
+// newLeadImporter validates the options against the list
+func (h *Handler) newLeadImporter(listID int, opts importOptions) (*leadImporter, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.DuplicateAction != "REJECT" {
+		return nil, fmt.Errorf("duplicate_action UPDATE is not supported for imports")
+	}
+	if len(opts.CustomFields) > 0 {
+		return nil, fmt.Errorf("Use mapping to import custom fields")
+	}
+	opts.Format = strings.ToLower(opts.Format)
+	if opts.Format != "" && opts.Format != "csv" && opts.Format != "tsv" {
+		return nil, fmt.Errorf("format must be csv or tsv")
+	}
+	if len(opts.Mapping) == 0 {
+		return nil, fmt.Errorf("mapping is required")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = importDefaultBatch
+	}
+	if opts.BatchSize > importMaxBatch {
+		opts.BatchSize = importMaxBatch
+	}
+	if opts.MaxErrors <= 0 {
+		opts.MaxErrors = importDefaultErrs
+	}
+
+	imp := &leadImporter{
+		h:          h,
+		opts:       opts,
+		listID:     listID,
+		fieldTypes: modelFieldTypes(models.Lead{}),
+		resolver:   newTimezoneResolver(h.DB),
+		result: importResult{
+			ListID:     listID,
+			RejectedBy: map[string]int{},
+			Errors:     []importError{},
+		},
+	}
+
+	err := h.DB.QueryRow("SELECT campaign_id FROM vicidial_lists WHERE list_id = ?", listID).Scan(&imp.campaignID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("List not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	imp.customFields, err = h.loadCustomFields(listID)
+	if err != nil {
+		return nil, err
+	}
+
+	for field := range opts.Mapping {
+		_, standard := imp.fieldTypes[field]
+		switch {
+		case standard && importReadOnly[field]:
+			return nil, fmt.Errorf("Field %s cannot be imported", field)
+		case !standard && imp.customFields.Fields[field] == nil:
+			return nil, fmt.Errorf("Unknown field %s", field)
+		case !standard && !imp.customFields.Fields[field].stored():
+			return nil, fmt.Errorf("Custom field %s has no column in %s", field, imp.customFields.table())
+		}
+	}
+	for field := range opts.Defaults {
+		if _, ok := imp.fieldTypes[field]; !ok || importReadOnly[field] {
+			return nil, fmt.Errorf("Invalid default field %s", field)
+		}
+	}
+	if _, ok := opts.Mapping["phone_number"]; !ok {
+		return nil, fmt.Errorf("mapping must include phone_number")
+	}
+
+	if opts.AddToHopper == "Y" {
+		var active string
+		err := h.DB.QueryRow("SELECT active FROM vicidial_campaigns WHERE campaign_id = ?", imp.campaignID).Scan(&active)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		imp.hopper = active == "Y"
+	}
+
+	return imp, nil
+}
+
+// run reads the file and writes it batch by batch
+func (imp *leadImporter) run(r *http.Request, file io.Reader) error {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.ReuseRecord = true
+	if imp.opts.Format == "tsv" {
+		reader.Comma = '\t'
+	}
+
+	header := imp.opts.Header == nil || *imp.opts.Header
+	if header {
+		record, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("could not read header: %v", err)
+		}
+		if err := imp.mapColumns(record); err != nil {
+			return err
+		}
+	} else if err := imp.mapColumns(nil); err != nil {
+		return err
+	}
+
+	batch := make([]importRow, 0, imp.opts.BatchSize)
+	for {
+		if r.Context().Err() != nil {
+			imp.result.Cancelled = true
+			break
+		}
+
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A malformed row is rejected; anything else, such as a
+			// truncated upload, fails again on every read and stops the import
+			parseErr, ok := err.(*csv.ParseError)
+			if !ok {
+				return fmt.Errorf("could not read file: %v", err)
+			}
+			imp.result.RowsRead++
+			imp.reject(parseErr.StartLine, "INVALID", err.Error())
+			continue
+		}
+		imp.result.RowsRead++
+		line, _ := reader.FieldPos(0)
+
+		row, err := imp.parseRow(line, record)
+		if err != nil {
+			imp.reject(line, "INVALID", err.Error())
+			continue
+		}
+		batch = append(batch, row)
+
+		if len(batch) >= imp.opts.BatchSize {
+			if err := imp.flush(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	return imp.flush(batch)
+}
+
+// mapColumns resolves the mapping against the header row. Mapping values are
+// header names, or zero-based column numbers when there is no header.
+func (imp *leadImporter) mapColumns(header []string) error {
+	positions := map[string]int{}
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for field, raw := range imp.opts.Mapping {
+		var index int
+		var name string
+		if err := json.Unmarshal(raw, &index); err == nil {
+			if index < 0 {
+				return fmt.Errorf("Invalid column for %s", field)
+			}
+		} else if err := json.Unmarshal(raw, &name); err == nil {
+			pos, ok := positions[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				return fmt.Errorf("Column %s for %s not found in header", name, field)
+			}
+			index = pos
+		} else {
+			return fmt.Errorf("Invalid column for %s", field)
+		}
+
+		_, standard := imp.fieldTypes[field]
+		imp.columns = append(imp.columns, importColumn{index: index, field: field, custom: !standard})
+	}
+	return nil
+}
+
+// parseRow builds a lead from a record and validates it
+func (imp *leadImporter) parseRow(line int, record []string) (importRow, error) {
+	row := importRow{line: line}
+	row.lead.ListID = imp.listID
+
+	for field, value := range imp.opts.Defaults {
+		if err := setLeadField(&row.lead, field, value); err != nil {
+			return row, err
+		}
+	}
+
+	for _, col := range imp.columns {
+		value := ""
+		if col.index < len(record) {
+			value = strings.TrimSpace(record[col.index])
+		}
+		if col.custom {
+			checked, err := imp.customFields.Fields[col.field].check(value)
+			if err != nil {
+				return row, fmt.Errorf("Invalid value for custom field %s: %v", col.field, err)
+			}
+			if row.custom == nil {
+				row.custom = map[string]interface{}{}
+			}
+			row.custom[col.field] = checked
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		if err := setLeadField(&row.lead, col.field, value); err != nil {
+			return row, err
+		}
+	}
+
+	lead := &row.lead
+	if lead.PhoneNumber == "" {
+		return row, fmt.Errorf("phone_number is required")
+	}
+	if err := normalizeLeadPhones(lead); err != nil {
+		return row, err
+	}
+	if lead.Status == "" {
+		lead.Status = "NEW"
+	}
+	if lead.CountryCode == "" {
+		lead.CountryCode = "1"
+	}
+
+	v := reflect.ValueOf(*lead)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		validate, ok := leadPatchSpec.Validators[name]
+		if !ok || v.Field(i).IsZero() {
+			continue
+		}
+		if err := validate(v.Field(i).Interface()); err != nil {
+			return row, fmt.Errorf("Invalid value for %s: %v", name, err)
+		}
+	}
+
+	return row, nil
+}
+
+// setLeadField sets a lead field by its json name from a string value
+func setLeadField(lead *models.Lead, name, value string) error {
+	v := reflect.ValueOf(lead).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] != name {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s", name)
+			}
+			field.SetInt(int64(n))
+		default:
+			return fmt.Errorf("Field %s cannot be imported", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown field %s", name)
+}
+
+// reject records a rejected row in the report
+func (imp *leadImporter) reject(line int, check, message string) {
+	imp.result.Rejected++
+	imp.result.RejectedBy[check]++
+	if len(imp.result.Errors) >= imp.opts.MaxErrors {
+		imp.result.ErrorsTruncated = true
+		return
+	}
+	imp.result.Errors = append(imp.result.Errors, importError{Line: line, Check: check, Error: message})
+}
+
+// flush applies the DNC and duplicate checks to a batch and inserts the rest
+func (imp *leadImporter) flush(batch []importRow) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	rows, err := imp.filterDNC(batch)
+	if err != nil {
+		return err
+	}
+	rows, err = imp.filterDuplicates(rows)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	for i := range rows {
+		lead := &rows[i].lead
+		if lead.GmtOffsetNow != "" {
+			continue
+		}
+		zone, err := imp.resolver.resolve(leadGMTInput(lead), imp.opts.GMTLookupMethod)
+		if err != nil {
+			return err
+		}
+		lead.GmtOffsetNow = zone.GMTOffsetNow
+		if zone.Unresolved != "" {
+			imp.result.GMTUnresolved++
+		}
+	}
+
+	return imp.insert(rows)
+}
+
+// filterDNC drops rows whose phone number is on the system or campaign DNC list
+func (imp *leadImporter) filterDNC(batch []importRow) ([]importRow, error) {
+	phones := make([]string, len(batch))
+	for i, row := range batch {
+		phones[i] = row.lead.PhoneNumber
+	}
+	reasons, err := imp.h.dncListed(imp.opts.leadAddOptions, imp.campaignID, phones)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := batch[:0]
+	for _, row := range batch {
+		switch reasons[row.lead.PhoneNumber] {
+		case "DNC":
+			imp.reject(row.line, "DNC", "Phone number is on the DNC list")
+		case "CAMPDNC":
+			imp.reject(row.line, "CAMPDNC", "Phone number is on the campaign DNC list")
+		default:
+			kept = append(kept, row)
+		}
+	}
+	return kept, nil
+}
+
+// filterDuplicates drops rows matching existing leads or earlier rows in the batch
+func (imp *leadImporter) filterDuplicates(batch []importRow) ([]importRow, error) {
+	mode := imp.opts.DuplicateCheck
+	if mode == "" || len(batch) == 0 {
+		return batch, nil
+	}
+	check := duplicateChecks[mode]
+
+	firstValues := map[string]bool{}
+	for i := range batch {
+		firstValues[duplicateValues(mode, &batch[i].lead)[0]] = true
+	}
+
+	query := "SELECT " + strings.Join(check.Columns, ", ") + " FROM vicidial_list WHERE " + check.Columns[0] +
+		" IN (" + placeholders(len(firstValues)) + ")"
+	args := []interface{}{}
+	for value := range firstValues {
+		args = append(args, value)
+	}
+	switch check.Scope {
+	case "LIST":
+		query += " AND list_id = ?"
+		args = append(args, imp.listID)
+	case "CAMP":
+		query += " AND list_id IN (SELECT list_id FROM vicidial_lists WHERE campaign_id = ?)"
+		args = append(args, imp.campaignID)
+	}
+
+	rows, err := imp.h.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(check.Columns))
+		dest := make([]interface{}, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		key := make([]string, len(values))
+		for i, value := range values {
+			key[i] = value.String
+		}
+		existing[strings.Join(key, "\x00")] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	kept := batch[:0]
+	for _, row := range batch {
+		key := strings.Join(duplicateValues(mode, &row.lead), "\x00")
+		if existing[key] {
+			imp.reject(row.line, mode, "Duplicate lead found")
+			continue
+		}
+		existing[key] = true
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
+
+// insert writes the rows with one multi-row INSERT per table in a transaction
+func (imp *leadImporter) insert(rows []importRow) error {
+	tx, err := imp.h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*27)
+	for i := range rows {
+		values[i] = leadInsertRow
+		args = append(args, leadInsertArgs(&rows[i].lead)...)
+	}
+
+	result, err := tx.Exec("INSERT INTO vicidial_list ("+leadInsertColumns+") VALUES "+strings.Join(values, ", "), args...)
+	if err != nil {
+		return err
+	}
+
+	needIDs := imp.hopper
+	for _, row := range rows {
+		if len(row.custom) > 0 {
+			needIDs = true
+		}
+	}
+
+	if needIDs {
+		if err := assignInsertedIDs(tx, result, rows); err != nil {
+			return err
+		}
+		if err := imp.insertCustom(tx, rows); err != nil {
+			return err
+		}
+		if imp.hopper {
+			if err := imp.insertHopper(tx, rows); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	imp.result.Inserted += len(rows)
+	if imp.hopper {
+		imp.result.AddedToHopper += len(rows)
+	}
+	return nil
+}
+
+// assignInsertedIDs sets lead IDs after a multi-row insert. MySQL assigns
+// consecutive IDs to a single multi-row INSERT starting at LastInsertId; the
+// phone numbers are checked against the rows to make sure that held.
+func assignInsertedIDs(tx *sql.Tx, result sql.Result, rows []importRow) error {
+	firstID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	check, err := tx.Query("SELECT lead_id, phone_number FROM vicidial_list WHERE lead_id BETWEEN ? AND ? ORDER BY lead_id",
+		firstID, firstID+int64(len(rows))-1)
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+
+	i := 0
+	for check.Next() {
+		var leadID int
+		var phone string
+		if err := check.Scan(&leadID, &phone); err != nil {
+			return err
+		}
+		if i >= len(rows) || rows[i].lead.PhoneNumber != phone {
+			return fmt.Errorf("inserted lead IDs are not consecutive")
+		}
+		rows[i].lead.LeadID = leadID
+		i++
+	}
+	if i != len(rows) {
+		return fmt.Errorf("inserted lead IDs are not consecutive")
+	}
+	return check.Err()
+}
+
+// insertCustom writes the custom_<list_id> rows, grouped by the set of fields present
+func (imp *leadImporter) insertCustom(tx *sql.Tx, rows []importRow) error {
+	labels := []string{}
+	for _, col := range imp.columns {
+		if col.custom {
+			labels = append(labels, col.field)
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	columns := []string{"lead_id"}
+	for _, label := range labels {
+		columns = append(columns, "`"+label+"`")
+	}
+	row := "(" + placeholders(len(columns)) + ")"
+
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	for i, r := range rows {
+		values[i] = row
+		args = append(args, r.lead.LeadID)
+		for _, label := range labels {
+			args = append(args, r.custom[label])
+		}
+	}
+
+	_, err := tx.Exec("INSERT INTO custom_"+strconv.Itoa(imp.listID)+" ("+strings.Join(columns, ", ")+") VALUES "+
+		strings.Join(values, ", "), args...)
+	return err
+}
+
+// insertHopper queues the new leads the same way add_lead does
+func (imp *leadImporter) insertHopper(tx *sql.Tx, rows []importRow) error {
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*7)
+	for i, r := range rows {
+		values[i] = "(?, ?, 'READY', '', ?, ?, ?, 'NONE', ?, 'A', ?)"
+		args = append(args, r.lead.LeadID, imp.campaignID, r.lead.ListID, r.lead.GmtOffsetNow,
+			r.lead.State, imp.opts.HopperPriority, r.lead.VendorLeadCode)
+	}
+
+	_, err := tx.Exec(`INSERT INTO vicidial_hopper
+		(lead_id, campaign_id, status, user, list_id, gmt_offset_now, state, alt_dial, priority, source, vendor_lead_code)
+		VALUES `+strings.Join(values, ", "), args...)
+	return err
+}
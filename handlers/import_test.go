@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/middleware"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// newImportRouter routes lead imports through authentication and
+// authorization as main.go does, with the legacy key "secret"
+func newImportRouter(t *testing.T) (http.Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	h := &Handler{DB: db}
+
+	router := mux.NewRouter()
+	router.Use(middleware.AuthenticationMiddleware(middleware.AuthModeBoth, middleware.NewKeyStore(db, "secret"), nil))
+	router.HandleFunc("/lists/{list_id}/import", middleware.Authorize(middleware.ScopeLeadsWrite, "add_lead", h.ImportLeads)).Methods("POST")
+
+	// The list and its custom fields, of which it has none
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT campaign_id FROM vicidial_lists WHERE list_id = ?")).
+		WithArgs(101).WillReturnRows(sqlmock.NewRows([]string{"campaign_id"}).AddRow("SALES"))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vicidial_lists_fields WHERE list_id = ?")).
+		WithArgs(101).WillReturnRows(sqlmock.NewRows([]string{"field_label", "field_type", "field_options", "field_max"}))
+	return router, mock
+}
+
+func TestImportLeadsMultipart(t *testing.T) {
+	router, mock := newImportRouter(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_list (")).WillReturnResult(sqlmock.NewResult(500, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_admin_log")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	options, _ := form.CreateFormField("options")
+	options.Write([]byte(`{"mapping": {"phone_number": "phone", "gmt_offset_now": "gmt"}}`))
+	file, _ := form.CreateFormFile("file", "leads.csv")
+	file.Write([]byte("phone,gmt\n(212) 555-1234,-5.00\nnot a phone,-5.00\n"))
+	form.Close()
+
+	// The key is in a header, since the body is streamed to the handler
+	r := httptest.NewRequest("POST", "/lists/101/import", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("X-API-Key", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Data importResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	if got := response.Data; got.RowsRead != 2 || got.Inserted != 1 || got.RejectedBy["INVALID"] != 1 {
+		t.Errorf("result = %+v, want 2 rows read, 1 inserted and 1 rejected", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportLeadsStopsOnReadError(t *testing.T) {
+	router, mock := newImportRouter(t)
+
+	// A read error other than a malformed row repeats on every read
+	file := io.MultiReader(strings.NewReader("phone\n2125551234\n"), iotest.ErrReader(errors.New("connection reset")))
+	r := httptest.NewRequest("POST", `/lists/101/import?options={"mapping":{"phone_number":"phone"}}`, file)
+	r.Header.Set("Content-Type", "text/csv")
+	r.Header.Set("X-API-Key", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500, body %s", w.Code, w.Body)
+	}
+	var response models.APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	if !strings.Contains(response.Error, "could not read file: connection reset") {
+		t.Errorf("error = %q, want the read error", response.Error)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
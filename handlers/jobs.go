@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/middleware"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Job types run by the background job manager
+const (
+	jobTypeGMTRecompute   = "gmt_recompute"
+	jobTypeLeadBulkUpdate = "lead_bulk_update"
+	jobTypeLeadArchive    = "lead_archive"
+	jobTypeLeadDearchive  = "lead_dearchive"
+	jobTypeListClone      = "list_clone"
+	jobTypeListDelete     = "list_delete"
+)
+
+// registerJobs adds the handler's job types to the job manager
+func (h *Handler) registerJobs() {
+	if h.Jobs == nil {
+		return
+	}
+	h.Jobs.Register(jobTypeGMTRecompute, jobs.Definition{
+		Run:       h.runGMTRecompute,
+		Resumable: true,
+		Finished:  h.gmtRecomputeFinished,
+	})
+	h.Jobs.Register(jobTypeLeadBulkUpdate, jobs.Definition{
+		Run:       h.runLeadBulkUpdate,
+		Resumable: true,
+		Finished:  h.leadBulkUpdateFinished,
+	})
+	h.Jobs.Register(jobTypeLeadArchive, jobs.Definition{
+		Run:       h.runLeadArchive,
+		Resumable: true,
+		Finished:  h.leadArchiveFinished,
+	})
+	h.Jobs.Register(jobTypeLeadDearchive, jobs.Definition{
+		Run:       h.runLeadDearchive,
+		Resumable: true,
+		Finished:  h.leadDearchiveFinished,
+	})
+	h.Jobs.Register(jobTypeListClone, jobs.Definition{
+		Run:       h.runListClone,
+		Resumable: true,
+		Finished:  h.listCloneFinished,
+	})
+	h.Jobs.Register(jobTypeListDelete, jobs.Definition{
+		Run:       h.runListDelete,
+		Resumable: true,
+		Finished:  h.listDeleteFinished,
+	})
+}
+
+// submitJob queues a job for the caller and responds with 202 Accepted and
+// the job's status URL
+func (h *Handler) submitJob(w http.ResponseWriter, r *http.Request, jobType string, params interface{}, message string) {
+	actor := requestActor(r)
+	job, err := h.Jobs.Submit(jobType, params, jobs.Requester{
+		User:       actor.User,
+		UserGroup:  actor.UserGroup,
+		APIClient:  actor.APIClient,
+		OnBehalfOf: actor.OnBehalfOf,
+		IPAddress:  actor.IPAddress,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to queue job: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/jobs/"+strconv.FormatInt(job.JobID, 10))
+	respondWithJSON(w, http.StatusAccepted, models.APIResponse{
+		Success: true,
+		Message: message,
+		Data:    job,
+	})
+}
+
+// jobActor returns who submitted a job, for auditing its changes
+func jobActor(job models.Job) auditActor {
+	return auditActor{
+		User:       job.User,
+		UserGroup:  job.UserGroup,
+		APIClient:  job.APIClient,
+		OnBehalfOf: job.OnBehalfOf,
+		IPAddress:  job.IPAddress,
+	}
+}
+
+// jobAuditResult is what a finished job's audit entry records
+func jobAuditResult(job models.Job) map[string]interface{} {
+	after := map[string]interface{}{
+		"job_id": job.JobID,
+		"status": job.Status,
+	}
+	if job.Result != nil {
+		after["result"] = job.Result
+	}
+	if job.Error != "" {
+		after["error"] = job.Error
+	}
+	return after
+}
+
+// seesAllJobs reports whether the caller may see every job: level 9 users
+// and API keys with every scope
+func seesAllJobs(r *http.Request) bool {
+	if apiUser, ok := middleware.GetAPIUserFromContext(r.Context()); ok {
+		return apiUser.UserLevel >= 9
+	}
+	if apiKey, ok := middleware.GetAPIKeyFromContext(r.Context()); ok {
+		for _, scope := range apiKey.Scopes {
+			if scope == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canSeeJob reports whether the caller submitted the job or may see every job
+func canSeeJob(r *http.Request, job models.Job) bool {
+	if seesAllJobs(r) {
+		return true
+	}
+	if apiUser, ok := middleware.GetAPIUserFromContext(r.Context()); ok {
+		return job.User == apiUser.User
+	}
+	if apiKey, ok := middleware.GetAPIKeyFromContext(r.Context()); ok {
+		return job.APIClient == apiKey.ClientName
+	}
+	return false
+}
+
+// jobFromRequest loads the job named in the URL, responding 404 when it does
+// not exist or belongs to someone else
+func (h *Handler) jobFromRequest(w http.ResponseWriter, r *http.Request) (models.Job, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["job_id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid job ID")
+		return models.Job{}, false
+	}
+
+	job, err := h.Jobs.Get(id)
+	if err == jobs.ErrNotFound || (err == nil && !canSeeJob(r, job)) {
+		respondWithError(w, http.StatusNotFound, "Job not found")
+		return job, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve job: "+err.Error())
+		return job, false
+	}
+	return job, true
+}
+
+// ListJobs lists the caller's recent jobs
+func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := jobs.Filter{
+		Status:  strings.ToUpper(q.Get("status")),
+		JobType: q.Get("job_type"),
+		Limit:   100,
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 1000 {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+
+	// Restrict to the caller's own jobs unless it may see every job
+	if !seesAllJobs(r) {
+		if apiUser, ok := middleware.GetAPIUserFromContext(r.Context()); ok {
+			filter.User = apiUser.User
+		} else if apiKey, ok := middleware.GetAPIKeyFromContext(r.Context()); ok {
+			filter.APIClient = apiKey.ClientName
+		}
+	}
+
+	list, err := h.Jobs.List(filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve jobs: "+err.Error())
+		return
+	}
+
+	respondWithSuccess(w, "Jobs retrieved", list)
+}
+
+// GetJob returns a job's status, progress and, once finished, its result
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "Job retrieved", job)
+}
+
+// CancelJob cancels a queued job or asks a running one to stop
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.Jobs.Cancel(job.JobID)
+	if err == jobs.ErrFinished {
+		respondWithError(w, http.StatusConflict, "Job already finished with status "+job.Status)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel job: "+err.Error())
+		return
+	}
+
+	message := "Job cancelled"
+	if job.Status == jobs.StatusRunning {
+		message = "Job cancellation requested"
+	}
+	respondWithSuccess(w, message, job)
+}
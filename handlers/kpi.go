@@ -42,20 +42,27 @@ func (h *Handler) GetKPIDispositions(w http.ResponseWriter, r *http.Request) {
 		groupBy = "campaign" // Default to campaign grouping
 	}
 
+	if campaignID != "" && !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+	if listID != "" && !h.requireListAccess(w, r, listID) {
+		return
+	}
+
 	switch groupBy {
 	case "list":
-		h.getKPIByList(w, listID, campaignID, startDate, endDate)
+		h.getKPIByList(w, r, listID, campaignID, startDate, endDate)
 	case "campaign":
-		h.getKPIByCampaign(w, campaignID, startDate, endDate)
+		h.getKPIByCampaign(w, r, campaignID, startDate, endDate)
 	case "both":
-		h.getKPIBoth(w, campaignID, startDate, endDate)
+		h.getKPIBoth(w, r, campaignID, startDate, endDate)
 	default:
 		respondWithError(w, http.StatusBadRequest, "Invalid group_by parameter. Use 'list', 'campaign', or 'both'")
 	}
 }
 
 // getKPIByList retrieves dispositions grouped by list
-func (h *Handler) getKPIByList(w http.ResponseWriter, listID, campaignID, startDate, endDate string) {
+func (h *Handler) getKPIByList(w http.ResponseWriter, r *http.Request, listID, campaignID, startDate, endDate string) {
 	query := `
 		SELECT
 			vl.list_id,
@@ -87,6 +94,10 @@ func (h *Handler) getKPIByList(w http.ResponseWriter, listID, campaignID, startD
 		args = append(args, endDate)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "log.campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	query += `
 		GROUP BY vl.list_id, vl.list_name, log.status
 		ORDER BY vl.list_id, count DESC
@@ -144,7 +155,7 @@ func (h *Handler) getKPIByList(w http.ResponseWriter, listID, campaignID, startD
 }
 
 // getKPIByCampaign retrieves dispositions grouped by campaign
-func (h *Handler) getKPIByCampaign(w http.ResponseWriter, campaignID, startDate, endDate string) {
+func (h *Handler) getKPIByCampaign(w http.ResponseWriter, r *http.Request, campaignID, startDate, endDate string) {
 	query := `
 		SELECT
 			log.campaign_id,
@@ -172,6 +183,10 @@ func (h *Handler) getKPIByCampaign(w http.ResponseWriter, campaignID, startDate,
 		args = append(args, endDate)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "log.campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	query += `
 		GROUP BY log.campaign_id, vc.campaign_name, log.status
 		ORDER BY log.campaign_id, count DESC
@@ -228,7 +243,7 @@ func (h *Handler) getKPIByCampaign(w http.ResponseWriter, campaignID, startDate,
 }
 
 // getKPIBoth retrieves dispositions grouped by both campaign and list
-func (h *Handler) getKPIBoth(w http.ResponseWriter, campaignID, startDate, endDate string) {
+func (h *Handler) getKPIBoth(w http.ResponseWriter, r *http.Request, campaignID, startDate, endDate string) {
 	query := `
 		SELECT
 			log.campaign_id,
@@ -259,6 +274,10 @@ func (h *Handler) getKPIBoth(w http.ResponseWriter, campaignID, startDate, endDa
 		args = append(args, endDate)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "log.campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	query += `
 		GROUP BY log.campaign_id, vc.campaign_name, log.list_id, vl.list_name, log.status
 		ORDER BY log.campaign_id, log.list_id, count DESC
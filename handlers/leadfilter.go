@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterKind is how a filtered field's values are parsed and compared
+type filterKind int
+
+const (
+	filterString filterKind = iota
+	filterInt
+	filterNumber
+	filterDate
+	filterDateTime
+)
+
+// leadFilterFields are the vicidial_list columns a lead filter may use.
+// security_phrase is deliberately absent.
+var leadFilterFields = map[string]filterKind{
+	"lead_id":                 filterInt,
+	"list_id":                 filterInt,
+	"entry_list_id":           filterInt,
+	"entry_date":              filterDateTime,
+	"modify_date":             filterDateTime,
+	"last_local_call_time":    filterDateTime,
+	"status":                  filterString,
+	"user":                    filterString,
+	"vendor_lead_code":        filterString,
+	"source_id":               filterString,
+	"gmt_offset_now":          filterNumber,
+	"called_since_last_reset": filterString,
+	"phone_code":              filterString,
+	"phone_number":            filterString,
+	"title":                   filterString,
+	"first_name":              filterString,
+	"middle_initial":          filterString,
+	"last_name":               filterString,
+	"address1":                filterString,
+	"address2":                filterString,
+	"address3":                filterString,
+	"city":                    filterString,
+	"state":                   filterString,
+	"province":                filterString,
+	"postal_code":             filterString,
+	"country_code":            filterString,
+	"gender":                  filterString,
+	"date_of_birth":           filterDate,
+	"alt_phone":               filterString,
+	"email":                   filterString,
+	"comments":                filterString,
+	"called_count":            filterInt,
+	"rank":                    filterInt,
+	"owner":                   filterString,
+}
+
+// Limits on a single lead filter
+const (
+	maxFilterClauses = 20
+	maxFilterValues  = 1000
+)
+
+// filterClause is one parsed comparison, such as state in (CA,TX)
+type filterClause struct {
+	Field  string
+	Op     string // =, !=, >, >=, <, <=, ^=, in, not in, between, is null, is not null
+	Values []string
+}
+
+var (
+	filterFieldPattern   = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z0-9_]+)?)\s*(.*?)\s*$`)
+	filterIsNullPattern  = regexp.MustCompile(`(?i)^is\s+(not\s+)?null$`)
+	filterInPattern      = regexp.MustCompile(`(?i)^(not\s+)?in\s*\((.*)\)$`)
+	filterBetweenPattern = regexp.MustCompile(`(?i)^between\s+(.+?)\s+and\s+(.+)$`)
+	filterOpPattern      = regexp.MustCompile(`^(>=|<=|!=|<>|\^=|=|>|<)\s*(.*)$`)
+	filterRelativeTime   = regexp.MustCompile(`^(now|today)(?:([+-])(\d+)([mhdw]))?$`)
+)
+
+// splitFilter splits s on sep, ignoring separators inside double quotes
+func splitFilter(s string, sep rune) []string {
+	var parts []string
+	var current strings.Builder
+	quoted := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			current.WriteRune(c)
+		case c == sep && !quoted:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	return append(parts, current.String())
+}
+
+// unquoteFilterValue trims a value and removes its surrounding double quotes
+func unquoteFilterValue(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parseFilterClause parses one comparison
+func parseFilterClause(text string) (filterClause, error) {
+	m := filterFieldPattern.FindStringSubmatch(text)
+	if m == nil {
+		return filterClause{}, fmt.Errorf("Invalid filter %q", strings.TrimSpace(text))
+	}
+	clause := filterClause{Field: m[1]}
+	rest := m[2]
+
+	if sub := filterIsNullPattern.FindStringSubmatch(rest); sub != nil {
+		clause.Op = "is null"
+		if sub[1] != "" {
+			clause.Op = "is not null"
+		}
+		return clause, nil
+	}
+	if sub := filterInPattern.FindStringSubmatch(rest); sub != nil {
+		clause.Op = "in"
+		if sub[1] != "" {
+			clause.Op = "not in"
+		}
+		for _, value := range splitFilter(sub[2], ',') {
+			clause.Values = append(clause.Values, unquoteFilterValue(value))
+		}
+		if len(clause.Values) > maxFilterValues {
+			return clause, fmt.Errorf("Filter on %s has more than %d values", clause.Field, maxFilterValues)
+		}
+		return clause, nil
+	}
+	if sub := filterBetweenPattern.FindStringSubmatch(rest); sub != nil {
+		clause.Op = "between"
+		clause.Values = []string{unquoteFilterValue(sub[1]), unquoteFilterValue(sub[2])}
+		return clause, nil
+	}
+	if sub := filterOpPattern.FindStringSubmatch(rest); sub != nil {
+		clause.Op = sub[1]
+		if clause.Op == "<>" {
+			clause.Op = "!="
+		}
+		clause.Values = []string{unquoteFilterValue(sub[2])}
+		return clause, nil
+	}
+	return clause, fmt.Errorf("Invalid filter %q", strings.TrimSpace(text))
+}
+
+// filterTime parses a date or time filter value and returns the first and
+// last second it covers. A date alone covers the whole day; now and today
+// may be offset, as in now-30d or today+1w.
+func filterTime(value string, kind filterKind) (string, string, error) {
+	if m := filterRelativeTime.FindStringSubmatch(strings.ToLower(value)); m != nil {
+		t := time.Now()
+		if m[1] == "today" {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		}
+		if m[2] != "" {
+			n, _ := strconv.Atoi(m[3])
+			if m[2] == "-" {
+				n = -n
+			}
+			switch m[4] {
+			case "m":
+				t = t.Add(time.Duration(n) * time.Minute)
+			case "h":
+				t = t.Add(time.Duration(n) * time.Hour)
+			case "d":
+				t = t.AddDate(0, 0, n)
+			case "w":
+				t = t.AddDate(0, 0, 7*n)
+			}
+		}
+		if m[1] == "today" || kind == filterDate {
+			return dayRange(t, kind)
+		}
+		return t.Format("2006-01-02 15:04:05"), t.Format("2006-01-02 15:04:05"), nil
+	}
+
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return dayRange(t, kind)
+	}
+	if kind == filterDateTime {
+		for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.Format("2006-01-02 15:04:05"), t.Format("2006-01-02 15:04:05"), nil
+			}
+		}
+		return "", "", fmt.Errorf("invalid date %q, use YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or now-30d", value)
+	}
+	return "", "", fmt.Errorf("invalid date %q, use YYYY-MM-DD or today-30d", value)
+}
+
+func dayRange(t time.Time, kind filterKind) (string, string, error) {
+	if kind == filterDate {
+		return t.Format("2006-01-02"), t.Format("2006-01-02"), nil
+	}
+	return t.Format("2006-01-02") + " 00:00:00", t.Format("2006-01-02") + " 23:59:59", nil
+}
+
+// filterRange returns the first and last value a filter value covers
+func filterRange(value string, kind filterKind) (string, string, error) {
+	switch kind {
+	case filterInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", "", fmt.Errorf("%q is not a whole number", value)
+		}
+	case filterNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", "", fmt.Errorf("%q is not a number", value)
+		}
+	case filterDate, filterDateTime:
+		return filterTime(value, kind)
+	}
+	return value, value, nil
+}
+
+// escapeLike escapes LIKE wildcards so a prefix matches literally
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// filterCondition builds the SQL for one clause on column. Conditions
+// compare the bare column so MySQL can use its indexes.
+func filterCondition(column string, kind filterKind, clause filterClause) (string, []interface{}, error) {
+	switch clause.Op {
+	case "is null":
+		if kind == filterString {
+			return "(" + column + " IS NULL OR " + column + " = '')", nil, nil
+		}
+		return column + " IS NULL", nil, nil
+	case "is not null":
+		if kind == filterString {
+			return "(" + column + " IS NOT NULL AND " + column + " != '')", nil, nil
+		}
+		return column + " IS NOT NULL", nil, nil
+	case "^=":
+		if kind != filterString {
+			return "", nil, fmt.Errorf("prefix match only works on text fields")
+		}
+		if clause.Values[0] == "" {
+			return "", nil, fmt.Errorf("prefix is empty")
+		}
+		return column + " LIKE ?", []interface{}{escapeLike(clause.Values[0]) + "%"}, nil
+	case "in", "not in":
+		args := make([]interface{}, 0, len(clause.Values))
+		var ranges []string
+		for _, value := range clause.Values {
+			first, last, err := filterRange(value, kind)
+			if err != nil {
+				return "", nil, err
+			}
+			if first != last {
+				// A whole day among datetime values
+				ranges = append(ranges, "("+column+" BETWEEN ? AND ?)")
+				args = append(args, first, last)
+				continue
+			}
+			ranges = append(ranges, column+" = ?")
+			args = append(args, first)
+		}
+		condition := "(" + strings.Join(ranges, " OR ") + ")"
+		if len(ranges) == len(args) {
+			condition = column + " IN (" + placeholders(len(args)) + ")"
+		}
+		if clause.Op == "not in" {
+			return "NOT " + condition, args, nil
+		}
+		return condition, args, nil
+	case "between":
+		first, _, err := filterRange(clause.Values[0], kind)
+		if err != nil {
+			return "", nil, err
+		}
+		_, last, err := filterRange(clause.Values[1], kind)
+		if err != nil {
+			return "", nil, err
+		}
+		return column + " BETWEEN ? AND ?", []interface{}{first, last}, nil
+	}
+
+	first, last, err := filterRange(clause.Values[0], kind)
+	if err != nil {
+		return "", nil, err
+	}
+	switch clause.Op {
+	case "=":
+		if first != last {
+			return column + " BETWEEN ? AND ?", []interface{}{first, last}, nil
+		}
+		return column + " = ?", []interface{}{first}, nil
+	case "!=":
+		if first != last {
+			return "NOT (" + column + " BETWEEN ? AND ?)", []interface{}{first, last}, nil
+		}
+		return column + " != ?", []interface{}{first}, nil
+	case ">":
+		return column + " > ?", []interface{}{last}, nil
+	case ">=":
+		return column + " >= ?", []interface{}{first}, nil
+	case "<":
+		return column + " < ?", []interface{}{first}, nil
+	case "<=":
+		return column + " <= ?", []interface{}{last}, nil
+	}
+	return "", nil, fmt.Errorf("unknown operator %s", clause.Op)
+}
+
+// negatedFilterOps maps the operators that match the absence of a value to
+// their opposites
+var negatedFilterOps = map[string]string{
+	"is null": "is not null",
+	"!=":      "=",
+	"not in":  "in",
+}
+
+// leadFilter is a compiled lead filter, ready to append to a query on
+// vicidial_list
+type leadFilter struct {
+	Where  string // " AND ..." conditions, empty when there are none
+	Args   []interface{}
+	ListID int  // the single list the filter is limited to, 0 when not limited
+	Custom bool // whether the filter uses custom fields
+}
+
+// parseLeadFilter compiles filter expressions, each a list of clauses
+// separated by semicolons, into conditions on vicidial_list. Custom fields
+// are named custom.<label> and need the filter limited to one list, either
+// by a list_id= clause or by listID.
+func (h *Handler) parseLeadFilter(expressions []string, listID int) (*leadFilter, error) {
+	var clauses []filterClause
+	for _, expression := range expressions {
+		for _, text := range splitFilter(expression, ';') {
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			clause, err := parseFilterClause(text)
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+	if len(clauses) > maxFilterClauses {
+		return nil, fmt.Errorf("Filter has more than %d clauses", maxFilterClauses)
+	}
+
+	filter := &leadFilter{ListID: listID}
+	for _, clause := range clauses {
+		if clause.Field == "list_id" && clause.Op == "=" {
+			id, err := strconv.Atoi(clause.Values[0])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter on list_id: %q is not a whole number", clause.Values[0])
+			}
+			if filter.ListID != 0 && filter.ListID != id {
+				return nil, fmt.Errorf("Filter names more than one list_id")
+			}
+			filter.ListID = id
+		}
+	}
+
+	var customFields *customFieldSet
+	var conditions []string
+	for _, clause := range clauses {
+		if !strings.HasPrefix(clause.Field, "custom.") {
+			kind, ok := leadFilterFields[clause.Field]
+			if !ok {
+				return nil, fmt.Errorf("Field %s cannot be filtered", clause.Field)
+			}
+			condition, args, err := filterCondition("`"+clause.Field+"`", kind, clause)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter on %s: %v", clause.Field, err)
+			}
+			conditions = append(conditions, condition)
+			filter.Args = append(filter.Args, args...)
+			continue
+		}
+
+		label := strings.TrimPrefix(clause.Field, "custom.")
+		filter.Custom = true
+		if filter.ListID == 0 {
+			return nil, fmt.Errorf("Filtering on %s needs a single list_id", clause.Field)
+		}
+		if customFields == nil {
+			set, err := h.loadCustomFields(filter.ListID)
+			if err != nil {
+				return nil, err
+			}
+			customFields = set
+		}
+		field, ok := customFields.Fields[label]
+		if !ok || !field.stored() {
+			return nil, fmt.Errorf("Field %s is not a custom field of list %d", clause.Field, filter.ListID)
+		}
+
+		kind := filterString
+		switch {
+		case field.Type == "DATE" || field.DataType == "date":
+			kind = filterDate
+		case field.DataType == "datetime" || field.DataType == "timestamp":
+			kind = filterDateTime
+		case field.numeric():
+			kind = filterNumber
+		}
+
+		// Leads without a custom row have no value, so null tests and
+		// negations look for the rows that do match and exclude them
+		column := "`" + label + "`"
+		subquery := "SELECT lead_id FROM " + customFields.table() + " WHERE "
+		var condition string
+		var args []interface{}
+		var err error
+		if negated, ok := negatedFilterOps[clause.Op]; ok {
+			clause.Op = negated
+			condition, args, err = filterCondition(column, kind, clause)
+			condition = "lead_id NOT IN (" + subquery + condition + ")"
+		} else {
+			condition, args, err = filterCondition(column, kind, clause)
+			condition = "lead_id IN (" + subquery + condition + ")"
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter on %s: %v", clause.Field, err)
+		}
+		conditions = append(conditions, condition)
+		filter.Args = append(filter.Args, args...)
+	}
+
+	if filter.ListID != 0 {
+		conditions = append(conditions, "list_id = ?")
+		filter.Args = append(filter.Args, filter.ListID)
+	}
+	if len(conditions) > 0 {
+		filter.Where = " AND " + strings.Join(conditions, " AND ")
+	}
+	return filter, nil
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testCustomField is a vicidial_lists_fields row and its custom_<list_id> column
+type testCustomField struct {
+	Label, Type, Options string
+	Max                  int
+	DataType             string
+	ColumnMax            int
+}
+
+// newCustomFieldsHandler returns a handler whose database serves the given
+// custom fields of a list to loadCustomFields
+func newCustomFieldsHandler(t *testing.T, listID int, fields ...testCustomField) (*Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	definitions := sqlmock.NewRows([]string{"field_label", "field_type", "field_options", "field_max"})
+	columns := sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE", "CHARACTER_MAXIMUM_LENGTH"}).
+		AddRow("lead_id", "int", 0)
+	for _, field := range fields {
+		definitions.AddRow(field.Label, field.Type, field.Options, field.Max)
+		if field.DataType != "" {
+			columns.AddRow(field.Label, field.DataType, field.ColumnMax)
+		}
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vicidial_lists_fields WHERE list_id = ?")).
+		WithArgs(listID).WillReturnRows(definitions)
+	if len(fields) > 0 {
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+			WithArgs("custom_" + strconv.Itoa(listID)).WillReturnRows(columns)
+	}
+	return &Handler{DB: db}, mock
+}
+
+func TestParseLeadFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		expressions []string
+		listID      int
+		wantWhere   string
+		wantArgs    []interface{}
+		wantListID  int
+	}{
+		{
+			name:        "equals",
+			expressions: []string{"status=NEW"},
+			wantWhere:   " AND `status` = ?",
+			wantArgs:    []interface{}{"NEW"},
+		},
+		{
+			name:        "clauses across expressions",
+			expressions: []string{"state in (CA,TX)", "called_count>3"},
+			wantWhere:   " AND `state` IN (?,?) AND `called_count` > ?",
+			wantArgs:    []interface{}{"CA", "TX", "3"},
+		},
+		{
+			name:        "quoted values",
+			expressions: []string{`state not in (CA,"A,B");comments="x;y"`},
+			wantWhere:   " AND NOT `state` IN (?,?) AND `comments` = ?",
+			wantArgs:    []interface{}{"CA", "A,B", "x;y"},
+		},
+		{
+			name:        "prefix escapes wildcards",
+			expressions: []string{"phone_number^=31_%"},
+			wantWhere:   " AND `phone_number` LIKE ?",
+			wantArgs:    []interface{}{`31\_\%%`},
+		},
+		{
+			name:        "text is null matches empty",
+			expressions: []string{"email is null; owner is not null"},
+			wantWhere:   " AND (`email` IS NULL OR `email` = '') AND (`owner` IS NOT NULL AND `owner` != '')",
+		},
+		{
+			name:        "date covers the whole day",
+			expressions: []string{"entry_date=2025-01-02"},
+			wantWhere:   " AND `entry_date` BETWEEN ? AND ?",
+			wantArgs:    []interface{}{"2025-01-02 00:00:00", "2025-01-02 23:59:59"},
+		},
+		{
+			name:        "days and times in a list",
+			expressions: []string{"modify_date in (2025-01-02, 2025-01-03 10:00:00)"},
+			wantWhere:   " AND ((`modify_date` BETWEEN ? AND ?) OR `modify_date` = ?)",
+			wantArgs:    []interface{}{"2025-01-02 00:00:00", "2025-01-02 23:59:59", "2025-01-03 10:00:00"},
+		},
+		{
+			name:        "not equal to a day",
+			expressions: []string{"entry_date!=2025-01-02"},
+			wantWhere:   " AND NOT (`entry_date` BETWEEN ? AND ?)",
+			wantArgs:    []interface{}{"2025-01-02 00:00:00", "2025-01-02 23:59:59"},
+		},
+		{
+			name:        "between dates",
+			expressions: []string{"date_of_birth between 1980-01-01 and 1989-12-31"},
+			wantWhere:   " AND `date_of_birth` BETWEEN ? AND ?",
+			wantArgs:    []interface{}{"1980-01-01", "1989-12-31"},
+		},
+		{
+			name:        "greater than a day starts after it",
+			expressions: []string{"last_local_call_time>2025-01-02"},
+			wantWhere:   " AND `last_local_call_time` > ?",
+			wantArgs:    []interface{}{"2025-01-02 23:59:59"},
+		},
+		{
+			name:        "list_id clause limits the filter",
+			expressions: []string{"list_id=101;status<>DNC"},
+			wantWhere:   " AND `list_id` = ? AND `status` != ? AND list_id = ?",
+			wantArgs:    []interface{}{"101", "DNC", 101},
+			wantListID:  101,
+		},
+		{
+			name:        "list from the caller",
+			expressions: []string{"rank>=2"},
+			listID:      101,
+			wantWhere:   " AND `rank` >= ? AND list_id = ?",
+			wantArgs:    []interface{}{"2", 101},
+			wantListID:  101,
+		},
+		{
+			name:        "empty filter",
+			expressions: []string{"", " ; "},
+		},
+	}
+
+	h := &Handler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := h.parseLeadFilter(tt.expressions, tt.listID)
+			if err != nil {
+				t.Fatalf("parseLeadFilter: %v", err)
+			}
+			if filter.Where != tt.wantWhere {
+				t.Errorf("Where = %q, want %q", filter.Where, tt.wantWhere)
+			}
+			if len(filter.Args) != 0 || len(tt.wantArgs) != 0 {
+				if !reflect.DeepEqual(filter.Args, tt.wantArgs) {
+					t.Errorf("Args = %#v, want %#v", filter.Args, tt.wantArgs)
+				}
+			}
+			if filter.ListID != tt.wantListID {
+				t.Errorf("ListID = %d, want %d", filter.ListID, tt.wantListID)
+			}
+			if filter.Custom {
+				t.Error("Custom = true for a filter on standard fields")
+			}
+		})
+	}
+}
+
+func TestParseLeadFilterErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		listID     int
+		wantErr    string
+	}{
+		{"unfilterable field", "security_phrase=x", 0, "Field security_phrase cannot be filtered"},
+		{"unknown field", "colour=red", 0, "Field colour cannot be filtered"},
+		{"missing operator", "status", 0, `Invalid filter "status"`},
+		{"not a number", "called_count>abc", 0, `Invalid filter on called_count: "abc" is not a whole number`},
+		{"bad date", "entry_date<2025-13-01", 0, "Invalid filter on entry_date: invalid date"},
+		{"prefix on a number", "called_count^=1", 0, "prefix match only works on text fields"},
+		{"two lists", "list_id=101;list_id=102", 0, "Filter names more than one list_id"},
+		{"list differs from caller's", "list_id=102", 101, "Filter names more than one list_id"},
+		{"custom field without a list", "custom.color=red", 0, "Filtering on custom.color needs a single list_id"},
+		{"too many clauses", strings.Repeat("status=NEW;", maxFilterClauses+1), 0, "Filter has more than 20 clauses"},
+		{"too many values", "lead_id in (" + strings.TrimSuffix(strings.Repeat("1,", maxFilterValues+1), ",") + ")", 0, "Filter on lead_id has more than 1000 values"},
+	}
+
+	h := &Handler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.parseLeadFilter([]string{tt.expression}, tt.listID)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseLeadFilter(%q) error = %v, want %q", tt.expression, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseLeadFilterCustomFields(t *testing.T) {
+	fields := []testCustomField{
+		{Label: "color", Type: "SELECT", Options: "red,blue", Max: 10, DataType: "varchar", ColumnMax: 10},
+		{Label: "score", Type: "TEXT", Max: 5, DataType: "int"},
+		{Label: "notice", Type: "DISPLAY"},
+	}
+	in := " AND lead_id IN (SELECT lead_id FROM custom_101 WHERE "
+	notIn := " AND lead_id NOT IN (SELECT lead_id FROM custom_101 WHERE "
+
+	tests := []struct {
+		name       string
+		expression string
+		wantWhere  string
+		wantArgs   []interface{}
+		wantErr    string
+	}{
+		{
+			name:       "equals",
+			expression: "custom.color=red",
+			wantWhere:  in + "`color` = ?) AND list_id = ?",
+			wantArgs:   []interface{}{"red", 101},
+		},
+		{
+			name:       "numeric column",
+			expression: "custom.score>5",
+			wantWhere:  in + "`score` > ?) AND list_id = ?",
+			wantArgs:   []interface{}{"5", 101},
+		},
+		{
+			name:       "not equal excludes matching rows",
+			expression: "custom.color!=red",
+			wantWhere:  notIn + "`color` = ?) AND list_id = ?",
+			wantArgs:   []interface{}{"red", 101},
+		},
+		{
+			name:       "not in excludes matching rows",
+			expression: "custom.color not in (red,blue)",
+			wantWhere:  notIn + "`color` IN (?,?)) AND list_id = ?",
+			wantArgs:   []interface{}{"red", "blue", 101},
+		},
+		{
+			name:       "is null excludes rows with a value",
+			expression: "custom.color is null",
+			wantWhere:  notIn + "(`color` IS NOT NULL AND `color` != '')) AND list_id = ?",
+			wantArgs:   []interface{}{101},
+		},
+		{
+			name:       "is not null",
+			expression: "custom.score is not null",
+			wantWhere:  in + "`score` IS NOT NULL) AND list_id = ?",
+			wantArgs:   []interface{}{101},
+		},
+		{
+			name:       "not a number",
+			expression: "custom.score=high",
+			wantErr:    `Invalid filter on custom.score: "high" is not a number`,
+		},
+		{
+			name:       "field without a column",
+			expression: "custom.notice=x",
+			wantErr:    "Field custom.notice is not a custom field of list 101",
+		},
+		{
+			name:       "unknown field",
+			expression: "custom.size=L",
+			wantErr:    "Field custom.size is not a custom field of list 101",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newCustomFieldsHandler(t, 101, fields...)
+			filter, err := h.parseLeadFilter([]string{"list_id=101", tt.expression}, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLeadFilter: %v", err)
+			}
+
+			wantWhere := " AND `list_id` = ?" + tt.wantWhere
+			wantArgs := append([]interface{}{"101"}, tt.wantArgs...)
+			if filter.Where != wantWhere {
+				t.Errorf("Where = %q, want %q", filter.Where, wantWhere)
+			}
+			if !reflect.DeepEqual(filter.Args, wantArgs) {
+				t.Errorf("Args = %#v, want %#v", filter.Args, wantArgs)
+			}
+			if !filter.Custom {
+				t.Error("Custom = false for a filter on a custom field")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
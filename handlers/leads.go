@@ -3,8 +3,11 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,13 +15,20 @@ import (
 	"github.com/vicidb/non-agent-api/models"
 )
 
-// AddLead adds a new lead to the system
+// AddLead adds a new lead to the system. Like the PHP add_lead it can reject
+// or merge duplicates, check DNC lists, look up the GMT offset, write custom
+// fields and queue the lead in the hopper.
 func (h *Handler) AddLead(w http.ResponseWriter, r *http.Request) {
-	var lead models.Lead
-	if err := json.NewDecoder(r.Body).Decode(&lead); err != nil {
+	var req struct {
+		models.Lead
+		leadAddOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	lead := req.Lead
+	opts := req.leadAddOptions
 
 	// Validate required fields
 	if lead.PhoneNumber == "" || lead.ListID == 0 {
@@ -26,7 +36,76 @@ func (h *Handler) AddLead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set default values
+	if err := opts.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := normalizeLeadPhones(&lead); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !h.requireListAccess(w, r, lead.ListID) {
+		return
+	}
+
+	var campaignID string
+	err := h.DB.QueryRow("SELECT campaign_id FROM vicidial_lists WHERE list_id = ?", lead.ListID).Scan(&campaignID)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve list: "+err.Error())
+		return
+	}
+
+	if len(opts.CustomFields) > 0 {
+		set, err := h.loadCustomFields(lead.ListID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve custom fields: "+err.Error())
+			return
+		}
+		opts.CustomFields, err = set.normalize(opts.CustomFields)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	result := models.LeadAddResult{}
+
+	dncCheck, err := h.checkLeadDNC(opts, lead.PhoneNumber, campaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check DNC: "+err.Error())
+		return
+	}
+	if dncCheck != "" {
+		result.Result = leadRejected
+		result.Check = dncCheck
+		result.Reason = "Phone number is on the DNC list"
+		respondWithJSON(w, http.StatusConflict, models.APIResponse{Success: false, Error: "Lead rejected by " + dncCheck + " check", Data: result})
+		return
+	}
+
+	if opts.DuplicateCheck != "" {
+		existingID, err := h.findDuplicateLead(opts.DuplicateCheck, &lead, campaignID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check duplicates: "+err.Error())
+			return
+		}
+		if existingID != 0 {
+			result.Check = opts.DuplicateCheck
+			result.ExistingLeadID = existingID
+			if opts.DuplicateAction != "UPDATE" {
+				result.Result = leadRejected
+				result.Reason = "Duplicate lead found"
+				respondWithJSON(w, http.StatusConflict, models.APIResponse{Success: false, Error: "Lead rejected by " + opts.DuplicateCheck + " check", Data: result})
+				return
+			}
+			h.mergeDuplicateLead(w, r, &lead, opts, result)
+			return
+		}
+	}
+
+	// Defaults apply to new leads only, so a merge never overwrites the
+	// duplicate's values with them
 	if lead.Status == "" {
 		lead.Status = "NEW"
 	}
@@ -34,34 +113,148 @@ func (h *Handler) AddLead(w http.ResponseWriter, r *http.Request) {
 		lead.CountryCode = "1"
 	}
 
-	query := `
-		INSERT INTO vicidial_list (
-			list_id, phone_number, first_name, last_name, middle_initial,
-			address1, address2, address3, city, state, province, postal_code,
-			country_code, gender, date_of_birth, alt_phone, email, security,
-			comments, status, entry_date, modify_date, rank, owner
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW(), ?, ?)
-	`
+	if lead.GmtOffsetNow == "" {
+		zone, err := newTimezoneResolver(h.DB).resolve(leadGMTInput(&lead), opts.GMTLookupMethod)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up GMT offset: "+err.Error())
+			return
+		}
+		lead.GmtOffsetNow = zone.GMTOffsetNow
+		result.GmtUnresolved = zone.Unresolved
+	}
 
-	result, err := h.DB.Exec(query,
-		lead.ListID, lead.PhoneNumber, lead.FirstName, lead.LastName, lead.MiddleInitial,
-		lead.Address1, lead.Address2, lead.Address3, lead.City, lead.State, lead.Province,
-		lead.PostalCode, lead.CountryCode, lead.Gender, lead.DateOfBirth, lead.AltPhone,
-		lead.Email, lead.Security, lead.Comments, lead.Status, lead.Rank, lead.Owner,
-	)
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
 
+	leadID, query, args, err := insertLead(tx, &lead)
 	if err != nil {
+		tx.Rollback()
+		respondWithError(w, http.StatusInternalServerError, "Failed to add lead: "+err.Error())
+		return
+	}
+	lead.LeadID = leadID
+
+	if err := writeCustomFields(tx, lead.ListID, lead.LeadID, opts.CustomFields); err != nil {
+		tx.Rollback()
+		respondWithError(w, http.StatusInternalServerError, "Failed to write custom fields: "+err.Error())
+		return
+	}
+
+	if opts.AddToHopper == "Y" {
+		result.Hopper, err = h.addLeadToHopper(tx, &lead, campaignID, opts.HopperPriority)
+		if err != nil {
+			tx.Rollback()
+			respondWithError(w, http.StatusInternalServerError, "Failed to add lead to hopper: "+err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to add lead: "+err.Error())
 		return
 	}
 
-	leadID, _ := result.LastInsertId()
-	lead.LeadID = int(leadID)
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "ADD",
+		RecordID: strconv.Itoa(lead.LeadID),
+		Code:     "ADMIN API ADD LEAD",
+		SQL:      query,
+		Args:     args,
+		After:    h.snapshotRow("vicidial_list", "lead_id", lead.LeadID),
+	})
+
+	result.Result = leadAdded
+	result.LeadID = lead.LeadID
+	result.GmtOffsetNow = lead.GmtOffsetNow
+
+	respondWithSuccess(w, "Lead added successfully", result)
+}
+
+// mergeDuplicateLead updates the duplicate found by duplicate_check with the
+// posted fields, for add_lead requests with duplicate_action=UPDATE
+func (h *Handler) mergeDuplicateLead(w http.ResponseWriter, r *http.Request, lead *models.Lead, opts leadAddOptions, result models.LeadAddResult) {
+	existingID := result.ExistingLeadID
+	if !h.requireLeadAccess(w, r, existingID) {
+		return
+	}
+
+	var existingListID int
+	if err := h.DB.QueryRow("SELECT list_id FROM vicidial_list WHERE lead_id = ?", existingID).Scan(&existingListID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lead: "+err.Error())
+		return
+	}
+
+	fields := leadMergeFields(lead)
+	query, args := buildPatchQuery(leadPatchSpec, fields, existingID)
+	before := h.snapshotRow("vicidial_list", "lead_id", existingID)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+
+	if _, err := tx.Exec(query, args...); err != nil {
+		tx.Rollback()
+		respondWithError(w, http.StatusInternalServerError, "Failed to update lead: "+err.Error())
+		return
+	}
+
+	// Custom fields only carry over when the duplicate is in the same list
+	if existingListID == lead.ListID {
+		if err := writeCustomFields(tx, existingListID, existingID, opts.CustomFields); err != nil {
+			tx.Rollback()
+			respondWithError(w, http.StatusInternalServerError, "Failed to write custom fields: "+err.Error())
+			return
+		}
+	}
+
+	if opts.AddToHopper == "Y" {
+		// The duplicate may be in another list, so queue it for that list's campaign
+		var merged models.Lead
+		var campaignID string
+		err := h.DB.QueryRow(`
+			SELECT l.lead_id, l.list_id, l.gmt_offset_now, l.state, l.vendor_lead_code, COALESCE(ls.campaign_id, '')
+			FROM vicidial_list l LEFT JOIN vicidial_lists ls ON l.list_id = ls.list_id
+			WHERE l.lead_id = ?
+		`, existingID).Scan(&merged.LeadID, &merged.ListID, &merged.GmtOffsetNow, &merged.State, &merged.VendorLeadCode, &campaignID)
+		if err == nil {
+			result.Hopper, err = h.addLeadToHopper(tx, &merged, campaignID, opts.HopperPriority)
+		}
+		if err != nil {
+			tx.Rollback()
+			respondWithError(w, http.StatusInternalServerError, "Failed to add lead to hopper: "+err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update lead: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(existingID),
+		Code:     "ADMIN API ADD LEAD MERGE " + result.Check,
+		SQL:      query,
+		Args:     args,
+		Before:   before,
+		After:    h.snapshotRow("vicidial_list", "lead_id", existingID),
+	})
 
-	respondWithSuccess(w, "Lead added successfully", lead)
+	result.Result = leadMerged
+	result.LeadID = existingID
+	result.Reason = "Duplicate lead updated"
+	respondWithSuccess(w, "Lead merged into existing lead", result)
 }
 
-// UpdateLead updates an existing lead
+// UpdateLead updates the fields of a lead present in the request body
 func (h *Handler) UpdateLead(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	leadID, err := strconv.Atoi(vars["lead_id"])
@@ -70,38 +263,106 @@ func (h *Handler) UpdateLead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var lead models.Lead
-	if err := json.NewDecoder(r.Body).Decode(&lead); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !h.requireLeadAccess(w, r, leadID) {
 		return
 	}
 
-	query := `
-		UPDATE vicidial_list SET
-			first_name = ?, last_name = ?, middle_initial = ?,
-			address1 = ?, address2 = ?, address3 = ?,
-			city = ?, state = ?, province = ?, postal_code = ?,
-			country_code = ?, gender = ?, date_of_birth = ?,
-			alt_phone = ?, email = ?, security = ?, comments = ?,
-			status = ?, modify_date = NOW(), owner = ?
-		WHERE lead_id = ?
-	`
+	// An unknown lead is reported by applyPatch
+	var phoneCode string
+	err = h.DB.QueryRow("SELECT phone_code FROM vicidial_list WHERE lead_id = ?", leadID).Scan(&phoneCode)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lead: "+err.Error())
+		return
+	}
 
-	_, err = h.DB.Exec(query,
-		lead.FirstName, lead.LastName, lead.MiddleInitial,
-		lead.Address1, lead.Address2, lead.Address3,
-		lead.City, lead.State, lead.Province, lead.PostalCode,
-		lead.CountryCode, lead.Gender, lead.DateOfBirth,
-		lead.AltPhone, lead.Email, lead.Security, lead.Comments,
-		lead.Status, lead.Owner, leadID,
-	)
+	fields, customValues, ok := readLeadPatch(w, r, phoneCode)
+	if !ok {
+		return
+	}
+
+	// Moving a lead requires access to the target list as well
+	if newListID, ok := patchValue(fields, "list_id"); ok && !h.requireListAccess(w, r, newListID) {
+		return
+	}
 
+	method := strings.ToUpper(r.URL.Query().Get("gmt_lookup_method"))
+	if !validGMTLookupMethod(method) {
+		respondWithError(w, http.StatusBadRequest, "gmt_lookup_method must be AREACODE, POSTAL or TZCODE")
+		return
+	}
+	fields, err = h.refreshLeadGMT(leadID, fields, method)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update lead: "+err.Error())
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up GMT offset: "+err.Error())
 		return
 	}
 
-	respondWithSuccess(w, "Lead updated successfully", map[string]int{"lead_id": leadID})
+	// Custom fields belong to the list the lead ends up in
+	customListID := 0
+	if customValues != nil {
+		err := h.DB.QueryRow("SELECT list_id FROM vicidial_list WHERE lead_id = ?", leadID).Scan(&customListID)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Lead not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lead: "+err.Error())
+			return
+		}
+		if newListID, ok := patchValue(fields, "list_id"); ok {
+			customListID = newListID.(int)
+		}
+
+		set, err := h.loadCustomFields(customListID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve custom fields: "+err.Error())
+			return
+		}
+		customValues, err = set.normalize(customValues)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if len(fields) > 0 {
+		found, err := h.applyPatch(r, leadPatchSpec, strconv.Itoa(leadID), fields, "LEADS", "ADMIN API UPDATE LEAD")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to update lead: "+err.Error())
+			return
+		}
+		if !found {
+			respondWithError(w, http.StatusNotFound, "Lead not found")
+			return
+		}
+	}
+
+	customLabels := []string{}
+	if len(customValues) > 0 {
+		table := "custom_" + strconv.Itoa(customListID)
+		before := h.snapshotRow(table, "lead_id", leadID)
+		if err := writeCustomFields(h.DB, customListID, leadID, customValues); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to write custom fields: "+err.Error())
+			return
+		}
+		h.audit(r, auditEvent{
+			Section:  "LEADS",
+			Type:     "MODIFY",
+			RecordID: strconv.Itoa(leadID),
+			Code:     "ADMIN API UPDATE LEAD CUSTOM FIELDS",
+			Before:   before,
+			After:    h.snapshotRow(table, "lead_id", leadID),
+		})
+		for label := range customValues {
+			customLabels = append(customLabels, label)
+		}
+		sort.Strings(customLabels)
+	}
+
+	respondWithSuccess(w, "Lead updated successfully", map[string]interface{}{
+		"lead_id":               leadID,
+		"updated_fields":        patchFieldNames(fields),
+		"updated_custom_fields": customLabels,
+	})
 }
 
 // BatchUpdateLead updates multiple leads
@@ -145,6 +406,17 @@ func (h *Handler) BatchUpdateLead(w http.ResponseWriter, r *http.Request) {
 	}
 	query += ")"
 
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
+	idArgs := make([]interface{}, len(req.LeadIDs))
+	for i, id := range req.LeadIDs {
+		idArgs[i] = id
+	}
+	snapshotQuery := "SELECT lead_id, status, owner FROM vicidial_list WHERE lead_id IN (" + placeholders(len(idArgs)) + ")"
+	before := h.snapshotRows(snapshotQuery, idArgs...)
+
 	result, err := h.DB.Exec(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update leads: "+err.Error())
@@ -152,9 +424,37 @@ func (h *Handler) BatchUpdateLead(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rowsAffected, _ := result.RowsAffected()
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: fmt.Sprintf("%d leads", len(req.LeadIDs)),
+		Code:     "ADMIN API BATCH UPDATE LEAD",
+		SQL:      query,
+		Args:     args,
+		Before:   before,
+		After:    h.snapshotRows(snapshotQuery, idArgs...),
+	})
 	respondWithSuccess(w, "Leads updated successfully", map[string]int64{"updated_count": rowsAffected})
 }
 
+// leadPageSpec pages LeadSearch and LeadStatusSearch results
+var leadPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"lead_id":      {Column: "lead_id"},
+		"list_id":      {Column: "list_id"},
+		"entry_date":   {Column: "entry_date", Time: true, Nullable: true},
+		"modify_date":  {Column: "modify_date", Time: true},
+		"phone_number": {Column: "phone_number"},
+		"last_name":    {Column: "last_name", Nullable: true},
+		"status":       {Column: "status", Nullable: true},
+	},
+	Key:          "lead_id",
+	DefaultSort:  "lead_id",
+	DefaultLimit: 100,
+	MaxLimit:     1000,
+}
+
 // LeadSearch searches for leads
 func (h *Handler) LeadSearch(w http.ResponseWriter, r *http.Request) {
 	phoneNumber := r.URL.Query().Get("phone_number")
@@ -164,12 +464,40 @@ func (h *Handler) LeadSearch(w http.ResponseWriter, r *http.Request) {
 	listID := r.URL.Query().Get("list_id")
 	status := r.URL.Query().Get("status")
 
-	query := "SELECT lead_id, list_id, phone_number, first_name, last_name, email, status, entry_date FROM vicidial_list WHERE 1=1"
-	args := []interface{}{}
+	page, ok := readPage(w, r, leadPageSpec)
+	if !ok {
+		return
+	}
+
+	filterListID := 0
+	if listID != "" {
+		id, err := strconv.Atoi(listID)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid list ID")
+			return
+		}
+		filterListID = id
+	}
+	filter, err := h.parseLeadFilter(r.URL.Query()["filter"], filterListID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.ListID != 0 && !h.requireListAccess(w, r, filter.ListID) {
+		return
+	}
+
+	query := " FROM vicidial_list WHERE 1=1" + filter.Where
+	args := append([]interface{}{}, filter.Args...)
 
 	if phoneNumber != "" {
+		digits := phoneSearchDigits(phoneNumber, r.URL.Query().Get("phone_code"))
+		if digits == "" {
+			respondWithError(w, http.StatusBadRequest, "phone_number must contain digits")
+			return
+		}
 		query += " AND phone_number LIKE ?"
-		args = append(args, "%"+phoneNumber+"%")
+		args = append(args, "%"+digits+"%")
 	}
 	if firstName != "" {
 		query += " AND first_name LIKE ?"
@@ -192,9 +520,11 @@ func (h *Handler) LeadSearch(w http.ResponseWriter, r *http.Request) {
 		args = append(args, status)
 	}
 
-	query += " LIMIT 100"
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := page.query(h.DB, "SELECT lead_id, list_id, phone_number, first_name, last_name, email, status, entry_date", query, args)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to search leads: "+err.Error())
 		return
@@ -204,14 +534,23 @@ func (h *Handler) LeadSearch(w http.ResponseWriter, r *http.Request) {
 	leads := []models.Lead{}
 	for rows.Next() {
 		var lead models.Lead
-		err := rows.Scan(&lead.LeadID, &lead.ListID, &lead.PhoneNumber, &lead.FirstName, &lead.LastName, &lead.Email, &lead.Status, &lead.EntryDate)
+		err := rows.Scan(page.dest(&lead.LeadID, &lead.ListID, &lead.PhoneNumber, &lead.FirstName, &lead.LastName, &lead.Email, &lead.Status, &lead.EntryDate)...)
 		if err != nil {
 			continue
 		}
+		if page.more() {
+			break
+		}
 		leads = append(leads, lead)
 	}
 
-	respondWithSuccess(w, "Leads retrieved successfully", leads)
+	withCustom, err := h.withCustomFields(leads)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve custom fields: "+err.Error())
+		return
+	}
+
+	respondWithPage(w, r, "Leads retrieved successfully", withCustom, page)
 }
 
 // LeadAllInfo retrieves all information for a lead
@@ -223,8 +562,13 @@ func (h *Handler) LeadAllInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !h.requireLeadAccess(w, r, leadID) {
+		return
+	}
+
 	query := `
-		SELECT lead_id, list_id, phone_number, first_name, last_name, middle_initial,
+		SELECT lead_id, list_id, vendor_lead_code, source_id, gmt_offset_now, phone_code,
+			   phone_number, title, first_name, last_name, middle_initial,
 			   address1, address2, address3, city, state, province, postal_code,
 			   country_code, gender, date_of_birth, alt_phone, email, security,
 			   comments, status, entry_date, modify_date, called_count, rank, owner
@@ -233,7 +577,8 @@ func (h *Handler) LeadAllInfo(w http.ResponseWriter, r *http.Request) {
 
 	var lead models.Lead
 	err = h.DB.QueryRow(query, leadID).Scan(
-		&lead.LeadID, &lead.ListID, &lead.PhoneNumber, &lead.FirstName, &lead.LastName,
+		&lead.LeadID, &lead.ListID, &lead.VendorLeadCode, &lead.SourceID, &lead.GmtOffsetNow, &lead.PhoneCode,
+		&lead.PhoneNumber, &lead.Title, &lead.FirstName, &lead.LastName,
 		&lead.MiddleInitial, &lead.Address1, &lead.Address2, &lead.Address3, &lead.City,
 		&lead.State, &lead.Province, &lead.PostalCode, &lead.CountryCode, &lead.Gender,
 		&lead.DateOfBirth, &lead.AltPhone, &lead.Email, &lead.Security, &lead.Comments,
@@ -249,7 +594,13 @@ func (h *Handler) LeadAllInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithSuccess(w, "Lead information retrieved", lead)
+	withCustom, err := h.withCustomFields([]models.Lead{lead})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve custom fields: "+err.Error())
+		return
+	}
+
+	respondWithSuccess(w, "Lead information retrieved", withCustom[0])
 }
 
 // LeadFieldInfo retrieves specific field information
@@ -274,6 +625,10 @@ func (h *Handler) LeadFieldInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !h.requireLeadAccess(w, r, leadID) {
+		return
+	}
+
 	query := "SELECT " + field + " FROM vicidial_list WHERE lead_id = ?"
 	var value string
 	err := h.DB.QueryRow(query, leadID).Scan(&value)
@@ -300,7 +655,12 @@ func (h *Handler) LeadStatusSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "SELECT lead_id, list_id, phone_number, first_name, last_name, status FROM vicidial_list WHERE status = ?"
+	page, ok := readPage(w, r, leadPageSpec)
+	if !ok {
+		return
+	}
+
+	query := " FROM vicidial_list WHERE status = ?"
 	args := []interface{}{status}
 
 	if listID != "" {
@@ -308,9 +668,11 @@ func (h *Handler) LeadStatusSearch(w http.ResponseWriter, r *http.Request) {
 		args = append(args, listID)
 	}
 
-	query += " LIMIT 100"
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := page.query(h.DB, "SELECT lead_id, list_id, phone_number, first_name, last_name, status", query, args)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to search leads: "+err.Error())
 		return
@@ -320,11 +682,14 @@ func (h *Handler) LeadStatusSearch(w http.ResponseWriter, r *http.Request) {
 	leads := []models.Lead{}
 	for rows.Next() {
 		var lead models.Lead
-		rows.Scan(&lead.LeadID, &lead.ListID, &lead.PhoneNumber, &lead.FirstName, &lead.LastName, &lead.Status)
+		rows.Scan(page.dest(&lead.LeadID, &lead.ListID, &lead.PhoneNumber, &lead.FirstName, &lead.LastName, &lead.Status)...)
+		if page.more() {
+			break
+		}
 		leads = append(leads, lead)
 	}
 
-	respondWithSuccess(w, "Leads retrieved", leads)
+	respondWithPage(w, r, "Leads retrieved", leads, page)
 }
 
 // LeadCallbackInfo retrieves callback information for a lead
@@ -332,6 +697,10 @@ func (h *Handler) LeadCallbackInfo(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	leadID := vars["lead_id"]
 
+	if !h.requireLeadAccess(w, r, leadID) {
+		return
+	}
+
 	query := `
 		SELECT callback_id, lead_id, list_id, campaign_id, status,
 			   entry_time, callback_time, user, recipient, comments
@@ -384,32 +753,41 @@ func (h *Handler) LeadDearchive(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusNotFound, "Archived lead not found")
 		return
 	}
-
-	// Move from archive to active table
-	tx, err := h.DB.Begin()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve archived lead: "+err.Error())
 		return
 	}
 
-	// Insert into active table
-	_, err = tx.Exec("INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive WHERE lead_id = ?", leadID)
-	if err != nil {
-		tx.Rollback()
-		respondWithError(w, http.StatusInternalServerError, "Failed to restore lead")
+	if !h.requireListAccess(w, r, archivedLead.ListID) {
 		return
 	}
 
-	// Delete from archive
-	_, err = tx.Exec("DELETE FROM vicidial_list_archive WHERE lead_id = ?", leadID)
+	// Move from archive to active table, with any archived custom fields
+	result, err := h.restoreLeadChunk(r.Context(), []interface{}{archivedLead.LeadID}, "", nil)
 	if err != nil {
-		tx.Rollback()
-		respondWithError(w, http.StatusInternalServerError, "Failed to remove from archive")
+		respondWithError(w, http.StatusInternalServerError, "Failed to restore lead: "+err.Error())
+		return
+	}
+	if result.Skipped > 0 {
+		respondWithError(w, http.StatusConflict, "Lead already exists in vicidial_list")
 		return
 	}
 
-	tx.Commit()
-	respondWithSuccess(w, "Lead restored successfully", map[string]int{"lead_id": archivedLead.LeadID})
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "MODIFY",
+		RecordID: strconv.Itoa(archivedLead.LeadID),
+		Code:     "ADMIN API DEARCHIVE LEAD",
+		SQL:      "INSERT INTO vicidial_list SELECT * FROM vicidial_list_archive WHERE lead_id = ?",
+		Args:     []interface{}{archivedLead.LeadID},
+		After:    h.snapshotRow("vicidial_list", "lead_id", archivedLead.LeadID),
+	})
+
+	respondWithSuccess(w, "Lead restored successfully", map[string]interface{}{
+		"lead_id":           archivedLead.LeadID,
+		"custom_rows":       result.CustomRows,
+		"custom_incomplete": result.CustomIncomplete,
+	})
 }
 
 // CheckPhoneNumber checks if a phone number exists
@@ -419,12 +797,22 @@ func (h *Handler) CheckPhoneNumber(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Phone number is required")
 		return
 	}
+	phone, ok := readPhoneNumber(w, "phone_number", phoneNumber, r.URL.Query().Get("phone_code"))
+	if !ok {
+		return
+	}
 
 	user := middleware.GetUserFromContext(r.Context())
 
 	query := "SELECT COUNT(*) FROM vicidial_list WHERE phone_number = ?"
+	args := []interface{}{phone.National}
+
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	var count int
-	err := h.DB.QueryRow(query, phoneNumber).Scan(&count)
+	err := h.DB.QueryRow(query, args...).Scan(&count)
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to check phone number")
@@ -433,7 +821,8 @@ func (h *Handler) CheckPhoneNumber(w http.ResponseWriter, r *http.Request) {
 
 	exists := count > 0
 	respondWithSuccess(w, "Phone check complete", map[string]interface{}{
-		"phone_number": phoneNumber,
+		"phone_number": phone.National,
+		"phone_code":   phone.Code,
 		"exists":       exists,
 		"count":        count,
 		"checked_by":   user,
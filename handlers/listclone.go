@@ -0,0 +1,590 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// List clone chunking: the default and largest number of leads copied per transaction
+const (
+	listCloneChunkSize    = 500
+	listCloneMaxChunkSize = 5000
+)
+
+// sqlExpr is a column value copied into SQL as is, rather than as an argument
+type sqlExpr string
+
+// tableColumns returns a table's columns in order
+func (h *Handler) tableColumns(ctx context.Context, table string) ([]string, error) {
+	rows, err := h.DB.QueryContext(ctx, `
+		SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+		ORDER BY ORDINAL_POSITION
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []string{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 && rows.Err() == nil {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	return columns, rows.Err()
+}
+
+// copyRowsQuery returns an INSERT ... SELECT copying rows of a table into
+// itself, or into target when given. Columns in set get the given value
+// instead, a sqlExpr or an argument, and columns set to nil, such as
+// AUTO_INCREMENT keys, are left to their defaults. The caller appends the
+// WHERE clause.
+func copyRowsQuery(table, target string, columns []string, set map[string]interface{}) (string, []interface{}) {
+	if target == "" {
+		target = table
+	}
+	names := []string{}
+	values := []string{}
+	args := []interface{}{}
+	for _, column := range columns {
+		value, ok := set[column]
+		switch {
+		case !ok:
+			values = append(values, "`"+column+"`")
+		case value == nil:
+			continue
+		default:
+			if expr, isExpr := value.(sqlExpr); isExpr {
+				values = append(values, string(expr))
+			} else {
+				values = append(values, "?")
+				args = append(args, value)
+			}
+		}
+		names = append(names, "`"+column+"`")
+	}
+	return "INSERT INTO " + target + " (" + strings.Join(names, ", ") + ") SELECT " +
+		strings.Join(values, ", ") + " FROM " + table, args
+}
+
+// listCloneParams are the parameters of a list_clone job, which copies the
+// leads of a list already cloned by CloneList
+type listCloneParams struct {
+	SourceListID int      `json:"source_list_id"`
+	ListID       int      `json:"list_id"`
+	Statuses     []string `json:"lead_statuses,omitempty"`
+	ResetLeads   bool     `json:"reset_leads"`
+	CopyCustom   bool     `json:"copy_custom"`
+	ChunkSize    int      `json:"chunk_size"`
+	Matched      int      `json:"matched"`
+}
+
+// where returns the conditions selecting the source leads to copy
+func (p listCloneParams) where() (string, []interface{}) {
+	where := " AND list_id = ?"
+	args := []interface{}{p.SourceListID}
+	if len(p.Statuses) > 0 {
+		where += " AND status IN (" + placeholders(len(p.Statuses)) + ")"
+		args = append(args, stringArgs(p.Statuses)...)
+	}
+	return where, args
+}
+
+// listCloneResult summarizes the leads copied by a list_clone job
+type listCloneResult struct {
+	Matched    int `json:"matched"`
+	Copied     int `json:"copied"`
+	CustomRows int `json:"custom_rows"`
+	Chunks     int `json:"chunks"`
+}
+
+// listCloneCheckpoint is where a list_clone job has got to
+type listCloneCheckpoint struct {
+	LastLeadID int             `json:"last_lead_id"`
+	Result     listCloneResult `json:"result"`
+}
+
+// CloneList copies a list's settings into a new list_id, with its custom
+// field definitions and custom_<list_id> table unless copy_custom_fields=N.
+// With copy_leads=Y the leads, optionally only those in lead_statuses, are
+// copied with their custom field values by a list_clone job.
+func (h *Handler) CloneList(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !h.requireListAccess(w, r, vars["list_id"]) {
+		return
+	}
+	sourceListID, ok := h.customFieldListID(w, vars["list_id"])
+	if !ok {
+		return
+	}
+
+	var req struct {
+		NewListID        int      `json:"new_list_id"`
+		ListName         string   `json:"list_name"`
+		CampaignID       string   `json:"campaign_id"`
+		Active           string   `json:"active"`
+		CopyCustomFields string   `json:"copy_custom_fields"`
+		CopyLeads        string   `json:"copy_leads"`
+		LeadStatuses     []string `json:"lead_statuses"`
+		ResetLeads       string   `json:"reset_leads"`
+		ChunkSize        int      `json:"chunk_size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if req.NewListID <= 0 {
+		respondWithError(w, http.StatusBadRequest, "new_list_id is required")
+		return
+	}
+	if req.Active == "" {
+		req.Active = "N"
+	}
+	if req.CopyCustomFields == "" {
+		req.CopyCustomFields = "Y"
+	}
+	if req.CopyLeads == "" {
+		req.CopyLeads = "N"
+	}
+	if req.ResetLeads == "" {
+		req.ResetLeads = "N"
+	}
+	for name, value := range map[string]string{"active": req.Active, "copy_custom_fields": req.CopyCustomFields,
+		"copy_leads": req.CopyLeads, "reset_leads": req.ResetLeads} {
+		if err := validateYN(value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid value for "+name+": "+err.Error())
+			return
+		}
+	}
+	if err := validateMaxLen(30)(req.ListName); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid value for list_name: "+err.Error())
+		return
+	}
+	for _, status := range req.LeadStatuses {
+		if err := validateStatus(status); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid lead status %q: %v", status, err))
+			return
+		}
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = listCloneChunkSize
+	}
+	if req.ChunkSize < 1 || req.ChunkSize > listCloneMaxChunkSize {
+		respondWithError(w, http.StatusBadRequest, "chunk_size must be between 1 and "+strconv.Itoa(listCloneMaxChunkSize))
+		return
+	}
+
+	var sourceName, sourceCampaignID string
+	if err := h.DB.QueryRow("SELECT list_name, COALESCE(campaign_id, '') FROM vicidial_lists WHERE list_id = ?", sourceListID).Scan(&sourceName, &sourceCampaignID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve list: "+err.Error())
+		return
+	}
+	if req.ListName == "" {
+		req.ListName = sourceName
+	}
+	if req.CampaignID == "" {
+		req.CampaignID = sourceCampaignID
+	} else {
+		if !requireCampaignAccess(w, r, req.CampaignID) {
+			return
+		}
+		var campaigns int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_campaigns WHERE campaign_id = ?", req.CampaignID).Scan(&campaigns); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up campaign: "+err.Error())
+			return
+		}
+		if campaigns == 0 {
+			respondWithError(w, http.StatusBadRequest, "Campaign "+req.CampaignID+" does not exist")
+			return
+		}
+	}
+
+	var exists int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists WHERE list_id = ?", req.NewListID).Scan(&exists); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up list: "+err.Error())
+		return
+	}
+	if exists > 0 {
+		respondWithError(w, http.StatusConflict, "List "+strconv.Itoa(req.NewListID)+" already exists")
+		return
+	}
+
+	sourceTable, err := h.loadCustomTable(sourceListID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+	targetTable, err := h.loadCustomTable(req.NewListID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+	copyCustom := req.CopyCustomFields == "Y"
+	if copyCustom && sourceTable.Exists && targetTable.Exists {
+		respondWithError(w, http.StatusConflict, "Table "+targetTable.name()+" already exists")
+		return
+	}
+	var fieldCount int
+	if copyCustom {
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists_fields WHERE list_id = ?", sourceListID).Scan(&fieldCount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to count custom fields: "+err.Error())
+			return
+		}
+	}
+
+	params := listCloneParams{
+		SourceListID: sourceListID,
+		ListID:       req.NewListID,
+		Statuses:     req.LeadStatuses,
+		ResetLeads:   req.ResetLeads == "Y",
+		CopyCustom:   copyCustom && sourceTable.Exists,
+		ChunkSize:    req.ChunkSize,
+	}
+	if req.CopyLeads == "Y" {
+		where, args := params.where()
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_list WHERE 1=1"+where, args...).Scan(&params.Matched); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to count leads: "+err.Error())
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"source_list_id": sourceListID,
+		"list_id":        req.NewListID,
+		"list_name":      req.ListName,
+		"campaign_id":    req.CampaignID,
+		"active":         req.Active,
+		"custom_fields":  fieldCount,
+		"custom_table":   params.CopyCustom,
+		"leads":          params.Matched,
+	}
+	if dryRun, _ := schemaFlags(r); dryRun {
+		respondWithSuccess(w, "Dry run, nothing was changed", data)
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	query, args, err := h.cloneListRows(r.Context(), tx, sourceListID, req.NewListID, map[string]interface{}{
+		"list_name":   req.ListName,
+		"campaign_id": req.CampaignID,
+		"active":      req.Active,
+	}, copyCustom && fieldCount > 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to clone list: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to clone list: "+err.Error())
+		return
+	}
+
+	// DDL commits implicitly, so the table is created after the rows
+	if params.CopyCustom {
+		if _, err := h.DB.Exec("CREATE TABLE " + targetTable.name() + " LIKE " + sourceTable.name()); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "List cloned, but failed to create "+targetTable.name()+": "+err.Error())
+			return
+		}
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "LISTS",
+		Type:     "COPY",
+		RecordID: strconv.Itoa(req.NewListID),
+		Code:     "ADMIN API CLONE LIST",
+		SQL:      query,
+		Args:     args,
+		After: map[string]interface{}{
+			"source_list_id": sourceListID,
+			"list":           h.snapshotRow("vicidial_lists", "list_id", req.NewListID),
+			"custom_fields":  fieldCount,
+			"custom_table":   params.CopyCustom,
+		},
+	})
+
+	if params.Matched == 0 {
+		respondWithSuccess(w, "List cloned successfully", data)
+		return
+	}
+	h.submitJob(w, r, jobTypeListClone, params, "List cloned successfully, lead copy queued")
+}
+
+// cloneListRows copies a list's vicidial_lists row, with the values in set,
+// into newListID, and with copyFields its custom field definitions. It
+// returns the list INSERT for the audit log. The custom_<list_id> table is
+// left to the caller, as DDL would commit the transaction.
+func (h *Handler) cloneListRows(ctx context.Context, tx *sql.Tx, sourceListID, newListID int, set map[string]interface{}, copyFields bool) (string, []interface{}, error) {
+	listColumns, err := h.tableColumns(ctx, "vicidial_lists")
+	if err != nil {
+		return "", nil, err
+	}
+	values := map[string]interface{}{
+		"list_id":           newListID,
+		"list_changedate":   sqlExpr("NOW()"),
+		"list_lastcalldate": nil,
+		"resets_today":      sqlExpr("0"),
+	}
+	for column, value := range set {
+		values[column] = value
+	}
+	query, args := copyRowsQuery("vicidial_lists", "", listColumns, values)
+	query += " WHERE list_id = ?"
+	args = append(args, sourceListID)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return "", nil, err
+	}
+
+	if copyFields {
+		fieldColumns, err := h.tableColumns(ctx, "vicidial_lists_fields")
+		if err != nil {
+			return "", nil, err
+		}
+		fieldQuery, fieldArgs := copyRowsQuery("vicidial_lists_fields", "", fieldColumns, map[string]interface{}{
+			"field_id": nil,
+			"list_id":  newListID,
+		})
+		if _, err := tx.ExecContext(ctx, fieldQuery+" WHERE list_id = ? ORDER BY field_rank, field_id", append(fieldArgs, sourceListID)...); err != nil {
+			return "", nil, err
+		}
+	}
+	return query, args, nil
+}
+
+// runListClone copies the source list's leads in lead_id order, one
+// transaction per chunk, then the chunk's custom rows. A chunk committed
+// before its checkpoint was saved is found on resume by counting the new
+// list's leads, so it is not copied twice, and its custom rows are copied again.
+func (h *Handler) runListClone(ctx context.Context, task *jobs.Task) (interface{}, error) {
+	var params listCloneParams
+	if err := task.Decode(&params); err != nil {
+		return nil, err
+	}
+
+	var cp listCloneCheckpoint
+	resumed, err := task.LoadCheckpoint(&cp)
+	if err != nil {
+		return nil, err
+	}
+	if !resumed {
+		cp.Result.Matched = params.Matched
+	}
+	task.SetTotal(params.Matched)
+
+	where, whereArgs := params.where()
+
+	leadColumns, err := h.tableColumns(ctx, "vicidial_list")
+	if err != nil {
+		return cp.Result, err
+	}
+	set := map[string]interface{}{
+		"lead_id":       nil,
+		"list_id":       params.ListID,
+		"entry_date":    sqlExpr("NOW()"),
+		"modify_date":   nil,
+		"entry_list_id": params.ListID,
+	}
+	if params.ResetLeads {
+		set["called_since_last_reset"] = sqlExpr("'N'")
+	}
+	leadInsert, leadArgs := copyRowsQuery("vicidial_list", "", leadColumns, set)
+
+	// REPLACE, so custom rows copied again on resume overwrite the first copy
+	customInsert := ""
+	if params.CopyCustom {
+		source := "custom_" + strconv.Itoa(params.SourceListID)
+		customColumns, err := h.tableColumns(ctx, source)
+		if err != nil {
+			return cp.Result, err
+		}
+		customInsert, _ = copyRowsQuery(source, "custom_"+strconv.Itoa(params.ListID), customColumns,
+			map[string]interface{}{"lead_id": sqlExpr("?")})
+		customInsert = "REPLACE" + strings.TrimPrefix(customInsert, "INSERT") + " WHERE lead_id = ?"
+	}
+
+	var copied int
+	if err := h.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM vicidial_list WHERE list_id = ?", params.ListID).Scan(&copied); err != nil {
+		return cp.Result, err
+	}
+	if extra := copied - cp.Result.Copied; extra > 0 {
+		ids, err := h.nextLeadChunk(ctx, "vicidial_list", where, whereArgs, cp.LastLeadID, extra)
+		if err != nil {
+			return cp.Result, err
+		}
+		if len(ids) > 0 {
+			if customInsert != "" {
+				newIDs, err := h.lastCopiedLeads(ctx, params.ListID, len(ids))
+				if err != nil {
+					return cp.Result, err
+				}
+				customRows, err := h.copyCustomRows(ctx, customInsert, ids, newIDs)
+				if err != nil {
+					return cp.Result, err
+				}
+				cp.Result.CustomRows += customRows
+			}
+			cp.LastLeadID = ids[len(ids)-1].(int)
+			cp.Result.Copied += len(ids)
+			cp.Result.Chunks++
+		}
+	}
+	task.SetProgress(cp.Result.Copied)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return cp.Result, err
+		}
+
+		ids, err := h.nextLeadChunk(ctx, "vicidial_list", where, whereArgs, cp.LastLeadID, params.ChunkSize)
+		if err != nil {
+			return cp.Result, err
+		}
+		if len(ids) == 0 {
+			return cp.Result, nil
+		}
+
+		newIDs, err := h.copyLeadChunk(ctx, ids, leadInsert, leadArgs, customInsert != "")
+		if err != nil {
+			return cp.Result, err
+		}
+		customRows := 0
+		if customInsert != "" {
+			customRows, err = h.copyCustomRows(ctx, customInsert, ids, newIDs)
+			if err != nil {
+				return cp.Result, err
+			}
+		}
+
+		cp.LastLeadID = ids[len(ids)-1].(int)
+		cp.Result.Copied += len(ids)
+		cp.Result.CustomRows += customRows
+		cp.Result.Chunks++
+		task.SetProgress(cp.Result.Copied)
+		if err := task.SaveCheckpoint(cp); err != nil {
+			return cp.Result, err
+		}
+
+		if len(ids) < params.ChunkSize {
+			return cp.Result, nil
+		}
+	}
+}
+
+// copyLeadChunk copies leads in one transaction. Without custom fields they
+// are copied with a single statement; otherwise each lead is copied on its
+// own and the new lead IDs are returned in the order of ids, so the custom
+// rows can follow them.
+func (h *Handler) copyLeadChunk(ctx context.Context, ids []interface{}, leadInsert string, leadArgs []interface{}, withIDs bool) ([]interface{}, error) {
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if !withIDs {
+		args := append(append([]interface{}{}, leadArgs...), ids...)
+		if _, err := tx.ExecContext(ctx, leadInsert+" WHERE lead_id IN ("+placeholders(len(ids))+") ORDER BY lead_id", args...); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+
+	newIDs := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		res, err := tx.ExecContext(ctx, leadInsert+" WHERE lead_id = ?", append(append([]interface{}{}, leadArgs...), id)...)
+		if err != nil {
+			return nil, err
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		newIDs = append(newIDs, newID)
+	}
+	return newIDs, tx.Commit()
+}
+
+// copyCustomRows copies the custom rows of source leads to the leads copied
+// from them. custom_<list_id> tables are MyISAM and cannot be rolled back, so
+// this runs only once the leads are committed.
+func (h *Handler) copyCustomRows(ctx context.Context, customInsert string, ids, newIDs []interface{}) (int, error) {
+	customRows := 0
+	for i, id := range ids {
+		res, err := h.DB.ExecContext(ctx, customInsert, newIDs[i], id)
+		if err != nil {
+			return customRows, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			customRows++
+		}
+	}
+	return customRows, nil
+}
+
+// lastCopiedLeads returns the IDs of the last n leads copied into a list, in
+// the order they were copied
+func (h *Handler) lastCopiedLeads(ctx context.Context, listID, n int) ([]interface{}, error) {
+	rows, err := h.DB.QueryContext(ctx, "SELECT lead_id FROM vicidial_list WHERE list_id = ? ORDER BY lead_id DESC LIMIT ?", listID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]interface{}, n)
+	i := n
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		i--
+		ids[i] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if i != 0 {
+		return nil, fmt.Errorf("list %d has fewer than %d copied leads", listID, n)
+	}
+	return ids, nil
+}
+
+// listCloneFinished audits a finished lead copy as its requester
+func (h *Handler) listCloneFinished(job models.Job) {
+	var params listCloneParams
+	json.Unmarshal(job.Params, &params)
+
+	where, args := params.where()
+	after := jobAuditResult(job)
+	after["source_list_id"] = params.SourceListID
+
+	h.auditAs(jobActor(job), auditEvent{
+		Section:  "LISTS",
+		Type:     "COPY",
+		RecordID: strconv.Itoa(params.ListID),
+		Code:     "ADMIN API CLONE LIST LEADS",
+		SQL:      "INSERT INTO vicidial_list SELECT * FROM vicidial_list WHERE 1=1" + where,
+		Args:     args,
+		After:    after,
+	})
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+func TestRunListCloneResumesPartialCopy(t *testing.T) {
+	h, mock := newMockHandler(t)
+
+	params, _ := json.Marshal(listCloneParams{SourceListID: 101, ListID: 102, CopyCustom: true, ChunkSize: 2, Matched: 5})
+	checkpoint, _ := json.Marshal(listCloneCheckpoint{LastLeadID: 11, Result: listCloneResult{Matched: 5, Copied: 2, CustomRows: 2, Chunks: 1}})
+	task := jobs.NewTask(models.Job{Params: params, Checkpoint: string(checkpoint)})
+
+	columns := regexp.QuoteMeta("SELECT COLUMN_NAME FROM information_schema.COLUMNS")
+	mock.ExpectQuery(columns).WithArgs("vicidial_list").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME"}).AddRow("lead_id").AddRow("list_id").AddRow("entry_date").
+			AddRow("modify_date").AddRow("status").AddRow("entry_list_id"))
+	mock.ExpectQuery(columns).WithArgs("custom_101").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME"}).AddRow("lead_id").AddRow("color"))
+
+	// The second chunk, leads 12 and 13, was committed before its checkpoint
+	// was saved, so its leads are not copied again but its custom rows are
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM vicidial_list WHERE list_id = ?")).WithArgs(102).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(4))
+	nextChunk := regexp.QuoteMeta("SELECT lead_id FROM vicidial_list WHERE lead_id > ? AND list_id = ? ORDER BY lead_id LIMIT ?")
+	mock.ExpectQuery(nextChunk).WithArgs(11, 101, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id"}).AddRow(12).AddRow(13))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT lead_id FROM vicidial_list WHERE list_id = ? ORDER BY lead_id DESC LIMIT ?")).WithArgs(102, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id"}).AddRow(504).AddRow(503))
+	customInsert := regexp.QuoteMeta("REPLACE INTO custom_102 (`lead_id`, `color`) SELECT ?, `color` FROM custom_101 WHERE lead_id = ?")
+	mock.ExpectExec(customInsert).WithArgs(503, 12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(customInsert).WithArgs(504, 13).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The rest is copied from lead 13 on
+	mock.ExpectQuery(nextChunk).WithArgs(13, 101, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"lead_id"}).AddRow(14))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_list (`list_id`, `entry_date`, `status`, `entry_list_id`) SELECT ?, NOW(), `status`, ? FROM vicidial_list WHERE lead_id = ?")).
+		WithArgs(102, 102, 14).
+		WillReturnResult(sqlmock.NewResult(505, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(customInsert).WithArgs(505, 14).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := h.runListClone(context.Background(), task)
+	if err != nil {
+		t.Fatalf("runListClone: %v", err)
+	}
+	want := listCloneResult{Matched: 5, Copied: 5, CustomRows: 4, Chunks: 3}
+	if result != want {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+
+	var saved listCloneCheckpoint
+	if _, err := task.LoadCheckpoint(&saved); err != nil {
+		t.Fatalf("LoadCheckpoint: %v", err)
+	}
+	if saved.LastLeadID != 14 || saved.Result != want {
+		t.Errorf("checkpoint = %+v", saved)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
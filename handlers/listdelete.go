@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// listDeleteParams are the parameters of a list_delete job. The list row is
+// kept so the audit entry shows what was deleted.
+type listDeleteParams struct {
+	ListID    int                    `json:"list_id"`
+	ChunkSize int                    `json:"chunk_size"`
+	Leads     int                    `json:"leads"`
+	Forced    bool                   `json:"forced"`
+	List      map[string]interface{} `json:"list"`
+}
+
+// listDeleteResult summarizes a list deletion
+type listDeleteResult struct {
+	Leads         int  `json:"leads"`
+	HopperRemoved int  `json:"hopper_removed"`
+	Callbacks     int  `json:"callbacks_inactivated"`
+	CustomFields  int  `json:"custom_fields"`
+	CustomTable   bool `json:"custom_table_dropped"`
+	Chunks        int  `json:"chunks"`
+}
+
+// listDeleteCheckpoint is where a list_delete job has got to
+type listDeleteCheckpoint struct {
+	Result listDeleteResult `json:"result"`
+}
+
+// DeleteList deletes a list with its leads, hopper entries, custom field
+// definitions and custom_<list_id> table, as VICIdial's list admin does.
+// A list whose campaign is active, or with leads in the hopper or pending
+// callbacks, is refused with 409 unless force=Y; dry_run=Y only counts what
+// would be deleted. The list is deactivated at
+// once and the rest is done by a list_delete job.
+func (h *Handler) DeleteList(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !h.requireListAccess(w, r, vars["list_id"]) {
+		return
+	}
+	listID, ok := h.customFieldListID(w, vars["list_id"])
+	if !ok {
+		return
+	}
+	dryRun, force := schemaFlags(r)
+
+	var campaignID, campaignActive string
+	err := h.DB.QueryRow(`
+		SELECT COALESCE(l.campaign_id, ''), COALESCE(c.active, '')
+		FROM vicidial_lists l LEFT JOIN vicidial_campaigns c ON l.campaign_id = c.campaign_id
+		WHERE l.list_id = ?`, listID).Scan(&campaignID, &campaignActive)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve list: "+err.Error())
+		return
+	}
+
+	counts := map[string]int{}
+	for name, query := range map[string]string{
+		"leads":         "SELECT COUNT(*) FROM vicidial_list WHERE list_id = ?",
+		"hopper":        "SELECT COUNT(*) FROM vicidial_hopper WHERE list_id = ?",
+		"callbacks":     "SELECT COUNT(*) FROM vicidial_callbacks WHERE list_id = ? AND status IN ('ACTIVE','LIVE')",
+		"custom_fields": "SELECT COUNT(*) FROM vicidial_lists_fields WHERE list_id = ?",
+	} {
+		var n int
+		if err := h.DB.QueryRow(query, listID).Scan(&n); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to count "+name+": "+err.Error())
+			return
+		}
+		counts[name] = n
+	}
+	table, err := h.loadCustomTable(listID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"list_id":         listID,
+		"campaign_id":     campaignID,
+		"campaign_active": campaignActive == "Y",
+		"leads":           counts["leads"],
+		"hopper":          counts["hopper"],
+		"callbacks":       counts["callbacks"],
+		"custom_fields":   counts["custom_fields"],
+		"custom_table":    table.Exists,
+	}
+	if dryRun {
+		respondWithSuccess(w, "Dry run, nothing was changed", data)
+		return
+	}
+	refuse := func(message string) {
+		respondWithJSON(w, http.StatusConflict, models.APIResponse{Success: false, Error: message, Data: data})
+	}
+	if campaignActive == "Y" && !force {
+		refuse("List belongs to active campaign " + campaignID + "; repeat with force=Y to delete it")
+		return
+	}
+	if (counts["hopper"] > 0 || counts["callbacks"] > 0) && !force {
+		refuse("List has leads in the hopper or pending callbacks; repeat with force=Y to delete it")
+		return
+	}
+
+	params := listDeleteParams{
+		ListID:    listID,
+		ChunkSize: listCloneChunkSize,
+		Leads:     counts["leads"],
+		Forced:    campaignActive == "Y" || counts["hopper"] > 0 || counts["callbacks"] > 0,
+		List:      h.snapshotRow("vicidial_lists", "list_id", listID),
+	}
+
+	// Stop the hopper loading the list while its leads are deleted
+	if _, err := h.DB.Exec("UPDATE vicidial_lists SET active = 'N', list_changedate = NOW() WHERE list_id = ?", listID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to deactivate list: "+err.Error())
+		return
+	}
+
+	h.submitJob(w, r, jobTypeListDelete, params, "List deactivated, deletion queued")
+}
+
+// runListDelete deletes the list's leads one chunk at a time, then its
+// custom fields and the list itself. Deleting is naturally repeatable, so a
+// resumed job simply carries on.
+func (h *Handler) runListDelete(ctx context.Context, task *jobs.Task) (interface{}, error) {
+	var params listDeleteParams
+	if err := task.Decode(&params); err != nil {
+		return nil, err
+	}
+
+	var cp listDeleteCheckpoint
+	if _, err := task.LoadCheckpoint(&cp); err != nil {
+		return nil, err
+	}
+	task.SetTotal(params.Leads)
+	task.SetProgress(cp.Result.Leads)
+
+	res, err := h.DB.ExecContext(ctx, "DELETE FROM vicidial_hopper WHERE list_id = ?", params.ListID)
+	if err != nil {
+		return cp.Result, err
+	}
+	n, _ := res.RowsAffected()
+	cp.Result.HopperRemoved += int(n)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return cp.Result, err
+		}
+
+		ids, err := h.nextLeadChunk(ctx, "vicidial_list", " AND list_id = ?", []interface{}{params.ListID}, 0, params.ChunkSize)
+		if err != nil {
+			return cp.Result, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		chunk, err := h.deleteLeadChunk(ctx, params.ListID, ids)
+		if err != nil {
+			return cp.Result, err
+		}
+		cp.Result.Leads += chunk.Leads
+		cp.Result.HopperRemoved += chunk.HopperRemoved
+		cp.Result.Callbacks += chunk.Callbacks
+		cp.Result.Chunks++
+		task.SetProgress(cp.Result.Leads)
+		if err := task.SaveCheckpoint(cp); err != nil {
+			return cp.Result, err
+		}
+	}
+
+	table, err := h.loadCustomTable(params.ListID)
+	if err != nil {
+		return cp.Result, err
+	}
+	if table.Exists {
+		if _, err := h.DB.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.name()); err != nil {
+			return cp.Result, err
+		}
+		cp.Result.CustomTable = true
+	}
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return cp.Result, err
+	}
+	defer tx.Rollback()
+
+	if res, err = tx.ExecContext(ctx, "DELETE FROM vicidial_lists_fields WHERE list_id = ?", params.ListID); err != nil {
+		return cp.Result, err
+	}
+	n, _ = res.RowsAffected()
+	cp.Result.CustomFields += int(n)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM vicidial_lists WHERE list_id = ?", params.ListID); err != nil {
+		return cp.Result, err
+	}
+	return cp.Result, tx.Commit()
+}
+
+// deleteLeadChunk deletes leads of a list with their hopper entries, and
+// makes their pending callbacks inactive
+func (h *Handler) deleteLeadChunk(ctx context.Context, listID int, ids []interface{}) (listDeleteResult, error) {
+	var result listDeleteResult
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	in := " WHERE lead_id IN (" + placeholders(len(ids)) + ")"
+	count := func(res sql.Result, err error) (int, error) {
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		return int(n), nil
+	}
+
+	if result.HopperRemoved, err = count(tx.ExecContext(ctx, "DELETE FROM vicidial_hopper"+in, ids...)); err != nil {
+		return result, err
+	}
+	if result.Callbacks, err = count(tx.ExecContext(ctx, "UPDATE vicidial_callbacks SET status = 'INACTIVE', modify_date = NOW()"+in+
+		" AND status IN ('ACTIVE','LIVE')", ids...)); err != nil {
+		return result, err
+	}
+	if result.Leads, err = count(tx.ExecContext(ctx, "DELETE FROM vicidial_list"+in+" AND list_id = ?", append(append([]interface{}{}, ids...), listID)...)); err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// listDeleteFinished audits a finished list deletion as its requester
+func (h *Handler) listDeleteFinished(job models.Job) {
+	var params listDeleteParams
+	json.Unmarshal(job.Params, &params)
+
+	after := jobAuditResult(job)
+	after["forced"] = params.Forced
+
+	h.auditAs(jobActor(job), auditEvent{
+		Section:  "LISTS",
+		Type:     "DELETE",
+		RecordID: strconv.Itoa(params.ListID),
+		Code:     "ADMIN API DELETE LIST",
+		SQL:      "DELETE FROM vicidial_lists WHERE list_id = ?",
+		Args:     []interface{}{params.ListID},
+		Before:   params.List,
+		After:    after,
+	})
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestDeleteListRefusesListInUse(t *testing.T) {
+	tests := []struct {
+		name      string
+		hopper    int
+		callbacks int
+	}{
+		{"hopper entries", 35, 0},
+		{"pending callbacks", 0, 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			// The counts are run in map order
+			mock.MatchExpectationsInOrder(false)
+
+			count := func(query string, n int) {
+				mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(102).
+					WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(n))
+			}
+			count("SELECT COUNT(*) FROM vicidial_lists WHERE list_id = ?", 1)
+			mock.ExpectQuery(regexp.QuoteMeta("FROM vicidial_lists l LEFT JOIN vicidial_campaigns c")).WithArgs(102).
+				WillReturnRows(sqlmock.NewRows([]string{"campaign_id", "active"}).AddRow("TESTCAMP", "N"))
+			count("SELECT COUNT(*) FROM vicidial_list WHERE list_id = ?", 100)
+			count("SELECT COUNT(*) FROM vicidial_hopper WHERE list_id = ?", tt.hopper)
+			count("SELECT COUNT(*) FROM vicidial_callbacks WHERE list_id = ?", tt.callbacks)
+			count("SELECT COUNT(*) FROM vicidial_lists_fields WHERE list_id = ?", 0)
+			mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).WithArgs("custom_102").
+				WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}))
+
+			// Refused before the list is deactivated or a job is queued
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest("DELETE", "/lists/102", nil), map[string]string{"list_id": "102"})
+			h.DeleteList(w, r)
+			if w.Code != http.StatusConflict {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, http.StatusConflict, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), "force=Y") {
+				t.Errorf("body = %s, want a hint to force", w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
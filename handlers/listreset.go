@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// listResetStatus is a list's reset schedule and when it was last reset.
+// VICIdial's keepalive resets lists at each reset_time and logs every reset,
+// scheduled or manual, in vicidial_admin_log as a LISTS RESET event.
+type listResetStatus struct {
+	ListID         int        `json:"list_id"`
+	ListName       string     `json:"list_name"`
+	CampaignID     string     `json:"campaign_id"`
+	Active         string     `json:"active"`
+	ExpirationDate string     `json:"expiration_date"`
+	Expired        bool       `json:"expired"`
+	ResetTime      string     `json:"reset_time"`
+	ResetsToday    int        `json:"resets_today"`
+	LastReset      *time.Time `json:"last_reset"`
+	NextReset      *time.Time `json:"next_reset"`
+}
+
+// listResetQuery selects listResetStatus rows from vicidial_lists aliased l
+const listResetQuery = `
+	SELECT l.list_id, l.list_name, COALESCE(l.campaign_id, ''), l.active,
+		   l.expiration_date, COALESCE(l.reset_time, ''), l.resets_today,
+		   (SELECT MAX(event_date) FROM vicidial_admin_log
+			WHERE event_section = 'LISTS' AND event_type = 'RESET' AND record_id = CAST(l.list_id AS CHAR))
+	FROM vicidial_lists l WHERE 1=1`
+
+// scanListReset reads a row selected with listResetQuery and works out the
+// next scheduled reset in server time
+func scanListReset(row rowScanner, now time.Time) (listResetStatus, error) {
+	var status listResetStatus
+	var expirationDate, lastReset sql.NullTime
+	if err := row.Scan(&status.ListID, &status.ListName, &status.CampaignID, &status.Active,
+		&expirationDate, &status.ResetTime, &status.ResetsToday, &lastReset); err != nil {
+		return status, err
+	}
+	if expirationDate.Valid {
+		status.ExpirationDate = expirationDate.Time.Format("2006-01-02")
+		status.Expired = status.ExpirationDate < now.Format("2006-01-02")
+	}
+	if lastReset.Valid {
+		status.LastReset = &lastReset.Time
+	}
+	status.NextReset = nextListReset(status.ResetTime, now)
+	return status, nil
+}
+
+// nextListReset returns the first time after now in a reset_time schedule
+// such as 0800-1700, or nil when the list has no scheduled resets
+func nextListReset(resetTime string, now time.Time) *time.Time {
+	if resetTime == "" {
+		return nil
+	}
+	var minutes []int
+	for _, hhmm := range strings.Split(resetTime, "-") {
+		if len(hhmm) != 4 {
+			continue
+		}
+		hours, err1 := strconv.Atoi(hhmm[:2])
+		mins, err2 := strconv.Atoi(hhmm[2:])
+		if err1 == nil && err2 == nil {
+			minutes = append(minutes, hours*60+mins)
+		}
+	}
+	if len(minutes) == 0 {
+		return nil
+	}
+	sort.Ints(minutes)
+
+	// Reset times are wall clock times, so they are built with time.Date
+	// rather than added to midnight, which is off by an hour on DST changes
+	year, month, day := now.Date()
+	for _, m := range minutes {
+		if next := time.Date(year, month, day, 0, m, 0, 0, now.Location()); next.After(now) {
+			return &next
+		}
+	}
+	next := time.Date(year, month, day+1, 0, minutes[0], 0, 0, now.Location())
+	return &next
+}
+
+// ListResets lists the reset schedule, expiration and last reset of every
+// list the caller may use
+func (h *Handler) ListResets(w http.ResponseWriter, r *http.Request) {
+	query := listResetQuery
+	args := []interface{}{}
+
+	if campaignID := r.URL.Query().Get("campaign_id"); campaignID != "" {
+		query += " AND l.campaign_id = ?"
+		args = append(args, campaignID)
+	}
+	if active := r.URL.Query().Get("active"); active != "" {
+		query += " AND l.active = ?"
+		args = append(args, active)
+	}
+
+	restrictSQL, restrictArgs := listFilter(r, "l.list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
+	query += " ORDER BY l.list_id"
+
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lists: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now().In(h.serverLocation())
+	lists := []listResetStatus{}
+	for rows.Next() {
+		status, err := scanListReset(rows, now)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read list: "+err.Error())
+			return
+		}
+		lists = append(lists, status)
+	}
+
+	respondWithSuccess(w, "List resets retrieved", lists)
+}
+
+// listResetStatusByID returns one list's reset status, responding with 404
+// when the list does not exist
+func (h *Handler) listResetStatusByID(w http.ResponseWriter, listID string) (listResetStatus, bool) {
+	status, err := scanListReset(h.DB.QueryRow(listResetQuery+" AND l.list_id = ?", listID), time.Now().In(h.serverLocation()))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "List not found")
+		return status, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve list: "+err.Error())
+		return status, false
+	}
+	return status, true
+}
+
+// GetListReset retrieves a list's reset schedule, expiration and last reset
+func (h *Handler) GetListReset(w http.ResponseWriter, r *http.Request) {
+	listID := mux.Vars(r)["list_id"]
+
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	status, ok := h.listResetStatusByID(w, listID)
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "List reset retrieved", status)
+}
+
+// ResetList marks the list's leads as not called since the last reset, so
+// the hopper dials them again, as the Reset Lead-Called-Status button in the
+// list admin screen does. statuses limits the reset to leads in those
+// statuses; with dry_run=Y the leads are only counted.
+func (h *Handler) ResetList(w http.ResponseWriter, r *http.Request) {
+	listID := mux.Vars(r)["list_id"]
+
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	var req struct {
+		Statuses []string `json:"statuses"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	for _, status := range req.Statuses {
+		if err := validateStatus(status); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid status %q: %v", status, err))
+			return
+		}
+	}
+
+	if _, ok := h.listResetStatusByID(w, listID); !ok {
+		return
+	}
+
+	where := " WHERE list_id = ? AND called_since_last_reset != 'N'"
+	args := []interface{}{listID}
+	if len(req.Statuses) > 0 {
+		where += " AND status IN (" + placeholders(len(req.Statuses)) + ")"
+		args = append(args, stringArgs(req.Statuses)...)
+	}
+
+	dryRun, _ := schemaFlags(r)
+	if dryRun {
+		var matched int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_list"+where, args...).Scan(&matched); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to count leads: "+err.Error())
+			return
+		}
+		respondWithSuccess(w, "List reset preview", map[string]interface{}{
+			"list_id":  listID,
+			"statuses": req.Statuses,
+			"matched":  matched,
+		})
+		return
+	}
+
+	query := "UPDATE vicidial_list SET called_since_last_reset = 'N'" + where
+	res, err := h.DB.Exec(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reset list: "+err.Error())
+		return
+	}
+	reset, _ := res.RowsAffected()
+
+	if _, err := h.DB.Exec("UPDATE vicidial_lists SET resets_today = resets_today + 1 WHERE list_id = ?", listID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to count list reset: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "LISTS",
+		Type:     "RESET",
+		RecordID: listID,
+		Code:     "ADMIN API RESET LIST",
+		SQL:      query,
+		Args:     args,
+		After: map[string]interface{}{
+			"statuses": req.Statuses,
+			"reset":    reset,
+		},
+	})
+
+	status, ok := h.listResetStatusByID(w, listID)
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "List reset successfully", map[string]interface{}{
+		"list_id":      listID,
+		"statuses":     req.Statuses,
+		"reset":        reset,
+		"resets_today": status.ResetsToday,
+		"last_reset":   status.LastReset,
+		"next_reset":   status.NextReset,
+	})
+}
+
+// listScheduleFields are the reset schedule settings of a list
+type listScheduleFields struct {
+	ExpirationDate string `json:"expiration_date"`
+	ResetTime      string `json:"reset_time"`
+}
+
+var listSchedulePatchSpec = patchSpec{
+	Table:     "vicidial_lists",
+	Model:     listScheduleFields{},
+	KeyColumn: "list_id",
+	Validators: map[string]fieldValidator{
+		"expiration_date": func(value interface{}) error {
+			if value == "" {
+				return fmt.Errorf("must be a date in YYYY-MM-DD format")
+			}
+			return validateDate(value)
+		},
+		"reset_time": validateResetTime,
+	},
+	Touch: "list_changedate = NOW()",
+}
+
+// UpdateListResetSchedule sets a list's expiration_date, after which the
+// hopper stops dialing it, and its reset_time schedule
+func (h *Handler) UpdateListResetSchedule(w http.ResponseWriter, r *http.Request) {
+	listID := mux.Vars(r)["list_id"]
+
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	fields, ok := readPatch(w, r, listSchedulePatchSpec)
+	if !ok {
+		return
+	}
+
+	found, err := h.applyPatch(r, listSchedulePatchSpec, listID, fields, "LISTS", "ADMIN API UPDATE LIST RESET SCHEDULE")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update list: "+err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "List not found")
+		return
+	}
+
+	status, ok := h.listResetStatusByID(w, listID)
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "List reset schedule updated successfully", status)
+}
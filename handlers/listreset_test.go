@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextListReset(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	at := func(value string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", value, newYork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name      string
+		resetTime string
+		now       string
+		want      string // "" when there is no next reset
+	}{
+		{"later today", "0800-1700", "2025-01-08 09:30", "2025-01-08 17:00"},
+		{"before the first", "0800-1700", "2025-01-08 06:00", "2025-01-08 08:00"},
+		{"tomorrow", "0800-1700", "2025-01-08 18:00", "2025-01-09 08:00"},
+		{"at a reset time", "0800-1700", "2025-01-08 17:00", "2025-01-09 08:00"},
+		{"unsorted", "1700-0800-1200", "2025-01-08 09:00", "2025-01-08 12:00"},
+		{"single", "2330", "2025-01-08 23:45", "2025-01-09 23:30"},
+		{"month end", "0100", "2025-01-31 02:00", "2025-02-01 01:00"},
+		{"malformed entries skipped", "800-1700-12:00", "2025-01-08 09:30", "2025-01-08 17:00"},
+		{"DST starts", "0800", "2025-03-09 01:00", "2025-03-09 08:00"},
+		{"DST ends", "0800-1700", "2025-11-02 09:00", "2025-11-02 17:00"},
+		{"no schedule", "", "2025-01-08 09:30", ""},
+		{"nothing valid", "8am-5pm", "2025-01-08 09:30", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextListReset(tt.resetTime, at(tt.now))
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("nextListReset(%q) = %v, want nil", tt.resetTime, got)
+				}
+				return
+			}
+			if got == nil || !got.Equal(at(tt.want)) {
+				t.Errorf("nextListReset(%q, %s) = %v, want %s", tt.resetTime, tt.now, got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/vicidb/non-agent-api/models"
@@ -22,6 +23,10 @@ func (h *Handler) AddList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if list.CampaignID != "" && !requireCampaignAccess(w, r, list.CampaignID) {
+		return
+	}
+
 	if list.Active == "" {
 		list.Active = "Y"
 	}
@@ -31,7 +36,9 @@ func (h *Handler) AddList(w http.ResponseWriter, r *http.Request) {
 		VALUES (?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := h.DB.Exec(query, list.ListName, list.CampaignID, list.Active, list.ListDescription, list.Script, list.WebForm)
+	args := []interface{}{list.ListName, list.CampaignID, list.Active, list.ListDescription, list.Script, list.WebForm}
+
+	result, err := h.DB.Exec(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to create list: "+err.Error())
 		return
@@ -40,36 +47,51 @@ func (h *Handler) AddList(w http.ResponseWriter, r *http.Request) {
 	listID, _ := result.LastInsertId()
 	list.ListID = int(listID)
 
+	h.audit(r, auditEvent{
+		Section:  "LISTS",
+		Type:     "ADD",
+		RecordID: strconv.Itoa(list.ListID),
+		Code:     "ADMIN API ADD LIST",
+		SQL:      query,
+		Args:     args,
+		After:    h.snapshotRow("vicidial_lists", "list_id", list.ListID),
+	})
+
 	respondWithSuccess(w, "List created successfully", list)
 }
 
-// UpdateList updates an existing list
+// UpdateList updates the fields of a list present in the request body
 func (h *Handler) UpdateList(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	listID := vars["list_id"]
 
-	var list models.List
-	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !h.requireListAccess(w, r, listID) {
 		return
 	}
 
-	query := `
-		UPDATE vicidial_lists SET
-			list_name = ?, campaign_id = ?, active = ?,
-			list_description = ?, script = ?, web_form = ?
-		WHERE list_id = ?
-	`
+	fields, ok := readPatch(w, r, listPatchSpec)
+	if !ok {
+		return
+	}
 
-	_, err := h.DB.Exec(query, list.ListName, list.CampaignID, list.Active,
-		list.ListDescription, list.Script, list.WebForm, listID)
+	if campaignID, ok := patchValue(fields, "campaign_id"); ok && campaignID != "" && !requireCampaignAccess(w, r, campaignID.(string)) {
+		return
+	}
 
+	found, err := h.applyPatch(r, listPatchSpec, listID, fields, "LISTS", "ADMIN API UPDATE LIST")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update list: "+err.Error())
 		return
 	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "List not found")
+		return
+	}
 
-	respondWithSuccess(w, "List updated successfully", map[string]string{"list_id": listID})
+	respondWithSuccess(w, "List updated successfully", map[string]interface{}{
+		"list_id":        listID,
+		"updated_fields": patchFieldNames(fields),
+	})
 }
 
 // ListInfo retrieves list information
@@ -77,16 +99,24 @@ func (h *Handler) ListInfo(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	listID := vars["list_id"]
 
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
 	query := `
-		SELECT list_id, list_name, campaign_id, active, list_description, script, web_form
+		SELECT list_id, list_name, campaign_id, active, list_description, script, web_form,
+			   expiration_date, reset_time
 		FROM vicidial_lists WHERE list_id = ?
 	`
 
 	var list models.List
+	var expDate sql.NullTime
 	err := h.DB.QueryRow(query, listID).Scan(
 		&list.ListID, &list.ListName, &list.CampaignID, &list.Active,
 		&list.ListDescription, &list.Script, &list.WebForm,
+		&expDate, &list.ResetTime,
 	)
+	list.ExpDate = expDate.Time
 
 	if err == sql.ErrNoRows {
 		respondWithError(w, http.StatusNotFound, "List not found")
@@ -112,6 +142,10 @@ func (h *Handler) ListCustomFields(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	listID := vars["list_id"]
 
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		h.getListCustomFields(w, listID)
@@ -161,73 +195,155 @@ func (h *Handler) getListCustomFields(w http.ResponseWriter, listID string) {
 }
 
 func (h *Handler) addListCustomField(w http.ResponseWriter, r *http.Request, listID string) {
-	type FieldRequest struct {
-		FieldLabel    string `json:"field_label"`
-		FieldName     string `json:"field_name"`
-		FieldType     string `json:"field_type"`
-		FieldOptions  string `json:"field_options"`
-		FieldSize     int    `json:"field_size"`
-		FieldMax      int    `json:"field_max"`
-		FieldDefault  string `json:"field_default"`
-		FieldRequired string `json:"field_required"`
+	id, ok := h.customFieldListID(w, listID)
+	if !ok {
+		return
 	}
+	dryRun, force := schemaFlags(r)
 
-	var field FieldRequest
+	var field customFieldDef
 	if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	if err := field.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	query := `
-		INSERT INTO vicidial_lists_fields (list_id, field_label, field_name, field_type, field_options, field_size, field_max, field_default, field_required)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+	var exists int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists_fields WHERE list_id = ? AND field_label = ?", id, field.FieldLabel).Scan(&exists); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check fields: "+err.Error())
+		return
+	}
+	if exists > 0 {
+		respondWithError(w, http.StatusConflict, "Field "+field.FieldLabel+" already exists in list "+listID)
+		return
+	}
 
-	result, err := h.DB.Exec(query, listID, field.FieldLabel, field.FieldName, field.FieldType,
-		field.FieldOptions, field.FieldSize, field.FieldMax, field.FieldDefault, field.FieldRequired)
+	// Storage is created first so the field never exists without its column
+	table, err := h.loadCustomTable(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+	plan, err := h.planAdd(table, field)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to plan custom field change: "+err.Error())
+		return
+	}
+	if !respondWithPlan(w, dryRun, force, map[string]interface{}{"field": field, "schema": plan}, plan.Warnings) {
+		return
+	}
+	if err := h.applyCustomSchema(plan); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to alter custom field table: "+err.Error())
+		return
+	}
 
+	query, err := insertCustomFieldDef(h.DB, id, field)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to add field: "+err.Error())
 		return
 	}
 
-	fieldID, _ := result.LastInsertId()
-	respondWithSuccess(w, "Field added successfully", map[string]int64{"field_id": fieldID})
+	var fieldID int64
+	h.DB.QueryRow("SELECT field_id FROM vicidial_lists_fields WHERE list_id = ? AND field_label = ?", id, field.FieldLabel).Scan(&fieldID)
+
+	h.audit(r, auditEvent{
+		Section:  "CUSTOM_FIELDS",
+		Type:     "ADD",
+		RecordID: listID,
+		Code:     "ADMIN API ADD CUSTOM FIELD",
+		SQL:      query,
+		Args: []interface{}{id, field.FieldLabel, field.FieldName, field.FieldType, field.FieldOptions,
+			field.FieldSize, field.FieldMax, field.FieldDefault, field.FieldRequired, id},
+		After: map[string]interface{}{
+			"field": h.snapshotRow("vicidial_lists_fields", "field_id", fieldID),
+			"ddl":   plan.DDL,
+		},
+	})
+	respondWithSuccess(w, "Field added successfully", map[string]interface{}{"field_id": fieldID, "schema": plan})
 }
 
 func (h *Handler) updateListCustomField(w http.ResponseWriter, r *http.Request, listID string) {
-	type FieldUpdate struct {
-		FieldID       int    `json:"field_id"`
-		FieldLabel    string `json:"field_label"`
-		FieldType     string `json:"field_type"`
-		FieldOptions  string `json:"field_options"`
-		FieldSize     int    `json:"field_size"`
-		FieldMax      int    `json:"field_max"`
-		FieldDefault  string `json:"field_default"`
-		FieldRequired string `json:"field_required"`
+	id, ok := h.customFieldListID(w, listID)
+	if !ok {
+		return
 	}
+	dryRun, force := schemaFlags(r)
 
-	var field FieldUpdate
+	var field customFieldDef
 	if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	if err := field.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	query := `
-		UPDATE vicidial_lists_fields SET
-			field_label = ?, field_type = ?, field_options = ?,
-			field_size = ?, field_max = ?, field_default = ?, field_required = ?
-		WHERE field_id = ? AND list_id = ?
-	`
+	old, err := scanCustomFieldDef(h.DB.QueryRow("SELECT "+customFieldDefColumns+" FROM vicidial_lists_fields WHERE field_id = ? AND list_id = ?", field.FieldID, id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Field not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve field: "+err.Error())
+		return
+	}
 
-	_, err := h.DB.Exec(query, field.FieldLabel, field.FieldType, field.FieldOptions,
-		field.FieldSize, field.FieldMax, field.FieldDefault, field.FieldRequired,
-		field.FieldID, listID)
+	if field.FieldLabel != old.FieldLabel {
+		var exists int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists_fields WHERE list_id = ? AND field_label = ?", id, field.FieldLabel).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check fields: "+err.Error())
+			return
+		}
+		if exists > 0 {
+			respondWithError(w, http.StatusConflict, "Field "+field.FieldLabel+" already exists in list "+listID)
+			return
+		}
+	}
 
+	table, err := h.loadCustomTable(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read custom field table: "+err.Error())
+		return
+	}
+	plan, err := h.planUpdate(table, old, field)
+	if err != nil {
+		respondWithError(w, http.StatusConflict, "Failed to plan custom field change: "+err.Error())
+		return
+	}
+	if !respondWithPlan(w, dryRun, force, map[string]interface{}{"field": field, "schema": plan}, plan.Warnings) {
+		return
+	}
+
+	before := h.snapshotRow("vicidial_lists_fields", "field_id", field.FieldID)
+	if err := h.applyCustomSchema(plan); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to alter custom field table: "+err.Error())
+		return
+	}
+
+	query, err := updateCustomFieldDef(h.DB, id, field)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update field: "+err.Error())
 		return
 	}
 
-	respondWithSuccess(w, "Field updated successfully", nil)
+	h.audit(r, auditEvent{
+		Section:  "CUSTOM_FIELDS",
+		Type:     "MODIFY",
+		RecordID: listID,
+		Code:     "ADMIN API UPDATE CUSTOM FIELD",
+		SQL:      query,
+		Args: []interface{}{field.FieldLabel, field.FieldName, field.FieldType, field.FieldOptions,
+			field.FieldSize, field.FieldMax, field.FieldDefault, field.FieldRequired, field.FieldID, id},
+		Before: before,
+		After: map[string]interface{}{
+			"field": h.snapshotRow("vicidial_lists_fields", "field_id", field.FieldID),
+			"ddl":   plan.DDL,
+		},
+	})
+
+	respondWithSuccess(w, "Field updated successfully", map[string]interface{}{"schema": plan})
 }
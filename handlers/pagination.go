@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// sortField is a column a paginated endpoint may be sorted by
+type sortField struct {
+	Column   string // SQL expression, qualified when the query joins
+	Time     bool   // DATETIME or TIMESTAMP column
+	Nullable bool
+}
+
+// pageSpec describes how an endpoint pages through its results. Pages are
+// keyset based: the cursor holds the sort values of the last row returned,
+// and Key, a unique column, is always added to the sort to break ties. For
+// tables without a unique column, Ties are added after Key until the
+// combination is unique.
+type pageSpec struct {
+	Sorts        map[string]sortField
+	Key          string
+	Ties         []string
+	DefaultSort  string
+	DefaultLimit int
+	MaxLimit     int
+}
+
+// sortKey is one column of a parsed sort
+type sortKey struct {
+	Name string
+	Desc bool
+}
+
+// pageCursor is the decoded form of the opaque cursor parameter
+type pageCursor struct {
+	Sort  string        `json:"s"`
+	After []interface{} `json:"a"`
+}
+
+// page is a request for one page of results
+type page struct {
+	spec      pageSpec
+	sort      []sortKey
+	limit     int
+	after     []interface{}
+	withTotal bool
+
+	total *int64
+	rows  int
+	keys  []interface{} // scan destinations for the sort columns of the current row
+	last  []interface{} // sort values of the last row on the page
+}
+
+// Errors returned by parsePage
+var (
+	errInvalidCursor   = errors.New("Invalid cursor")
+	errCursorSortMatch = errors.New("Cursor was issued for a different sort")
+)
+
+// parsePage reads the limit, sort, cursor and include_total parameters
+func parsePage(r *http.Request, spec pageSpec) (*page, error) {
+	q := r.URL.Query()
+	p := &page{spec: spec, limit: spec.DefaultLimit, withTotal: strings.ToUpper(q.Get("include_total")) == "Y"}
+
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > spec.MaxLimit {
+			return nil, errors.New("limit must be between 1 and " + strconv.Itoa(spec.MaxLimit))
+		}
+		p.limit = n
+	}
+
+	sortParam := q.Get("sort")
+	var cursor pageCursor
+	if value := q.Get("cursor"); value != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || json.Unmarshal(decoded, &cursor) != nil {
+			return nil, errInvalidCursor
+		}
+		if sortParam == "" {
+			sortParam = cursor.Sort
+		}
+	}
+	if sortParam == "" {
+		sortParam = spec.DefaultSort
+	}
+
+	seen := map[string]bool{}
+	for _, part := range strings.Split(sortParam, ",") {
+		key := sortKey{Name: strings.TrimSpace(part)}
+		if strings.HasPrefix(key.Name, "-") {
+			key.Desc = true
+			key.Name = key.Name[1:]
+		}
+		if _, ok := spec.Sorts[key.Name]; !ok {
+			return nil, errors.New("Invalid sort field " + key.Name + ", use " + spec.sortNames())
+		}
+		if seen[key.Name] {
+			return nil, errors.New("Duplicate sort field " + key.Name)
+		}
+		seen[key.Name] = true
+		p.sort = append(p.sort, key)
+	}
+	for _, name := range append([]string{spec.Key}, spec.Ties...) {
+		if !seen[name] {
+			p.sort = append(p.sort, sortKey{Name: name, Desc: p.sort[0].Desc})
+		}
+	}
+
+	if cursor.After != nil {
+		if cursor.Sort != p.sortString() {
+			return nil, errCursorSortMatch
+		}
+		if len(cursor.After) != len(p.sort) {
+			return nil, errInvalidCursor
+		}
+		p.after = cursor.After
+	}
+	return p, nil
+}
+
+// readPage parses the page parameters, responding with 400 when they are invalid
+func readPage(w http.ResponseWriter, r *http.Request, spec pageSpec) (*page, bool) {
+	p, err := parsePage(r, spec)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return p, true
+}
+
+// sortNames lists the fields an endpoint can be sorted by
+func (s pageSpec) sortNames() string {
+	names := make([]string, 0, len(s.Sorts))
+	for name := range s.Sorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// sortString is the page's sort in the sort parameter's syntax
+func (p *page) sortString() string {
+	parts := make([]string, len(p.sort))
+	for i, key := range p.sort {
+		if key.Desc {
+			parts[i] = "-" + key.Name
+		} else {
+			parts[i] = key.Name
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// keysetCondition returns the clause selecting rows after the cursor. NULLs
+// sort first in MySQL, so nullable columns need their own comparisons.
+func (p *page) keysetCondition() (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+
+	for i, key := range p.sort {
+		var parts []string
+		var partArgs []interface{}
+		for j := 0; j < i; j++ {
+			prev := p.spec.Sorts[p.sort[j].Name]
+			if p.after[j] == nil {
+				parts = append(parts, prev.Column+" IS NULL")
+			} else {
+				parts = append(parts, prev.Column+" = ?")
+				partArgs = append(partArgs, p.after[j])
+			}
+		}
+
+		field := p.spec.Sorts[key.Name]
+		switch {
+		case p.after[i] == nil && key.Desc:
+			// Nothing sorts after NULL in descending order
+			continue
+		case p.after[i] == nil:
+			parts = append(parts, field.Column+" IS NOT NULL")
+		case key.Desc && field.Nullable:
+			parts = append(parts, "("+field.Column+" < ? OR "+field.Column+" IS NULL)")
+			partArgs = append(partArgs, p.after[i])
+		case key.Desc:
+			parts = append(parts, field.Column+" < ?")
+			partArgs = append(partArgs, p.after[i])
+		default:
+			parts = append(parts, field.Column+" > ?")
+			partArgs = append(partArgs, p.after[i])
+		}
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+		args = append(args, partArgs...)
+	}
+
+	if len(clauses) == 0 {
+		return " AND 1=0", nil
+	}
+	return " AND (" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// query runs the page's query. selectSQL is the SELECT list without FROM and
+// fromSQL the FROM and WHERE clauses with their args; the sort columns are
+// selected after the caller's columns and must be scanned with dest.
+func (p *page) query(db *sql.DB, selectSQL, fromSQL string, args []interface{}) (*sql.Rows, error) {
+	if p.withTotal {
+		var total int64
+		if err := db.QueryRow("SELECT COUNT(*) "+fromSQL, args...).Scan(&total); err != nil {
+			return nil, err
+		}
+		p.total = &total
+	}
+
+	columns := make([]string, len(p.sort))
+	order := make([]string, len(p.sort))
+	for i, key := range p.sort {
+		columns[i] = p.spec.Sorts[key.Name].Column
+		order[i] = columns[i]
+		if key.Desc {
+			order[i] += " DESC"
+		}
+	}
+
+	query := selectSQL + ", " + strings.Join(columns, ", ") + " " + fromSQL
+	queryArgs := append([]interface{}{}, args...)
+	if p.after != nil {
+		condition, conditionArgs := p.keysetCondition()
+		query += condition
+		queryArgs = append(queryArgs, conditionArgs...)
+	}
+	query += " ORDER BY " + strings.Join(order, ", ") + " LIMIT ?"
+	queryArgs = append(queryArgs, p.limit+1)
+
+	return db.Query(query, queryArgs...)
+}
+
+// dest appends the scan destinations of the sort columns to the caller's
+func (p *page) dest(dest ...interface{}) []interface{} {
+	p.keys = make([]interface{}, len(p.sort))
+	for i, key := range p.sort {
+		if p.spec.Sorts[key.Name].Time {
+			p.keys[i] = new(sql.NullTime)
+		} else {
+			p.keys[i] = new(sql.NullString)
+		}
+		dest = append(dest, p.keys[i])
+	}
+	return dest
+}
+
+// more is called after scanning each row and reports whether the row is
+// past the end of the page, in which case it is dropped and the caller stops
+func (p *page) more() bool {
+	p.rows++
+	if p.rows > p.limit {
+		return true
+	}
+
+	p.last = make([]interface{}, len(p.keys))
+	for i, key := range p.keys {
+		switch v := key.(type) {
+		case *sql.NullTime:
+			if v.Valid {
+				p.last[i] = v.Time.Format("2006-01-02 15:04:05")
+			}
+		case *sql.NullString:
+			if v.Valid {
+				p.last[i] = v.String
+			}
+		}
+	}
+	return false
+}
+
+// pagination returns the page's pagination details and links
+func (p *page) pagination(r *http.Request) (*models.Pagination, *models.Links) {
+	count := p.rows
+	if count > p.limit {
+		count = p.limit
+	}
+	info := &models.Pagination{
+		Limit:   p.limit,
+		Sort:    p.sortString(),
+		Count:   count,
+		HasMore: p.rows > p.limit,
+		Total:   p.total,
+	}
+	links := &models.Links{Self: pageLink(r, "")}
+
+	if info.HasMore {
+		encoded, _ := json.Marshal(pageCursor{Sort: info.Sort, After: p.last})
+		info.NextCursor = base64.RawURLEncoding.EncodeToString(encoded)
+		links.Next = pageLink(r, info.NextCursor)
+	}
+	return info, links
+}
+
+// pageLink returns the request's URL with the cursor replaced. Credentials
+// passed as query parameters are left out.
+func pageLink(r *http.Request, cursor string) string {
+	q := r.URL.Query()
+	q.Del("api_key")
+	q.Del("pass")
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	if len(q) == 0 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// respondWithPage sends a success response for one page of results
+func respondWithPage(w http.ResponseWriter, r *http.Request, message string, data interface{}, p *page) {
+	info, links := p.pagination(r)
+	respondWithJSON(w, http.StatusOK, models.APIResponse{
+		Success:    true,
+		Message:    message,
+		Data:       data,
+		Pagination: info,
+		Links:      links,
+	})
+}
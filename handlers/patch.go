@@ -0,0 +1,490 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// fieldValidator checks a decoded value before it is written
+type fieldValidator func(value interface{}) error
+
+// patchSpec describes how a model maps onto its table for partial updates.
+// Every json field of the model is updatable unless listed as read-only, so
+// new columns only need a model field, not a new UPDATE statement.
+type patchSpec struct {
+	Table       string
+	KeyColumn   string
+	ScopeColumn string // second key column of per-campaign rows, such as campaign_id
+	Model       interface{}
+	Columns     map[string]string // json name to column, where they differ
+	ReadOnly    map[string]bool
+	Validators  map[string]fieldValidator
+	Touch       string // extra assignment applied on every update, e.g. "modify_date = NOW()"
+}
+
+// patchField is one validated assignment from a request body
+type patchField struct {
+	Name   string
+	Column string
+	Value  interface{}
+}
+
+// decodePatch parses a JSON object and returns an assignment for every field
+// present in it. Unknown, read-only and invalid fields are rejected.
+func decodePatch(spec patchSpec, body []byte) ([]patchField, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid request payload")
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("No fields to update")
+	}
+
+	types := modelFieldTypes(spec.Model)
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := []patchField{}
+	columns := map[string]string{}
+	for _, name := range names {
+		fieldType, ok := types[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown field %s", name)
+		}
+		if spec.ReadOnly[name] {
+			return nil, fmt.Errorf("Field %s cannot be updated", name)
+		}
+
+		value, err := decodePatchValue(raw[name], fieldType)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s", name)
+		}
+
+		if validate, ok := spec.Validators[name]; ok {
+			if err := validate(value); err != nil {
+				return nil, fmt.Errorf("Invalid value for %s: %v", name, err)
+			}
+		}
+
+		column := name
+		if mapped, ok := spec.Columns[name]; ok {
+			column = mapped
+		}
+		if other, ok := columns[column]; ok {
+			return nil, fmt.Errorf("Fields %s and %s cannot both be given", other, name)
+		}
+		columns[column] = name
+		fields = append(fields, patchField{Name: name, Column: column, Value: value})
+	}
+
+	return fields, nil
+}
+
+// readPatch decodes the request body as a patch, responding with 400 on error
+func readPatch(w http.ResponseWriter, r *http.Request, spec patchSpec) ([]patchField, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, false
+	}
+	fields, err := decodePatch(spec, body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return fields, true
+}
+
+// patchTimeLayouts are accepted for date and datetime fields
+var patchTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// decodePatchValue decodes a JSON value into the model field's type. Dates
+// are accepted in the formats VICIdial uses and passed on as strings.
+func decodePatchValue(raw json.RawMessage, fieldType reflect.Type) (interface{}, error) {
+	if fieldType == reflect.TypeOf(time.Time{}) {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		for _, layout := range patchTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.Format("2006-01-02 15:04:05"), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q", s)
+	}
+
+	ptr := reflect.New(fieldType)
+	if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// patchWhere returns the WHERE clause identifying a row, by KeyColumn or by
+// ScopeColumn and KeyColumn, whose values are passed in that order
+func patchWhere(spec patchSpec) string {
+	if spec.ScopeColumn != "" {
+		return " WHERE " + spec.ScopeColumn + " = ? AND " + spec.KeyColumn + " = ?"
+	}
+	return " WHERE " + spec.KeyColumn + " = ?"
+}
+
+// buildPatchQuery returns the UPDATE statement and arguments for the fields.
+// keys are the scope and key values for scoped specs, otherwise the key.
+func buildPatchQuery(spec patchSpec, fields []patchField, keys ...interface{}) (string, []interface{}) {
+	sets := make([]string, 0, len(fields)+1)
+	args := make([]interface{}, 0, len(fields)+len(keys))
+	for _, field := range fields {
+		sets = append(sets, "`"+field.Column+"` = ?")
+		args = append(args, field.Value)
+	}
+	if spec.Touch != "" {
+		sets = append(sets, spec.Touch)
+	}
+	args = append(args, keys...)
+
+	query := "UPDATE " + spec.Table + " SET " + strings.Join(sets, ", ") + patchWhere(spec)
+	return query, args
+}
+
+// buildInsertQuery returns an INSERT of the fields, with extra assignments
+// such as "entry_date": "NOW()" written into the statement as is
+func buildInsertQuery(table string, fields []patchField, extra map[string]string) (string, []interface{}) {
+	columns := make([]string, 0, len(fields)+len(extra))
+	values := make([]string, 0, len(fields)+len(extra))
+	args := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		columns = append(columns, "`"+field.Column+"`")
+		values = append(values, "?")
+		args = append(args, field.Value)
+	}
+	names := make([]string, 0, len(extra))
+	for column := range extra {
+		names = append(names, column)
+	}
+	sort.Strings(names)
+	for _, column := range names {
+		columns = append(columns, "`"+column+"`")
+		values = append(values, extra[column])
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(values, ", ") + ")", args
+}
+
+// applyPatch updates the row identified by key and records the change in the
+// admin log. It reports false when the row does not exist.
+func (h *Handler) applyPatch(r *http.Request, spec patchSpec, key string, fields []patchField, section, code string) (bool, error) {
+	return h.applyPatchKeys(r, spec, key, []interface{}{key}, fields, section, code)
+}
+
+// applyScopedPatch is applyPatch for a row of a scoped spec, such as one
+// campaign's status. The change is logged against the scope.
+func (h *Handler) applyScopedPatch(r *http.Request, spec patchSpec, scope, key string, fields []patchField, section, code string) (bool, error) {
+	return h.applyPatchKeys(r, spec, scope, []interface{}{scope, key}, fields, section, code)
+}
+
+func (h *Handler) applyPatchKeys(r *http.Request, spec patchSpec, recordID string, keys []interface{}, fields []patchField, section, code string) (bool, error) {
+	snapshot := func() map[string]interface{} {
+		rows := h.snapshotRows("SELECT * FROM "+spec.Table+patchWhere(spec)+" LIMIT 1", keys...)
+		if len(rows) == 0 {
+			return nil
+		}
+		return rows[0]
+	}
+	before := snapshot()
+	if before == nil {
+		return false, nil
+	}
+
+	query, args := buildPatchQuery(spec, fields, keys...)
+	if _, err := h.DB.Exec(query, args...); err != nil {
+		return true, err
+	}
+
+	// Keep secrets out of event_sql
+	logArgs := append([]interface{}{}, args...)
+	for i, field := range fields {
+		if auditRedactedColumns[field.Column] {
+			logArgs[i] = "********"
+		}
+	}
+
+	h.audit(r, auditEvent{
+		Section:  section,
+		Type:     "MODIFY",
+		RecordID: recordID,
+		Code:     code,
+		SQL:      query,
+		Args:     logArgs,
+		Before:   before,
+		After:    snapshot(),
+	})
+	return true, nil
+}
+
+// patchValue returns the value of a field in the patch, if present
+func patchValue(fields []patchField, name string) (interface{}, bool) {
+	for _, field := range fields {
+		if field.Name == name {
+			return field.Value, true
+		}
+	}
+	return nil, false
+}
+
+// patchFieldNames lists the fields that a patch changes
+func patchFieldNames(fields []patchField) []string {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Name
+	}
+	return names
+}
+
+// modelFieldTypes maps a struct's json field names to their Go types
+func modelFieldTypes(model interface{}) map[string]reflect.Type {
+	t := reflect.TypeOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	types := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			// Embedded structs contribute their fields, as encoding/json does
+			for name, fieldType := range modelFieldTypes(reflect.New(field.Type).Elem().Interface()) {
+				types[name] = fieldType
+			}
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		types[name] = field.Type
+	}
+	return types
+}
+
+// Common validators
+
+func validateYN(value interface{}) error {
+	return validateEnum("Y", "N")(value)
+}
+
+func validateEnum(allowed ...string) fieldValidator {
+	return func(value interface{}) error {
+		s := fmt.Sprint(value)
+		for _, option := range allowed {
+			if s == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(allowed, ", "))
+	}
+}
+
+func validateMaxLen(max int) fieldValidator {
+	return func(value interface{}) error {
+		if len(fmt.Sprint(value)) > max {
+			return fmt.Errorf("must be at most %d characters", max)
+		}
+		return nil
+	}
+}
+
+func validateIntRange(min, max int) fieldValidator {
+	return func(value interface{}) error {
+		n, ok := value.(int)
+		if !ok || n < min || n > max {
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return nil
+	}
+}
+
+var digitsPattern = regexp.MustCompile(`^[0-9]*$`)
+
+func validateDigits(min, max int) fieldValidator {
+	return func(value interface{}) error {
+		s := fmt.Sprint(value)
+		if !digitsPattern.MatchString(s) || len(s) < min || len(s) > max {
+			return fmt.Errorf("must be %d to %d digits", min, max)
+		}
+		return nil
+	}
+}
+
+func validateEmail(value interface{}) error {
+	s := fmt.Sprint(value)
+	if s == "" {
+		return nil
+	}
+	if _, err := mail.ParseAddress(s); err != nil {
+		return fmt.Errorf("must be a valid email address")
+	}
+	return nil
+}
+
+func validateDate(value interface{}) error {
+	s := fmt.Sprint(value)
+	if s == "" {
+		return nil
+	}
+	if _, err := time.Parse("2006-01-02", s); err != nil {
+		return fmt.Errorf("must be a date in YYYY-MM-DD format")
+	}
+	return nil
+}
+
+func validateIP(value interface{}) error {
+	s := fmt.Sprint(value)
+	if s == "" {
+		return nil
+	}
+	if net.ParseIP(s) == nil {
+		return fmt.Errorf("must be a valid IP address")
+	}
+	return nil
+}
+
+var statusPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,6}$`)
+
+func validateStatus(value interface{}) error {
+	if !statusPattern.MatchString(fmt.Sprint(value)) {
+		return fmt.Errorf("must be 1 to 6 letters, digits or underscores")
+	}
+	return nil
+}
+
+var gmtOffsetPattern = regexp.MustCompile(`^[+-]?[0-9]{1,2}(\.[0-9]{1,2})?$`)
+
+func validateGMTOffset(value interface{}) error {
+	if !gmtOffsetPattern.MatchString(fmt.Sprint(value)) {
+		return fmt.Errorf("must be an offset such as -5.00")
+	}
+	return nil
+}
+
+var resetTimePattern = regexp.MustCompile(`^(([01][0-9]|2[0-3])[0-5][0-9](-([01][0-9]|2[0-3])[0-5][0-9])*)?$`)
+
+func validateResetTime(value interface{}) error {
+	if !resetTimePattern.MatchString(fmt.Sprint(value)) {
+		return fmt.Errorf("must be HHMM times separated by dashes")
+	}
+	return nil
+}
+
+// Patch specs for the updatable models
+
+var leadPatchSpec = patchSpec{
+	Table:     "vicidial_list",
+	Model:     models.Lead{},
+	KeyColumn: "lead_id",
+	ReadOnly: map[string]bool{
+		"lead_id": true, "entry_date": true, "modify_date": true,
+	},
+	Validators: map[string]fieldValidator{
+		"phone_number":            validateDigits(6, 18),
+		"phone_code":              validateDigits(1, 10),
+		"vendor_lead_code":        validateMaxLen(20),
+		"source_id":               validateMaxLen(50),
+		"title":                   validateMaxLen(4),
+		"gmt_offset_now":          validateGMTOffset,
+		"alt_phone":               validateMaxLen(12),
+		"status":                  validateStatus,
+		"email":                   validateEmail,
+		"gender":                  validateEnum("M", "F", "U", ""),
+		"date_of_birth":           validateDate,
+		"middle_initial":          validateMaxLen(1),
+		"state":                   validateMaxLen(2),
+		"postal_code":             validateMaxLen(10),
+		"country_code":            validateMaxLen(3),
+		"called_since_last_reset": validateEnum("Y", "N", "Y1", "Y2", "Y3", "Y4", "Y5", "Y6", "Y7", "Y8", "Y9", "Y10", "D"),
+		"owner":                   validateMaxLen(20),
+	},
+	Touch: "modify_date = NOW()",
+}
+
+var listPatchSpec = patchSpec{
+	Table:     "vicidial_lists",
+	Model:     models.List{},
+	KeyColumn: "list_id",
+	Columns: map[string]string{
+		"exp_date": "expiration_date",
+	},
+	ReadOnly: map[string]bool{
+		"list_id": true, "list_changeuser": true,
+	},
+	Validators: map[string]fieldValidator{
+		"list_name":   validateMaxLen(30),
+		"active":      validateYN,
+		"campaign_id": validateMaxLen(8),
+		"reset_time":  validateResetTime,
+	},
+	Touch: "list_changedate = NOW()",
+}
+
+var campaignPatchSpec = patchSpec{
+	Table:     "vicidial_campaigns",
+	Model:     campaignUpdate{},
+	KeyColumn: "campaign_id",
+	Columns: map[string]string{
+		"dial_status": "dial_statuses",
+		"script":      "campaign_script",
+	},
+	ReadOnly: map[string]bool{
+		"campaign_id": true,
+	},
+	Validators: campaignUpdateValidators(),
+}
+
+var userPatchSpec = patchSpec{
+	Table:     "vicidial_users",
+	Model:     models.User{},
+	KeyColumn: "user",
+	ReadOnly: map[string]bool{
+		"user_id": true, "user": true, "pass": true, "user_start": true,
+	},
+	Validators: map[string]fieldValidator{
+		"full_name":              validateMaxLen(50),
+		"user_level":             validateIntRange(1, 9),
+		"active":                 validateYN,
+		"email":                  validateEmail,
+		"agent_choose_ingroups":  validateEnum("0", "1"),
+		"agent_choose_blended":   validateEnum("0", "1"),
+		"closer_default_blended": validateEnum("0", "1"),
+	},
+}
+
+var phonePatchSpec = patchSpec{
+	Table:     "phones",
+	Model:     models.Phone{},
+	KeyColumn: "extension",
+	ReadOnly: map[string]bool{
+		"extension": true, "last_update_time": true, "messages": true,
+	},
+	Validators: map[string]fieldValidator{
+		"active":       validateYN,
+		"phone_ip":     validateIP,
+		"computer_ip":  validateIP,
+		"server_ip":    validateIP,
+		"outbound_cid": validateDigits(0, 20),
+	},
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBuildPatchQuery(t *testing.T) {
+	fields := []patchField{
+		{Name: "list_name", Column: "list_name", Value: "Spring"},
+		{Name: "active", Column: "active", Value: "Y"},
+	}
+
+	tests := []struct {
+		name      string
+		spec      patchSpec
+		keys      []interface{}
+		wantQuery string
+		wantArgs  []interface{}
+	}{
+		{
+			name:      "keyed",
+			spec:      patchSpec{Table: "vicidial_lists", KeyColumn: "list_id"},
+			keys:      []interface{}{"101"},
+			wantQuery: "UPDATE vicidial_lists SET `list_name` = ?, `active` = ? WHERE list_id = ?",
+			wantArgs:  []interface{}{"Spring", "Y", "101"},
+		},
+		{
+			name:      "touch",
+			spec:      patchSpec{Table: "vicidial_lists", KeyColumn: "list_id", Touch: "list_changedate = NOW()"},
+			keys:      []interface{}{"101"},
+			wantQuery: "UPDATE vicidial_lists SET `list_name` = ?, `active` = ?, list_changedate = NOW() WHERE list_id = ?",
+			wantArgs:  []interface{}{"Spring", "Y", "101"},
+		},
+		{
+			name:      "scoped",
+			spec:      patchSpec{Table: "vicidial_campaign_statuses", KeyColumn: "status", ScopeColumn: "campaign_id"},
+			keys:      []interface{}{"SALES", "CALLBK"},
+			wantQuery: "UPDATE vicidial_campaign_statuses SET `list_name` = ?, `active` = ? WHERE campaign_id = ? AND status = ?",
+			wantArgs:  []interface{}{"Spring", "Y", "SALES", "CALLBK"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := buildPatchQuery(tt.spec, fields, tt.keys...)
+			if query != tt.wantQuery {
+				t.Errorf("query = %q, want %q", query, tt.wantQuery)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestApplyScopedPatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	h := &Handler{DB: db}
+
+	snapshot := regexp.QuoteMeta("SELECT * FROM vicidial_pause_codes WHERE campaign_id = ? AND pause_code = ? LIMIT 1")
+	mock.ExpectQuery(snapshot).WithArgs("SALES", "LUNCH").
+		WillReturnRows(sqlmock.NewRows([]string{"pause_code", "pause_code_name", "billable", "campaign_id"}).
+			AddRow("LUNCH", "Lunch", "NO", "SALES"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_pause_codes SET `billable` = ? WHERE campaign_id = ? AND pause_code = ?")).
+		WithArgs("YES", "SALES", "LUNCH").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(snapshot).WithArgs("SALES", "LUNCH").
+		WillReturnRows(sqlmock.NewRows([]string{"pause_code", "pause_code_name", "billable", "campaign_id"}).
+			AddRow("LUNCH", "Lunch", "YES", "SALES"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_admin_log")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "CAMPAIGNS", "MODIFY", "SALES",
+			"ADMIN API MODIFY PAUSE CODE LUNCH",
+			"UPDATE vicidial_pause_codes SET `billable` = 'YES' WHERE campaign_id = 'SALES' AND pause_code = 'LUNCH'",
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r := httptest.NewRequest("PATCH", "/campaigns/SALES/pause-codes/LUNCH", nil)
+	fields := []patchField{{Name: "billable", Column: "billable", Value: "YES"}}
+	found, err := h.applyScopedPatch(r, pauseCodePatchSpec, "SALES", "LUNCH", fields, "CAMPAIGNS", "ADMIN API MODIFY PAUSE CODE LUNCH")
+	if err != nil {
+		t.Fatalf("applyScopedPatch: %v", err)
+	}
+	if !found {
+		t.Error("applyScopedPatch found = false for an existing row")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyScopedPatchMissingRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	h := &Handler{DB: db}
+
+	// Nothing is updated or logged when the scope has no such row
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM vicidial_pause_codes WHERE campaign_id = ? AND pause_code = ? LIMIT 1")).
+		WithArgs("SALES", "NAP").
+		WillReturnRows(sqlmock.NewRows([]string{"pause_code", "pause_code_name", "billable", "campaign_id"}))
+
+	r := httptest.NewRequest("PATCH", "/campaigns/SALES/pause-codes/NAP", nil)
+	fields := []patchField{{Name: "billable", Column: "billable", Value: "YES"}}
+	found, err := h.applyScopedPatch(r, pauseCodePatchSpec, "SALES", "NAP", fields, "CAMPAIGNS", "ADMIN API MODIFY PAUSE CODE NAP")
+	if err != nil || found {
+		t.Errorf("applyScopedPatch = %v, %v, want false, nil", found, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyPatchRedactsSecrets(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	h := &Handler{DB: db}
+
+	spec := patchSpec{Table: "vicidial_users", KeyColumn: "user"}
+	snapshot := regexp.QuoteMeta("SELECT * FROM vicidial_users WHERE user = ? LIMIT 1")
+	mock.ExpectQuery(snapshot).WithArgs("6001").
+		WillReturnRows(sqlmock.NewRows([]string{"user", "pass"}).AddRow("6001", "old"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_users SET `pass` = ? WHERE user = ?")).
+		WithArgs("s3cret", "6001").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(snapshot).WithArgs("6001").
+		WillReturnRows(sqlmock.NewRows([]string{"user", "pass"}).AddRow("6001", "s3cret"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vicidial_admin_log")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "USERS", "MODIFY", "6001", "ADMIN API MODIFY USER",
+			"UPDATE vicidial_users SET `pass` = '********' WHERE user = '6001'",
+			`{"after":{"pass":"********","user":"6001"},"before":{"pass":"********","user":"6001"}}`,
+			sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	r := httptest.NewRequest("PATCH", "/users/6001", nil)
+	fields := []patchField{{Name: "pass", Column: "pass", Value: "s3cret"}}
+	if _, err := h.applyPatch(r, spec, "6001", fields, "USERS", "ADMIN API MODIFY USER"); err != nil {
+		t.Fatalf("applyPatch: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+var pauseCodePatchSpec = patchSpec{
+	Table:       "vicidial_pause_codes",
+	Model:       models.PauseCode{},
+	KeyColumn:   "pause_code",
+	ScopeColumn: "campaign_id",
+	ReadOnly:    map[string]bool{"pause_code": true, "campaign_id": true},
+	Validators: map[string]fieldValidator{
+		"pause_code":      validateStatus,
+		"pause_code_name": validateMaxLen(30),
+		"billable":        validateEnum("YES", "NO", "HALF"),
+	},
+}
+
+// ListPauseCodes lists the pause codes agents of a campaign can choose
+func (h *Handler) ListPauseCodes(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+	if !h.requireCampaign(w, r, campaignID) {
+		return
+	}
+
+	rows, err := h.DB.Query(`
+		SELECT pause_code, pause_code_name, billable, campaign_id
+		FROM vicidial_pause_codes WHERE campaign_id = ? ORDER BY pause_code
+	`, campaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve pause codes: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	codes := []models.PauseCode{}
+	for rows.Next() {
+		var pc models.PauseCode
+		if err := rows.Scan(&pc.PauseCode, &pc.PauseCodeName, &pc.Billable, &pc.CampaignID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read pause code: "+err.Error())
+			return
+		}
+		codes = append(codes, pc)
+	}
+	respondWithSuccess(w, "Pause codes retrieved", codes)
+}
+
+// CreatePauseCode adds a pause code to a campaign. billable defaults to NO.
+func (h *Handler) CreatePauseCode(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+	if !h.requireCampaign(w, r, campaignID) {
+		return
+	}
+
+	fields, ok := readCreate(w, r, pauseCodePatchSpec, "pause_code", "pause_code_name")
+	if !ok {
+		return
+	}
+	code, _ := patchValue(fields, "pause_code")
+
+	var taken int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_pause_codes WHERE campaign_id = ? AND pause_code = ?", campaignID, code).Scan(&taken); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up pause code: "+err.Error())
+		return
+	}
+	if taken > 0 {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Pause code %s already exists", code))
+		return
+	}
+	if _, ok := patchValue(fields, "billable"); !ok {
+		fields = append(fields, patchField{Name: "billable", Column: "billable", Value: "NO"})
+	}
+	fields = append(fields, patchField{Name: "campaign_id", Column: "campaign_id", Value: campaignID})
+
+	query, args := buildInsertQuery(pauseCodePatchSpec.Table, fields, nil)
+	if _, err := h.DB.Exec(query, args...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create pause code: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "ADD",
+		RecordID: campaignID,
+		Code:     fmt.Sprintf("ADMIN API ADD PAUSE CODE %s", code),
+		SQL:      query,
+		Args:     args,
+	})
+
+	pc := models.PauseCode{CampaignID: campaignID}
+	for _, field := range fields {
+		switch field.Name {
+		case "pause_code":
+			pc.PauseCode = field.Value.(string)
+		case "pause_code_name":
+			pc.PauseCodeName = field.Value.(string)
+		case "billable":
+			pc.Billable = field.Value.(string)
+		}
+	}
+	respondWithSuccess(w, "Pause code created successfully", pc)
+}
+
+// UpdatePauseCode updates the name or billable flag of a pause code
+func (h *Handler) UpdatePauseCode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	campaignID, code := vars["campaign_id"], vars["pause_code"]
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	fields, ok := readPatch(w, r, pauseCodePatchSpec)
+	if !ok {
+		return
+	}
+	found, err := h.applyScopedPatch(r, pauseCodePatchSpec, campaignID, code, fields, "CAMPAIGNS", "ADMIN API MODIFY PAUSE CODE "+code)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update pause code: "+err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Pause code not found")
+		return
+	}
+	respondWithSuccess(w, "Pause code updated successfully", map[string]interface{}{
+		"campaign_id":    campaignID,
+		"pause_code":     code,
+		"updated_fields": patchFieldNames(fields),
+	})
+}
+
+// DeletePauseCode removes a pause code from a campaign. Past agent pauses
+// keep the code in vicidial_agent_log.
+func (h *Handler) DeletePauseCode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	campaignID, code := vars["campaign_id"], vars["pause_code"]
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+	h.deleteScopedRow(w, r, pauseCodePatchSpec, campaignID, code, "Pause code", "ADMIN API DELETE PAUSE CODE "+code)
+}
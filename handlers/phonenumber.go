@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// phoneNumber is a normalized phone number split the way vicidial_list
+// stores it: the country calling code in phone_code and the national number,
+// without trunk prefix, in phone_number
+type phoneNumber struct {
+	Code     string `json:"phone_code"`
+	National string `json:"phone_number"`
+}
+
+// phoneCountry holds the numbering rules for one country calling code: the
+// length of national numbers and the trunk prefix dialed before them at home
+type phoneCountry struct {
+	Code   string
+	MinLen int
+	MaxLen int
+	Trunk  string
+}
+
+// phoneCountries are the calling codes with known rules. Other codes accept
+// any national number that fits E.164.
+var phoneCountries = map[string]phoneCountry{
+	"1":   {Code: "1", MinLen: 10, MaxLen: 10},
+	"7":   {Code: "7", MinLen: 10, MaxLen: 10, Trunk: "8"},
+	"20":  {Code: "20", MinLen: 8, MaxLen: 10, Trunk: "0"},
+	"27":  {Code: "27", MinLen: 9, MaxLen: 9, Trunk: "0"},
+	"30":  {Code: "30", MinLen: 10, MaxLen: 10},
+	"31":  {Code: "31", MinLen: 9, MaxLen: 9, Trunk: "0"},
+	"32":  {Code: "32", MinLen: 8, MaxLen: 9, Trunk: "0"},
+	"33":  {Code: "33", MinLen: 9, MaxLen: 9, Trunk: "0"},
+	"34":  {Code: "34", MinLen: 9, MaxLen: 9},
+	"39":  {Code: "39", MinLen: 6, MaxLen: 11},
+	"41":  {Code: "41", MinLen: 9, MaxLen: 9, Trunk: "0"},
+	"43":  {Code: "43", MinLen: 4, MaxLen: 13, Trunk: "0"},
+	"44":  {Code: "44", MinLen: 9, MaxLen: 10, Trunk: "0"},
+	"45":  {Code: "45", MinLen: 8, MaxLen: 8},
+	"46":  {Code: "46", MinLen: 6, MaxLen: 9, Trunk: "0"},
+	"47":  {Code: "47", MinLen: 8, MaxLen: 8},
+	"48":  {Code: "48", MinLen: 9, MaxLen: 9},
+	"49":  {Code: "49", MinLen: 6, MaxLen: 13, Trunk: "0"},
+	"52":  {Code: "52", MinLen: 10, MaxLen: 10},
+	"54":  {Code: "54", MinLen: 10, MaxLen: 10, Trunk: "0"},
+	"55":  {Code: "55", MinLen: 10, MaxLen: 11, Trunk: "0"},
+	"56":  {Code: "56", MinLen: 9, MaxLen: 9},
+	"57":  {Code: "57", MinLen: 10, MaxLen: 10},
+	"60":  {Code: "60", MinLen: 9, MaxLen: 10, Trunk: "0"},
+	"61":  {Code: "61", MinLen: 9, MaxLen: 9, Trunk: "0"},
+	"62":  {Code: "62", MinLen: 8, MaxLen: 12, Trunk: "0"},
+	"63":  {Code: "63", MinLen: 8, MaxLen: 10, Trunk: "0"},
+	"64":  {Code: "64", MinLen: 8, MaxLen: 10, Trunk: "0"},
+	"65":  {Code: "65", MinLen: 8, MaxLen: 8},
+	"66":  {Code: "66", MinLen: 8, MaxLen: 9, Trunk: "0"},
+	"81":  {Code: "81", MinLen: 9, MaxLen: 10, Trunk: "0"},
+	"82":  {Code: "82", MinLen: 8, MaxLen: 10, Trunk: "0"},
+	"86":  {Code: "86", MinLen: 10, MaxLen: 11, Trunk: "0"},
+	"90":  {Code: "90", MinLen: 10, MaxLen: 10, Trunk: "0"},
+	"91":  {Code: "91", MinLen: 10, MaxLen: 10, Trunk: "0"},
+	"92":  {Code: "92", MinLen: 9, MaxLen: 10, Trunk: "0"},
+	"234": {Code: "234", MinLen: 8, MaxLen: 10, Trunk: "0"},
+	"254": {Code: "254", MinLen: 9, MaxLen: 9, Trunk: "0"},
+	"351": {Code: "351", MinLen: 9, MaxLen: 9},
+	"353": {Code: "353", MinLen: 7, MaxLen: 9, Trunk: "0"},
+	"358": {Code: "358", MinLen: 5, MaxLen: 12, Trunk: "0"},
+	"971": {Code: "971", MinLen: 8, MaxLen: 9, Trunk: "0"},
+	"972": {Code: "972", MinLen: 8, MaxLen: 9, Trunk: "0"},
+}
+
+// countryForCode returns the rules for a calling code
+func countryForCode(code string) phoneCountry {
+	if country, ok := phoneCountries[code]; ok {
+		return country
+	}
+	return phoneCountry{Code: code, MinLen: 4, MaxLen: 15 - len(code)}
+}
+
+// twoDigitCallingCodes are the E.164 calling codes of two digits. The only
+// one digit codes are 1 and 7; every other code has three.
+var twoDigitCallingCodes = map[string]bool{
+	"20": true, "27": true, "30": true, "31": true, "32": true, "33": true, "34": true, "36": true,
+	"39": true, "40": true, "41": true, "43": true, "44": true, "45": true, "46": true, "47": true,
+	"48": true, "49": true, "51": true, "52": true, "53": true, "54": true, "55": true, "56": true,
+	"57": true, "58": true, "60": true, "61": true, "62": true, "63": true, "64": true, "65": true,
+	"66": true, "81": true, "82": true, "84": true, "86": true, "90": true, "91": true, "92": true,
+	"93": true, "94": true, "95": true, "98": true,
+}
+
+// countryForNumber finds the calling code an international number starts
+// with. Calling codes are prefix free, so at most one matches; codes without
+// known rules get the generic ones of countryForCode.
+func countryForNumber(digits string) (phoneCountry, bool) {
+	if digits == "" || digits[0] == '0' {
+		return phoneCountry{}, false
+	}
+	for n := 1; n <= 3 && n < len(digits); n++ {
+		if country, ok := phoneCountries[digits[:n]]; ok {
+			return country, true
+		}
+	}
+
+	n := 3
+	if len(digits) >= 2 && twoDigitCallingCodes[digits[:2]] {
+		n = 2
+	}
+	if len(digits) <= n {
+		return phoneCountry{}, false
+	}
+	return countryForCode(digits[:n]), true
+}
+
+// phoneFormatting are the characters stripped from phone numbers
+const phoneFormatting = " -.()/\t"
+
+// normalizePhone strips formatting from a phone number and splits it into
+// calling code and national number. The number may be international, as
+// "+44 20 7946 0000" or "0044...", or national for phoneCode, which
+// defaults to 1, with or without the calling code and trunk prefix, as
+// "(555) 234-5678", "15552345678" or "020 7946 0000".
+func normalizePhone(raw, phoneCode string) (phoneNumber, error) {
+	s := strings.TrimSpace(raw)
+	international := strings.HasPrefix(s, "+")
+	s = strings.TrimPrefix(s, "+")
+
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case strings.ContainsRune(phoneFormatting, c):
+		default:
+			return phoneNumber{}, fmt.Errorf("must contain only digits and formatting, not %q", c)
+		}
+	}
+	digits := b.String()
+	if digits == "" {
+		return phoneNumber{}, fmt.Errorf("must contain digits")
+	}
+
+	phoneCode = strings.TrimPrefix(strings.TrimSpace(phoneCode), "+")
+	if phoneCode != "" && (!digitsPattern.MatchString(phoneCode) || len(phoneCode) > 3) {
+		return phoneNumber{}, fmt.Errorf("phone_code %s is not a country calling code", phoneCode)
+	}
+
+	// International dialing prefixes: 011 from NANP numbers, 00 elsewhere.
+	// National numbers never start with them.
+	if !international {
+		switch {
+		case (phoneCode == "" || phoneCode == "1") && strings.HasPrefix(digits, "011"):
+			international = true
+			digits = digits[3:]
+		case strings.HasPrefix(digits, "00"):
+			international = true
+			digits = digits[2:]
+		}
+	}
+
+	var country phoneCountry
+	if international {
+		var ok bool
+		if country, ok = countryForNumber(digits); !ok {
+			return phoneNumber{}, fmt.Errorf("does not start with a country calling code")
+		}
+		if phoneCode != "" && phoneCode != country.Code {
+			return phoneNumber{}, fmt.Errorf("has country calling code %s, not phone_code %s", country.Code, phoneCode)
+		}
+		digits = digits[len(country.Code):]
+	} else {
+		if phoneCode == "" {
+			phoneCode = "1"
+		}
+		country = countryForCode(phoneCode)
+		// The calling code may be written without the plus, as in 15552345678
+		if len(digits) > country.MaxLen && strings.HasPrefix(digits, country.Code) {
+			digits = digits[len(country.Code):]
+		}
+	}
+
+	if country.Trunk != "" && strings.HasPrefix(digits, country.Trunk) && len(digits) > country.MinLen {
+		digits = digits[len(country.Trunk):]
+	}
+
+	if len(digits) < country.MinLen || len(digits) > country.MaxLen {
+		if country.MinLen == country.MaxLen {
+			return phoneNumber{}, fmt.Errorf("must have %d digits for country code %s", country.MinLen, country.Code)
+		}
+		return phoneNumber{}, fmt.Errorf("must have %d to %d digits for country code %s", country.MinLen, country.MaxLen, country.Code)
+	}
+	if country.Code == "1" {
+		if err := validateNANP(digits); err != nil {
+			return phoneNumber{}, err
+		}
+	}
+	return phoneNumber{Code: country.Code, National: digits}, nil
+}
+
+// validateNANP checks the area code and exchange of a 10 digit North
+// American number. Both must start with 2-9 and may not be an N11 service
+// code; N9X area codes are reserved for expansion.
+func validateNANP(number string) error {
+	npa, nxx := number[:3], number[3:6]
+	switch {
+	case npa[0] < '2':
+		return fmt.Errorf("has invalid area code %s: area codes cannot start with 0 or 1", npa)
+	case npa[1:] == "11":
+		return fmt.Errorf("has invalid area code %s: N11 codes are service codes", npa)
+	case npa[1] == '9':
+		return fmt.Errorf("has invalid area code %s: N9X area codes are reserved", npa)
+	case nxx[0] < '2':
+		return fmt.Errorf("has invalid exchange %s: exchanges cannot start with 0 or 1", nxx)
+	case nxx[1:] == "11":
+		return fmt.Errorf("has invalid exchange %s: N11 codes are service codes", nxx)
+	}
+	return nil
+}
+
+// phoneSearchDigits returns the national number to search for. Partial
+// numbers, which do not normalize, are searched for by their digits.
+func phoneSearchDigits(raw, phoneCode string) string {
+	if phone, err := normalizePhone(raw, phoneCode); err == nil {
+		return phone.National
+	}
+	return strings.Map(func(c rune) rune {
+		if c >= '0' && c <= '9' {
+			return c
+		}
+		return -1
+	}, raw)
+}
+
+// readPhoneNumber normalizes a phone number from a request, responding with
+// 400 when it is invalid
+func readPhoneNumber(w http.ResponseWriter, name, raw, phoneCode string) (phoneNumber, bool) {
+	phone, err := normalizePhone(raw, phoneCode)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid "+name+": "+err.Error())
+		return phone, false
+	}
+	return phone, true
+}
+
+// dncAreaCodePattern matches DNC entries that block a whole NANP area code
+var dncAreaCodePattern = regexp.MustCompile(`^[2-9][0-9]{2}XXXXXXX$`)
+
+// readDNCPhoneNumber normalizes a phone number for vicidial_dnc or
+// vicidial_filter_phone_groups, which store the national number. Area code
+// entries such as 201XXXXXXX are kept as they are.
+func readDNCPhoneNumber(w http.ResponseWriter, raw, phoneCode string) (string, bool) {
+	if dncAreaCodePattern.MatchString(strings.ToUpper(strings.TrimSpace(raw))) {
+		return strings.ToUpper(strings.TrimSpace(raw)), true
+	}
+	phone, ok := readPhoneNumber(w, "phone_number", raw, phoneCode)
+	return phone.National, ok
+}
+
+// normalizeLeadPhones normalizes a new lead's phone_number, setting its
+// phone_code, and its alt_phone in the same country
+func normalizeLeadPhones(lead *models.Lead) error {
+	phone, err := normalizePhone(lead.PhoneNumber, lead.PhoneCode)
+	if err != nil {
+		return fmt.Errorf("Invalid phone_number: %v", err)
+	}
+	lead.PhoneCode = phone.Code
+	lead.PhoneNumber = phone.National
+
+	if lead.AltPhone != "" {
+		alt, err := normalizePhone(lead.AltPhone, lead.PhoneCode)
+		if err != nil {
+			return fmt.Errorf("Invalid alt_phone: %v", err)
+		}
+		lead.AltPhone = alt.National
+	}
+	return nil
+}
+
+// normalizePatchPhones normalizes phone_number and alt_phone in a lead update
+// body for the lead's phone_code, or the phone_code the body sets. A new
+// phone_number also sets phone_code, in case it was given in international form.
+func normalizePatchPhones(raw map[string]json.RawMessage, phoneCode string) error {
+	if encoded, ok := raw["phone_code"]; ok {
+		var code string
+		if json.Unmarshal(encoded, &code) == nil && code != "" {
+			phoneCode = code
+		}
+	}
+
+	// Values that are not strings are left for decodePatch to reject
+	if encoded, ok := raw["phone_number"]; ok {
+		var number string
+		if json.Unmarshal(encoded, &number) == nil {
+			phone, err := normalizePhone(number, phoneCode)
+			if err != nil {
+				return fmt.Errorf("Invalid value for phone_number: %v", err)
+			}
+			raw["phone_number"], _ = json.Marshal(phone.National)
+			raw["phone_code"], _ = json.Marshal(phone.Code)
+			phoneCode = phone.Code
+		}
+	}
+	if encoded, ok := raw["alt_phone"]; ok {
+		var number string
+		if json.Unmarshal(encoded, &number) == nil && number != "" {
+			phone, err := normalizePhone(number, phoneCode)
+			if err != nil {
+				return fmt.Errorf("Invalid value for alt_phone: %v", err)
+			}
+			raw["alt_phone"], _ = json.Marshal(phone.National)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		phoneCode string
+		want      phoneNumber
+		wantErr   string
+	}{
+		{"NANP with formatting", "(555) 234-5678", "", phoneNumber{"1", "5552345678"}, ""},
+		{"NANP with calling code, no plus", "15552345678", "", phoneNumber{"1", "5552345678"}, ""},
+		{"NANP international", "+1 555 234 5678", "", phoneNumber{"1", "5552345678"}, ""},
+		{"NANP dots and slashes", "555.234/5678", "1", phoneNumber{"1", "5552345678"}, ""},
+		{"011 prefix from NANP", "011 44 20 7946 0000", "", phoneNumber{"44", "2079460000"}, ""},
+		{"00 prefix", "0044 20 7946 0000", "44", phoneNumber{"44", "2079460000"}, ""},
+		{"international with trunk prefix", "+44 (0)20 7946 0000", "", phoneNumber{"44", "2079460000"}, ""},
+		{"national with trunk prefix", "020 7946 0000", "44", phoneNumber{"44", "2079460000"}, ""},
+		{"trunk prefix other than 0", "8 912 345 67 89", "7", phoneNumber{"7", "9123456789"}, ""},
+		{"phone_code with plus", "612 345 678", "+34", phoneNumber{"34", "612345678"}, ""},
+		{"unknown calling code given as phone_code", "+999 12345678", "999", phoneNumber{"999", "12345678"}, ""},
+		{"calling code without known rules", "+380 50 123 4567", "", phoneNumber{"380", "501234567"}, ""},
+		{"two digit calling code without known rules", "0036 1 234 5678", "", phoneNumber{"36", "12345678"}, ""},
+		{"unassigned calling code", "+999 12345678", "", phoneNumber{"999", "12345678"}, ""},
+
+		{"empty", "", "", phoneNumber{}, "must contain digits"},
+		{"letters", "555 234 5678 x12", "", phoneNumber{}, "must contain only digits"},
+		{"invalid phone_code", "5552345678", "1234", phoneNumber{}, "is not a country calling code"},
+		{"no calling code", "+0 20 7946 0000", "", phoneNumber{}, "does not start with a country calling code"},
+		{"longer than E.164", "+380 1234 5678 90123", "", phoneNumber{}, "must have 4 to 12 digits for country code 380"},
+		{"calling code without known rules differs from phone_code", "+380 50 123 4567", "38", phoneNumber{}, "has country calling code 380, not phone_code 38"},
+		{"calling code differs from phone_code", "+44 20 7946 0000", "1", phoneNumber{}, "has country calling code 44, not phone_code 1"},
+		{"NANP too short", "555-234-567", "", phoneNumber{}, "must have 10 digits for country code 1"},
+		{"range of lengths", "+44 20 79", "", phoneNumber{}, "must have 9 to 10 digits for country code 44"},
+		{"NANP area code starting with 1", "155 234 5678", "", phoneNumber{}, "has invalid area code 155"},
+		{"NANP exchange starting with 0", "555 034 5678", "", phoneNumber{}, "has invalid exchange 034"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizePhone(tt.raw, tt.phoneCode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("normalizePhone(%q, %q) error = %v, want %q", tt.raw, tt.phoneCode, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizePhone(%q, %q) error = %v", tt.raw, tt.phoneCode, err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizePhone(%q, %q) = %+v, want %+v", tt.raw, tt.phoneCode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPhoneSearchDigits(t *testing.T) {
+	tests := []struct {
+		raw, phoneCode, want string
+	}{
+		{"+1 (555) 234-5678", "", "5552345678"},
+		{"020 7946 0000", "44", "2079460000"},
+		{"555-23", "", "55523"},
+		{"abc", "", ""},
+	}
+	for _, tt := range tests {
+		if got := phoneSearchDigits(tt.raw, tt.phoneCode); got != tt.want {
+			t.Errorf("phoneSearchDigits(%q, %q) = %q, want %q", tt.raw, tt.phoneCode, got, tt.want)
+		}
+	}
+}
+
+func TestValidateNANP(t *testing.T) {
+	tests := []struct {
+		number  string
+		wantErr string
+	}{
+		{"2125551234", ""},
+		{"5552345678", ""},
+		{"9892000000", ""},
+		{"0125551234", "area codes cannot start with 0 or 1"},
+		{"1125551234", "area codes cannot start with 0 or 1"},
+		{"4115551234", "N11 codes are service codes"},
+		{"2965551234", "N9X area codes are reserved"},
+		{"2121551234", "exchanges cannot start with 0 or 1"},
+		{"2120551234", "exchanges cannot start with 0 or 1"},
+		{"2124111234", "N11 codes are service codes"},
+	}
+
+	for _, tt := range tests {
+		err := validateNANP(tt.number)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateNANP(%s) = %v, want nil", tt.number, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateNANP(%s) = %v, want %q", tt.number, err, tt.wantErr)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/vicidb/non-agent-api/models"
@@ -42,38 +43,46 @@ func (h *Handler) AddPhone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "PHONES",
+		Type:     "ADD",
+		RecordID: phone.Extension,
+		Code:     "ADMIN API ADD PHONE",
+		SQL:      query,
+		Args: []interface{}{phone.Extension, phone.Dialplan, phone.VoicemailExt,
+			phone.PhoneIP, phone.ComputerIP, phone.ServerIP, phone.Login, "********",
+			phone.Status, phone.Active, phone.PhoneType, phone.FullName,
+			phone.CompanyName, phone.OutboundCID},
+		After: h.snapshotRow("phones", "extension", phone.Extension),
+	})
+
 	respondWithSuccess(w, "Phone added successfully", map[string]string{"extension": phone.Extension})
 }
 
-// UpdatePhone updates an existing phone
+// UpdatePhone updates the fields of a phone present in the request body
 func (h *Handler) UpdatePhone(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	phoneID := vars["phone_id"]
 
-	var phone models.Phone
-	if err := json.NewDecoder(r.Body).Decode(&phone); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	fields, ok := readPatch(w, r, phonePatchSpec)
+	if !ok {
 		return
 	}
 
-	query := `
-		UPDATE phones SET
-			dialplan_number = ?, voicemail_ext = ?, phone_ip = ?,
-			computer_ip = ?, server_ip = ?, status = ?, active = ?,
-			phone_type = ?, fullname = ?, company = ?, outbound_cid = ?
-		WHERE extension = ?
-	`
-
-	_, err := h.DB.Exec(query, phone.Dialplan, phone.VoicemailExt, phone.PhoneIP,
-		phone.ComputerIP, phone.ServerIP, phone.Status, phone.Active,
-		phone.PhoneType, phone.FullName, phone.CompanyName, phone.OutboundCID, phoneID)
-
+	found, err := h.applyPatch(r, phonePatchSpec, phoneID, fields, "PHONES", "ADMIN API UPDATE PHONE")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update phone: "+err.Error())
 		return
 	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Phone not found")
+		return
+	}
 
-	respondWithSuccess(w, "Phone updated successfully", map[string]string{"extension": phoneID})
+	respondWithSuccess(w, "Phone updated successfully", map[string]interface{}{
+		"extension":      phoneID,
+		"updated_fields": patchFieldNames(fields),
+	})
 }
 
 // AddPhoneAlias adds a phone alias
@@ -98,6 +107,16 @@ func (h *Handler) AddPhoneAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "PHONEALIASES",
+		Type:     "ADD",
+		RecordID: req.AliasID,
+		Code:     "ADMIN API ADD PHONE ALIAS",
+		SQL:      query,
+		Args:     []interface{}{req.AliasID, req.AliasName, req.Extension, req.Active},
+		After:    h.snapshotRow("phone_aliases", "alias_id", req.AliasID),
+	})
+
 	respondWithSuccess(w, "Phone alias added successfully", map[string]string{"alias_id": req.AliasID})
 }
 
@@ -118,6 +137,8 @@ func (h *Handler) UpdatePhoneAlias(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := `UPDATE phone_aliases SET alias_name = ?, logins_list = ?, active = ? WHERE alias_id = ?`
+	before := h.snapshotRow("phone_aliases", "alias_id", aliasID)
+
 	_, err := h.DB.Exec(query, req.AliasName, req.Extension, req.Active, aliasID)
 
 	if err != nil {
@@ -125,6 +146,17 @@ func (h *Handler) UpdatePhoneAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "PHONEALIASES",
+		Type:     "MODIFY",
+		RecordID: aliasID,
+		Code:     "ADMIN API UPDATE PHONE ALIAS",
+		SQL:      query,
+		Args:     []interface{}{req.AliasName, req.Extension, req.Active, aliasID},
+		Before:   before,
+		After:    h.snapshotRow("phone_aliases", "alias_id", aliasID),
+	})
+
 	respondWithSuccess(w, "Phone alias updated successfully", map[string]string{"alias_id": aliasID})
 }
 
@@ -152,16 +184,27 @@ func (h *Handler) AddDID(w http.ResponseWriter, r *http.Request) {
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := h.DB.Exec(query, did.DIDPattern, did.DIDDescription, did.DIDRoute,
+	args := []interface{}{did.DIDPattern, did.DIDDescription, did.DIDRoute,
 		did.RecordCall, did.Extension, did.Exten, did.VoicemailExt,
-		did.FilterInboundGroup, did.Group, did.User, did.Active)
+		did.FilterInboundGroup, did.Group, did.User, did.Active}
 
+	result, err := h.DB.Exec(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to add DID: "+err.Error())
 		return
 	}
 
 	didID, _ := result.LastInsertId()
+
+	h.audit(r, auditEvent{
+		Section:  "DIDS",
+		Type:     "ADD",
+		RecordID: strconv.FormatInt(didID, 10),
+		Code:     "ADMIN API ADD DID",
+		SQL:      query,
+		Args:     args,
+		After:    h.snapshotRow("vicidial_inbound_dids", "did_id", didID),
+	})
 	respondWithSuccess(w, "DID added successfully", map[string]int64{"did_id": didID})
 }
 
@@ -184,15 +227,29 @@ func (h *Handler) UpdateDID(w http.ResponseWriter, r *http.Request) {
 		WHERE did_id = ?
 	`
 
-	_, err := h.DB.Exec(query, did.DIDPattern, did.DIDDescription, did.DIDRoute,
+	args := []interface{}{did.DIDPattern, did.DIDDescription, did.DIDRoute,
 		did.RecordCall, did.Extension, did.Exten, did.VoicemailExt,
-		did.FilterInboundGroup, did.Group, did.User, did.Active, didID)
+		did.FilterInboundGroup, did.Group, did.User, did.Active, didID}
+
+	before := h.snapshotRow("vicidial_inbound_dids", "did_id", didID)
 
+	_, err := h.DB.Exec(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update DID: "+err.Error())
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "DIDS",
+		Type:     "MODIFY",
+		RecordID: didID,
+		Code:     "ADMIN API UPDATE DID",
+		SQL:      query,
+		Args:     args,
+		Before:   before,
+		After:    h.snapshotRow("vicidial_inbound_dids", "did_id", didID),
+	})
+
 	respondWithSuccess(w, "DID updated successfully", map[string]string{"did_id": didID})
 }
 
@@ -226,5 +283,15 @@ func (h *Handler) CopyDID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	newDIDID, _ := result.LastInsertId()
+
+	h.audit(r, auditEvent{
+		Section:  "DIDS",
+		Type:     "COPY",
+		RecordID: strconv.FormatInt(newDIDID, 10),
+		Code:     "ADMIN API COPY DID FROM " + sourceDID,
+		SQL:      query,
+		Args:     []interface{}{req.NewDIDPattern, sourceDID},
+		After:    h.snapshotRow("vicidial_inbound_dids", "did_id", newDIDID),
+	})
 	respondWithSuccess(w, "DID copied successfully", map[string]int64{"new_did_id": newDIDID})
 }
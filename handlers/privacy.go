@@ -0,0 +1,781 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// privacyMaxRows is the most rows exported from any one table
+const privacyMaxRows = 10000
+
+// privacySubject identifies the person a privacy request is about
+type privacySubject struct {
+	Type  string // phone_number, email or lead_id
+	Value string
+}
+
+// readPrivacySubject reads the single identifier of a privacy request. Phone
+// numbers are normalized to their national number, emails compared
+// case-insensitively.
+func readPrivacySubject(phoneNumber, email, leadID string) (privacySubject, bool) {
+	var subject privacySubject
+	given := 0
+	if phoneNumber = strings.TrimSpace(phoneNumber); phoneNumber != "" {
+		subject = privacySubject{Type: "phone_number", Value: phoneSearchDigits(phoneNumber, "")}
+		given++
+	}
+	if email = strings.TrimSpace(email); email != "" {
+		subject = privacySubject{Type: "email", Value: strings.ToLower(email)}
+		given++
+	}
+	if leadID = strings.TrimSpace(leadID); leadID != "" {
+		if _, err := strconv.Atoi(leadID); err != nil {
+			return subject, false
+		}
+		subject = privacySubject{Type: "lead_id", Value: leadID}
+		given++
+	}
+	return subject, given == 1 && subject.Value != ""
+}
+
+// hash is how the subject is recorded in proofs of erasure, which must not
+// hold the identifier itself. It is keyed with a server-side secret, since
+// phone numbers are few enough to recover from a plain hash by trying them all.
+func (s privacySubject) hash(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(s.Type + ":" + s.Value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// privacyHashSecret returns the secret for subject hashes, or responds with
+// an error and returns false when none is configured
+func (h *Handler) privacyHashSecret(w http.ResponseWriter) (string, bool) {
+	if h.Config == nil || h.Config.PrivacyHashSecret == "" {
+		respondWithError(w, http.StatusInternalServerError, "Privacy requests are not configured (set PRIVACY_HASH_SECRET)")
+		return "", false
+	}
+	return h.Config.PrivacyHashSecret, true
+}
+
+// leadCondition matches the subject's leads in vicidial_list or vicidial_list_archive
+func (s privacySubject) leadCondition() (string, []interface{}) {
+	switch s.Type {
+	case "phone_number":
+		return "(phone_number = ? OR alt_phone = ? OR address3 = ?)", []interface{}{s.Value, s.Value, s.Value}
+	case "email":
+		return "LOWER(email) = ?", []interface{}{s.Value}
+	default:
+		return "lead_id = ?", []interface{}{s.Value}
+	}
+}
+
+// privacyLead is one of the subject's leads
+type privacyLead struct {
+	LeadID   int  `json:"lead_id"`
+	ListID   int  `json:"list_id"`
+	Archived bool `json:"archived"`
+}
+
+// privacySource is a log table holding data about the subject. Rows are
+// matched by the subject's lead IDs and, when searching by phone number, by
+// PhoneColumn. Anonymize is the SET clause that strips the personal data.
+type privacySource struct {
+	Name        string
+	Table       string
+	PhoneColumn string
+	ListColumn  string
+	Anonymize   string
+}
+
+// privacySources are the log tables covered by export and erasure, in the
+// order they appear in an export bundle
+var privacySources = []privacySource{
+	{Name: "outbound_calls", Table: "vicidial_log", PhoneColumn: "phone_number", ListColumn: "list_id", Anonymize: "phone_number = '', comments = ''"},
+	{Name: "inbound_calls", Table: "vicidial_closer_log", PhoneColumn: "phone_number", ListColumn: "list_id", Anonymize: "phone_number = '', comments = ''"},
+	{Name: "recordings", Table: "recording_log", Anonymize: "filename = '', location = ''"},
+	{Name: "callbacks", Table: "vicidial_callbacks", ListColumn: "list_id", Anonymize: "status = 'INACTIVE', comments = ''"},
+	{Name: "carrier_log", Table: "vicidial_carrier_log", Anonymize: "channel = ''"},
+	{Name: "dial_log", Table: "vicidial_dial_log", Anonymize: "extension = '', channel = ''"},
+}
+
+// privacyLeadAnonymize strips the personal fields of a lead
+const privacyLeadAnonymize = `vendor_lead_code = '', phone_number = '', title = '', first_name = '',
+	middle_initial = '', last_name = '', address1 = '', address2 = '', address3 = '', city = '',
+	state = '', province = '', postal_code = '', gender = 'U', date_of_birth = NULL, alt_phone = '',
+	email = '', security_phrase = '', comments = '', modify_date = NOW()`
+
+// condition matches the source's rows for the subject
+func (s privacySource) condition(r *http.Request, subject privacySubject, leadIDs []interface{}) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+	if len(leadIDs) > 0 {
+		parts = append(parts, "lead_id IN ("+placeholders(len(leadIDs))+")")
+		args = append(args, leadIDs...)
+	}
+	if s.PhoneColumn != "" && subject.Type == "phone_number" {
+		parts = append(parts, s.PhoneColumn+" = ?")
+		args = append(args, subject.Value)
+	}
+	if len(parts) == 0 {
+		return " WHERE 1=0", nil
+	}
+
+	where := " WHERE (" + strings.Join(parts, " OR ") + ")"
+	if s.ListColumn != "" {
+		restrictSQL, restrictArgs := listFilter(r, s.ListColumn)
+		where += restrictSQL
+		args = append(args, restrictArgs...)
+	}
+	return where, args
+}
+
+// privacyLeads finds the subject's leads in the lists the caller may access,
+// including archived ones
+func (h *Handler) privacyLeads(r *http.Request, subject privacySubject) ([]privacyLead, error) {
+	condition, args := subject.leadCondition()
+	restrictSQL, restrictArgs := listFilter(r, "list_id")
+	args = append(args, restrictArgs...)
+
+	leads := []privacyLead{}
+	for _, archived := range []bool{false, true} {
+		table := "vicidial_list"
+		if archived {
+			table = "vicidial_list_archive"
+		}
+		rows, err := h.DB.Query("SELECT lead_id, list_id FROM "+table+" WHERE "+condition+restrictSQL+" ORDER BY lead_id", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			lead := privacyLead{Archived: archived}
+			if err := rows.Scan(&lead.LeadID, &lead.ListID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			leads = append(leads, lead)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return leads, nil
+}
+
+// privacyLeadIDs returns the lead IDs as query arguments
+func privacyLeadIDs(leads []privacyLead) []interface{} {
+	ids := make([]interface{}, len(leads))
+	for i, lead := range leads {
+		ids[i] = lead.LeadID
+	}
+	return ids
+}
+
+// queryRowMaps runs a SELECT and returns every row as strings. Unlike
+// snapshotRows it reports errors, since an export must not silently miss data.
+func (h *Handler) queryRowMaps(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := map[string]interface{}{}
+		for i, column := range columns {
+			if values[i].Valid {
+				row[column] = values[i].String
+			} else {
+				row[column] = nil
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// PrivacyExport collects everything held about a phone number, email or lead
+// into one subject access bundle
+func (h *Handler) PrivacyExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	subject, ok := readPrivacySubject(q.Get("phone_number"), q.Get("email"), q.Get("lead_id"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Provide exactly one of phone_number, email or lead_id")
+		return
+	}
+	secret, ok := h.privacyHashSecret(w)
+	if !ok {
+		return
+	}
+
+	leads, err := h.privacyLeads(r, subject)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to find leads: "+err.Error())
+		return
+	}
+	leadIDs := privacyLeadIDs(leads)
+
+	leadRows := []map[string]interface{}{}
+	customRows := []map[string]interface{}{}
+	if len(leadIDs) > 0 {
+		in := " WHERE lead_id IN (" + placeholders(len(leadIDs)) + ")"
+		for _, table := range []string{"vicidial_list", "vicidial_list_archive"} {
+			rows, err := h.queryRowMaps("SELECT * FROM "+table+in, leadIDs...)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to read "+table+": "+err.Error())
+				return
+			}
+			for _, row := range rows {
+				row["archived"] = table == "vicidial_list_archive"
+			}
+			leadRows = append(leadRows, rows...)
+		}
+
+		// Custom fields live in the list's custom table, or as JSON while archived
+		byList := map[int][]interface{}{}
+		for _, lead := range leads {
+			if !lead.Archived {
+				byList[lead.ListID] = append(byList[lead.ListID], lead.LeadID)
+			}
+		}
+		for listID, ids := range byList {
+			table, err := h.loadCustomTable(listID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to read custom fields: "+err.Error())
+				return
+			}
+			if !table.Exists {
+				continue
+			}
+			rows, err := h.queryRowMaps("SELECT * FROM "+table.name()+" WHERE lead_id IN ("+placeholders(len(ids))+")", ids...)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to read "+table.name()+": "+err.Error())
+				return
+			}
+			for _, row := range rows {
+				row["list_id"] = listID
+			}
+			customRows = append(customRows, rows...)
+		}
+		archived, err := h.queryRowMaps("SELECT lead_id, list_id, fields, archived_at FROM go_api_custom_archive"+in, leadIDs...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read archived custom fields: "+err.Error())
+			return
+		}
+		for _, row := range archived {
+			var fields map[string]interface{}
+			if json.Unmarshal([]byte(row["fields"].(string)), &fields) == nil {
+				row["fields"] = fields
+			}
+			row["archived"] = true
+		}
+		customRows = append(customRows, archived...)
+	}
+
+	bundle := map[string]interface{}{
+		"subject":       map[string]string{subject.Type: subject.Value},
+		"generated_at":  time.Now().Format("2006-01-02 15:04:05"),
+		"leads":         leadRows,
+		"custom_fields": customRows,
+	}
+	counts := map[string]int{"leads": len(leadRows), "custom_fields": len(customRows)}
+	truncated := []string{}
+
+	for _, source := range privacySources {
+		where, args := source.condition(r, subject, leadIDs)
+		rows, err := h.queryRowMaps("SELECT * FROM "+source.Table+where+" LIMIT "+strconv.Itoa(privacyMaxRows+1), args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read "+source.Table+": "+err.Error())
+			return
+		}
+		if len(rows) > privacyMaxRows {
+			rows = rows[:privacyMaxRows]
+			truncated = append(truncated, source.Name)
+		}
+		bundle[source.Name] = rows
+		counts[source.Name] = len(rows)
+	}
+	bundle["counts"] = counts
+	bundle["truncated"] = truncated
+
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     "EXPORT",
+		RecordID: strconv.Itoa(len(leads)) + " leads",
+		Code:     "ADMIN API PRIVACY EXPORT",
+		After:    map[string]interface{}{"identifier_type": subject.Type, "identifier_hash": subject.hash(secret), "counts": counts},
+	})
+
+	respondWithSuccess(w, "Subject access export generated", bundle)
+}
+
+// privacyErasure is a proof of erasure from go_api_privacy_erasures
+type privacyErasure struct {
+	ErasureID      int            `json:"erasure_id"`
+	IdentifierType string         `json:"identifier_type"`
+	IdentifierHash string         `json:"identifier_hash"`
+	Mode           string         `json:"mode"`
+	Reference      string         `json:"reference"`
+	LeadIDs        []int          `json:"lead_ids"`
+	RecordingIDs   []string       `json:"recording_ids"`
+	Counts         map[string]int `json:"counts"`
+	User           string         `json:"user"`
+	UserGroup      string         `json:"user_group"`
+	APIClient      string         `json:"api_client"`
+	OnBehalfOf     string         `json:"on_behalf_of,omitempty"`
+	IPAddress      string         `json:"ip_address"`
+	ErasedAt       string         `json:"erased_at"`
+}
+
+const privacyErasureColumns = `erasure_id, identifier_type, identifier_hash, mode, reference, lead_ids,
+	recording_ids, counts, user, user_group, api_client, on_behalf_of, ip_address, erased_at`
+
+func scanPrivacyErasure(row rowScanner) (privacyErasure, error) {
+	var e privacyErasure
+	var leadIDs, recordingIDs, counts string
+	var erasedAt time.Time
+	err := row.Scan(&e.ErasureID, &e.IdentifierType, &e.IdentifierHash, &e.Mode, &e.Reference, &leadIDs,
+		&recordingIDs, &counts, &e.User, &e.UserGroup, &e.APIClient, &e.OnBehalfOf, &e.IPAddress, &erasedAt)
+	if err != nil {
+		return e, err
+	}
+	json.Unmarshal([]byte(leadIDs), &e.LeadIDs)
+	json.Unmarshal([]byte(recordingIDs), &e.RecordingIDs)
+	json.Unmarshal([]byte(counts), &e.Counts)
+	e.ErasedAt = erasedAt.Format("2006-01-02 15:04:05")
+	return e, nil
+}
+
+// PrivacyErase anonymizes or deletes everything held about a phone number,
+// email or lead and records a proof of erasure. The proof holds a hash of the
+// identifier, never the identifier itself.
+func (h *Handler) PrivacyErase(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PhoneNumber string `json:"phone_number"`
+		Email       string `json:"email"`
+		LeadID      string `json:"lead_id"`
+		Mode        string `json:"mode"`
+		Reference   string `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	subject, ok := readPrivacySubject(req.PhoneNumber, req.Email, req.LeadID)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Provide exactly one of phone_number, email or lead_id")
+		return
+	}
+	mode := strings.ToUpper(req.Mode)
+	if mode == "" {
+		mode = "ANONYMIZE"
+	}
+	if mode != "ANONYMIZE" && mode != "DELETE" {
+		respondWithError(w, http.StatusBadRequest, "mode must be anonymize or delete")
+		return
+	}
+	if len(req.Reference) > 100 {
+		respondWithError(w, http.StatusBadRequest, "reference must be at most 100 characters")
+		return
+	}
+	secret, ok := h.privacyHashSecret(w)
+	if !ok {
+		return
+	}
+
+	leads, err := h.privacyLeads(r, subject)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to find leads: "+err.Error())
+		return
+	}
+	leadIDs := privacyLeadIDs(leads)
+
+	// Recording files live on the recording servers; their locations are
+	// returned so they can be purged there before the references are cleared
+	recordingWhere, recordingArgs := privacySource{Table: "recording_log"}.condition(r, subject, leadIDs)
+	recordings, err := h.queryRowMaps("SELECT recording_id, filename, location FROM recording_log"+recordingWhere, recordingArgs...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read recording_log: "+err.Error())
+		return
+	}
+	recordingIDs := make([]string, len(recordings))
+	for i, recording := range recordings {
+		recordingIDs[i], _ = recording["recording_id"].(string)
+	}
+
+	dryRun, _ := schemaFlags(r)
+	if dryRun {
+		counts, err := h.privacyCounts(r, subject, leads)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to count records: "+err.Error())
+			return
+		}
+		respondWithSuccess(w, "Erasure preview", map[string]interface{}{
+			"mode":       mode,
+			"leads":      leads,
+			"counts":     counts,
+			"recordings": recordings,
+		})
+		return
+	}
+
+	counts, err := h.privacyErase(r.Context(), r, subject, leads, mode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to erase records: "+err.Error())
+		return
+	}
+
+	ids := make([]int, len(leads))
+	for i, lead := range leads {
+		ids[i] = lead.LeadID
+	}
+	leadIDsJSON, _ := json.Marshal(ids)
+	recordingIDsJSON, _ := json.Marshal(recordingIDs)
+	countsJSON, _ := json.Marshal(counts)
+	actor := requestActor(r)
+
+	res, err := h.DB.Exec(`
+		INSERT INTO go_api_privacy_erasures
+		(identifier_type, identifier_hash, mode, reference, lead_ids, recording_ids, counts,
+		 user, user_group, api_client, on_behalf_of, ip_address, erased_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, subject.Type, subject.hash(secret), mode, req.Reference, string(leadIDsJSON), string(recordingIDsJSON), string(countsJSON),
+		actor.User, actor.UserGroup, actor.APIClient, actor.OnBehalfOf, actor.IPAddress)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Records were erased but the proof of erasure could not be saved: "+err.Error())
+		return
+	}
+	erasureID, _ := res.LastInsertId()
+
+	proof, err := scanPrivacyErasure(h.DB.QueryRow("SELECT "+privacyErasureColumns+" FROM go_api_privacy_erasures WHERE erasure_id = ?", erasureID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve proof of erasure: "+err.Error())
+		return
+	}
+
+	eventType := "MODIFY"
+	if mode == "DELETE" {
+		eventType = "DELETE"
+	}
+	h.audit(r, auditEvent{
+		Section:  "LEADS",
+		Type:     eventType,
+		RecordID: "erasure " + strconv.FormatInt(erasureID, 10),
+		Code:     "ADMIN API PRIVACY ERASURE",
+		After:    proof,
+	})
+
+	respondWithSuccess(w, "Records erased", map[string]interface{}{
+		"proof":      proof,
+		"recordings": recordings,
+	})
+}
+
+// privacyCounts counts the records an erasure would change
+func (h *Handler) privacyCounts(r *http.Request, subject privacySubject, leads []privacyLead) (map[string]int, error) {
+	counts := map[string]int{"leads": len(leads)}
+	leadIDs := privacyLeadIDs(leads)
+
+	for _, source := range privacySources {
+		where, args := source.condition(r, subject, leadIDs)
+		var n int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM "+source.Table+where, args...).Scan(&n); err != nil {
+			return nil, err
+		}
+		counts[source.Name] = n
+	}
+	if len(leadIDs) == 0 {
+		counts["custom_fields"] = 0
+		return counts, nil
+	}
+
+	custom := 0
+	for _, lead := range leads {
+		table, err := h.loadCustomTable(lead.ListID)
+		if err != nil {
+			return nil, err
+		}
+		if !table.Exists {
+			continue
+		}
+		var n int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM "+table.name()+" WHERE lead_id = ?", lead.LeadID).Scan(&n); err != nil {
+			return nil, err
+		}
+		custom += n
+	}
+	var archived int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM go_api_custom_archive WHERE lead_id IN ("+placeholders(len(leadIDs))+")", leadIDs...).Scan(&archived); err != nil {
+		return nil, err
+	}
+	counts["custom_fields"] = custom + archived
+	return counts, nil
+}
+
+// privacyErase anonymizes or deletes the subject's leads and log rows and
+// returns the number of rows changed in each. Custom field rows, hopper
+// entries and the API's own audit snapshots of the leads, including bulk
+// entries that name the subject or its leads, are always removed, since they
+// may hold personal data that cannot be told apart.
+func (h *Handler) privacyErase(ctx context.Context, r *http.Request, subject privacySubject, leads []privacyLead, mode string) (map[string]int, error) {
+	counts := map[string]int{}
+	leadIDs := privacyLeadIDs(leads)
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	exec := func(name, query string, args ...interface{}) error {
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		counts[name] += int(n)
+		return nil
+	}
+
+	for _, source := range privacySources {
+		where, args := source.condition(r, subject, leadIDs)
+		query := "UPDATE " + source.Table + " SET " + source.Anonymize + where
+		if mode == "DELETE" {
+			query = "DELETE FROM " + source.Table + where
+		}
+		if err := exec(source.Name, query, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	counts["leads"] = 0
+	counts["custom_fields"] = 0
+	if len(leadIDs) > 0 {
+		in := " WHERE lead_id IN (" + placeholders(len(leadIDs)) + ")"
+		for _, table := range []string{"vicidial_list", "vicidial_list_archive"} {
+			query := "UPDATE " + table + " SET " + privacyLeadAnonymize + in
+			if mode == "DELETE" {
+				query = "DELETE FROM " + table + in
+			}
+			if err := exec("leads", query, leadIDs...); err != nil {
+				return nil, err
+			}
+		}
+		if err := exec("hopper", "DELETE FROM vicidial_hopper"+in, leadIDs...); err != nil {
+			return nil, err
+		}
+		if err := exec("custom_fields", "DELETE FROM go_api_custom_archive"+in, leadIDs...); err != nil {
+			return nil, err
+		}
+
+		recordIDs := make([]interface{}, len(leads))
+		for i, lead := range leads {
+			recordIDs[i] = strconv.Itoa(lead.LeadID)
+		}
+		if err := exec("audit_entries", "UPDATE vicidial_admin_log SET event_sql = '', event_notes = ''"+
+			" WHERE event_section = 'LEADS' AND record_id IN ("+placeholders(len(recordIDs))+")", recordIDs...); err != nil {
+			return nil, err
+		}
+
+		tables := map[int]*customTable{}
+		for _, lead := range leads {
+			table, ok := tables[lead.ListID]
+			if !ok {
+				if table, err = h.loadCustomTable(lead.ListID); err != nil {
+					return nil, err
+				}
+				tables[lead.ListID] = table
+			}
+			if !table.Exists {
+				continue
+			}
+			if err := exec("custom_fields", "DELETE FROM "+table.name()+" WHERE lead_id = ?", lead.LeadID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	mentions, err := privacyAuditMentions(ctx, tx, subject, leadIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(mentions) > 0 {
+		if err := exec("audit_entries", "UPDATE vicidial_admin_log SET event_sql = '', event_notes = ''"+
+			" WHERE admin_log_id IN ("+placeholders(len(mentions))+")", mentions...); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, tx.Commit()
+}
+
+// privacyAuditMentions returns the IDs of LEADS audit entries, other than
+// the leads' own, whose record_id, SQL or notes mention the subject's
+// identifier or one of its lead IDs, such as bulk updates and archives
+func privacyAuditMentions(ctx context.Context, tx *sql.Tx, subject privacySubject, leadIDs []interface{}) ([]interface{}, error) {
+	var value string
+	if subject.Type != "lead_id" {
+		value = subject.Value
+	}
+	ids := make([]string, len(leadIDs))
+	for i, id := range leadIDs {
+		ids[i] = strconv.Itoa(id.(int))
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, term := range append([]string{value}, ids...) {
+		if term == "" {
+			continue
+		}
+		like := "%" + escapeLike(term) + "%"
+		conditions = append(conditions, "record_id LIKE ? OR event_sql LIKE ? OR event_notes LIKE ?")
+		args = append(args, like, like, like)
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	// LIKE narrows the search; lead IDs must then stand alone, so that
+	// erasing lead 12 leaves entries about lead 123 alone
+	query := "SELECT admin_log_id, record_id, event_sql, event_notes FROM vicidial_admin_log" +
+		" WHERE event_section = 'LEADS' AND (" + strings.Join(conditions, " OR ") + ")"
+	if len(ids) > 0 {
+		query += " AND record_id NOT IN (" + placeholders(len(ids)) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := []interface{}{}
+	for rows.Next() {
+		var logID int64
+		var recordID, eventSQL, eventNotes string
+		if err := rows.Scan(&logID, &recordID, &eventSQL, &eventNotes); err != nil {
+			return nil, err
+		}
+		text := strings.ToLower(recordID + "\n" + eventSQL + "\n" + eventNotes)
+		if (value != "" && strings.Contains(text, value)) || mentionsNumber(text, ids) {
+			mentions = append(mentions, logID)
+		}
+	}
+	return mentions, rows.Err()
+}
+
+// mentionsNumber reports whether text holds one of the numbers other than as
+// part of a longer number
+func mentionsNumber(text string, numbers []string) bool {
+	isDigit := func(i int) bool { return i >= 0 && i < len(text) && text[i] >= '0' && text[i] <= '9' }
+	for _, number := range numbers {
+		for start := 0; ; {
+			i := strings.Index(text[start:], number)
+			if i < 0 {
+				break
+			}
+			i += start
+			if !isDigit(i-1) && !isDigit(i+len(number)) {
+				return true
+			}
+			start = i + 1
+		}
+	}
+	return false
+}
+
+// GetPrivacyErasure returns a proof of erasure
+func (h *Handler) GetPrivacyErasure(w http.ResponseWriter, r *http.Request) {
+	erasureID, err := strconv.Atoi(mux.Vars(r)["erasure_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid erasure ID")
+		return
+	}
+
+	proof, err := scanPrivacyErasure(h.DB.QueryRow("SELECT "+privacyErasureColumns+" FROM go_api_privacy_erasures WHERE erasure_id = ?", erasureID))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Erasure not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve erasure: "+err.Error())
+		return
+	}
+
+	respondWithSuccess(w, "Erasure retrieved", proof)
+}
+
+// ListPrivacyErasures lists proofs of erasure, optionally for one phone
+// number, email or lead, which is hashed the same way as when it was erased
+func (h *Handler) ListPrivacyErasures(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := "SELECT " + privacyErasureColumns + " FROM go_api_privacy_erasures WHERE 1=1"
+	args := []interface{}{}
+
+	if q.Get("phone_number") != "" || q.Get("email") != "" || q.Get("lead_id") != "" {
+		subject, ok := readPrivacySubject(q.Get("phone_number"), q.Get("email"), q.Get("lead_id"))
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, "Provide at most one of phone_number, email or lead_id")
+			return
+		}
+		secret, ok := h.privacyHashSecret(w)
+		if !ok {
+			return
+		}
+		query += " AND identifier_hash = ?"
+		args = append(args, subject.hash(secret))
+	}
+	if reference := q.Get("reference"); reference != "" {
+		query += " AND reference = ?"
+		args = append(args, reference)
+	}
+	query += " ORDER BY erasure_id DESC LIMIT 500"
+
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve erasures: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	erasures := []privacyErasure{}
+	for rows.Next() {
+		proof, err := scanPrivacyErasure(rows)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read erasure: "+err.Error())
+			return
+		}
+		erasures = append(erasures, proof)
+	}
+
+	respondWithSuccess(w, "Erasures retrieved", erasures)
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/vicidb/non-agent-api/config"
+)
+
+func TestPrivacySubjectHash(t *testing.T) {
+	subject := privacySubject{Type: "phone_number", Value: "5552345678"}
+
+	if subject.hash("one") != subject.hash("one") {
+		t.Error("hash differs between calls with the same secret")
+	}
+	if subject.hash("one") == subject.hash("two") {
+		t.Error("hash does not depend on the secret")
+	}
+	plain := sha256.Sum256([]byte("phone_number:5552345678"))
+	if subject.hash("one") == hex.EncodeToString(plain[:]) {
+		t.Error("hash is not keyed")
+	}
+	other := privacySubject{Type: "lead_id", Value: "5552345678"}
+	if subject.hash("one") == other.hash("one") {
+		t.Error("hash ignores the identifier type")
+	}
+}
+
+func TestPrivacyRequiresHashSecret(t *testing.T) {
+	h := &Handler{Config: &config.Config{}}
+	w := httptest.NewRecorder()
+	h.ListPrivacyErasures(w, httptest.NewRequest("GET", "/privacy/erasures?phone_number=5552345678", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestMentionsNumber(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"lead_id IN (11,12,13)", true},
+		{`{"lead_id":12}`, true},
+		{"lead_id IN (120,121)", false},
+		{"lead_id = 112", false},
+		{"12", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := mentionsNumber(tt.text, []string{"12"}); got != tt.want {
+			t.Errorf("mentionsNumber(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPrivacyEraseAnonymize(t *testing.T) {
+	h, mock := newMockHandler(t)
+	subject := privacySubject{Type: "phone_number", Value: "5552345678"}
+	leads := []privacyLead{{LeadID: 12, ListID: 101}}
+
+	mock.ExpectBegin()
+	// Log rows match the lead or, for call logs, the number itself
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_log SET phone_number = '', comments = '' WHERE (lead_id IN (?) OR phone_number = ?)")).
+		WithArgs(12, "5552345678").WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_closer_log SET phone_number = '', comments = '' WHERE (lead_id IN (?) OR phone_number = ?)")).
+		WithArgs(12, "5552345678").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE recording_log SET filename = '', location = '' WHERE (lead_id IN (?))")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_callbacks SET status = 'INACTIVE', comments = '' WHERE (lead_id IN (?))")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_carrier_log SET channel = '' WHERE (lead_id IN (?))")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_dial_log SET extension = '', channel = '' WHERE (lead_id IN (?))")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 4))
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_list SET vendor_lead_code = ''")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_list_archive SET vendor_lead_code = ''")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_hopper WHERE lead_id IN (?)")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM go_api_custom_archive WHERE lead_id IN (?)")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_admin_log SET event_sql = '', event_notes = '' WHERE event_section = 'LEADS' AND record_id IN (?)")).
+		WithArgs("12").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// The lead's custom table row is deleted
+	mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+		WithArgs("custom_101").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}).AddRow("lead_id", "int").AddRow("color", "varchar"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM custom_101 WHERE lead_id = ?")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Bulk entries naming the number or the lead are redacted, those that
+	// only mention a longer lead ID are not
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT admin_log_id, record_id, event_sql, event_notes FROM vicidial_admin_log WHERE event_section = 'LEADS'"+
+		" AND (record_id LIKE ? OR event_sql LIKE ? OR event_notes LIKE ? OR record_id LIKE ? OR event_sql LIKE ? OR event_notes LIKE ?)"+
+		" AND record_id NOT IN (?)")).
+		WithArgs("%5552345678%", "%5552345678%", "%5552345678%", "%12%", "%12%", "%12%", "12").
+		WillReturnRows(sqlmock.NewRows([]string{"admin_log_id", "record_id", "event_sql", "event_notes"}).
+			AddRow(900, "3 leads", "INSERT INTO vicidial_list_archive SELECT * FROM vicidial_list WHERE 1=1 AND lead_id IN (11,12,13)", "").
+			AddRow(901, "2 leads", "INSERT INTO vicidial_list_archive SELECT * FROM vicidial_list WHERE 1=1 AND lead_id IN (120,121)", "").
+			AddRow(902, "40 leads", "UPDATE vicidial_list SET `status` = 'DNC' WHERE 1=1 AND `phone_number` = '5552345678'", ""))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_admin_log SET event_sql = '', event_notes = '' WHERE admin_log_id IN (?,?)")).
+		WithArgs(900, 902).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest("POST", "/privacy/erase", nil)
+	counts, err := h.privacyErase(context.Background(), r, subject, leads, "ANONYMIZE")
+	if err != nil {
+		t.Fatalf("privacyErase: %v", err)
+	}
+	want := map[string]int{
+		"outbound_calls": 4, "inbound_calls": 0, "recordings": 1, "callbacks": 1, "carrier_log": 4, "dial_log": 4,
+		"leads": 1, "hopper": 0, "custom_fields": 1, "audit_entries": 4,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrivacyEraseDelete(t *testing.T) {
+	h, mock := newMockHandler(t)
+	subject := privacySubject{Type: "lead_id", Value: "12"}
+	leads := []privacyLead{{LeadID: 12, ListID: 101, Archived: true}}
+
+	mock.ExpectBegin()
+	for _, table := range []string{"vicidial_log", "vicidial_closer_log", "recording_log", "vicidial_callbacks", "vicidial_carrier_log", "vicidial_dial_log"} {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM " + table + " WHERE (lead_id IN (?))")).
+			WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_list WHERE lead_id IN (?)")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_list_archive WHERE lead_id IN (?)")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vicidial_hopper WHERE lead_id IN (?)")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM go_api_custom_archive WHERE lead_id IN (?)")).
+		WithArgs(12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vicidial_admin_log SET event_sql = '', event_notes = '' WHERE event_section = 'LEADS' AND record_id IN (?)")).
+		WithArgs("12").WillReturnResult(sqlmock.NewResult(0, 1))
+	// The list has no custom table
+	mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+		WithArgs("custom_101").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}))
+	// A lead ID subject is only searched for by its lead ID
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT admin_log_id, record_id, event_sql, event_notes FROM vicidial_admin_log WHERE event_section = 'LEADS'"+
+		" AND (record_id LIKE ? OR event_sql LIKE ? OR event_notes LIKE ?) AND record_id NOT IN (?)")).
+		WithArgs("%12%", "%12%", "%12%", "12").
+		WillReturnRows(sqlmock.NewRows([]string{"admin_log_id", "record_id", "event_sql", "event_notes"}))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest("POST", "/privacy/erase", nil)
+	counts, err := h.privacyErase(context.Background(), r, subject, leads, "DELETE")
+	if err != nil {
+		t.Fatalf("privacyErase: %v", err)
+	}
+	if counts["leads"] != 1 || counts["custom_fields"] != 1 || counts["audit_entries"] != 1 || counts["dial_log"] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
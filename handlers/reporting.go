@@ -10,6 +10,50 @@ import (
 	"github.com/vicidb/non-agent-api/models"
 )
 
+// recordingPageSpec pages RecordingLookup results
+var recordingPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"recording_id":  {Column: "rl.recording_id"},
+		"start_time":    {Column: "rl.start_time", Time: true, Nullable: true},
+		"length_in_sec": {Column: "rl.length_in_sec", Nullable: true},
+	},
+	Key:          "recording_id",
+	DefaultSort:  "-start_time",
+	DefaultLimit: 100,
+	MaxLimit:     1000,
+}
+
+// didLogPageSpec pages DIDLogExport results. vicidial_did_log has no unique
+// key and a call logs a row for each DID it is routed through, so channel
+// and did_id break ties after uniqueid.
+var didLogPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"call_date": {Column: "call_date", Time: true, Nullable: true},
+		"uniqueid":  {Column: "uniqueid"},
+		"channel":   {Column: "channel"},
+		"did_id":    {Column: "did_id", Nullable: true},
+	},
+	Key:          "uniqueid",
+	Ties:         []string{"channel", "did_id"},
+	DefaultSort:  "-call_date",
+	DefaultLimit: 1000,
+	MaxLimit:     10000,
+}
+
+// agentStatsPageSpec pages AgentStatsExport results
+var agentStatsPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"agent_log_id": {Column: "agent_log_id"},
+		"event_time":   {Column: "event_time", Time: true, Nullable: true},
+		"user":         {Column: "user", Nullable: true},
+		"campaign_id":  {Column: "campaign_id", Nullable: true},
+	},
+	Key:          "agent_log_id",
+	DefaultSort:  "-event_time",
+	DefaultLimit: 1000,
+	MaxLimit:     10000,
+}
+
 // RecordingLookup searches for call recordings
 func (h *Handler) RecordingLookup(w http.ResponseWriter, r *http.Request) {
 	leadID := r.URL.Query().Get("lead_id")
@@ -17,33 +61,44 @@ func (h *Handler) RecordingLookup(w http.ResponseWriter, r *http.Request) {
 	startDate := r.URL.Query().Get("start_date")
 	endDate := r.URL.Query().Get("end_date")
 
-	query := `
-		SELECT recording_id, channel, server_ip, extension, start_time,
-			   end_time, length_in_sec, filename, location, lead_id, user, vicidial_id
-		FROM recording_log WHERE 1=1
-	`
+	page, ok := readPage(w, r, recordingPageSpec)
+	if !ok {
+		return
+	}
+
+	if leadID != "" && !h.requireLeadAccess(w, r, leadID) {
+		return
+	}
+
+	// Recordings are limited to leads the caller may see, like the lead
+	// endpoints; the LEFT JOIN keeps recordings without a lead otherwise
+	query := " FROM recording_log rl LEFT JOIN vicidial_list vl ON vl.lead_id = rl.lead_id WHERE 1=1"
 	args := []interface{}{}
 
 	if leadID != "" {
-		query += " AND lead_id = ?"
+		query += " AND rl.lead_id = ?"
 		args = append(args, leadID)
 	}
 	if user != "" {
-		query += " AND user = ?"
+		query += " AND rl.user = ?"
 		args = append(args, user)
 	}
 	if startDate != "" {
-		query += " AND start_time >= ?"
+		query += " AND rl.start_time >= ?"
 		args = append(args, startDate)
 	}
 	if endDate != "" {
-		query += " AND start_time <= ?"
+		query += " AND rl.start_time <= ?"
 		args = append(args, endDate)
 	}
 
-	query += " ORDER BY start_time DESC LIMIT 100"
+	restrictSQL, restrictArgs := listFilter(r, "vl.list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := page.query(h.DB, `
+		SELECT rl.recording_id, rl.channel, rl.server_ip, rl.extension, rl.start_time,
+			   rl.end_time, rl.length_in_sec, rl.filename, rl.location, rl.lead_id, rl.user, rl.vicidial_id`, query, args)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to search recordings: "+err.Error())
 		return
@@ -53,13 +108,16 @@ func (h *Handler) RecordingLookup(w http.ResponseWriter, r *http.Request) {
 	recordings := []models.Recording{}
 	for rows.Next() {
 		var rec models.Recording
-		rows.Scan(&rec.RecordingID, &rec.Channel, &rec.ServerIP, &rec.Extension,
+		rows.Scan(page.dest(&rec.RecordingID, &rec.Channel, &rec.ServerIP, &rec.Extension,
 			&rec.StartTime, &rec.EndTime, &rec.Length, &rec.Filename,
-			&rec.Location, &rec.LeadID, &rec.User, &rec.VicidialID)
+			&rec.Location, &rec.LeadID, &rec.User, &rec.VicidialID)...)
+		if page.more() {
+			break
+		}
 		recordings = append(recordings, rec)
 	}
 
-	respondWithSuccess(w, "Recordings retrieved", recordings)
+	respondWithPage(w, r, "Recordings retrieved", recordings, page)
 }
 
 // DIDLogExport exports DID call logs
@@ -68,11 +126,12 @@ func (h *Handler) DIDLogExport(w http.ResponseWriter, r *http.Request) {
 	endDate := r.URL.Query().Get("end_date")
 	didPattern := r.URL.Query().Get("did_pattern")
 
-	query := `
-		SELECT uniqueid, server_ip, channel, caller_id_number, caller_id_name,
-			   extension, call_date, did_id, did_route
-		FROM vicidial_did_log WHERE 1=1
-	`
+	page, ok := readPage(w, r, didLogPageSpec)
+	if !ok {
+		return
+	}
+
+	query := " FROM vicidial_did_log WHERE 1=1"
 	args := []interface{}{}
 
 	if startDate != "" {
@@ -88,9 +147,9 @@ func (h *Handler) DIDLogExport(w http.ResponseWriter, r *http.Request) {
 		args = append(args, "%"+didPattern+"%")
 	}
 
-	query += " ORDER BY call_date DESC LIMIT 1000"
-
-	rows, err := h.DB.Query(query, args...)
+	rows, err := page.query(h.DB, `
+		SELECT uniqueid, server_ip, channel, caller_id_number, caller_id_name,
+			   extension, call_date, did_id, did_route`, query, args)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to export DID logs: "+err.Error())
 		return
@@ -112,27 +171,39 @@ func (h *Handler) DIDLogExport(w http.ResponseWriter, r *http.Request) {
 	logs := []DIDLog{}
 	for rows.Next() {
 		var log DIDLog
-		rows.Scan(&log.UniqueID, &log.ServerIP, &log.Channel, &log.CallerIDNumber,
-			&log.CallerIDName, &log.Extension, &log.CallDate, &log.DIDID, &log.DIDRoute)
+		rows.Scan(page.dest(&log.UniqueID, &log.ServerIP, &log.Channel, &log.CallerIDNumber,
+			&log.CallerIDName, &log.Extension, &log.CallDate, &log.DIDID, &log.DIDRoute)...)
+		if page.more() {
+			break
+		}
 		logs = append(logs, log)
 	}
 
-	respondWithSuccess(w, "DID logs exported", logs)
+	respondWithPage(w, r, "DID logs exported", logs, page)
 }
 
 // PhoneNumberLog retrieves call history for a phone number
 func (h *Handler) PhoneNumberLog(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	phoneNumber := vars["phone"]
+	phone, ok := readPhoneNumber(w, "phone number", vars["phone"], r.URL.Query().Get("phone_code"))
+	if !ok {
+		return
+	}
 
 	query := `
 		SELECT uniqueid, lead_id, list_id, campaign_id, call_date, start_epoch,
 			   end_epoch, length_in_sec, status, phone_code, phone_number, user, comments
 		FROM vicidial_log WHERE phone_number = ?
-		ORDER BY call_date DESC LIMIT 50
 	`
+	args := []interface{}{phone.National}
 
-	rows, err := h.DB.Query(query, phoneNumber)
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
+	query += " ORDER BY call_date DESC LIMIT 50"
+
+	rows, err := h.DB.Query(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve phone logs: "+err.Error())
 		return
@@ -158,12 +229,12 @@ func (h *Handler) AgentStatsExport(w http.ResponseWriter, r *http.Request) {
 	user := r.URL.Query().Get("user")
 	campaignID := r.URL.Query().Get("campaign_id")
 
-	query := `
-		SELECT user, event_time, campaign_id, pause_epoch, pause_sec,
-			   wait_epoch, wait_sec, talk_epoch, talk_sec, dispo_epoch, dispo_sec,
-			   status, calls
-		FROM vicidial_agent_log WHERE 1=1
-	`
+	page, ok := readPage(w, r, agentStatsPageSpec)
+	if !ok {
+		return
+	}
+
+	query := " FROM vicidial_agent_log WHERE 1=1"
 	args := []interface{}{}
 
 	if startDate != "" {
@@ -183,9 +254,14 @@ func (h *Handler) AgentStatsExport(w http.ResponseWriter, r *http.Request) {
 		args = append(args, campaignID)
 	}
 
-	query += " ORDER BY event_time DESC LIMIT 1000"
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := page.query(h.DB, `
+		SELECT user, event_time, campaign_id, pause_epoch, pause_sec,
+			   wait_epoch, wait_sec, talk_epoch, talk_sec, dispo_epoch, dispo_sec,
+			   status, calls`, query, args)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to export agent stats: "+err.Error())
 		return
@@ -211,13 +287,16 @@ func (h *Handler) AgentStatsExport(w http.ResponseWriter, r *http.Request) {
 	stats := []AgentStat{}
 	for rows.Next() {
 		var stat AgentStat
-		rows.Scan(&stat.User, &stat.EventTime, &stat.CampaignID, &stat.PauseEpoch,
+		rows.Scan(page.dest(&stat.User, &stat.EventTime, &stat.CampaignID, &stat.PauseEpoch,
 			&stat.PauseSec, &stat.WaitEpoch, &stat.WaitSec, &stat.TalkEpoch,
-			&stat.TalkSec, &stat.DispoEpoch, &stat.DispoSec, &stat.Status, &stat.Calls)
+			&stat.TalkSec, &stat.DispoEpoch, &stat.DispoSec, &stat.Status, &stat.Calls)...)
+		if page.more() {
+			break
+		}
 		stats = append(stats, stat)
 	}
 
-	respondWithSuccess(w, "Agent statistics exported", stats)
+	respondWithPage(w, r, "Agent statistics exported", stats, page)
 }
 
 // CallStatusStats retrieves call status statistics
@@ -245,6 +324,10 @@ func (h *Handler) CallStatusStats(w http.ResponseWriter, r *http.Request) {
 		args = append(args, endDate)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	query += " GROUP BY status ORDER BY count DESC"
 
 	rows, err := h.DB.Query(query, args...)
@@ -295,6 +378,10 @@ func (h *Handler) CallDispoReport(w http.ResponseWriter, r *http.Request) {
 		args = append(args, endDate)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	query += " GROUP BY status, user ORDER BY count DESC LIMIT 500"
 
 	rows, err := h.DB.Query(query, args...)
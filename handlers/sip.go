@@ -22,6 +22,22 @@ type SIPLog struct {
 	CallerCode       string    `json:"caller_code"`
 }
 
+// sipLogPageSpec pages GetSIPLog results. vicidial_carrier_log has no
+// unique key and a call that fails over to another trunk logs a row per
+// channel, so channel breaks ties after uniqueid.
+var sipLogPageSpec = pageSpec{
+	Sorts: map[string]sortField{
+		"call_date": {Column: "cl.call_date", Time: true, Nullable: true},
+		"uniqueid":  {Column: "cl.uniqueid"},
+		"channel":   {Column: "cl.channel", Nullable: true},
+	},
+	Key:          "uniqueid",
+	Ties:         []string{"channel"},
+	DefaultSort:  "-call_date",
+	DefaultLimit: 100,
+	MaxLimit:     5000,
+}
+
 // GetSIPLog fetches data from carrier log
 func (h *Handler) GetSIPLog(w http.ResponseWriter, r *http.Request) {
 	// Query parameters
@@ -31,50 +47,57 @@ func (h *Handler) GetSIPLog(w http.ResponseWriter, r *http.Request) {
 	serverIP := r.URL.Query().Get("server_ip")
 	dialStatus := r.URL.Query().Get("dialstatus")
 	sipHangupCause := r.URL.Query().Get("sip_hangup_cause")
-	limit := r.URL.Query().Get("limit")
 
-	if limit == "" {
-		limit = "100"
+	page, ok := readPage(w, r, sipLogPageSpec)
+	if !ok {
+		return
 	}
 
+	// Calls are limited to leads the caller may see, like the lead
+	// endpoints; the LEFT JOIN keeps calls without a lead otherwise
 	query := `
-		SELECT uniqueid, call_date, server_ip, lead_id, hangup_cause,
-			   dialstatus, channel, dial_time, answered_time,
-			   sip_hangup_cause, sip_hangup_reason, caller_code
-		FROM vicidial_carrier_log
+		FROM vicidial_carrier_log cl
+		LEFT JOIN vicidial_list vl ON vl.lead_id = cl.lead_id
 		WHERE 1=1
 	`
 	args := []interface{}{}
 
 	if startDate != "" {
-		query += " AND call_date >= ?"
+		query += " AND cl.call_date >= ?"
 		args = append(args, startDate)
 	}
 	if endDate != "" {
-		query += " AND call_date <= ?"
+		query += " AND cl.call_date <= ?"
 		args = append(args, endDate)
 	}
 	if leadID != "" {
-		query += " AND lead_id = ?"
+		if !h.requireLeadAccess(w, r, leadID) {
+			return
+		}
+		query += " AND cl.lead_id = ?"
 		args = append(args, leadID)
 	}
 	if serverIP != "" {
-		query += " AND server_ip = ?"
+		query += " AND cl.server_ip = ?"
 		args = append(args, serverIP)
 	}
 	if dialStatus != "" {
-		query += " AND dialstatus = ?"
+		query += " AND cl.dialstatus = ?"
 		args = append(args, dialStatus)
 	}
 	if sipHangupCause != "" {
-		query += " AND sip_hangup_cause = ?"
+		query += " AND cl.sip_hangup_cause = ?"
 		args = append(args, sipHangupCause)
 	}
 
-	query += " ORDER BY call_date DESC LIMIT ?"
-	args = append(args, limit)
+	restrictSQL, restrictArgs := listFilter(r, "vl.list_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := page.query(h.DB, `
+		SELECT cl.uniqueid, cl.call_date, cl.server_ip, cl.lead_id, cl.hangup_cause,
+			   cl.dialstatus, cl.channel, cl.dial_time, cl.answered_time,
+			   cl.sip_hangup_cause, cl.sip_hangup_reason, cl.caller_code`, query, args)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve carrier logs: "+err.Error())
 		return
@@ -87,16 +110,19 @@ func (h *Handler) GetSIPLog(w http.ResponseWriter, r *http.Request) {
 		var callDate sql.NullTime
 		var leadID sql.NullInt64
 
-		err := rows.Scan(
+		err := rows.Scan(page.dest(
 			&log.UniqueID, &callDate, &log.ServerIP, &leadID,
 			&log.HangupCause, &log.DialStatus, &log.Channel,
 			&log.DialTime, &log.AnsweredTime, &log.SIPHangupCause,
 			&log.SIPHangupReason, &log.CallerCode,
-		)
+		)...)
 
 		if err != nil {
 			continue
 		}
+		if page.more() {
+			break
+		}
 
 		if callDate.Valid {
 			log.CallDate = callDate.Time
@@ -108,10 +134,10 @@ func (h *Handler) GetSIPLog(w http.ResponseWriter, r *http.Request) {
 		logs = append(logs, log)
 	}
 
-	respondWithSuccess(w, "SIP/Carrier logs retrieved successfully", map[string]interface{}{
+	respondWithPage(w, r, "SIP/Carrier logs retrieved successfully", map[string]interface{}{
 		"count": len(logs),
 		"logs":  logs,
-	})
+	}, page)
 }
 
 // GetSIPEventLog fetches SIP event logs
@@ -0,0 +1,606 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// statusFlagValidators check the Y/N flags and times shared by system and
+// campaign statuses
+var statusFlagValidators = map[string]fieldValidator{
+	"status":             validateStatus,
+	"status_name":        validateMaxLen(30),
+	"selectable":         validateYN,
+	"human_answered":     validateYN,
+	"category":           validateMaxLen(20),
+	"sale":               validateYN,
+	"dnc":                validateYN,
+	"customer_contact":   validateYN,
+	"not_interested":     validateYN,
+	"unworkable":         validateYN,
+	"scheduled_callback": validateYN,
+	"completed":          validateYN,
+	"min_sec":            validateIntRange(0, 99999),
+	"max_sec":            validateIntRange(0, 99999),
+	"answering_machine":  validateYN,
+}
+
+var systemStatusPatchSpec = patchSpec{
+	Table:      "vicidial_statuses",
+	Model:      models.Status{},
+	KeyColumn:  "status",
+	ReadOnly:   map[string]bool{"status": true, "campaign_id": true},
+	Validators: statusFlagValidators,
+}
+
+var campaignStatusPatchSpec = patchSpec{
+	Table:       "vicidial_campaign_statuses",
+	Model:       models.Status{},
+	KeyColumn:   "status",
+	ScopeColumn: "campaign_id",
+	ReadOnly:    map[string]bool{"status": true, "campaign_id": true},
+	Validators:  statusFlagValidators,
+}
+
+var hotkeyPatchSpec = patchSpec{
+	Table:       "vicidial_campaign_hotkeys",
+	Model:       models.Hotkey{},
+	KeyColumn:   "hotkey",
+	ScopeColumn: "campaign_id",
+	ReadOnly:    map[string]bool{"hotkey": true, "campaign_id": true},
+	Validators: map[string]fieldValidator{
+		"hotkey":      validateEnum("1", "2", "3", "4", "5", "6", "7", "8", "9"),
+		"status":      validateStatus,
+		"status_name": validateMaxLen(30),
+		"selectable":  validateYN,
+	},
+}
+
+// reservedStatuses are set by the dialer and agent screen themselves, so
+// they cannot be deleted
+var reservedStatuses = map[string]bool{
+	"NEW": true, "QUEUE": true, "INCALL": true, "DISPO": true, "DROP": true, "XDROP": true,
+	"NA": true, "CALLBK": true, callbackHoldStatus: true, "PDROP": true, "LRERR": true,
+	"AFTHRS": true, "TIMEOT": true, "MAXCAL": true,
+}
+
+// createSpec returns a copy of a patch spec that also accepts the key
+// column, for creating rows. The scope column stays read-only, as it comes
+// from the URL.
+func createSpec(spec patchSpec) patchSpec {
+	spec.ReadOnly = map[string]bool{}
+	if spec.ScopeColumn != "" {
+		spec.ReadOnly[spec.ScopeColumn] = true
+	}
+	return spec
+}
+
+// readCreate decodes a request body with createSpec and checks the required
+// fields are present, responding with 400 on error
+func readCreate(w http.ResponseWriter, r *http.Request, spec patchSpec, required ...string) ([]patchField, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, false
+	}
+	fields, err := decodePatch(createSpec(spec), body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	for _, name := range required {
+		if value, ok := patchValue(fields, name); !ok || value == "" {
+			respondWithError(w, http.StatusBadRequest, name+" is required")
+			return nil, false
+		}
+	}
+	return fields, true
+}
+
+// requireCampaign responds with 403 or 404 and returns false when the
+// caller may not use the campaign or it does not exist
+func (h *Handler) requireCampaign(w http.ResponseWriter, r *http.Request, campaignID string) bool {
+	if !requireCampaignAccess(w, r, campaignID) {
+		return false
+	}
+	exists, err := h.campaignExists(campaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up campaign: "+err.Error())
+		return false
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return false
+	}
+	return true
+}
+
+// statusColumns are the models.Status columns after campaign_id
+const statusColumns = `status, status_name, selectable, human_answered, COALESCE(category, ''),
+	sale, dnc, customer_contact, not_interested, unworkable, scheduled_callback, completed,
+	min_sec, max_sec, answering_machine`
+
+func scanStatus(row rowScanner) (models.Status, error) {
+	var s models.Status
+	err := row.Scan(&s.CampaignID, &s.Status, &s.StatusName, &s.Selectable, &s.HumanAnswered, &s.Category,
+		&s.Sale, &s.DNC, &s.CustomerContact, &s.NotInterested, &s.Unworkable, &s.ScheduledCallback,
+		&s.Completed, &s.MinSec, &s.MaxSec, &s.AnsweringMachine)
+	return s, err
+}
+
+// queryStatuses lists statuses from either status table
+func (h *Handler) queryStatuses(w http.ResponseWriter, query string, args ...interface{}) ([]models.Status, bool) {
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve statuses: "+err.Error())
+		return nil, false
+	}
+	defer rows.Close()
+
+	statuses := []models.Status{}
+	for rows.Next() {
+		status, err := scanStatus(rows)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read status: "+err.Error())
+			return nil, false
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, true
+}
+
+// statusExists reports whether a status is defined system-wide or, when
+// campaignID is given, for that campaign, and returns its name
+func (h *Handler) statusExists(status, campaignID string) (string, bool, error) {
+	query := "SELECT status_name FROM vicidial_statuses WHERE status = ?"
+	args := []interface{}{status}
+	if campaignID != "" {
+		query += " UNION ALL SELECT status_name FROM vicidial_campaign_statuses WHERE status = ? AND campaign_id = ?"
+		args = append(args, status, campaignID)
+	}
+	var name string
+	err := h.DB.QueryRow(query+" LIMIT 1", args...).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return name, err == nil, err
+}
+
+// ListStatuses lists the system-wide statuses
+func (h *Handler) ListStatuses(w http.ResponseWriter, r *http.Request) {
+	statuses, ok := h.queryStatuses(w, "SELECT '', "+statusColumns+" FROM vicidial_statuses ORDER BY status")
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "Statuses retrieved", statuses)
+}
+
+// ListCampaignStatuses lists a campaign's own statuses. With
+// include_system=Y the system-wide statuses are listed too.
+func (h *Handler) ListCampaignStatuses(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+	if !h.requireCampaign(w, r, campaignID) {
+		return
+	}
+
+	query := "SELECT campaign_id, " + statusColumns + " FROM vicidial_campaign_statuses WHERE campaign_id = ?"
+	if r.URL.Query().Get("include_system") == "Y" {
+		query += " UNION ALL SELECT '', " + statusColumns + " FROM vicidial_statuses"
+	}
+	statuses, ok := h.queryStatuses(w, query+" ORDER BY status", campaignID)
+	if !ok {
+		return
+	}
+	respondWithSuccess(w, "Campaign statuses retrieved", statuses)
+}
+
+// CreateStatus adds a system-wide status
+func (h *Handler) CreateStatus(w http.ResponseWriter, r *http.Request) {
+	h.createStatus(w, r, "")
+}
+
+// CreateCampaignStatus adds a status to one campaign
+func (h *Handler) CreateCampaignStatus(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+	if !h.requireCampaign(w, r, campaignID) {
+		return
+	}
+	h.createStatus(w, r, campaignID)
+}
+
+// createStatus adds a system status, or a campaign status when campaignID is
+// given. As in VICIdial a campaign cannot redefine a system status.
+func (h *Handler) createStatus(w http.ResponseWriter, r *http.Request, campaignID string) {
+	spec, section := systemStatusPatchSpec, "STATUSES"
+	if campaignID != "" {
+		spec, section = campaignStatusPatchSpec, "CAMPAIGNS"
+	}
+	fields, ok := readCreate(w, r, spec, "status", "status_name")
+	if !ok {
+		return
+	}
+	status, _ := patchValue(fields, "status")
+
+	_, exists, err := h.statusExists(status.(string), campaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up status: "+err.Error())
+		return
+	}
+	if exists {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Status %s already exists", status))
+		return
+	}
+
+	recordID := status.(string)
+	if campaignID != "" {
+		fields = append(fields, patchField{Name: "campaign_id", Column: "campaign_id", Value: campaignID})
+		recordID = campaignID
+	}
+	query, args := buildInsertQuery(spec.Table, fields, nil)
+	if _, err := h.DB.Exec(query, args...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create status: "+err.Error())
+		return
+	}
+
+	where := patchWhere(spec)
+	keys := []interface{}{status}
+	if campaignID != "" {
+		keys = []interface{}{campaignID, status}
+	}
+	h.audit(r, auditEvent{
+		Section:  section,
+		Type:     "ADD",
+		RecordID: recordID,
+		Code:     "ADMIN API ADD STATUS " + recordID,
+		SQL:      query,
+		Args:     args,
+		After:    h.snapshotRows("SELECT * FROM "+spec.Table+where, keys...),
+	})
+
+	columnsFrom := "SELECT '', " + statusColumns + " FROM vicidial_statuses"
+	if campaignID != "" {
+		columnsFrom = "SELECT campaign_id, " + statusColumns + " FROM vicidial_campaign_statuses"
+	}
+	created, err := scanStatus(h.DB.QueryRow(columnsFrom+where, keys...))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Status created, but failed to read it back: "+err.Error())
+		return
+	}
+	respondWithSuccess(w, "Status created successfully", created)
+}
+
+// UpdateStatus updates the fields of a system status present in the request body
+func (h *Handler) UpdateStatus(w http.ResponseWriter, r *http.Request) {
+	status := mux.Vars(r)["status"]
+
+	fields, ok := readPatch(w, r, systemStatusPatchSpec)
+	if !ok {
+		return
+	}
+	found, err := h.applyPatch(r, systemStatusPatchSpec, status, fields, "STATUSES", "ADMIN API MODIFY STATUS")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update status: "+err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Status not found")
+		return
+	}
+	respondWithSuccess(w, "Status updated successfully", map[string]interface{}{
+		"status":         status,
+		"updated_fields": patchFieldNames(fields),
+	})
+}
+
+// UpdateCampaignStatus updates the fields of a campaign status present in the request body
+func (h *Handler) UpdateCampaignStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	campaignID, status := vars["campaign_id"], vars["status"]
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	fields, ok := readPatch(w, r, campaignStatusPatchSpec)
+	if !ok {
+		return
+	}
+	found, err := h.applyScopedPatch(r, campaignStatusPatchSpec, campaignID, status, fields, "CAMPAIGNS", "ADMIN API MODIFY CAMPAIGN STATUS "+status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update status: "+err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Status not found")
+		return
+	}
+	respondWithSuccess(w, "Campaign status updated successfully", map[string]interface{}{
+		"campaign_id":    campaignID,
+		"status":         status,
+		"updated_fields": patchFieldNames(fields),
+	})
+}
+
+// DeleteStatus deletes a system status no lead has
+func (h *Handler) DeleteStatus(w http.ResponseWriter, r *http.Request) {
+	h.deleteStatus(w, r, "", mux.Vars(r)["status"])
+}
+
+// DeleteCampaignStatus deletes a campaign status no lead in the campaign's lists has
+func (h *Handler) DeleteCampaignStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !requireCampaignAccess(w, r, vars["campaign_id"]) {
+		return
+	}
+	h.deleteStatus(w, r, vars["campaign_id"], vars["status"])
+}
+
+// deleteStatus deletes a status, refusing with 409 while leads still have
+// it, and removes the hotkeys that set it
+func (h *Handler) deleteStatus(w http.ResponseWriter, r *http.Request, campaignID, status string) {
+	spec, section, recordID := systemStatusPatchSpec, "STATUSES", status
+	keys := []interface{}{status}
+	leadQuery := "SELECT COUNT(*) FROM vicidial_list WHERE status = ?"
+	hotkeyQuery := "DELETE FROM vicidial_campaign_hotkeys WHERE status = ?"
+	if campaignID != "" {
+		spec, section, recordID = campaignStatusPatchSpec, "CAMPAIGNS", campaignID
+		keys = []interface{}{campaignID, status}
+		leadQuery += " AND list_id IN (SELECT list_id FROM vicidial_lists WHERE campaign_id = ?)"
+		hotkeyQuery += " AND campaign_id = ?"
+	}
+	leadArgs := append([]interface{}{status}, keys[:len(keys)-1]...)
+
+	before := h.snapshotRows("SELECT * FROM "+spec.Table+patchWhere(spec), keys...)
+	if len(before) == 0 {
+		respondWithError(w, http.StatusNotFound, "Status not found")
+		return
+	}
+	if reservedStatuses[status] {
+		respondWithError(w, http.StatusConflict, "Status "+status+" is used by the dialer and cannot be deleted")
+		return
+	}
+
+	var leads int
+	if err := h.DB.QueryRow(leadQuery, leadArgs...).Scan(&leads); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to count leads: "+err.Error())
+		return
+	}
+	if leads > 0 {
+		respondWithJSON(w, http.StatusConflict, models.APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Status %s is still used by %d leads", status, leads),
+			Data:    map[string]interface{}{"status": status, "leads": leads},
+		})
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM " + spec.Table + patchWhere(spec)
+	if _, err := tx.Exec(query, keys...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete status: "+err.Error())
+		return
+	}
+	res, err := tx.Exec(hotkeyQuery, leadArgs...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete hotkeys: "+err.Error())
+		return
+	}
+	hotkeys, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete status: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  section,
+		Type:     "DELETE",
+		RecordID: recordID,
+		Code:     "ADMIN API DELETE STATUS " + status,
+		SQL:      query,
+		Args:     keys,
+		Before:   before,
+		After:    map[string]interface{}{"hotkeys_removed": hotkeys},
+	})
+
+	respondWithSuccess(w, "Status deleted successfully", map[string]interface{}{
+		"campaign_id":     campaignID,
+		"status":          status,
+		"hotkeys_removed": hotkeys,
+	})
+}
+
+// ListHotkeys lists a campaign's disposition hotkeys
+func (h *Handler) ListHotkeys(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+	if !h.requireCampaign(w, r, campaignID) {
+		return
+	}
+
+	rows, err := h.DB.Query(`
+		SELECT hotkey, status, status_name, selectable, campaign_id
+		FROM vicidial_campaign_hotkeys WHERE campaign_id = ? ORDER BY hotkey
+	`, campaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve hotkeys: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	hotkeys := []models.Hotkey{}
+	for rows.Next() {
+		var hk models.Hotkey
+		if err := rows.Scan(&hk.Hotkey, &hk.Status, &hk.StatusName, &hk.Selectable, &hk.CampaignID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read hotkey: "+err.Error())
+			return
+		}
+		hotkeys = append(hotkeys, hk)
+	}
+	respondWithSuccess(w, "Hotkeys retrieved", hotkeys)
+}
+
+// hotkeyStatusName checks a hotkey's status exists for the campaign and adds
+// its name to the fields when status_name is not given
+func (h *Handler) hotkeyStatusName(w http.ResponseWriter, campaignID string, fields []patchField) ([]patchField, bool) {
+	status, ok := patchValue(fields, "status")
+	if !ok {
+		return fields, true
+	}
+	name, exists, err := h.statusExists(status.(string), campaignID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up status: "+err.Error())
+		return nil, false
+	}
+	if !exists {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Status %s does not exist for campaign %s", status, campaignID))
+		return nil, false
+	}
+	if _, ok := patchValue(fields, "status_name"); !ok {
+		fields = append(fields, patchField{Name: "status_name", Column: "status_name", Value: name})
+	}
+	return fields, true
+}
+
+// CreateHotkey assigns a key from 1 to 9 to a status for a campaign's agents
+func (h *Handler) CreateHotkey(w http.ResponseWriter, r *http.Request) {
+	campaignID := mux.Vars(r)["campaign_id"]
+	if !h.requireCampaign(w, r, campaignID) {
+		return
+	}
+
+	fields, ok := readCreate(w, r, hotkeyPatchSpec, "hotkey", "status")
+	if !ok {
+		return
+	}
+	if fields, ok = h.hotkeyStatusName(w, campaignID, fields); !ok {
+		return
+	}
+	hotkey, _ := patchValue(fields, "hotkey")
+
+	var taken int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_campaign_hotkeys WHERE campaign_id = ? AND hotkey = ?", campaignID, hotkey).Scan(&taken); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up hotkey: "+err.Error())
+		return
+	}
+	if taken > 0 {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Hotkey %s is already assigned", hotkey))
+		return
+	}
+	if _, ok := patchValue(fields, "selectable"); !ok {
+		fields = append(fields, patchField{Name: "selectable", Column: "selectable", Value: "Y"})
+	}
+	fields = append(fields, patchField{Name: "campaign_id", Column: "campaign_id", Value: campaignID})
+
+	query, args := buildInsertQuery(hotkeyPatchSpec.Table, fields, nil)
+	if _, err := h.DB.Exec(query, args...); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create hotkey: "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "ADD",
+		RecordID: campaignID,
+		Code:     fmt.Sprintf("ADMIN API ADD HOTKEY %s", hotkey),
+		SQL:      query,
+		Args:     args,
+	})
+
+	hk := models.Hotkey{CampaignID: campaignID}
+	for _, field := range fields {
+		switch field.Name {
+		case "hotkey":
+			hk.Hotkey = field.Value.(string)
+		case "status":
+			hk.Status = field.Value.(string)
+		case "status_name":
+			hk.StatusName = field.Value.(string)
+		case "selectable":
+			hk.Selectable = field.Value.(string)
+		}
+	}
+	respondWithSuccess(w, "Hotkey created successfully", hk)
+}
+
+// UpdateHotkey changes the status, name or selectable flag of a hotkey
+func (h *Handler) UpdateHotkey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	campaignID, hotkey := vars["campaign_id"], vars["hotkey"]
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+
+	fields, ok := readPatch(w, r, hotkeyPatchSpec)
+	if !ok {
+		return
+	}
+	if fields, ok = h.hotkeyStatusName(w, campaignID, fields); !ok {
+		return
+	}
+	found, err := h.applyScopedPatch(r, hotkeyPatchSpec, campaignID, hotkey, fields, "CAMPAIGNS", "ADMIN API MODIFY HOTKEY "+hotkey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update hotkey: "+err.Error())
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Hotkey not found")
+		return
+	}
+	respondWithSuccess(w, "Hotkey updated successfully", map[string]interface{}{
+		"campaign_id":    campaignID,
+		"hotkey":         hotkey,
+		"updated_fields": patchFieldNames(fields),
+	})
+}
+
+// DeleteHotkey removes a hotkey from a campaign
+func (h *Handler) DeleteHotkey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	campaignID, hotkey := vars["campaign_id"], vars["hotkey"]
+	if !requireCampaignAccess(w, r, campaignID) {
+		return
+	}
+	h.deleteScopedRow(w, r, hotkeyPatchSpec, campaignID, hotkey, "Hotkey", "ADMIN API DELETE HOTKEY "+hotkey)
+}
+
+// deleteScopedRow deletes one campaign's row of a scoped spec, responding
+// with 404 when it does not exist
+func (h *Handler) deleteScopedRow(w http.ResponseWriter, r *http.Request, spec patchSpec, campaignID, key, noun, code string) {
+	where := patchWhere(spec)
+	before := h.snapshotRows("SELECT * FROM "+spec.Table+where, campaignID, key)
+	if len(before) == 0 {
+		respondWithError(w, http.StatusNotFound, noun+" not found")
+		return
+	}
+
+	query := "DELETE FROM " + spec.Table + where
+	if _, err := h.DB.Exec(query, campaignID, key); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete "+strings.ToLower(noun)+": "+err.Error())
+		return
+	}
+
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "DELETE",
+		RecordID: campaignID,
+		Code:     code,
+		SQL:      query,
+		Args:     []interface{}{campaignID, key},
+		Before:   before,
+	})
+
+	respondWithSuccess(w, noun+" deleted successfully", map[string]interface{}{
+		"campaign_id":  campaignID,
+		spec.KeyColumn: key,
+	})
+}
@@ -275,6 +275,15 @@ func (h *Handler) ServerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "SERVERS",
+		Type:     "OTHER",
+		RecordID: req.ServerIP,
+		Code:     "ADMIN API SERVER REFRESH",
+		SQL:      query,
+		Args:     []interface{}{req.ServerIP},
+	})
+
 	respondWithSuccess(w, "Server refresh triggered", map[string]string{
 		"server_ip": req.ServerIP,
 		"status":    "refresh_requested",
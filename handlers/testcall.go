@@ -36,15 +36,17 @@ func (h *Handler) SendTestCall(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "phone_number is required")
 		return
 	}
-	if len(req.PhoneNumber) < 6 {
-		respondWithError(w, http.StatusBadRequest, "phone_number too small, must be at least 6 digits")
+	phone, ok := readPhoneNumber(w, "phone_number", req.PhoneNumber, req.PhoneCode)
+	if !ok {
 		return
 	}
+	req.PhoneNumber, req.PhoneCode = phone.National, phone.Code
 
-	// Set defaults
-	if req.PhoneCode == "" {
-		req.PhoneCode = "1"
+	if !requireCampaignAccess(w, r, req.CampaignID) {
+		return
 	}
+
+	// Set defaults
 	if req.User == "" {
 		req.User = "API"
 	}
@@ -276,6 +278,21 @@ func (h *Handler) SendTestCall(w http.ResponseWriter, r *http.Request) {
 
 	managerID, _ := result.LastInsertId()
 
+	h.audit(r, auditEvent{
+		Section:  "CAMPAIGNS",
+		Type:     "OTHER",
+		RecordID: req.CampaignID,
+		Code:     "ADMIN API TEST CALL " + vQueryCID,
+		SQL:      managerQuery,
+		Args: []interface{}{sqlDate, serverIP, vQueryCID,
+			cmdLineB, cmdLineC, cmdLineD, cmdLineE, cmdLineF, cmdLineG, cmdLineK},
+		After: map[string]interface{}{
+			"lead_id":      leadID,
+			"phone_code":   req.PhoneCode,
+			"phone_number": req.PhoneNumber,
+		},
+	})
+
 	// Insert into vicidial_auto_calls
 	autoCallQuery := `
 		INSERT INTO vicidial_auto_calls
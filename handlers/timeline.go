@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// timelineEvent is one entry in a lead's activity timeline
+type timelineEvent struct {
+	EventTime  time.Time              `json:"event_time"`
+	EventType  string                 `json:"event_type"`
+	Source     string                 `json:"source"`
+	ID         string                 `json:"id"`
+	User       string                 `json:"user,omitempty"`
+	CampaignID string                 `json:"campaign_id,omitempty"`
+	Status     string                 `json:"status,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// timelineSource reads one event type from a log table. The query selects
+// the event time, ID, user, campaign and status first, followed by any detail
+// columns, for a single lead_id; filters and ordering are appended on TimeColumn.
+// Events of sources with a CampaignColumn are limited to the caller's campaigns.
+type timelineSource struct {
+	EventType      string
+	Table          string
+	TimeColumn     string
+	CampaignColumn string
+	Query          string
+}
+
+// timelineSources are the tables merged into a lead timeline, in the order
+// events with the same time are listed
+var timelineSources = []timelineSource{
+	{
+		EventType:      "outbound_call",
+		Table:          "vicidial_log",
+		TimeColumn:     "call_date",
+		CampaignColumn: "campaign_id",
+		Query: `
+			SELECT call_date, uniqueid, user, campaign_id, status,
+				   list_id, phone_code, phone_number, length_in_sec, term_reason, alt_dial, comments
+			FROM vicidial_log WHERE lead_id = ?`,
+	},
+	{
+		EventType:      "inbound_call",
+		Table:          "vicidial_closer_log",
+		TimeColumn:     "call_date",
+		CampaignColumn: "campaign_id",
+		Query: `
+			SELECT call_date, closecallid, user, campaign_id, status,
+				   list_id, phone_code, phone_number, length_in_sec, queue_seconds, term_reason, uniqueid
+			FROM vicidial_closer_log WHERE lead_id = ?`,
+	},
+	{
+		EventType:  "carrier",
+		Table:      "vicidial_carrier_log",
+		TimeColumn: "call_date",
+		Query: `
+			SELECT call_date, uniqueid, '', '', dialstatus,
+				   server_ip, channel, hangup_cause, sip_hangup_cause, sip_hangup_reason,
+				   dial_time, answered_time, caller_code
+			FROM vicidial_carrier_log WHERE lead_id = ?`,
+	},
+	{
+		EventType:  "recording",
+		Table:      "recording_log",
+		TimeColumn: "start_time",
+		Query: `
+			SELECT start_time, recording_id, user, '', '',
+				   end_time, length_in_sec, filename, location, vicidial_id
+			FROM recording_log WHERE lead_id = ?`,
+	},
+	{
+		EventType:      "callback",
+		Table:          "vicidial_callbacks",
+		TimeColumn:     "entry_time",
+		CampaignColumn: "campaign_id",
+		Query: `
+			SELECT entry_time, callback_id, user, campaign_id, status,
+				   callback_time, modify_date, recipient, lead_status, comments
+			FROM vicidial_callbacks WHERE lead_id = ?`,
+	},
+	{
+		EventType:      "disposition",
+		Table:          "vicidial_agent_log",
+		TimeColumn:     "event_time",
+		CampaignColumn: "campaign_id",
+		Query: `
+			SELECT event_time, agent_log_id, user, campaign_id, status,
+				   sub_status, talk_sec, dispo_sec, uniqueid
+			FROM vicidial_agent_log WHERE lead_id = ? AND status IS NOT NULL AND status != ''`,
+	},
+	{
+		EventType:  "modification",
+		Table:      "vicidial_admin_log",
+		TimeColumn: "event_date",
+		Query: `
+			SELECT event_date, admin_log_id, user, '', event_type,
+				   event_code, event_notes, ip_address
+			FROM vicidial_admin_log WHERE record_id = ? AND event_section = 'LEADS'`,
+	},
+}
+
+// timelineTypes returns the event types the timeline can include
+func timelineTypes() []string {
+	types := make([]string, len(timelineSources))
+	for i, source := range timelineSources {
+		types[i] = source.EventType
+	}
+	return types
+}
+
+// parseTimelineTime reads a start_date or end_date filter. A date without a
+// time covers the whole day, so an end date is moved to its last second.
+func parseTimelineTime(value string, end bool) (string, bool) {
+	for _, layout := range patchTimeLayouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if end && layout == "2006-01-02" {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return t.Format("2006-01-02 15:04:05"), true
+	}
+	return "", false
+}
+
+// readTimelineSource returns up to limit events of one type for the lead
+// from campaigns the caller may use
+func (h *Handler) readTimelineSource(r *http.Request, source timelineSource, leadID int, startDate, endDate string, descending bool, limit int) ([]timelineEvent, error) {
+	query := source.Query
+	args := []interface{}{leadID}
+
+	if source.CampaignColumn != "" {
+		restrictSQL, restrictArgs := campaignFilter(r, source.CampaignColumn)
+		query += restrictSQL
+		args = append(args, restrictArgs...)
+	}
+
+	if startDate != "" {
+		query += " AND " + source.TimeColumn + " >= ?"
+		args = append(args, startDate)
+	}
+	if endDate != "" {
+		query += " AND " + source.TimeColumn + " <= ?"
+		args = append(args, endDate)
+	}
+	if descending {
+		query += " ORDER BY " + source.TimeColumn + " DESC LIMIT ?"
+	} else {
+		query += " ORDER BY " + source.TimeColumn + " LIMIT ?"
+	}
+	args = append(args, limit)
+
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []timelineEvent{}
+	for rows.Next() {
+		var eventTime sql.NullTime
+		var id, user, campaignID, status sql.NullString
+		details := make([]sql.NullString, len(columns)-5)
+		dest := []interface{}{&eventTime, &id, &user, &campaignID, &status}
+		for i := range details {
+			dest = append(dest, &details[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if !eventTime.Valid {
+			continue
+		}
+
+		event := timelineEvent{
+			EventTime:  eventTime.Time,
+			EventType:  source.EventType,
+			Source:     source.Table,
+			ID:         id.String,
+			User:       user.String,
+			CampaignID: campaignID.String,
+			Status:     status.String,
+			Details:    map[string]interface{}{},
+		}
+		for i, value := range details {
+			name := columns[i+5]
+			switch {
+			case !value.Valid:
+				event.Details[name] = nil
+			case name == "event_notes" && json.Valid([]byte(value.String)):
+				// The API's own audit entries carry before and after snapshots
+				event.Details[name] = json.RawMessage(value.String)
+			default:
+				event.Details[name] = value.String
+			}
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// LeadTimeline merges a lead's calls, carrier attempts, recordings,
+// callbacks, dispositions and modifications in chronological order
+func (h *Handler) LeadTimeline(w http.ResponseWriter, r *http.Request) {
+	leadID, err := strconv.Atoi(mux.Vars(r)["lead_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid lead ID")
+		return
+	}
+
+	q := r.URL.Query()
+	var startDate, endDate string
+	if value := q.Get("start_date"); value != "" {
+		var ok bool
+		if startDate, ok = parseTimelineTime(value, false); !ok {
+			respondWithError(w, http.StatusBadRequest, "Invalid start_date, use YYYY-MM-DD or YYYY-MM-DD HH:MM:SS")
+			return
+		}
+	}
+	if value := q.Get("end_date"); value != "" {
+		var ok bool
+		if endDate, ok = parseTimelineTime(value, true); !ok {
+			respondWithError(w, http.StatusBadRequest, "Invalid end_date, use YYYY-MM-DD or YYYY-MM-DD HH:MM:SS")
+			return
+		}
+	}
+
+	descending := false
+	switch strings.ToLower(q.Get("order")) {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		respondWithError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+
+	limit := 500
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 5000 {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 5000")
+			return
+		}
+		limit = n
+	}
+
+	sources := timelineSources
+	if value := q.Get("types"); value != "" {
+		wanted := map[string]bool{}
+		for _, t := range strings.Split(value, ",") {
+			wanted[strings.TrimSpace(strings.ToLower(t))] = true
+		}
+		sources = nil
+		for _, source := range timelineSources {
+			if wanted[source.EventType] {
+				sources = append(sources, source)
+				delete(wanted, source.EventType)
+			}
+		}
+		if len(wanted) > 0 {
+			respondWithError(w, http.StatusBadRequest, "Unknown event type, use "+strings.Join(timelineTypes(), ", "))
+			return
+		}
+	}
+
+	// The lead may have been archived since its calls were logged
+	var listID int
+	err = h.DB.QueryRow("SELECT list_id FROM vicidial_list WHERE lead_id = ?", leadID).Scan(&listID)
+	if err == sql.ErrNoRows {
+		err = h.DB.QueryRow("SELECT list_id FROM vicidial_list_archive WHERE lead_id = ?", leadID).Scan(&listID)
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Lead not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve lead: "+err.Error())
+		return
+	}
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	events := []timelineEvent{}
+	truncated := false
+	for _, source := range sources {
+		sourceEvents, err := h.readTimelineSource(r, source, leadID, startDate, endDate, descending, limit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read "+source.Table+": "+err.Error())
+			return
+		}
+		if len(sourceEvents) == limit {
+			truncated = true
+		}
+		events = append(events, sourceEvents...)
+	}
+
+	// Stable sort keeps same-second events in source order, which follows a call's life
+	sort.SliceStable(events, func(i, j int) bool {
+		if descending {
+			return events[i].EventTime.After(events[j].EventTime)
+		}
+		return events[i].EventTime.Before(events[j].EventTime)
+	})
+	if len(events) > limit {
+		events = events[:limit]
+		truncated = true
+	}
+
+	respondWithSuccess(w, "Lead timeline retrieved", map[string]interface{}{
+		"lead_id":   leadID,
+		"list_id":   listID,
+		"events":    events,
+		"count":     len(events),
+		"truncated": truncated,
+	})
+}
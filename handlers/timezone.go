@@ -0,0 +1,585 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/jobs"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// GMT lookup methods, as in the PHP add_lead gmt_lookup_method option
+const (
+	gmtLookupAreaCode = "AREACODE"
+	gmtLookupPostal   = "POSTAL"
+	gmtLookupTZCode   = "TZCODE"
+)
+
+// gmtZone is a matching row of vicidial_phone_codes or vicidial_postal_codes
+type gmtZone struct {
+	GMTOffset float64
+	DST       string
+	DSTRange  string
+}
+
+// gmtResolution is the result of resolving a lead's time zone
+type gmtResolution struct {
+	GMTOffsetNow string  `json:"gmt_offset_now"`
+	GMTOffset    float64 `json:"gmt_offset"`
+	DST          string  `json:"dst"`
+	DSTRange     string  `json:"dst_range"`
+	MatchedBy    string  `json:"matched_by"`
+	Unresolved   string  `json:"unresolved,omitempty"`
+}
+
+// gmtLookupInput holds the lead fields the resolver uses
+type gmtLookupInput struct {
+	PhoneCode   string
+	PhoneNumber string
+	PostalCode  string
+	State       string
+	Owner       string
+}
+
+// timezoneResolver resolves leads to GMT offsets following VICIdial's
+// lookup_gmt: POSTAL tries the postal code first and TZCODE the time zone code
+// in the owner field, and both fall back to the area code. Every method
+// ends with the country's zone when all of its phone codes share one GMT
+// offset; a lead of a country spanning several zones is left unresolved
+// rather than guessed. Lookups are cached, so
+// a resolver should be shared across a batch of leads but not kept for long.
+type timezoneResolver struct {
+	db        *sql.DB
+	now       time.Time
+	cache     map[string]*gmtZone
+	multiZone map[string]bool
+}
+
+func newTimezoneResolver(db *sql.DB) *timezoneResolver {
+	return &timezoneResolver{
+		db:        db,
+		now:       time.Now().UTC(),
+		cache:     map[string]*gmtZone{},
+		multiZone: map[string]bool{},
+	}
+}
+
+// validGMTLookupMethod reports whether method is a supported gmt_lookup_method
+func validGMTLookupMethod(method string) bool {
+	switch method {
+	case "", gmtLookupAreaCode, gmtLookupPostal, gmtLookupTZCode:
+		return true
+	}
+	return false
+}
+
+// resolve returns the lead's zone. MatchedBy is empty when nothing matched,
+// and Unresolved then says why if the country has more than one zone.
+func (tr *timezoneResolver) resolve(in gmtLookupInput, method string) (gmtResolution, error) {
+	if in.PhoneCode == "" {
+		in.PhoneCode = "1"
+	}
+	in.PhoneNumber = strings.TrimSpace(in.PhoneNumber)
+
+	if method == gmtLookupPostal && in.PostalCode != "" {
+		zone, err := tr.postalZone(in.PhoneCode, in.PostalCode)
+		if err != nil {
+			return gmtResolution{}, err
+		}
+		if zone != nil {
+			return tr.resolution(zone, gmtLookupPostal), nil
+		}
+	}
+
+	if method == gmtLookupTZCode && in.Owner != "" {
+		zone, err := tr.lookup("tz:"+in.PhoneCode+":"+in.Owner, `
+			SELECT GMT_offset, DST, DST_range FROM vicidial_phone_codes
+			WHERE country_code = ? AND tz_code = ? LIMIT 1
+		`, in.PhoneCode, in.Owner)
+		if err != nil {
+			return gmtResolution{}, err
+		}
+		if zone != nil {
+			return tr.resolution(zone, gmtLookupTZCode), nil
+		}
+	}
+
+	if len(in.PhoneNumber) >= 3 {
+		areaCode := in.PhoneNumber[:3]
+		var zone *gmtZone
+		var err error
+		// Area codes that span time zones have one row per state
+		if in.State != "" {
+			zone, err = tr.lookup("ac:"+in.PhoneCode+":"+areaCode+":"+in.State, `
+				SELECT GMT_offset, DST, DST_range FROM vicidial_phone_codes
+				WHERE country_code = ? AND areacode = ? AND state = ? LIMIT 1
+			`, in.PhoneCode, areaCode, in.State)
+		}
+		if zone == nil && err == nil {
+			zone, err = tr.lookup("ac:"+in.PhoneCode+":"+areaCode, `
+				SELECT GMT_offset, DST, DST_range FROM vicidial_phone_codes
+				WHERE country_code = ? AND areacode = ? LIMIT 1
+			`, in.PhoneCode, areaCode)
+		}
+		if err != nil {
+			return gmtResolution{}, err
+		}
+		if zone != nil {
+			return tr.resolution(zone, gmtLookupAreaCode), nil
+		}
+	}
+
+	zone, err := tr.countryZone(in.PhoneCode)
+	if err != nil {
+		return gmtResolution{}, err
+	}
+	if zone != nil {
+		return tr.resolution(zone, "COUNTRY"), nil
+	}
+	if tr.multiZone[in.PhoneCode] {
+		return gmtResolution{Unresolved: "Country code " + in.PhoneCode + " spans more than one time zone"}, nil
+	}
+	return gmtResolution{}, nil
+}
+
+// countryZone returns the zone of a country whose phone codes all share one
+// GMT offset. It returns nil, and records the country in multiZone, when
+// the phone codes have different offsets.
+func (tr *timezoneResolver) countryZone(phoneCode string) (*gmtZone, error) {
+	cacheKey := "cc:" + phoneCode
+	if zone, ok := tr.cache[cacheKey]; ok {
+		return zone, nil
+	}
+
+	var offsets int
+	if err := tr.db.QueryRow("SELECT COUNT(DISTINCT GMT_offset) FROM vicidial_phone_codes WHERE country_code = ?", phoneCode).Scan(&offsets); err != nil {
+		return nil, err
+	}
+	if offsets > 1 {
+		tr.cache[cacheKey] = nil
+		tr.multiZone[phoneCode] = true
+		return nil, nil
+	}
+	return tr.lookup(cacheKey, `
+		SELECT GMT_offset, DST, DST_range FROM vicidial_phone_codes
+		WHERE country_code = ? ORDER BY areacode LIMIT 1
+	`, phoneCode)
+}
+
+// postalZone looks up a postal code. US ZIP+4 codes match on the first five digits.
+func (tr *timezoneResolver) postalZone(phoneCode, postalCode string) (*gmtZone, error) {
+	postalCode = strings.ToUpper(strings.TrimSpace(postalCode))
+	if phoneCode == "1" && len(postalCode) > 5 && digitsPattern.MatchString(postalCode[:5]) {
+		postalCode = postalCode[:5]
+	}
+	return tr.lookup("pc:"+phoneCode+":"+postalCode, `
+		SELECT GMT_offset, DST, DST_range FROM vicidial_postal_codes
+		WHERE country_code = ? AND postal_code = ? LIMIT 1
+	`, phoneCode, postalCode)
+}
+
+// lookup runs a zone query, caching both hits and misses
+func (tr *timezoneResolver) lookup(cacheKey, query string, args ...interface{}) (*gmtZone, error) {
+	if zone, ok := tr.cache[cacheKey]; ok {
+		return zone, nil
+	}
+
+	var zone gmtZone
+	err := tr.db.QueryRow(query, args...).Scan(&zone.GMTOffset, &zone.DST, &zone.DSTRange)
+	if err == sql.ErrNoRows {
+		tr.cache[cacheKey] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tr.cache[cacheKey] = &zone
+	return &zone, nil
+}
+
+func (tr *timezoneResolver) resolution(zone *gmtZone, matchedBy string) gmtResolution {
+	return gmtResolution{
+		GMTOffsetNow: formatGMTOffset(zone.offsetAt(tr.now)),
+		GMTOffset:    zone.GMTOffset,
+		DST:          zone.DST,
+		DSTRange:     zone.DSTRange,
+		MatchedBy:    matchedBy,
+	}
+}
+
+// offsetAt returns the zone's offset at the given time, including DST
+func (z gmtZone) offsetAt(now time.Time) float64 {
+	if z.DST == "Y" && dstActive(z.DSTRange, now.Add(time.Duration(z.GMTOffset*float64(time.Hour)))) {
+		return z.GMTOffset + 1
+	}
+	return z.GMTOffset
+}
+
+// leadGMTInput returns the resolver input for a lead
+func leadGMTInput(lead *models.Lead) gmtLookupInput {
+	return gmtLookupInput{
+		PhoneCode:   lead.PhoneCode,
+		PhoneNumber: lead.PhoneNumber,
+		PostalCode:  lead.PostalCode,
+		State:       lead.State,
+		Owner:       lead.Owner,
+	}
+}
+
+// formatGMTOffset formats an offset as VICIdial does, e.g. "-5.00"
+func formatGMTOffset(offset float64) string {
+	return fmt.Sprintf("%.2f", offset)
+}
+
+// dstMonths maps the month letter of a DST_range code to its month
+var dstMonths = map[byte]time.Month{
+	'F': time.February,
+	'M': time.March,
+	'A': time.April,
+	'S': time.September,
+	'O': time.October,
+	'N': time.November,
+}
+
+// dstActive reports whether local time t falls inside a VICIdial DST_range
+// such as SSM-FSN (second Sunday of March to first Sunday of November).
+// Ranges that wrap the new year, like FSO-FSA, cover the southern summer.
+func dstActive(dstRange string, t time.Time) bool {
+	parts := strings.Split(dstRange, "-")
+	if len(parts) != 2 {
+		return false
+	}
+	start, ok := dstBoundary(parts[0], t.Year())
+	if !ok {
+		return false
+	}
+	end, ok := dstBoundary(parts[1], t.Year())
+	if !ok {
+		return false
+	}
+
+	// Changes happen at 2 AM local time
+	start = start.Add(2 * time.Hour)
+	end = end.Add(2 * time.Hour)
+	local := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+
+	if start.Before(end) {
+		return !local.Before(start) && local.Before(end)
+	}
+	return !local.Before(start) || local.Before(end)
+}
+
+// dstBoundary resolves a code like "SSM" (second Sunday of March) or "LSO"
+// (last Sunday of October) to a date in the given year
+func dstBoundary(code string, year int) (time.Time, bool) {
+	if len(code) != 3 || code[1] != 'S' {
+		return time.Time{}, false
+	}
+	month, ok := dstMonths[code[2]]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	firstSunday := first.AddDate(0, 0, (7-int(first.Weekday()))%7)
+
+	switch code[0] {
+	case 'F':
+		return firstSunday, true
+	case 'S':
+		return firstSunday.AddDate(0, 0, 7), true
+	case 'T':
+		return firstSunday.AddDate(0, 0, 14), true
+	case 'L':
+		last := firstSunday.AddDate(0, 0, 28)
+		if last.Month() != month {
+			last = last.AddDate(0, 0, -7)
+		}
+		return last, true
+	}
+	return time.Time{}, false
+}
+
+// gmtLeadFields are the lead fields that decide its time zone
+var gmtLeadFields = []string{"phone_code", "phone_number", "postal_code", "state", "owner"}
+
+// refreshLeadGMT adds a recomputed gmt_offset_now to a lead patch when it
+// changes a field the time zone depends on and does not set the offset itself
+func (h *Handler) refreshLeadGMT(leadID int, fields []patchField, method string) ([]patchField, error) {
+	if _, ok := patchValue(fields, "gmt_offset_now"); ok {
+		return fields, nil
+	}
+
+	values := map[string]*string{}
+	var lead models.Lead
+	values["phone_code"] = &lead.PhoneCode
+	values["phone_number"] = &lead.PhoneNumber
+	values["postal_code"] = &lead.PostalCode
+	values["state"] = &lead.State
+	values["owner"] = &lead.Owner
+
+	changed := false
+	for _, name := range gmtLeadFields {
+		if _, ok := patchValue(fields, name); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return fields, nil
+	}
+
+	err := h.DB.QueryRow("SELECT phone_code, phone_number, postal_code, state, owner FROM vicidial_list WHERE lead_id = ?", leadID).
+		Scan(&lead.PhoneCode, &lead.PhoneNumber, &lead.PostalCode, &lead.State, &lead.Owner)
+	if err == sql.ErrNoRows {
+		return fields, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range gmtLeadFields {
+		if value, ok := patchValue(fields, name); ok {
+			*values[name] = fmt.Sprint(value)
+		}
+	}
+
+	zone, err := newTimezoneResolver(h.DB).resolve(leadGMTInput(&lead), method)
+	if err != nil {
+		return nil, err
+	}
+	if zone.MatchedBy == "" {
+		return fields, nil
+	}
+	return append(fields, patchField{Name: "gmt_offset_now", Column: "gmt_offset_now", Value: zone.GMTOffsetNow}), nil
+}
+
+// LookupGMT resolves the time zone for a phone number, postal code or tz code
+func (h *Handler) LookupGMT(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	method := strings.ToUpper(q.Get("gmt_lookup_method"))
+	if !validGMTLookupMethod(method) {
+		respondWithError(w, http.StatusBadRequest, "gmt_lookup_method must be AREACODE, POSTAL or TZCODE")
+		return
+	}
+
+	in := gmtLookupInput{
+		PhoneCode:   q.Get("phone_code"),
+		PhoneNumber: q.Get("phone_number"),
+		PostalCode:  q.Get("postal_code"),
+		State:       q.Get("state"),
+		Owner:       q.Get("tz_code"),
+	}
+	if in.PhoneNumber == "" && in.PostalCode == "" && in.Owner == "" {
+		respondWithError(w, http.StatusBadRequest, "phone_number, postal_code or tz_code is required")
+		return
+	}
+	if in.PhoneNumber != "" {
+		phone, ok := readPhoneNumber(w, "phone_number", in.PhoneNumber, in.PhoneCode)
+		if !ok {
+			return
+		}
+		in.PhoneNumber, in.PhoneCode = phone.National, phone.Code
+	}
+
+	zone, err := newTimezoneResolver(h.DB).resolve(in, method)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up time zone: "+err.Error())
+		return
+	}
+	if zone.MatchedBy == "" {
+		message := "No matching time zone found"
+		if zone.Unresolved != "" {
+			message += ": " + zone.Unresolved
+		}
+		respondWithError(w, http.StatusNotFound, message)
+		return
+	}
+
+	respondWithSuccess(w, "Time zone resolved", zone)
+}
+
+// gmtRecomputeBatch is how many leads are read and updated at a time
+const gmtRecomputeBatch = 1000
+
+// gmtRecomputeParams are the parameters of a gmt_recompute job
+type gmtRecomputeParams struct {
+	ListID          string `json:"list_id"`
+	GMTLookupMethod string `json:"gmt_lookup_method,omitempty"`
+}
+
+// gmtRecomputeResult summarizes a bulk GMT offset recompute
+type gmtRecomputeResult struct {
+	ListID    string `json:"list_id"`
+	Scanned   int    `json:"scanned"`
+	Updated   int    `json:"updated"`
+	Unmatched int    `json:"unmatched"`
+	MultiZone int    `json:"multi_zone"`
+}
+
+// gmtRecomputeCheckpoint is where a recompute job has got to
+type gmtRecomputeCheckpoint struct {
+	LastLeadID int                `json:"last_lead_id"`
+	Result     gmtRecomputeResult `json:"result"`
+}
+
+// RecomputeListGMT queues a job that recomputes gmt_offset_now for every lead
+// in a list, like VICIdial's ADMIN_adjust_GMTnow_on_leads.pl does for the
+// whole system
+func (h *Handler) RecomputeListGMT(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listID := vars["list_id"]
+
+	if !h.requireListAccess(w, r, listID) {
+		return
+	}
+
+	method := strings.ToUpper(r.URL.Query().Get("gmt_lookup_method"))
+	if !validGMTLookupMethod(method) {
+		respondWithError(w, http.StatusBadRequest, "gmt_lookup_method must be AREACODE, POSTAL or TZCODE")
+		return
+	}
+
+	var exists int
+	err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_lists WHERE list_id = ?", listID).Scan(&exists)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up list: "+err.Error())
+		return
+	}
+	if exists == 0 {
+		respondWithError(w, http.StatusNotFound, "List not found")
+		return
+	}
+
+	h.submitJob(w, r, jobTypeGMTRecompute, gmtRecomputeParams{ListID: listID, GMTLookupMethod: method}, "GMT offset recompute queued")
+}
+
+// runGMTRecompute walks the list in lead_id order, updating leads whose
+// offset changed with one statement per offset value in each batch. Each
+// batch is checkpointed, and repeating one after a restart is harmless.
+func (h *Handler) runGMTRecompute(ctx context.Context, task *jobs.Task) (interface{}, error) {
+	var params gmtRecomputeParams
+	if err := task.Decode(&params); err != nil {
+		return nil, err
+	}
+
+	var cp gmtRecomputeCheckpoint
+	resumed, err := task.LoadCheckpoint(&cp)
+	if err != nil {
+		return nil, err
+	}
+	if !resumed {
+		cp.Result.ListID = params.ListID
+	}
+
+	var total int
+	if err := h.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM vicidial_list WHERE list_id = ?", params.ListID).Scan(&total); err != nil {
+		return cp.Result, err
+	}
+	task.SetTotal(total)
+	task.SetProgress(cp.Result.Scanned)
+
+	resolver := newTimezoneResolver(h.DB)
+	for {
+		if err := ctx.Err(); err != nil {
+			return cp.Result, err
+		}
+
+		count, err := h.recomputeGMTBatch(ctx, resolver, params, &cp)
+		if err != nil {
+			return cp.Result, err
+		}
+		task.SetProgress(cp.Result.Scanned)
+		if err := task.SaveCheckpoint(cp); err != nil {
+			return cp.Result, err
+		}
+
+		if count < gmtRecomputeBatch {
+			return cp.Result, nil
+		}
+	}
+}
+
+// recomputeGMTBatch recomputes the next batch of leads after the checkpoint
+// and returns how many were read
+func (h *Handler) recomputeGMTBatch(ctx context.Context, resolver *timezoneResolver, params gmtRecomputeParams, cp *gmtRecomputeCheckpoint) (int, error) {
+	rows, err := h.DB.QueryContext(ctx, `
+		SELECT lead_id, phone_code, phone_number, postal_code, state, owner, gmt_offset_now
+		FROM vicidial_list WHERE list_id = ? AND lead_id > ?
+		ORDER BY lead_id LIMIT ?
+	`, params.ListID, cp.LastLeadID, gmtRecomputeBatch)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	changes := map[string][]interface{}{}
+	count := 0
+	lastID := cp.LastLeadID
+	unmatched, multiZone := 0, 0
+	for rows.Next() {
+		var lead models.Lead
+		if err := rows.Scan(&lead.LeadID, &lead.PhoneCode, &lead.PhoneNumber, &lead.PostalCode,
+			&lead.State, &lead.Owner, &lead.GmtOffsetNow); err != nil {
+			return 0, err
+		}
+		count++
+		lastID = lead.LeadID
+
+		zone, err := resolver.resolve(leadGMTInput(&lead), params.GMTLookupMethod)
+		if err != nil {
+			return 0, err
+		}
+		if zone.MatchedBy == "" {
+			unmatched++
+			if zone.Unresolved != "" {
+				multiZone++
+			}
+			continue
+		}
+		if zone.GMTOffsetNow != lead.GmtOffsetNow {
+			changes[zone.GMTOffsetNow] = append(changes[zone.GMTOffsetNow], lead.LeadID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	updated := 0
+	for offset, ids := range changes {
+		args := append([]interface{}{offset}, ids...)
+		res, err := h.DB.ExecContext(ctx, "UPDATE vicidial_list SET gmt_offset_now = ? WHERE lead_id IN ("+placeholders(len(ids))+")", args...)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		updated += int(n)
+	}
+
+	cp.LastLeadID = lastID
+	cp.Result.Scanned += count
+	cp.Result.Updated += updated
+	cp.Result.Unmatched += unmatched
+	cp.Result.MultiZone += multiZone
+	return count, nil
+}
+
+// gmtRecomputeFinished audits a finished recompute as its requester
+func (h *Handler) gmtRecomputeFinished(job models.Job) {
+	var params gmtRecomputeParams
+	json.Unmarshal(job.Params, &params)
+
+	h.auditAs(jobActor(job), auditEvent{
+		Section:  "LISTS",
+		Type:     "MODIFY",
+		RecordID: params.ListID,
+		Code:     "ADMIN API RECOMPUTE GMT OFFSETS",
+		After:    jobAuditResult(job),
+	})
+}
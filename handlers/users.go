@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/vicidb/non-agent-api/middleware"
 	"github.com/vicidb/non-agent-api/models"
 )
 
@@ -27,6 +28,10 @@ func (h *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
 		user.Active = "Y"
 	}
 
+	if !requireLevelWithin(w, r, user.UserLevel, "Cannot set user_level above your own") {
+		return
+	}
+
 	query := `
 		INSERT INTO vicidial_users (user, pass, full_name, user_level, user_group, phone_login, phone_pass, active, email)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
@@ -40,36 +45,71 @@ func (h *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "USERS",
+		Type:     "ADD",
+		RecordID: user.User,
+		Code:     "ADMIN API ADD USER",
+		SQL:      query,
+		Args: []interface{}{user.User, "********", user.FullName, user.UserLevel,
+			user.UserGroup, user.PhoneLogin, "********", user.Active, user.Email},
+		After: h.snapshotRow("vicidial_users", "user", user.User),
+	})
+
 	respondWithSuccess(w, "User created successfully", map[string]string{"user": user.User})
 }
 
-// UpdateUser updates an existing user
+// UpdateUser updates the fields of a user present in the request body
 func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["user_id"]
 
-	var user models.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	fields, ok := readPatch(w, r, userPatchSpec)
+	if !ok {
 		return
 	}
 
-	query := `
-		UPDATE vicidial_users SET
-			full_name = ?, user_level = ?, user_group = ?,
-			phone_login = ?, phone_pass = ?, active = ?, email = ?
-		WHERE user = ?
-	`
+	// As in the admin screens, a user cannot modify a user above their own
+	// level or grant a level above their own
+	currentLevel, ok := h.userLevel(w, userID)
+	if !ok {
+		return
+	}
+	if !requireLevelWithin(w, r, currentLevel, "Cannot modify a user above your own level") {
+		return
+	}
+	if level, ok := patchValue(fields, "user_level"); ok {
+		if !requireLevelWithin(w, r, level.(int), "Cannot set user_level above your own") {
+			return
+		}
+	}
 
-	_, err := h.DB.Exec(query, user.FullName, user.UserLevel, user.UserGroup,
-		user.PhoneLogin, user.PhonePass, user.Active, user.Email, userID)
+	if userGroup, ok := patchValue(fields, "user_group"); ok {
+		var count int
+		if err := h.DB.QueryRow("SELECT COUNT(*) FROM vicidial_user_groups WHERE user_group = ?", userGroup).Scan(&count); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check user group: "+err.Error())
+			return
+		}
+		if count == 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid value for user_group: user group does not exist")
+			return
+		}
+	}
 
+	found, err := h.applyPatch(r, userPatchSpec, userID, fields, "USERS", "ADMIN API UPDATE USER")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update user: "+err.Error())
 		return
 	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
 
-	respondWithSuccess(w, "User updated successfully", map[string]string{"user": userID})
+	respondWithSuccess(w, "User updated successfully", map[string]interface{}{
+		"user":           userID,
+		"updated_fields": patchFieldNames(fields),
+	})
 }
 
 // CopyUser duplicates a user configuration
@@ -87,6 +127,15 @@ func (h *Handler) CopyUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The copy gets the source user's level, which the caller must be able to grant
+	sourceLevel, ok := h.userLevel(w, sourceUser)
+	if !ok {
+		return
+	}
+	if !requireLevelWithin(w, r, sourceLevel, "Cannot copy a user above your own level") {
+		return
+	}
+
 	// Copy user settings
 	query := `
 		INSERT INTO vicidial_users (user, pass, full_name, user_level, user_group, phone_login, phone_pass, active, email)
@@ -100,9 +149,46 @@ func (h *Handler) CopyUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "USERS",
+		Type:     "COPY",
+		RecordID: req.NewUser,
+		Code:     "ADMIN API COPY USER FROM " + sourceUser,
+		SQL:      query,
+		Args:     []interface{}{req.NewUser, "********", sourceUser},
+		After:    h.snapshotRow("vicidial_users", "user", req.NewUser),
+	})
+
 	respondWithSuccess(w, "User copied successfully", map[string]string{"new_user": req.NewUser})
 }
 
+// userLevel returns a user's user_level, responding with 404 when the user
+// does not exist
+func (h *Handler) userLevel(w http.ResponseWriter, userID string) (int, bool) {
+	var level int
+	err := h.DB.QueryRow("SELECT user_level FROM vicidial_users WHERE user = ?", userID).Scan(&level)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return 0, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve user: "+err.Error())
+		return 0, false
+	}
+	return level, true
+}
+
+// requireLevelWithin responds with 403 when a user level is above the
+// calling user's own. Callers authenticated by API key alone have no level
+// and are not limited.
+func requireLevelWithin(w http.ResponseWriter, r *http.Request, level int, message string) bool {
+	if apiUser, isUser := middleware.GetAPIUserFromContext(r.Context()); isUser && level > apiUser.UserLevel {
+		respondWithError(w, http.StatusForbidden, message)
+		return false
+	}
+	return true
+}
+
 // UserDetails retrieves detailed user information
 func (h *Handler) UserDetails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -137,11 +223,14 @@ func (h *Handler) UserDetails(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) LoggedInAgents(w http.ResponseWriter, r *http.Request) {
 	query := `
 		SELECT user, server_ip, extension, status, campaign_id, last_update_time
-		FROM vicidial_live_agents
-		ORDER BY last_update_time DESC
+		FROM vicidial_live_agents WHERE 1=1
 	`
 
-	rows, err := h.DB.Query(query)
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	query += " ORDER BY last_update_time DESC"
+
+	rows, err := h.DB.Query(query, restrictArgs...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve agents: "+err.Error())
 		return
@@ -184,6 +273,10 @@ func (h *Handler) AgentStatus(w http.ResponseWriter, r *http.Request) {
 		args = append(args, campaignID)
 	}
 
+	restrictSQL, restrictArgs := campaignFilter(r, "campaign_id")
+	query += restrictSQL
+	args = append(args, restrictArgs...)
+
 	rows, err := h.DB.Query(query, args...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve status: "+err.Error())
@@ -305,11 +398,24 @@ func (h *Handler) UpdateRemoteAgent(w http.ResponseWriter, r *http.Request) {
 		WHERE user = ? AND remote_agent_id = ?
 	`
 
+	before := h.snapshotRow("vicidial_remote_agents", "remote_agent_id", req.RemoteAgentID)
+
 	_, err := h.DB.Exec(query, req.Status, req.ServerIP, agentID, req.RemoteAgentID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update remote agent: "+err.Error())
 		return
 	}
 
+	h.audit(r, auditEvent{
+		Section:  "REMOTEAGENTS",
+		Type:     "MODIFY",
+		RecordID: req.RemoteAgentID,
+		Code:     "ADMIN API UPDATE REMOTE AGENT",
+		SQL:      query,
+		Args:     []interface{}{req.Status, req.ServerIP, agentID, req.RemoteAgentID},
+		Before:   before,
+		After:    h.snapshotRow("vicidial_remote_agents", "remote_agent_id", req.RemoteAgentID),
+	})
+
 	respondWithSuccess(w, "Remote agent updated successfully", nil)
 }
@@ -0,0 +1,700 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Job statuses stored in go_api_jobs.status
+const (
+	StatusQueued    = "QUEUED"
+	StatusRunning   = "RUNNING"
+	StatusDone      = "DONE"
+	StatusFailed    = "FAILED"
+	StatusCancelled = "CANCELLED"
+)
+
+// maxAttempts bounds how often an interrupted resumable job is requeued
+const maxAttempts = 3
+
+var (
+	// ErrNotFound is returned for a job ID that does not exist
+	ErrNotFound = errors.New("job not found")
+	// ErrFinished is returned when cancelling a job that already finished
+	ErrFinished = errors.New("job already finished")
+)
+
+// RunFunc executes a job. It should return promptly once ctx is cancelled,
+// which happens when the job is cancelled, the API shuts down or another
+// instance has taken the job over.
+type RunFunc func(ctx context.Context, task *Task) (interface{}, error)
+
+// Definition describes a job type
+type Definition struct {
+	Run RunFunc
+
+	// Resumable jobs are requeued when their instance dies or shuts down and
+	// continue from their last saved checkpoint. Other jobs are failed.
+	Resumable bool
+
+	// Finished, when set, is called once the job's final status is stored
+	Finished func(job models.Job)
+}
+
+// Requester identifies who submitted a job. OnBehalfOf is the unverified
+// user an API key caller said it acts for.
+type Requester struct {
+	User       string
+	UserGroup  string
+	APIClient  string
+	OnBehalfOf string
+	IPAddress  string
+}
+
+// Filter narrows a job listing
+type Filter struct {
+	Status    string
+	JobType   string
+	User      string
+	APIClient string
+	Limit     int
+}
+
+// Manager stores jobs in go_api_jobs and runs them on a bounded pool of
+// workers. Every API instance polls the same table; a job is claimed with a
+// conditional UPDATE so only one instance ever runs it. Running jobs send a
+// heartbeat, and jobs whose instance stopped sending one are requeued or
+// failed by whichever instance notices first.
+type Manager struct {
+	db           *sql.DB
+	instance     string
+	workers      int
+	pollInterval time.Duration
+	staleAfter   time.Duration
+	retention    time.Duration
+
+	mu       sync.Mutex
+	types    map[string]Definition
+	running  map[int64]*Task
+	stopping bool
+	wake     chan struct{}
+	stopped  chan struct{}  // closed once the polling loop has shut down
+	active   sync.WaitGroup // running jobs, until their final state is stored
+}
+
+// NewManager creates a job manager. The instance ID must be unique per API
+// process and stable across its restarts, so jobs left running by a previous
+// run of the same instance can be recovered straight away.
+func NewManager(db *sql.DB, instance string, workers int, pollInterval, staleAfter, retention time.Duration) *Manager {
+	return &Manager{
+		db:           db,
+		instance:     instance,
+		workers:      workers,
+		pollInterval: pollInterval,
+		staleAfter:   staleAfter,
+		retention:    retention,
+		types:        map[string]Definition{},
+		running:      map[int64]*Task{},
+		wake:         make(chan struct{}, 1),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Register adds a job type. It must be called before Start.
+func (m *Manager) Register(jobType string, def Definition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.types[jobType] = def
+}
+
+func (m *Manager) definition(jobType string) (Definition, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	def, ok := m.types[jobType]
+	return def, ok
+}
+
+// jobTypes returns the registered job types in a stable order
+func (m *Manager) jobTypes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	types := make([]string, 0, len(m.types))
+	for jobType := range m.types {
+		types = append(types, jobType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Submit queues a job and wakes the dispatcher
+func (m *Manager) Submit(jobType string, params interface{}, req Requester) (models.Job, error) {
+	if _, ok := m.definition(jobType); !ok {
+		return models.Job{}, fmt.Errorf("unknown job type %s", jobType)
+	}
+
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return models.Job{}, err
+	}
+
+	res, err := m.db.Exec(`
+		INSERT INTO go_api_jobs (job_type, status, params, user, user_group, api_client, on_behalf_of, ip_address, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, jobType, StatusQueued, string(paramsJSON), req.User, req.UserGroup, req.APIClient, req.OnBehalfOf, req.IPAddress)
+	if err != nil {
+		return models.Job{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return models.Job{}, err
+	}
+
+	m.signal()
+	return m.Get(id)
+}
+
+// jobColumns is the column list read by scanJob
+const jobColumns = `job_id, job_type, status, params, progress, total, checkpoint, result, error,
+	user, user_group, api_client, on_behalf_of, ip_address, owner, attempts, cancel_requested,
+	created_at, started_at, heartbeat_at, finished_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (models.Job, error) {
+	var job models.Job
+	var params string
+	var checkpoint, result, jobError, owner sql.NullString
+	var cancelRequested string
+	var startedAt, heartbeatAt, finishedAt sql.NullTime
+	if err := row.Scan(&job.JobID, &job.JobType, &job.Status, &params, &job.Progress, &job.Total,
+		&checkpoint, &result, &jobError, &job.User, &job.UserGroup, &job.APIClient, &job.OnBehalfOf, &job.IPAddress,
+		&owner, &job.Attempts, &cancelRequested, &job.CreatedAt, &startedAt, &heartbeatAt, &finishedAt); err != nil {
+		return job, err
+	}
+
+	job.Params = json.RawMessage(params)
+	if result.Valid && result.String != "" {
+		job.Result = json.RawMessage(result.String)
+	}
+	job.Checkpoint = checkpoint.String
+	job.Error = jobError.String
+	job.Owner = owner.String
+	job.CancelRequested = cancelRequested == "Y"
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if heartbeatAt.Valid {
+		job.HeartbeatAt = &heartbeatAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, nil
+}
+
+// Get returns a job by ID
+func (m *Manager) Get(id int64) (models.Job, error) {
+	job, err := scanJob(m.db.QueryRow("SELECT "+jobColumns+" FROM go_api_jobs WHERE job_id = ?", id))
+	if err == sql.ErrNoRows {
+		return job, ErrNotFound
+	}
+	return job, err
+}
+
+// List returns the most recent jobs matching the filter
+func (m *Manager) List(f Filter) ([]models.Job, error) {
+	query := "SELECT " + jobColumns + " FROM go_api_jobs WHERE 1=1"
+	args := []interface{}{}
+
+	if f.Status != "" {
+		query += " AND status = ?"
+		args = append(args, f.Status)
+	}
+	if f.JobType != "" {
+		query += " AND job_type = ?"
+		args = append(args, f.JobType)
+	}
+	if f.User != "" {
+		query += " AND user = ?"
+		args = append(args, f.User)
+	}
+	if f.APIClient != "" {
+		query += " AND api_client = ?"
+		args = append(args, f.APIClient)
+	}
+
+	query += " ORDER BY job_id DESC LIMIT ?"
+	args = append(args, f.Limit)
+
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Cancel cancels a queued job at once and asks a running one to stop. The
+// running job's instance sees the request on its next heartbeat.
+func (m *Manager) Cancel(id int64) (models.Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return job, err
+	}
+
+	switch job.Status {
+	case StatusQueued:
+		res, err := m.db.Exec(`
+			UPDATE go_api_jobs SET status = ?, cancel_requested = 'Y', error = 'Cancelled', finished_at = NOW()
+			WHERE job_id = ? AND status = ?
+		`, StatusCancelled, id, StatusQueued)
+		if err != nil {
+			return job, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Claimed in the meantime; fall through to a running cancel
+			return m.requestCancel(id)
+		}
+		job, err = m.Get(id)
+		if err == nil {
+			m.notifyFinished(job)
+		}
+		return job, err
+	case StatusRunning:
+		return m.requestCancel(id)
+	}
+	return job, ErrFinished
+}
+
+func (m *Manager) requestCancel(id int64) (models.Job, error) {
+	if _, err := m.db.Exec("UPDATE go_api_jobs SET cancel_requested = 'Y' WHERE job_id = ? AND status = ?", id, StatusRunning); err != nil {
+		return models.Job{}, err
+	}
+
+	m.mu.Lock()
+	task := m.running[id]
+	m.mu.Unlock()
+	if task != nil {
+		task.stop(true)
+	}
+	return m.Get(id)
+}
+
+// Start recovers jobs left behind by a previous run and then polls for work
+// until stop is closed
+func (m *Manager) Start(stop <-chan struct{}) {
+	m.recoverStale(true)
+	m.dispatch()
+
+	heartbeatInterval := m.staleAfter / 4
+	if heartbeatInterval < time.Second {
+		heartbeatInterval = time.Second
+	}
+
+	go func() {
+		defer close(m.stopped)
+		poll := time.NewTicker(m.pollInterval)
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer poll.Stop()
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-poll.C:
+				m.dispatch()
+			case <-m.wake:
+				m.dispatch()
+			case <-heartbeat.C:
+				m.heartbeat()
+				m.recoverStale(false)
+				m.purge()
+			case <-stop:
+				m.shutdown()
+				return
+			}
+		}
+	}()
+}
+
+// Wait blocks, after the stop channel given to Start is closed, until every
+// running job has returned and been released back to the queue or failed.
+// It gives up when ctx is done, leaving the rest to stale job recovery.
+func (m *Manager) Wait(ctx context.Context) error {
+	select {
+	case <-m.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch claims queued jobs while workers are free
+func (m *Manager) dispatch() {
+	m.mu.Lock()
+	free := m.workers - len(m.running)
+	stopping := m.stopping
+	m.mu.Unlock()
+	if free <= 0 || stopping {
+		return
+	}
+
+	types := m.jobTypes()
+	if len(types) == 0 {
+		return
+	}
+
+	args := []interface{}{StatusQueued}
+	for _, jobType := range types {
+		args = append(args, jobType)
+	}
+	args = append(args, free)
+
+	rows, err := m.db.Query(`
+		SELECT job_id FROM go_api_jobs
+		WHERE status = ? AND job_type IN (?`+strings.Repeat(", ?", len(types)-1)+`)
+		ORDER BY job_id LIMIT ?
+	`, args...)
+	if err != nil {
+		log.Printf("Failed to poll jobs: %v", err)
+		return
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		job, ok, err := m.claim(id)
+		if err != nil {
+			log.Printf("Failed to claim job %d: %v", id, err)
+			continue
+		}
+		if ok {
+			m.run(job)
+		}
+	}
+}
+
+// claim takes a queued job for this instance. Only one instance's UPDATE
+// can move the job out of QUEUED, so a job never runs twice.
+func (m *Manager) claim(id int64) (models.Job, bool, error) {
+	res, err := m.db.Exec(`
+		UPDATE go_api_jobs
+		SET status = ?, owner = ?, attempts = attempts + 1,
+			started_at = COALESCE(started_at, NOW()), heartbeat_at = NOW()
+		WHERE job_id = ? AND status = ? AND cancel_requested = 'N'
+	`, StatusRunning, m.instance, id, StatusQueued)
+	if err != nil {
+		return models.Job{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Job{}, false, nil
+	}
+
+	job, err := m.Get(id)
+	if err != nil {
+		return job, false, err
+	}
+	return job, true, nil
+}
+
+func (m *Manager) run(job models.Job) {
+	def, _ := m.definition(job.JobType)
+	ctx, cancel := context.WithCancel(context.Background())
+	task := NewTask(job)
+	task.cancel = cancel
+
+	m.mu.Lock()
+	m.running[job.JobID] = task
+	m.mu.Unlock()
+
+	m.active.Add(1)
+	go func() {
+		defer m.active.Done()
+		defer cancel()
+		result, err := runSafely(ctx, def.Run, task)
+		m.finish(task, def, result, err)
+	}()
+}
+
+// runSafely turns a panicking job into a failed one
+func runSafely(ctx context.Context, run RunFunc, task *Task) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return run(ctx, task)
+}
+
+// finish stores the job's final state, unless another instance took it over
+func (m *Manager) finish(task *Task, def Definition, result interface{}, runErr error) {
+	m.mu.Lock()
+	delete(m.running, task.Job.JobID)
+	stopping := m.stopping
+	m.mu.Unlock()
+	defer m.signal()
+
+	progress, total, checkpoint, cancelRequested, lost := task.snapshot()
+	if lost {
+		log.Printf("Job %d was taken over by another instance", task.Job.JobID)
+		return
+	}
+
+	status := StatusDone
+	errText := ""
+	switch {
+	case runErr == nil:
+	case cancelRequested:
+		status = StatusCancelled
+		errText = "Cancelled"
+	case stopping:
+		m.release(task, def, progress, total, checkpoint)
+		return
+	default:
+		status = StatusFailed
+		errText = runErr.Error()
+	}
+
+	var resultJSON interface{}
+	if result != nil {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			status = StatusFailed
+			errText = "Failed to encode job result: " + err.Error()
+		} else {
+			resultJSON = string(encoded)
+		}
+	}
+
+	_, err := m.db.Exec(`
+		UPDATE go_api_jobs
+		SET status = ?, progress = ?, total = ?, checkpoint = ?, result = ?, error = ?, finished_at = NOW()
+		WHERE job_id = ? AND owner = ? AND status = ?
+	`, status, progress, total, checkpoint, resultJSON, errText, task.Job.JobID, m.instance, StatusRunning)
+	if err != nil {
+		log.Printf("Failed to record result of job %d: %v", task.Job.JobID, err)
+		return
+	}
+
+	if job, err := m.Get(task.Job.JobID); err == nil {
+		m.notifyFinished(job)
+	}
+}
+
+// release hands a job interrupted by shutdown back to the queue, or fails it
+// when it cannot resume
+func (m *Manager) release(task *Task, def Definition, progress, total int, checkpoint string) {
+	var err error
+	if def.Resumable && task.Job.Attempts < maxAttempts {
+		_, err = m.db.Exec(`
+			UPDATE go_api_jobs SET status = ?, owner = NULL, progress = ?, total = ?, checkpoint = ?
+			WHERE job_id = ? AND owner = ? AND status = ?
+		`, StatusQueued, progress, total, checkpoint, task.Job.JobID, m.instance, StatusRunning)
+	} else {
+		_, err = m.db.Exec(`
+			UPDATE go_api_jobs SET status = ?, progress = ?, total = ?, checkpoint = ?,
+				error = 'Interrupted by API shutdown', finished_at = NOW()
+			WHERE job_id = ? AND owner = ? AND status = ?
+		`, StatusFailed, progress, total, checkpoint, task.Job.JobID, m.instance, StatusRunning)
+	}
+	if err != nil {
+		log.Printf("Failed to release job %d: %v", task.Job.JobID, err)
+	}
+}
+
+func (m *Manager) notifyFinished(job models.Job) {
+	def, ok := m.definition(job.JobType)
+	if ok && def.Finished != nil {
+		def.Finished(job)
+	}
+}
+
+// heartbeat stores the progress of this instance's running jobs and picks up
+// cancel requests and takeovers
+func (m *Manager) heartbeat() {
+	m.mu.Lock()
+	tasks := make([]*Task, 0, len(m.running))
+	for _, task := range m.running {
+		tasks = append(tasks, task)
+	}
+	m.mu.Unlock()
+
+	for _, task := range tasks {
+		progress, total, checkpoint, _, _ := task.snapshot()
+		if _, err := m.db.Exec(`
+			UPDATE go_api_jobs SET heartbeat_at = NOW(), progress = ?, total = ?, checkpoint = ?
+			WHERE job_id = ? AND owner = ? AND status = ?
+		`, progress, total, checkpoint, task.Job.JobID, m.instance, StatusRunning); err != nil {
+			log.Printf("Failed to record heartbeat of job %d: %v", task.Job.JobID, err)
+			continue
+		}
+
+		var status, cancelRequested string
+		var owner sql.NullString
+		err := m.db.QueryRow("SELECT status, owner, cancel_requested FROM go_api_jobs WHERE job_id = ?", task.Job.JobID).
+			Scan(&status, &owner, &cancelRequested)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Failed to check job %d: %v", task.Job.JobID, err)
+			continue
+		}
+		if err == sql.ErrNoRows || status != StatusRunning || owner.String != m.instance {
+			task.lose()
+			continue
+		}
+		if cancelRequested == "Y" {
+			task.stop(true)
+		}
+	}
+}
+
+// recoverStale requeues or fails running jobs whose instance stopped sending
+// heartbeats. At startup, jobs still owned by this instance are recovered
+// immediately since nothing in this process can be running them.
+func (m *Manager) recoverStale(startup bool) {
+	query := `
+		SELECT job_id, job_type, owner, attempts, cancel_requested, heartbeat_at
+		FROM go_api_jobs
+		WHERE status = ? AND (heartbeat_at IS NULL OR heartbeat_at < NOW() - INTERVAL ? SECOND`
+	args := []interface{}{StatusRunning, int(m.staleAfter / time.Second)}
+	if startup {
+		query += " OR owner = ?"
+		args = append(args, m.instance)
+	}
+	query += ")"
+
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to check for stale jobs: %v", err)
+		return
+	}
+
+	type staleJob struct {
+		id              int64
+		jobType         string
+		owner           sql.NullString
+		attempts        int
+		cancelRequested string
+		heartbeatAt     sql.NullTime
+	}
+	stale := []staleJob{}
+	for rows.Next() {
+		var job staleJob
+		if err := rows.Scan(&job.id, &job.jobType, &job.owner, &job.attempts, &job.cancelRequested, &job.heartbeatAt); err == nil {
+			stale = append(stale, job)
+		}
+	}
+	rows.Close()
+
+	for _, job := range stale {
+		def, known := m.definition(job.jobType)
+
+		var res sql.Result
+		// The owner and heartbeat must be unchanged, so a job that came back
+		// to life or was already recovered by another instance is left alone
+		guard := " WHERE job_id = ? AND status = ? AND owner <=> ? AND heartbeat_at <=> ?"
+		guardArgs := []interface{}{job.id, StatusRunning, job.owner, job.heartbeatAt}
+
+		switch {
+		case job.cancelRequested == "Y":
+			res, err = m.db.Exec("UPDATE go_api_jobs SET status = ?, error = 'Cancelled', finished_at = NOW()"+guard,
+				append([]interface{}{StatusCancelled}, guardArgs...)...)
+		case known && def.Resumable && job.attempts < maxAttempts:
+			res, err = m.db.Exec("UPDATE go_api_jobs SET status = ?, owner = NULL"+guard,
+				append([]interface{}{StatusQueued}, guardArgs...)...)
+		default:
+			errText := fmt.Sprintf("Interrupted: instance %s stopped responding", job.owner.String)
+			res, err = m.db.Exec("UPDATE go_api_jobs SET status = ?, error = ?, finished_at = NOW()"+guard,
+				append([]interface{}{StatusFailed, errText}, guardArgs...)...)
+		}
+		if err != nil {
+			log.Printf("Failed to recover job %d: %v", job.id, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		log.Printf("Recovered stale job %d from instance %s", job.id, job.owner.String)
+		if recovered, err := m.Get(job.id); err == nil {
+			if recovered.Status == StatusQueued {
+				m.signal()
+			} else {
+				m.notifyFinished(recovered)
+			}
+		}
+	}
+}
+
+// purge removes finished jobs older than the retention period
+func (m *Manager) purge() {
+	if m.retention <= 0 {
+		return
+	}
+	_, err := m.db.Exec(`
+		DELETE FROM go_api_jobs
+		WHERE status IN (?, ?, ?) AND finished_at < NOW() - INTERVAL ? SECOND
+		LIMIT 1000
+	`, StatusDone, StatusFailed, StatusCancelled, int(m.retention/time.Second))
+	if err != nil {
+		log.Printf("Failed to purge old jobs: %v", err)
+	}
+}
+
+// shutdown stops claiming jobs and interrupts the running ones, which are
+// released back to the queue or failed as they return
+func (m *Manager) shutdown() {
+	m.mu.Lock()
+	m.stopping = true
+	tasks := make([]*Task, 0, len(m.running))
+	for _, task := range m.running {
+		tasks = append(tasks, task)
+	}
+	m.mu.Unlock()
+
+	for _, task := range tasks {
+		task.stop(false)
+	}
+}
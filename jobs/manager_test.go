@@ -0,0 +1,288 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/vicidb/non-agent-api/models"
+)
+
+const testInstance = "api1:8080"
+
+func newTestManager(t *testing.T) (*Manager, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewManager(db, testInstance, 2, time.Second, 60*time.Second, 0), mock
+}
+
+// jobRow returns a go_api_jobs row in jobColumns order
+func jobRow(id int64, jobType, status string, owner interface{}, attempts int) *sqlmock.Rows {
+	now := time.Date(2025, 1, 8, 15, 30, 0, 0, time.UTC)
+	return sqlmock.NewRows([]string{
+		"job_id", "job_type", "status", "params", "progress", "total", "checkpoint", "result", "error",
+		"user", "user_group", "api_client", "on_behalf_of", "ip_address", "owner", "attempts", "cancel_requested",
+		"created_at", "started_at", "heartbeat_at", "finished_at",
+	}).AddRow(id, jobType, status, "{}", 0, 0, nil, nil, nil,
+		"admin", "ADMIN", "", "", "10.0.0.5", owner, attempts, "N",
+		now, now, now, nil)
+}
+
+var selectJob = regexp.QuoteMeta("FROM go_api_jobs WHERE job_id = ?")
+
+func TestClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		claimed int64
+		wantOK  bool
+	}{
+		{"queued job is claimed", 1, true},
+		{"job taken by another instance", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestManager(t)
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs")).
+				WithArgs(StatusRunning, testInstance, int64(7), StatusQueued).
+				WillReturnResult(sqlmock.NewResult(0, tt.claimed))
+			if tt.wantOK {
+				mock.ExpectQuery(selectJob).WithArgs(int64(7)).
+					WillReturnRows(jobRow(7, "gmt_recompute", StatusRunning, testInstance, 1))
+			}
+
+			job, ok, err := m.claim(7)
+			if err != nil {
+				t.Fatalf("claim: %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("claim ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (job.Status != StatusRunning || job.Owner != testInstance) {
+				t.Errorf("claimed job = %s owned by %q, want RUNNING owned by %q", job.Status, job.Owner, testInstance)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRecoverStale(t *testing.T) {
+	tests := []struct {
+		name            string
+		resumable       bool
+		attempts        int
+		cancelRequested string
+		recovered       int64
+		wantArgs        []driver.Value // leading arguments of the recovering UPDATE
+		wantStatus      string         // status read back, "" when nothing was recovered
+		wantFinished    bool
+	}{
+		{
+			name:       "resumable job is requeued",
+			resumable:  true,
+			attempts:   1,
+			recovered:  1,
+			wantArgs:   []driver.Value{StatusQueued},
+			wantStatus: StatusQueued,
+		},
+		{
+			name:         "resumable job out of attempts fails",
+			resumable:    true,
+			attempts:     maxAttempts,
+			recovered:    1,
+			wantArgs:     []driver.Value{StatusFailed, "Interrupted: instance api2:8080 stopped responding"},
+			wantStatus:   StatusFailed,
+			wantFinished: true,
+		},
+		{
+			name:         "other job fails",
+			attempts:     1,
+			recovered:    1,
+			wantArgs:     []driver.Value{StatusFailed, "Interrupted: instance api2:8080 stopped responding"},
+			wantStatus:   StatusFailed,
+			wantFinished: true,
+		},
+		{
+			name:            "cancel requested job is cancelled",
+			resumable:       true,
+			attempts:        1,
+			cancelRequested: "Y",
+			recovered:       1,
+			wantArgs:        []driver.Value{StatusCancelled},
+			wantStatus:      StatusCancelled,
+			wantFinished:    true,
+		},
+		{
+			name:      "job recovered elsewhere is left alone",
+			resumable: true,
+			attempts:  1,
+			recovered: 0,
+			wantArgs:  []driver.Value{StatusQueued},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestManager(t)
+			var finished []models.Job
+			m.Register("list_clone", Definition{
+				Resumable: tt.resumable,
+				Finished:  func(job models.Job) { finished = append(finished, job) },
+			})
+
+			cancelRequested := tt.cancelRequested
+			if cancelRequested == "" {
+				cancelRequested = "N"
+			}
+			heartbeat := time.Date(2025, 1, 8, 15, 0, 0, 0, time.UTC)
+			mock.ExpectQuery(regexp.QuoteMeta("FROM go_api_jobs")).
+				WithArgs(StatusRunning, 60).
+				WillReturnRows(sqlmock.NewRows([]string{"job_id", "job_type", "owner", "attempts", "cancel_requested", "heartbeat_at"}).
+					AddRow(int64(9), "list_clone", "api2:8080", tt.attempts, cancelRequested, heartbeat))
+
+			args := append(tt.wantArgs, int64(9), StatusRunning, sqlmock.AnyArg(), sqlmock.AnyArg())
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs SET status = ?")).
+				WithArgs(args...).
+				WillReturnResult(sqlmock.NewResult(0, tt.recovered))
+			if tt.wantStatus != "" {
+				mock.ExpectQuery(selectJob).WithArgs(int64(9)).
+					WillReturnRows(jobRow(9, "list_clone", tt.wantStatus, nil, tt.attempts))
+			}
+
+			m.recoverStale(false)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if got := len(finished) > 0; got != tt.wantFinished {
+				t.Errorf("Finished called = %v, want %v", got, tt.wantFinished)
+			}
+			requeued := len(m.wake) > 0
+			if want := tt.wantStatus == StatusQueued; requeued != want {
+				t.Errorf("dispatcher woken = %v, want %v", requeued, want)
+			}
+		})
+	}
+}
+
+func TestRecoverStaleAtStartup(t *testing.T) {
+	m, mock := newTestManager(t)
+	m.Register("gmt_recompute", Definition{Resumable: true})
+
+	// At startup this instance's own running jobs are recovered however
+	// recent their heartbeat
+	mock.ExpectQuery(regexp.QuoteMeta("OR owner = ?)")).
+		WithArgs(StatusRunning, 60, testInstance).
+		WillReturnRows(sqlmock.NewRows([]string{"job_id", "job_type", "owner", "attempts", "cancel_requested", "heartbeat_at"}).
+			AddRow(int64(3), "gmt_recompute", testInstance, 1, "N", time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs SET status = ?, owner = NULL")).
+		WithArgs(StatusQueued, int64(3), StatusRunning, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectJob).WithArgs(int64(3)).
+		WillReturnRows(jobRow(3, "gmt_recompute", StatusQueued, nil, 1))
+
+	m.recoverStale(true)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelQueuedJobClaimedMeanwhile(t *testing.T) {
+	m, mock := newTestManager(t)
+
+	mock.ExpectQuery(selectJob).WithArgs(int64(5)).
+		WillReturnRows(jobRow(5, "lead_import", StatusQueued, nil, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs SET status = ?, cancel_requested = 'Y'")).
+		WithArgs(StatusCancelled, int64(5), StatusQueued).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	// Claimed before the cancel landed, so it becomes a running cancel
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs SET cancel_requested = 'Y' WHERE job_id = ? AND status = ?")).
+		WithArgs(int64(5), StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectJob).WithArgs(int64(5)).
+		WillReturnRows(jobRow(5, "lead_import", StatusRunning, "api2:8080", 1))
+
+	job, err := m.Cancel(5)
+	if err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if job.Status != StatusRunning {
+		t.Errorf("status = %s, want %s", job.Status, StatusRunning)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelFinishedJob(t *testing.T) {
+	m, mock := newTestManager(t)
+	mock.ExpectQuery(selectJob).WithArgs(int64(6)).
+		WillReturnRows(jobRow(6, "lead_import", StatusDone, nil, 1))
+
+	if _, err := m.Cancel(6); err != ErrFinished {
+		t.Errorf("Cancel error = %v, want %v", err, ErrFinished)
+	}
+}
+
+func TestGetMissingJob(t *testing.T) {
+	m, mock := newTestManager(t)
+	mock.ExpectQuery(selectJob).WithArgs(int64(404)).WillReturnError(sql.ErrNoRows)
+
+	if _, err := m.Get(404); err != ErrNotFound {
+		t.Errorf("Get error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestShutdownReleasesRunningJob(t *testing.T) {
+	m, mock := newTestManager(t)
+	started := make(chan struct{})
+	m.Register("list_clone", Definition{
+		Resumable: true,
+		Run: func(ctx context.Context, task *Task) (interface{}, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	mock.ExpectQuery(regexp.QuoteMeta("OR owner = ?)")).
+		WithArgs(StatusRunning, 60, testInstance).
+		WillReturnRows(sqlmock.NewRows([]string{"job_id", "job_type", "owner", "attempts", "cancel_requested", "heartbeat_at"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT job_id FROM go_api_jobs")).
+		WithArgs(StatusQueued, "list_clone", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"job_id"}).AddRow(int64(4)))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs")).
+		WithArgs(StatusRunning, testInstance, int64(4), StatusQueued).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectJob).WithArgs(int64(4)).
+		WillReturnRows(jobRow(4, "list_clone", StatusRunning, testInstance, 1))
+	// Interrupted by shutdown, the job goes back to the queue
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE go_api_jobs SET status = ?, owner = NULL")).
+		WithArgs(StatusQueued, 0, 0, "", int64(4), testInstance, StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stop := make(chan struct{})
+	m.Start(stop)
+	<-started
+	close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Wait(ctx); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Task is a running job as seen by its RunFunc. Progress and checkpoints are
+// kept in memory and written to go_api_jobs with each heartbeat.
+type Task struct {
+	Job models.Job
+
+	cancel context.CancelFunc
+
+	mu              sync.Mutex
+	progress        int
+	total           int
+	checkpoint      string
+	cancelRequested bool
+	lost            bool
+}
+
+// NewTask returns a task for the job that carries on from its saved progress
+// and checkpoint. The Manager runs jobs through it; tests can use it to run
+// a RunFunc directly.
+func NewTask(job models.Job) *Task {
+	return &Task{
+		Job:        job,
+		cancel:     func() {},
+		progress:   job.Progress,
+		total:      job.Total,
+		checkpoint: job.Checkpoint,
+	}
+}
+
+// Decode unmarshals the job's parameters
+func (t *Task) Decode(v interface{}) error {
+	return json.Unmarshal(t.Job.Params, v)
+}
+
+// SetTotal sets the amount of work the job expects to do
+func (t *Task) SetTotal(total int) {
+	t.mu.Lock()
+	t.total = total
+	t.mu.Unlock()
+}
+
+// SetProgress sets how much of the work is done
+func (t *Task) SetProgress(done int) {
+	t.mu.Lock()
+	t.progress = done
+	t.mu.Unlock()
+}
+
+// SaveCheckpoint records where a resumable job has got to. The checkpoint
+// is written with the next heartbeat, so a resumed job may repeat the work
+// done since then and must be safe to repeat.
+func (t *Task) SaveCheckpoint(v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.checkpoint = string(encoded)
+	t.mu.Unlock()
+	return nil
+}
+
+// LoadCheckpoint unmarshals the checkpoint saved by an earlier attempt and
+// reports whether there was one
+func (t *Task) LoadCheckpoint(v interface{}) (bool, error) {
+	t.mu.Lock()
+	checkpoint := t.checkpoint
+	t.mu.Unlock()
+	if checkpoint == "" {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(checkpoint), v)
+}
+
+func (t *Task) snapshot() (progress, total int, checkpoint string, cancelRequested, lost bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress, t.total, t.checkpoint, t.cancelRequested, t.lost
+}
+
+// stop cancels the job's context, recording whether a caller asked for it
+func (t *Task) stop(requested bool) {
+	t.mu.Lock()
+	if requested {
+		t.cancelRequested = true
+	}
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// lose cancels a job another instance has taken over
+func (t *Task) lose() {
+	t.mu.Lock()
+	t.lost = true
+	t.mu.Unlock()
+	t.cancel()
+}
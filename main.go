@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -11,9 +16,14 @@ import (
 	"github.com/vicidb/non-agent-api/config"
 	"github.com/vicidb/non-agent-api/database"
 	"github.com/vicidb/non-agent-api/handlers"
+	"github.com/vicidb/non-agent-api/jobs"
 	"github.com/vicidb/non-agent-api/middleware"
 )
 
+// shutdownTimeout bounds how long open requests and running jobs get to
+// finish after SIGINT or SIGTERM
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
@@ -32,6 +42,27 @@ func main() {
 
 	log.Println("Successfully connected to database")
 
+	if err := database.EnsureSchema(db); err != nil {
+		log.Fatalf("Failed to prepare API tables: %v", err)
+	}
+
+	switch cfg.AuthMode {
+	case middleware.AuthModeAPIKey, middleware.AuthModeVicidial, middleware.AuthModeBoth:
+	default:
+		log.Fatalf("Invalid AUTH_MODE %q (use api_key, vicidial or both)", cfg.AuthMode)
+	}
+
+	// Load API client keys and keep them fresh so rotations apply without a restart
+	keys := middleware.NewKeyStore(db, cfg.APIKey)
+	if err := keys.Reload(); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	stopKeyRefresh := make(chan struct{})
+	defer close(stopKeyRefresh)
+	keys.StartRefresh(time.Duration(cfg.APIKeyRefreshSeconds)*time.Second, stopKeyRefresh)
+
+	users := middleware.NewUserAuthenticator(db, time.Duration(cfg.AuthCacheSeconds)*time.Second)
+
 	// Initialize router
 	router := mux.NewRouter()
 
@@ -39,107 +70,186 @@ func main() {
 	apiRouter := router.PathPrefix("/api/v1").Subrouter()
 
 	// Apply authentication middleware
-	apiRouter.Use(middleware.AuthenticationMiddleware(cfg))
+	apiRouter.Use(middleware.AuthenticationMiddleware(cfg.AuthMode, keys, users))
 	apiRouter.Use(middleware.LoggingMiddleware)
 
+	// Background jobs are shared through go_api_jobs by every API instance
+	instanceID := cfg.JobInstanceID
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = fmt.Sprintf("%s:%s", hostname, cfg.APIPort)
+	}
+	jobManager := jobs.NewManager(db, instanceID, cfg.JobWorkers,
+		time.Duration(cfg.JobPollSeconds)*time.Second,
+		time.Duration(cfg.JobStaleSeconds)*time.Second,
+		time.Duration(cfg.JobRetentionDays)*24*time.Hour)
+
 	// Initialize handlers
-	h := handlers.NewHandler(db, cfg)
+	h := handlers.NewHandler(db, cfg, keys, jobManager)
+
+	stopJobs := make(chan struct{})
+	jobManager.Start(stopJobs)
+
+	// API Key Management
+	apiRouter.HandleFunc("/api-keys", middleware.Authorize(middleware.ScopeKeysAdmin, "", h.ListAPIKeys)).Methods("GET")
+	apiRouter.HandleFunc("/api-keys", middleware.Authorize(middleware.ScopeKeysAdmin, "", h.CreateAPIKey)).Methods("POST")
+	apiRouter.HandleFunc("/api-keys/{key_id}/rotate", middleware.Authorize(middleware.ScopeKeysAdmin, "", h.RotateAPIKey)).Methods("POST")
+	apiRouter.HandleFunc("/api-keys/{key_id}", middleware.Authorize(middleware.ScopeKeysAdmin, "", h.RevokeAPIKey)).Methods("DELETE")
 
 	// Version endpoint
 	apiRouter.HandleFunc("/version", h.GetVersion).Methods("GET")
 
 	// Lead Management
-	apiRouter.HandleFunc("/leads", h.AddLead).Methods("POST")
-	apiRouter.HandleFunc("/leads/{lead_id}", h.UpdateLead).Methods("PUT")
-	apiRouter.HandleFunc("/leads/batch", h.BatchUpdateLead).Methods("PUT")
-	apiRouter.HandleFunc("/leads/search", h.LeadSearch).Methods("GET")
-	apiRouter.HandleFunc("/leads/{lead_id}/info", h.LeadAllInfo).Methods("GET")
-	apiRouter.HandleFunc("/leads/{lead_id}/field-info", h.LeadFieldInfo).Methods("GET")
-	apiRouter.HandleFunc("/leads/status-search", h.LeadStatusSearch).Methods("GET")
-	apiRouter.HandleFunc("/leads/{lead_id}/callback-info", h.LeadCallbackInfo).Methods("GET")
-	apiRouter.HandleFunc("/leads/{lead_id}/dearchive", h.LeadDearchive).Methods("POST")
-	apiRouter.HandleFunc("/phone/check", h.CheckPhoneNumber).Methods("GET")
+	apiRouter.HandleFunc("/leads", middleware.Authorize(middleware.ScopeLeadsWrite, "add_lead", h.AddLead)).Methods("POST")
+	apiRouter.HandleFunc("/leads/batch", middleware.Authorize(middleware.ScopeLeadsWrite, "batch_update_lead", h.BatchUpdateLead)).Methods("PUT")
+	apiRouter.HandleFunc("/leads/bulk-update", middleware.Authorize(middleware.ScopeLeadsWrite, "batch_update_lead", h.BulkUpdateLeads)).Methods("POST")
+	apiRouter.HandleFunc("/leads/{lead_id}", middleware.Authorize(middleware.ScopeLeadsWrite, "update_lead", h.UpdateLead)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/leads/search", middleware.Authorize(middleware.ScopeLeadsRead, "lead_search", h.LeadSearch)).Methods("GET")
+	apiRouter.HandleFunc("/leads/{lead_id}/info", middleware.Authorize(middleware.ScopeLeadsRead, "lead_all_info", h.LeadAllInfo)).Methods("GET")
+	apiRouter.HandleFunc("/leads/{lead_id}/field-info", middleware.Authorize(middleware.ScopeLeadsRead, "lead_field_info", h.LeadFieldInfo)).Methods("GET")
+	apiRouter.HandleFunc("/leads/status-search", middleware.Authorize(middleware.ScopeLeadsRead, "lead_status_search", h.LeadStatusSearch)).Methods("GET")
+	apiRouter.HandleFunc("/leads/{lead_id}/callback-info", middleware.Authorize(middleware.ScopeLeadsRead, "lead_callback_info", h.LeadCallbackInfo)).Methods("GET")
+	apiRouter.HandleFunc("/leads/{lead_id}/timeline", middleware.Authorize(middleware.ScopeLeadsRead, "lead_all_info", h.LeadTimeline)).Methods("GET")
+	apiRouter.HandleFunc("/leads/archive", middleware.Authorize(middleware.ScopeLeadsWrite, "lead_archive", h.ArchiveLeads)).Methods("POST")
+	apiRouter.HandleFunc("/leads/dearchive", middleware.Authorize(middleware.ScopeLeadsWrite, "lead_dearchive", h.DearchiveLeads)).Methods("POST")
+	apiRouter.HandleFunc("/leads/{lead_id}/dearchive", middleware.Authorize(middleware.ScopeLeadsWrite, "lead_dearchive", h.LeadDearchive)).Methods("POST")
+	apiRouter.HandleFunc("/phone/check", middleware.Authorize(middleware.ScopeLeadsRead, "check_phone_number", h.CheckPhoneNumber)).Methods("GET")
+	apiRouter.HandleFunc("/timezone/lookup", middleware.Authorize(middleware.ScopeLeadsRead, "lookup_gmt", h.LookupGMT)).Methods("GET")
+
+	// Callbacks
+	apiRouter.HandleFunc("/callbacks", middleware.Authorize(middleware.ScopeLeadsRead, "lead_callback_info", h.ListCallbacks)).Methods("GET")
+	apiRouter.HandleFunc("/callbacks", middleware.Authorize(middleware.ScopeLeadsWrite, "update_lead", h.ScheduleCallback)).Methods("POST")
+	apiRouter.HandleFunc("/callbacks/{callback_id}", middleware.Authorize(middleware.ScopeLeadsRead, "lead_callback_info", h.GetCallback)).Methods("GET")
+	apiRouter.HandleFunc("/callbacks/{callback_id}", middleware.Authorize(middleware.ScopeLeadsWrite, "update_lead", h.UpdateCallback)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/callbacks/{callback_id}", middleware.Authorize(middleware.ScopeLeadsWrite, "update_lead", h.CancelCallback)).Methods("DELETE")
 
 	// List Management
-	apiRouter.HandleFunc("/lists", h.AddList).Methods("POST")
-	apiRouter.HandleFunc("/lists/{list_id}", h.UpdateList).Methods("PUT")
-	apiRouter.HandleFunc("/lists/{list_id}/info", h.ListInfo).Methods("GET")
-	apiRouter.HandleFunc("/lists/{list_id}/custom-fields", h.ListCustomFields).Methods("GET", "POST", "PUT")
+	apiRouter.HandleFunc("/lists", middleware.Authorize(middleware.ScopeListsWrite, "add_list", h.AddList)).Methods("POST")
+	apiRouter.HandleFunc("/lists/{list_id}", middleware.Authorize(middleware.ScopeListsWrite, "update_list", h.UpdateList)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/lists/{list_id}", middleware.Authorize(middleware.ScopeListsWrite, "delete_list", h.DeleteList)).Methods("DELETE")
+	apiRouter.HandleFunc("/lists/{list_id}/clone", middleware.Authorize(middleware.ScopeListsWrite, "add_list", h.CloneList)).Methods("POST")
+	apiRouter.HandleFunc("/lists/{list_id}/penetration", middleware.Authorize(middleware.ScopeListsRead, "list_info", h.ListPenetration)).Methods("GET")
+	apiRouter.HandleFunc("/lists/{list_id}/info", middleware.Authorize(middleware.ScopeListsRead, "list_info", h.ListInfo)).Methods("GET")
+	apiRouter.HandleFunc("/lists/{list_id}/custom-fields", middleware.Authorize(middleware.ScopeListsRead, "list_custom_fields", h.ListCustomFields)).Methods("GET")
+	apiRouter.HandleFunc("/lists/{list_id}/custom-fields", middleware.Authorize(middleware.ScopeListsWrite, "list_custom_fields", h.ListCustomFields)).Methods("POST", "PUT")
+	apiRouter.HandleFunc("/lists/{list_id}/custom-fields/copy", middleware.Authorize(middleware.ScopeListsWrite, "list_custom_fields", h.CopyListCustomFields)).Methods("POST")
+	apiRouter.HandleFunc("/lists/{list_id}/custom-fields/{field_id}", middleware.Authorize(middleware.ScopeListsWrite, "list_custom_fields", h.DeleteListCustomField)).Methods("DELETE")
+	apiRouter.HandleFunc("/lists/{list_id}/import", middleware.Authorize(middleware.ScopeLeadsWrite, "add_lead", h.ImportLeads)).Methods("POST")
+	apiRouter.HandleFunc("/lists/{list_id}/gmt-recompute", middleware.Authorize(middleware.ScopeListsWrite, "update_list", h.RecomputeListGMT)).Methods("POST")
+	apiRouter.HandleFunc("/lists/resets", middleware.Authorize(middleware.ScopeListsRead, "list_info", h.ListResets)).Methods("GET")
+	apiRouter.HandleFunc("/lists/{list_id}/reset", middleware.Authorize(middleware.ScopeListsRead, "list_info", h.GetListReset)).Methods("GET")
+	apiRouter.HandleFunc("/lists/{list_id}/reset", middleware.Authorize(middleware.ScopeListsWrite, "update_list", h.ResetList)).Methods("POST")
+	apiRouter.HandleFunc("/lists/{list_id}/reset-schedule", middleware.Authorize(middleware.ScopeListsWrite, "update_list", h.UpdateListResetSchedule)).Methods("PUT", "PATCH")
 
 	// User/Agent Management
-	apiRouter.HandleFunc("/users", h.AddUser).Methods("POST")
-	apiRouter.HandleFunc("/users/{user_id}", h.UpdateUser).Methods("PUT")
-	apiRouter.HandleFunc("/users/{user_id}/copy", h.CopyUser).Methods("POST")
-	apiRouter.HandleFunc("/users/{user_id}/details", h.UserDetails).Methods("GET")
-	apiRouter.HandleFunc("/users/logged-in", h.LoggedInAgents).Methods("GET")
-	apiRouter.HandleFunc("/agents/status", h.AgentStatus).Methods("GET")
-	apiRouter.HandleFunc("/agents/{agent_id}/ingroup-info", h.AgentIngroupInfo).Methods("GET")
-	apiRouter.HandleFunc("/agents/{agent_id}/campaigns", h.AgentCampaigns).Methods("GET")
-	apiRouter.HandleFunc("/remote-agents/{agent_id}", h.UpdateRemoteAgent).Methods("PUT")
+	apiRouter.HandleFunc("/users", middleware.Authorize(middleware.ScopeUsersWrite, "add_user", h.AddUser)).Methods("POST")
+	apiRouter.HandleFunc("/users/{user_id}", middleware.Authorize(middleware.ScopeUsersWrite, "update_user", h.UpdateUser)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/users/{user_id}/copy", middleware.Authorize(middleware.ScopeUsersWrite, "copy_user", h.CopyUser)).Methods("POST")
+	apiRouter.HandleFunc("/users/{user_id}/details", middleware.Authorize(middleware.ScopeUsersRead, "user_details", h.UserDetails)).Methods("GET")
+	apiRouter.HandleFunc("/users/logged-in", middleware.Authorize(middleware.ScopeUsersRead, "logged_in_agents", h.LoggedInAgents)).Methods("GET")
+	apiRouter.HandleFunc("/agents/status", middleware.Authorize(middleware.ScopeUsersRead, "agent_status", h.AgentStatus)).Methods("GET")
+	apiRouter.HandleFunc("/agents/{agent_id}/ingroup-info", middleware.Authorize(middleware.ScopeUsersRead, "agent_ingroup_info", h.AgentIngroupInfo)).Methods("GET")
+	apiRouter.HandleFunc("/agents/{agent_id}/campaigns", middleware.Authorize(middleware.ScopeUsersRead, "agent_campaigns", h.AgentCampaigns)).Methods("GET")
+	apiRouter.HandleFunc("/remote-agents/{agent_id}", middleware.Authorize(middleware.ScopeUsersWrite, "update_remote_agent", h.UpdateRemoteAgent)).Methods("PUT")
 
 	// Campaign Management
-	apiRouter.HandleFunc("/campaigns/{campaign_id}", h.UpdateCampaign).Methods("PUT")
-	apiRouter.HandleFunc("/campaigns", h.CampaignsList).Methods("GET")
-	apiRouter.HandleFunc("/campaigns/with-lists", h.GetCampaignsWithLists).Methods("GET")
-	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper", h.HopperList).Methods("GET")
-	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper/bulk", h.HopperBulkInsert).Methods("POST")
+	apiRouter.HandleFunc("/campaigns", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.CreateCampaign)).Methods("POST")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}", middleware.Authorize(middleware.ScopeCampaignsWrite, "delete_campaign", h.DeleteCampaign)).Methods("DELETE")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/copy", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.CopyCampaign)).Methods("POST")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.UpdateCampaign)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/campaigns", middleware.Authorize(middleware.ScopeCampaignsRead, "campaigns_list", h.CampaignsList)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/with-lists", middleware.Authorize(middleware.ScopeCampaignsRead, "campaigns_list", h.GetCampaignsWithLists)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/penetration", middleware.Authorize(middleware.ScopeCampaignsRead, "campaigns_list", h.CampaignPenetration)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/statuses", middleware.Authorize(middleware.ScopeCampaignsRead, "campaigns_list", h.ListCampaignStatuses)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/statuses", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.CreateCampaignStatus)).Methods("POST")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/statuses/{status}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.UpdateCampaignStatus)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/statuses/{status}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.DeleteCampaignStatus)).Methods("DELETE")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/pause-codes", middleware.Authorize(middleware.ScopeCampaignsRead, "campaigns_list", h.ListPauseCodes)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/pause-codes", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.CreatePauseCode)).Methods("POST")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/pause-codes/{pause_code}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.UpdatePauseCode)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/pause-codes/{pause_code}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.DeletePauseCode)).Methods("DELETE")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hotkeys", middleware.Authorize(middleware.ScopeCampaignsRead, "campaigns_list", h.ListHotkeys)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hotkeys", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.CreateHotkey)).Methods("POST")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hotkeys/{hotkey}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.UpdateHotkey)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hotkeys/{hotkey}", middleware.Authorize(middleware.ScopeCampaignsWrite, "update_campaign", h.DeleteHotkey)).Methods("DELETE")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper", middleware.Authorize(middleware.ScopeCampaignsRead, "hopper_list", h.HopperList)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper/bulk", middleware.Authorize(middleware.ScopeCampaignsWrite, "hopper_bulk_insert", h.HopperBulkInsert)).Methods("POST")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper", middleware.Authorize(middleware.ScopeCampaignsWrite, "hopper_remove", h.HopperRemove)).Methods("DELETE")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper", middleware.Authorize(middleware.ScopeCampaignsWrite, "hopper_priority", h.HopperPriority)).Methods("PATCH")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper/stats", middleware.Authorize(middleware.ScopeCampaignsRead, "hopper_list", h.HopperStats)).Methods("GET")
+	apiRouter.HandleFunc("/campaigns/{campaign_id}/hopper/simulate", middleware.Authorize(middleware.ScopeCampaignsRead, "hopper_list", h.HopperSimulate)).Methods("GET")
 
 	// SIP/Carrier Logs
-	apiRouter.HandleFunc("/sip/carrier-log", h.GetSIPLog).Methods("GET")
-	apiRouter.HandleFunc("/sip/event-log", h.GetSIPEventLog).Methods("GET")
-	apiRouter.HandleFunc("/sip/live-channels", h.GetLiveSIPChannels).Methods("GET")
+	apiRouter.HandleFunc("/sip/carrier-log", middleware.Authorize(middleware.ScopeReportsRead, "sip_log", h.GetSIPLog)).Methods("GET")
+	apiRouter.HandleFunc("/sip/event-log", middleware.Authorize(middleware.ScopeReportsRead, "sip_event_log", h.GetSIPEventLog)).Methods("GET")
+	apiRouter.HandleFunc("/sip/live-channels", middleware.Authorize(middleware.ScopeReportsRead, "live_sip_channels", h.GetLiveSIPChannels)).Methods("GET")
 
 	// KPI & Analytics
-	apiRouter.HandleFunc("/kpi/dispositions", h.GetKPIDispositions).Methods("GET")
+	apiRouter.HandleFunc("/kpi/dispositions", middleware.Authorize(middleware.ScopeReportsRead, "kpi_dispositions", h.GetKPIDispositions)).Methods("GET")
 
 	// Test Calls
-	apiRouter.HandleFunc("/test-call/send", h.SendTestCall).Methods("POST")
-	apiRouter.HandleFunc("/test-call/status", h.GetTestCallStatus).Methods("GET")
-	apiRouter.HandleFunc("/test-call/list", h.ListTestCalls).Methods("GET")
+	apiRouter.HandleFunc("/test-call/send", middleware.Authorize(middleware.ScopeCallsOriginate, "send_test_call", h.SendTestCall)).Methods("POST")
+	apiRouter.HandleFunc("/test-call/status", middleware.Authorize(middleware.ScopeReportsRead, "test_call_status", h.GetTestCallStatus)).Methods("GET")
+	apiRouter.HandleFunc("/test-call/list", middleware.Authorize(middleware.ScopeReportsRead, "test_call_list", h.ListTestCalls)).Methods("GET")
 
 	// Phone/DID Management
-	apiRouter.HandleFunc("/phones", h.AddPhone).Methods("POST")
-	apiRouter.HandleFunc("/phones/{phone_id}", h.UpdatePhone).Methods("PUT")
-	apiRouter.HandleFunc("/phone-aliases", h.AddPhoneAlias).Methods("POST")
-	apiRouter.HandleFunc("/phone-aliases/{alias_id}", h.UpdatePhoneAlias).Methods("PUT")
-	apiRouter.HandleFunc("/dids", h.AddDID).Methods("POST")
-	apiRouter.HandleFunc("/dids/{did_id}", h.UpdateDID).Methods("PUT")
-	apiRouter.HandleFunc("/dids/{did_id}/copy", h.CopyDID).Methods("POST")
+	apiRouter.HandleFunc("/phones", middleware.Authorize(middleware.ScopePhonesWrite, "add_phone", h.AddPhone)).Methods("POST")
+	apiRouter.HandleFunc("/phones/{phone_id}", middleware.Authorize(middleware.ScopePhonesWrite, "update_phone", h.UpdatePhone)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/phone-aliases", middleware.Authorize(middleware.ScopePhonesWrite, "add_phone_alias", h.AddPhoneAlias)).Methods("POST")
+	apiRouter.HandleFunc("/phone-aliases/{alias_id}", middleware.Authorize(middleware.ScopePhonesWrite, "update_phone_alias", h.UpdatePhoneAlias)).Methods("PUT")
+	apiRouter.HandleFunc("/dids", middleware.Authorize(middleware.ScopePhonesWrite, "add_did", h.AddDID)).Methods("POST")
+	apiRouter.HandleFunc("/dids/{did_id}", middleware.Authorize(middleware.ScopePhonesWrite, "update_did", h.UpdateDID)).Methods("PUT")
+	apiRouter.HandleFunc("/dids/{did_id}/copy", middleware.Authorize(middleware.ScopePhonesWrite, "copy_did", h.CopyDID)).Methods("POST")
 
 	// DNC Management
-	apiRouter.HandleFunc("/dnc", h.AddDNCPhone).Methods("POST")
-	apiRouter.HandleFunc("/dnc/{phone}", h.DeleteDNCPhone).Methods("DELETE")
-	apiRouter.HandleFunc("/fpg", h.AddFPGPhone).Methods("POST")
-	apiRouter.HandleFunc("/fpg/{phone}", h.DeleteFPGPhone).Methods("DELETE")
+	apiRouter.HandleFunc("/dnc", middleware.Authorize(middleware.ScopeDNCWrite, "add_dnc_phone", h.AddDNCPhone)).Methods("POST")
+	apiRouter.HandleFunc("/dnc/{phone}", middleware.Authorize(middleware.ScopeDNCWrite, "delete_dnc_phone", h.DeleteDNCPhone)).Methods("DELETE")
+	apiRouter.HandleFunc("/fpg", middleware.Authorize(middleware.ScopeDNCWrite, "add_fpg_phone", h.AddFPGPhone)).Methods("POST")
+	apiRouter.HandleFunc("/fpg/{phone}", middleware.Authorize(middleware.ScopeDNCWrite, "delete_fpg_phone", h.DeleteFPGPhone)).Methods("DELETE")
 
 	// Reporting & Monitoring
-	apiRouter.HandleFunc("/recordings/lookup", h.RecordingLookup).Methods("GET")
-	apiRouter.HandleFunc("/did-logs/export", h.DIDLogExport).Methods("GET")
-	apiRouter.HandleFunc("/phone-logs/{phone}", h.PhoneNumberLog).Methods("GET")
-	apiRouter.HandleFunc("/agent-stats/export", h.AgentStatsExport).Methods("GET")
-	apiRouter.HandleFunc("/call-stats/status", h.CallStatusStats).Methods("GET")
-	apiRouter.HandleFunc("/call-stats/dispo", h.CallDispoReport).Methods("GET")
-	apiRouter.HandleFunc("/monitor/blind", h.BlindMonitor).Methods("POST")
+	apiRouter.HandleFunc("/recordings/lookup", middleware.Authorize(middleware.ScopeReportsRead, "recording_lookup", h.RecordingLookup)).Methods("GET")
+	apiRouter.HandleFunc("/did-logs/export", middleware.Authorize(middleware.ScopeReportsRead, "did_log_export", h.DIDLogExport)).Methods("GET")
+	apiRouter.HandleFunc("/phone-logs/{phone}", middleware.Authorize(middleware.ScopeReportsRead, "phone_number_log", h.PhoneNumberLog)).Methods("GET")
+	apiRouter.HandleFunc("/agent-stats/export", middleware.Authorize(middleware.ScopeReportsRead, "agent_stats_export", h.AgentStatsExport)).Methods("GET")
+	apiRouter.HandleFunc("/call-stats/status", middleware.Authorize(middleware.ScopeReportsRead, "call_status_stats", h.CallStatusStats)).Methods("GET")
+	apiRouter.HandleFunc("/call-stats/dispo", middleware.Authorize(middleware.ScopeReportsRead, "call_dispo_report", h.CallDispoReport)).Methods("GET")
+	apiRouter.HandleFunc("/monitor/blind", middleware.Authorize(middleware.ScopeCallsOriginate, "blind_monitor", h.BlindMonitor)).Methods("POST")
 
 	// System Management
-	apiRouter.HandleFunc("/system/sounds", h.SoundsList).Methods("GET")
-	apiRouter.HandleFunc("/system/moh", h.MOHList).Methods("GET")
-	apiRouter.HandleFunc("/system/voicemail", h.VMList).Methods("GET")
-	apiRouter.HandleFunc("/ingroups", h.IngroupList).Methods("GET")
-	apiRouter.HandleFunc("/ingroups/status", h.InGroupStatus).Methods("GET")
-	apiRouter.HandleFunc("/callmenus", h.CallmenuList).Methods("GET")
-	apiRouter.HandleFunc("/containers", h.ContainerList).Methods("GET")
-	apiRouter.HandleFunc("/system/refresh", h.ServerRefresh).Methods("POST")
-	apiRouter.HandleFunc("/user-groups/status", h.UserGroupStatus).Methods("GET")
+	apiRouter.HandleFunc("/system/sounds", middleware.Authorize(middleware.ScopeSystemRead, "sounds_list", h.SoundsList)).Methods("GET")
+	apiRouter.HandleFunc("/system/moh", middleware.Authorize(middleware.ScopeSystemRead, "moh_list", h.MOHList)).Methods("GET")
+	apiRouter.HandleFunc("/system/voicemail", middleware.Authorize(middleware.ScopeSystemRead, "vm_list", h.VMList)).Methods("GET")
+	apiRouter.HandleFunc("/ingroups", middleware.Authorize(middleware.ScopeSystemRead, "ingroup_list", h.IngroupList)).Methods("GET")
+	apiRouter.HandleFunc("/ingroups/status", middleware.Authorize(middleware.ScopeSystemRead, "in_group_status", h.InGroupStatus)).Methods("GET")
+	apiRouter.HandleFunc("/callmenus", middleware.Authorize(middleware.ScopeSystemRead, "callmenu_list", h.CallmenuList)).Methods("GET")
+	apiRouter.HandleFunc("/containers", middleware.Authorize(middleware.ScopeSystemRead, "container_list", h.ContainerList)).Methods("GET")
+	apiRouter.HandleFunc("/statuses", middleware.Authorize(middleware.ScopeSystemRead, "statuses_list", h.ListStatuses)).Methods("GET")
+	apiRouter.HandleFunc("/statuses", middleware.Authorize(middleware.ScopeSystemWrite, "update_status", h.CreateStatus)).Methods("POST")
+	apiRouter.HandleFunc("/statuses/{status}", middleware.Authorize(middleware.ScopeSystemWrite, "update_status", h.UpdateStatus)).Methods("PUT", "PATCH")
+	apiRouter.HandleFunc("/statuses/{status}", middleware.Authorize(middleware.ScopeSystemWrite, "update_status", h.DeleteStatus)).Methods("DELETE")
+	apiRouter.HandleFunc("/system/refresh", middleware.Authorize(middleware.ScopeSystemWrite, "server_refresh", h.ServerRefresh)).Methods("POST")
+	apiRouter.HandleFunc("/user-groups/status", middleware.Authorize(middleware.ScopeSystemRead, "user_group_status", h.UserGroupStatus)).Methods("GET")
 
 	// Advanced Features
-	apiRouter.HandleFunc("/group-aliases", h.AddGroupAlias).Methods("POST")
-	apiRouter.HandleFunc("/log-entries/{entry_id}", h.UpdateLogEntry).Methods("PUT")
-	apiRouter.HandleFunc("/cid-groups/{entry_id}", h.UpdateCIDGroupEntry).Methods("PUT")
-	apiRouter.HandleFunc("/alt-urls/{url_id}", h.UpdateAltURL).Methods("PUT")
-	apiRouter.HandleFunc("/presets/{preset_id}", h.UpdatePresets).Methods("PUT")
-	apiRouter.HandleFunc("/calls/{call_id}/info", h.CallidInfo).Methods("GET")
-	apiRouter.HandleFunc("/ccc/lead-info/{lead_id}", h.CCCLeadInfo).Methods("GET")
+	apiRouter.HandleFunc("/group-aliases", middleware.Authorize(middleware.ScopeSystemWrite, "add_group_alias", h.AddGroupAlias)).Methods("POST")
+	apiRouter.HandleFunc("/log-entries/{entry_id}", middleware.Authorize(middleware.ScopeLeadsWrite, "update_log_entry", h.UpdateLogEntry)).Methods("PUT")
+	apiRouter.HandleFunc("/cid-groups/{entry_id}", middleware.Authorize(middleware.ScopeSystemWrite, "update_cid_group_entry", h.UpdateCIDGroupEntry)).Methods("PUT")
+	apiRouter.HandleFunc("/alt-urls/{url_id}", middleware.Authorize(middleware.ScopeSystemWrite, "update_alt_url", h.UpdateAltURL)).Methods("PUT")
+	apiRouter.HandleFunc("/presets/{preset_id}", middleware.Authorize(middleware.ScopeListsWrite, "update_presets", h.UpdatePresets)).Methods("PUT")
+	apiRouter.HandleFunc("/calls/{call_id}/info", middleware.Authorize(middleware.ScopeReportsRead, "callid_info", h.CallidInfo)).Methods("GET")
+	apiRouter.HandleFunc("/ccc/lead-info/{lead_id}", middleware.Authorize(middleware.ScopeLeadsRead, "ccc_lead_info", h.CCCLeadInfo)).Methods("GET")
+
+	// Privacy Requests (subject access and erasure, level 9 users only)
+	apiRouter.HandleFunc("/privacy/export", middleware.Authorize(middleware.ScopePrivacyAdmin, "", h.PrivacyExport)).Methods("GET")
+	apiRouter.HandleFunc("/privacy/erase", middleware.Authorize(middleware.ScopePrivacyAdmin, "", h.PrivacyErase)).Methods("POST")
+	apiRouter.HandleFunc("/privacy/erasures", middleware.Authorize(middleware.ScopePrivacyAdmin, "", h.ListPrivacyErasures)).Methods("GET")
+	apiRouter.HandleFunc("/privacy/erasures/{erasure_id}", middleware.Authorize(middleware.ScopePrivacyAdmin, "", h.GetPrivacyErasure)).Methods("GET")
+
+	// Background Jobs (each caller sees the jobs it submitted)
+	apiRouter.HandleFunc("/jobs", middleware.Authorize(middleware.ScopeJobsRead, "jobs_list", h.ListJobs)).Methods("GET")
+	apiRouter.HandleFunc("/jobs/{job_id}", middleware.Authorize(middleware.ScopeJobsRead, "jobs_list", h.GetJob)).Methods("GET")
+	apiRouter.HandleFunc("/jobs/{job_id}/cancel", middleware.Authorize(middleware.ScopeJobsWrite, "job_cancel", h.CancelJob)).Methods("POST")
 
 	// Health check endpoint (no auth required)
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -150,7 +260,7 @@ func main() {
 	// CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 	})
@@ -163,8 +273,39 @@ func main() {
 		port = "8080"
 	}
 
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	srv := &http.Server{Addr: ":" + port, Handler: handler}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
 	log.Printf("Starting VICIdial Non-Agent API server on port %s", port)
-	if err := http.ListenAndServe(":"+port, handler); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+
+	failed := false
+	select {
+	case err := <-serverErr:
+		log.Printf("Server failed: %v", err)
+		failed = true
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	}
+
+	// Finish in-flight requests, then interrupt running jobs and wait for
+	// them to be released back to the queue for another instance
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish open requests: %v", err)
+	}
+	close(stopJobs)
+	if err := jobManager.Wait(shutdownCtx); err != nil {
+		log.Printf("Jobs still running at shutdown are left to stale job recovery: %v", err)
+	}
+
+	if failed {
+		db.Close()
+		os.Exit(1)
 	}
 }
@@ -3,15 +3,20 @@ package middleware
 import (
 	"context"
 	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
 
-	"github.com/vicidb/non-agent-api/config"
+	"github.com/vicidb/non-agent-api/models"
 )
 
 type contextKey string
 
 const (
-	userContextKey contextKey = "user"
+	userContextKey       contextKey = "user"
+	keyContextKey        contextKey = "api_key"
+	apiUserContextKey    contextKey = "api_user"
+	onBehalfOfContextKey contextKey = "on_behalf_of"
 )
 
 // ErrorResponse represents an error response
@@ -20,52 +25,122 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
-// AuthenticationMiddleware validates requests using a shared API key from the environment.
-func AuthenticationMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+// AuthenticationMiddleware validates requests according to the auth mode:
+// API keys from the key store, VICIdial user/pass credentials, or either.
+func AuthenticationMiddleware(mode string, keys *KeyStore, users *UserAuthenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if cfg.APIKey == "" {
-				respondWithError(w, http.StatusInternalServerError, "Authentication not configured", "Missing API_KEY in environment")
+			acceptKeys := mode == AuthModeAPIKey || mode == AuthModeBoth
+			acceptUsers := mode == AuthModeVicidial || mode == AuthModeBoth
+
+			if acceptKeys && !acceptUsers && !keys.Configured() {
+				respondWithError(w, http.StatusInternalServerError, "Authentication not configured", "No API keys configured (set API_KEY or create keys in go_api_keys)")
 				return
 			}
 
 			// Accept API key from header or query/form for flexibility
 			providedKey := r.Header.Get("X-API-Key")
 			if providedKey == "" {
-				providedKey = r.URL.Query().Get("api_key")
-			}
-			if providedKey == "" {
-				providedKey = r.FormValue("api_key")
+				providedKey = requestParam(r, "api_key")
 			}
 
-			if providedKey == "" {
-				respondWithError(w, http.StatusUnauthorized, "Authentication required", "Missing API key (use header X-API-Key or query param api_key)")
+			if acceptKeys && providedKey != "" {
+				apiKey, ok := keys.Lookup(providedKey)
+				if !ok {
+					respondWithError(w, http.StatusUnauthorized, "Authentication failed", "Invalid, expired or revoked API key")
+					return
+				}
+
+				// The key's client is the user. A user named by the caller is
+				// only a hint of who it acts for; nothing verifies it.
+				onBehalfOf := r.Header.Get("X-User")
+				if onBehalfOf == "" {
+					onBehalfOf = requestParam(r, "user")
+				}
+
+				ctx := context.WithValue(r.Context(), userContextKey, apiKey.ClientName)
+				ctx = context.WithValue(ctx, keyContextKey, apiKey)
+				if onBehalfOf != "" && onBehalfOf != apiKey.ClientName {
+					ctx = context.WithValue(ctx, onBehalfOfContextKey, onBehalfOf)
+				}
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
 
-			if providedKey != cfg.APIKey {
-				respondWithError(w, http.StatusUnauthorized, "Authentication failed", "Invalid API key")
+			if acceptUsers {
+				// Credentials from Basic auth or the PHP API's user/pass parameters
+				user, pass, ok := r.BasicAuth()
+				if !ok {
+					user = requestParam(r, "user")
+					pass = requestParam(r, "pass")
+				}
+
+				if user == "" || pass == "" {
+					respondWithError(w, http.StatusUnauthorized, "Authentication required", "Missing credentials (use HTTP Basic auth or user/pass parameters)")
+					return
+				}
+
+				apiUser, err := users.Authenticate(user, pass)
+				if err == ErrInvalidLogin {
+					respondWithError(w, http.StatusUnauthorized, "Authentication failed", "Invalid username or password, or user not allowed API access")
+					return
+				}
+				if err != nil {
+					log.Printf("User authentication error: %v", err)
+					respondWithError(w, http.StatusInternalServerError, "Authentication failed", "Unable to verify credentials")
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), userContextKey, apiUser.User)
+				ctx = context.WithValue(ctx, apiUserContextKey, apiUser)
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
 
-			// Optional user hint for downstream logging if provided
-			user := r.Header.Get("X-User")
-			if user == "" {
-				user = r.URL.Query().Get("user")
-			}
-			if user == "" {
-				user = r.FormValue("user")
-			}
-			if user == "" {
-				user = "api-key"
-			}
+			respondWithError(w, http.StatusUnauthorized, "Authentication required", "Missing API key (use header X-API-Key or query param api_key)")
+		})
+	}
+}
 
-			// Add user to context for handlers to use
-			ctx := context.WithValue(r.Context(), userContextKey, user)
+// requestParam returns a credential parameter from the query string or a
+// url-encoded form body. Multipart bodies are left unread so that handlers
+// such as lead import can stream them; credentials for those go in headers
+// or the query string.
+func requestParam(r *http.Request, name string) string {
+	if value := r.URL.Query().Get(name); value != "" {
+		return value
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return ""
+	}
+	return r.FormValue(name)
+}
 
-			// Call next handler with updated context
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
+// Authorize wraps a handler with the route's permission check. API key callers
+// need the scope; VICIdial user callers need the function in
+// api_allowed_functions. Routes with no function are limited to level 9 users.
+func Authorize(scope, function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiUser, ok := GetAPIUserFromContext(r.Context()); ok {
+			if function == "" {
+				if apiUser.UserLevel < 9 {
+					respondWithError(w, http.StatusForbidden, "Not allowed", "This function requires user level 9")
+					return
+				}
+			} else if !AllowsFunction(apiUser, function) {
+				respondWithError(w, http.StatusForbidden, "Not allowed", "User is not allowed to use function "+function)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		apiKey, ok := GetAPIKeyFromContext(r.Context())
+		if !ok || !HasScope(apiKey.Scopes, scope) {
+			respondWithError(w, http.StatusForbidden, "Insufficient scope", "API key lacks required scope "+scope)
+			return
+		}
+		next(w, r)
 	}
 }
 
@@ -77,6 +152,27 @@ func GetUserFromContext(ctx context.Context) string {
 	return ""
 }
 
+// GetOnBehalfOfFromContext retrieves the unverified user an API key caller
+// says it acts for, from the X-User header or user parameter
+func GetOnBehalfOfFromContext(ctx context.Context) string {
+	if user, ok := ctx.Value(onBehalfOfContextKey).(string); ok {
+		return user
+	}
+	return ""
+}
+
+// GetAPIKeyFromContext retrieves the authenticated API key from request context
+func GetAPIKeyFromContext(ctx context.Context) (models.APIKey, bool) {
+	apiKey, ok := ctx.Value(keyContextKey).(models.APIKey)
+	return apiKey, ok
+}
+
+// GetAPIUserFromContext retrieves the authenticated VICIdial user from request context
+func GetAPIUserFromContext(ctx context.Context) (models.APIUser, bool) {
+	apiUser, ok := ctx.Value(apiUserContextKey).(models.APIUser)
+	return apiUser, ok
+}
+
 // respondWithError sends an error response
 func respondWithError(w http.ResponseWriter, code int, error, message string) {
 	w.Header().Set("Content-Type", "application/json")
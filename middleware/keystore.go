@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicidb/non-agent-api/models"
+)
+
+// Scopes understood by the API. A key may also carry "*" for every scope
+// or "<resource>:*" for every action on one resource.
+const (
+	ScopeLeadsRead      = "leads:read"
+	ScopeLeadsWrite     = "leads:write"
+	ScopeListsRead      = "lists:read"
+	ScopeListsWrite     = "lists:write"
+	ScopeUsersRead      = "users:read"
+	ScopeUsersWrite     = "users:write"
+	ScopeCampaignsRead  = "campaigns:read"
+	ScopeCampaignsWrite = "campaigns:write"
+	ScopePhonesRead     = "phones:read"
+	ScopePhonesWrite    = "phones:write"
+	ScopeDNCWrite       = "dnc:write"
+	ScopeReportsRead    = "reports:read"
+	ScopeSystemRead     = "system:read"
+	ScopeSystemWrite    = "system:write"
+	ScopeCallsOriginate = "calls:originate"
+	ScopeKeysAdmin      = "keys:admin"
+	ScopePrivacyAdmin   = "privacy:admin"
+	ScopeJobsRead       = "jobs:read"
+	ScopeJobsWrite      = "jobs:write"
+)
+
+// knownScopes are the scopes a key can be issued with
+var knownScopes = []string{
+	ScopeLeadsRead, ScopeLeadsWrite, ScopeListsRead, ScopeListsWrite,
+	ScopeUsersRead, ScopeUsersWrite, ScopeCampaignsRead, ScopeCampaignsWrite,
+	ScopePhonesRead, ScopePhonesWrite, ScopeDNCWrite, ScopeReportsRead,
+	ScopeSystemRead, ScopeSystemWrite, ScopeCallsOriginate, ScopeKeysAdmin,
+	ScopePrivacyAdmin, ScopeJobsRead, ScopeJobsWrite,
+}
+
+// legacyClientName is the client name reported for the shared API_KEY
+const legacyClientName = "api-key"
+
+// KeyStore caches the API keys from go_api_keys in memory and reloads them
+// periodically so that new, rotated and revoked keys apply without a restart.
+type KeyStore struct {
+	db        *sql.DB
+	legacyKey string
+
+	mu   sync.RWMutex
+	keys map[string]models.APIKey
+}
+
+// NewKeyStore creates a key store. The legacy key, when set, is accepted
+// with every scope so existing deployments keep working.
+func NewKeyStore(db *sql.DB, legacyKey string) *KeyStore {
+	return &KeyStore{
+		db:        db,
+		legacyKey: legacyKey,
+		keys:      map[string]models.APIKey{},
+	}
+}
+
+// Reload replaces the cached keys with the active keys in the database
+func (ks *KeyStore) Reload() error {
+	rows, err := ks.db.Query(`
+		SELECT key_id, client_name, key_prefix, key_hash, scopes, active, expires_at, created_at
+		FROM go_api_keys WHERE active = 'Y'
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := map[string]models.APIKey{}
+	for rows.Next() {
+		var key models.APIKey
+		var scopes string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&key.KeyID, &key.ClientName, &key.KeyPrefix, &key.KeyHash,
+			&scopes, &key.Active, &expiresAt, &key.CreatedAt); err != nil {
+			return err
+		}
+		key.Scopes = ParseScopes(scopes)
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		keys[key.KeyHash] = key
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+// StartRefresh reloads the key store on the given interval until stop is closed
+func (ks *KeyStore) StartRefresh(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ks.Reload(); err != nil {
+					log.Printf("Failed to reload API keys: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Configured reports whether any key can currently authenticate
+func (ks *KeyStore) Configured() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.legacyKey != "" || len(ks.keys) > 0
+}
+
+// Lookup returns the key matching the raw secret if it is active and unexpired
+func (ks *KeyStore) Lookup(raw string) (models.APIKey, bool) {
+	if ks.legacyKey != "" && raw == ks.legacyKey {
+		return models.APIKey{ClientName: legacyClientName, Scopes: []string{"*"}, Active: "Y"}, true
+	}
+
+	ks.mu.RLock()
+	key, ok := ks.keys[HashKey(raw)]
+	ks.mu.RUnlock()
+	if !ok {
+		return models.APIKey{}, false
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return models.APIKey{}, false
+	}
+	return key, true
+}
+
+// GenerateKey returns a new random key secret and its display prefix
+func GenerateKey() (string, string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	raw := "vk_" + hex.EncodeToString(buf)
+	return raw, raw[:11], nil
+}
+
+// HashKey returns the SHA-256 hex digest stored for a key secret
+func HashKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseScopes splits a comma separated scope list
+func ParseScopes(s string) []string {
+	scopes := []string{}
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// ValidScope reports whether a scope is "*", a known scope or "<resource>:*"
+// for a known resource
+func ValidScope(scope string) bool {
+	if scope == "*" {
+		return true
+	}
+	for _, known := range knownScopes {
+		if scope == known || scope == known[:strings.Index(known, ":")]+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the granted scopes satisfy the required scope
+func HasScope(granted []string, required string) bool {
+	resource := required
+	if i := strings.Index(required, ":"); i >= 0 {
+		resource = required[:i]
+	}
+	for _, scope := range granted {
+		if scope == "*" || scope == required || scope == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
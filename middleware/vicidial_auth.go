@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicidb/non-agent-api/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authentication modes selectable with AUTH_MODE
+const (
+	AuthModeAPIKey   = "api_key"
+	AuthModeVicidial = "vicidial"
+	AuthModeBoth     = "both"
+)
+
+// minAPIUserLevel mirrors the non_agent_api requirement of user_level > 7
+const minAPIUserLevel = 8
+
+// allCampaigns is VICIdial's marker for an unrestricted user group
+const allCampaigns = "-ALL-CAMPAIGNS-"
+
+// ErrInvalidLogin is returned for unknown users, wrong passwords and
+// users that are inactive or below the API user level.
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+// bcryptEncoding is the base64 alphabet VICIdial's bp.pl uses for the salt
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+type cachedUser struct {
+	user    models.APIUser
+	expires time.Time
+}
+
+// UserAuthenticator validates callers against vicidial_users the same way
+// the PHP non_agent_api does. Successful logins are cached briefly so the
+// bcrypt check does not run on every request.
+type UserAuthenticator struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedUser
+}
+
+// NewUserAuthenticator creates an authenticator that caches logins for ttl
+func NewUserAuthenticator(db *sql.DB, ttl time.Duration) *UserAuthenticator {
+	return &UserAuthenticator{
+		db:    db,
+		ttl:   ttl,
+		cache: map[string]cachedUser{},
+	}
+}
+
+// Authenticate checks the user/pass pair and loads the user's API permissions
+func (ua *UserAuthenticator) Authenticate(user, pass string) (models.APIUser, error) {
+	if user == "" || pass == "" {
+		return models.APIUser{}, ErrInvalidLogin
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + pass))
+	cacheKey := hex.EncodeToString(sum[:])
+
+	ua.mu.Lock()
+	if cached, ok := ua.cache[cacheKey]; ok && cached.expires.After(time.Now()) {
+		ua.mu.Unlock()
+		return cached.user, nil
+	}
+	ua.mu.Unlock()
+
+	apiUser, err := ua.load(user, pass)
+	if err != nil {
+		return models.APIUser{}, err
+	}
+
+	now := time.Now()
+	ua.mu.Lock()
+	for key, cached := range ua.cache {
+		if !cached.expires.After(now) {
+			delete(ua.cache, key)
+		}
+	}
+	ua.cache[cacheKey] = cachedUser{user: apiUser, expires: now.Add(ua.ttl)}
+	ua.mu.Unlock()
+
+	return apiUser, nil
+}
+
+func (ua *UserAuthenticator) load(user, pass string) (models.APIUser, error) {
+	var passHashEnabled, passCost int
+	var passKey string
+	err := ua.db.QueryRow("SELECT pass_hash_enabled, pass_key, pass_cost FROM system_settings LIMIT 1").
+		Scan(&passHashEnabled, &passKey, &passCost)
+	if err != nil {
+		return models.APIUser{}, err
+	}
+
+	query := `
+		SELECT u.user, u.pass, u.pass_hash, u.user_level, u.user_group,
+			   u.api_allowed_functions, u.api_list_restrict, u.active,
+			   COALESCE(g.allowed_campaigns, '')
+		FROM vicidial_users u
+		LEFT JOIN vicidial_user_groups g ON u.user_group = g.user_group
+		WHERE u.user = ?
+	`
+
+	var apiUser models.APIUser
+	var storedPass, storedHash, allowedFunctions, listRestrict, active, allowedCampaigns string
+	err = ua.db.QueryRow(query, user).Scan(
+		&apiUser.User, &storedPass, &storedHash, &apiUser.UserLevel, &apiUser.UserGroup,
+		&allowedFunctions, &listRestrict, &active, &allowedCampaigns,
+	)
+	if err == sql.ErrNoRows {
+		return models.APIUser{}, ErrInvalidLogin
+	}
+	if err != nil {
+		return models.APIUser{}, err
+	}
+
+	if passHashEnabled > 0 {
+		if !checkPassHash(pass, storedHash, passKey, passCost) {
+			return models.APIUser{}, ErrInvalidLogin
+		}
+	} else if storedPass != pass {
+		return models.APIUser{}, ErrInvalidLogin
+	}
+
+	if active != "Y" || apiUser.UserLevel < minAPIUserLevel {
+		return models.APIUser{}, ErrInvalidLogin
+	}
+
+	apiUser.AllowedFunctions = strings.Fields(allowedFunctions)
+	apiUser.ListRestrict = listRestrict == "Y"
+	apiUser.AllowedCampaigns = parseAllowedCampaigns(allowedCampaigns)
+	return apiUser, nil
+}
+
+// checkPassHash verifies a password against vicidial_users.pass_hash.
+// VICIdial stores only the 31-character digest of a bcrypt hash built from
+// system_settings.pass_key and pass_cost, so the full hash is rebuilt here.
+func checkPassHash(pass, storedHash, passKey string, passCost int) bool {
+	if strings.HasPrefix(storedHash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(pass)) == nil
+	}
+	if len(storedHash) != 31 {
+		return false
+	}
+
+	salt := passKey
+	if len(salt) != 22 {
+		salt = bcryptEncoding.EncodeToString([]byte(passKey))
+		if len(salt) < 22 {
+			return false
+		}
+		salt = salt[:22]
+	}
+	if passCost < bcrypt.MinCost {
+		passCost = bcrypt.MinCost
+	}
+
+	full := fmt.Sprintf("$2a$%02d$%s%s", passCost, salt, storedHash)
+	return bcrypt.CompareHashAndPassword([]byte(full), []byte(pass)) == nil
+}
+
+// parseAllowedCampaigns turns vicidial_user_groups.allowed_campaigns into a
+// campaign list. A nil result means every campaign is allowed.
+func parseAllowedCampaigns(s string) []string {
+	campaigns := []string{}
+	for _, campaign := range strings.Fields(s) {
+		if campaign == allCampaigns {
+			return nil
+		}
+		if campaign != "-" {
+			campaigns = append(campaigns, campaign)
+		}
+	}
+	return campaigns
+}
+
+// AllowsFunction reports whether the user's api_allowed_functions grants the function
+func AllowsFunction(user models.APIUser, function string) bool {
+	for _, allowed := range user.AllowedFunctions {
+		if allowed == "ALL_FUNCTIONS" || allowed == function {
+			return true
+		}
+	}
+	return false
+}
@@ -1,20 +1,46 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // APIResponse represents a standard API response
 type APIResponse struct {
-	Success bool        `json:"success"`
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success    bool        `json:"success"`
+	Message    string      `json:"message,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+	Links      *Links      `json:"links,omitempty"`
+}
+
+// Pagination describes one page of a paginated result
+type Pagination struct {
+	Limit      int    `json:"limit"`
+	Sort       string `json:"sort"`
+	Count      int    `json:"count"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Total      *int64 `json:"total,omitempty"`
+}
+
+// Links are URLs related to a response, such as the next page
+type Links struct {
+	Self string `json:"self"`
+	Next string `json:"next,omitempty"`
 }
 
 // Lead represents a lead in the system
 type Lead struct {
 	LeadID              int       `json:"lead_id"`
 	ListID              int       `json:"list_id"`
+	VendorLeadCode      string    `json:"vendor_lead_code"`
+	SourceID            string    `json:"source_id"`
+	GmtOffsetNow        string    `json:"gmt_offset_now"`
+	PhoneCode           string    `json:"phone_code"`
 	PhoneNumber         string    `json:"phone_number"`
+	Title               string    `json:"title"`
 	FirstName           string    `json:"first_name"`
 	LastName            string    `json:"last_name"`
 	MiddleInitial       string    `json:"middle_initial"`
@@ -207,6 +233,61 @@ type Hopper struct {
 	Source     string    `json:"source"`
 }
 
+// Callback represents a scheduled callback in vicidial_callbacks
+type Callback struct {
+	CallbackID   int        `json:"callback_id"`
+	LeadID       int        `json:"lead_id"`
+	ListID       int        `json:"list_id"`
+	CampaignID   string     `json:"campaign_id"`
+	Status       string     `json:"status"`
+	EntryTime    time.Time  `json:"entry_time"`
+	CallbackTime time.Time  `json:"callback_time"`
+	ModifyDate   *time.Time `json:"modify_date,omitempty"`
+	User         string     `json:"user"`
+	Recipient    string     `json:"recipient"`
+	Comments     string     `json:"comments"`
+	UserGroup    string     `json:"user_group"`
+	LeadStatus   string     `json:"lead_status"`
+}
+
+// Status represents a lead disposition, system-wide in vicidial_statuses or
+// for one campaign in vicidial_campaign_statuses
+type Status struct {
+	Status            string `json:"status"`
+	StatusName        string `json:"status_name"`
+	CampaignID        string `json:"campaign_id,omitempty"`
+	Selectable        string `json:"selectable"`
+	HumanAnswered     string `json:"human_answered"`
+	Category          string `json:"category"`
+	Sale              string `json:"sale"`
+	DNC               string `json:"dnc"`
+	CustomerContact   string `json:"customer_contact"`
+	NotInterested     string `json:"not_interested"`
+	Unworkable        string `json:"unworkable"`
+	ScheduledCallback string `json:"scheduled_callback"`
+	Completed         string `json:"completed"`
+	MinSec            int    `json:"min_sec"`
+	MaxSec            int    `json:"max_sec"`
+	AnsweringMachine  string `json:"answering_machine"`
+}
+
+// PauseCode represents an agent pause code of a campaign
+type PauseCode struct {
+	PauseCode     string `json:"pause_code"`
+	PauseCodeName string `json:"pause_code_name"`
+	Billable      string `json:"billable"`
+	CampaignID    string `json:"campaign_id"`
+}
+
+// Hotkey represents a key an agent presses to dispose a call with a status
+type Hotkey struct {
+	Hotkey     string `json:"hotkey"`
+	Status     string `json:"status"`
+	StatusName string `json:"status_name"`
+	Selectable string `json:"selectable"`
+	CampaignID string `json:"campaign_id"`
+}
+
 // InboundGroup represents an inbound call group
 type InboundGroup struct {
 	GroupID              string `json:"group_id"`
@@ -236,3 +317,74 @@ type SystemVersion struct {
 	Timezone string `json:"timezone"`
 	Date     string `json:"date"`
 }
+
+// APIKey represents a named API client key stored in go_api_keys
+type APIKey struct {
+	KeyID      int        `json:"key_id"`
+	ClientName string     `json:"client_name"`
+	KeyPrefix  string     `json:"key_prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	Active     string     `json:"active"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Key        string     `json:"key,omitempty"`
+}
+
+// APIUser represents a caller authenticated against vicidial_users
+type APIUser struct {
+	User             string   `json:"user"`
+	UserLevel        int      `json:"user_level"`
+	UserGroup        string   `json:"user_group"`
+	AllowedFunctions []string `json:"api_allowed_functions"`
+	AllowedCampaigns []string `json:"allowed_campaigns"`
+	ListRestrict     bool     `json:"api_list_restrict"`
+}
+
+// LeadAddResult reports what add_lead did with a posted lead and, when it
+// was not simply added, which check rejected or merged it
+type LeadAddResult struct {
+	Result         string `json:"result"`
+	LeadID         int    `json:"lead_id,omitempty"`
+	Check          string `json:"check,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	ExistingLeadID int    `json:"existing_lead_id,omitempty"`
+	GmtOffsetNow   string `json:"gmt_offset_now,omitempty"`
+	GmtUnresolved  string `json:"gmt_unresolved,omitempty"`
+	Hopper         string `json:"hopper,omitempty"`
+}
+
+// Job represents a background job stored in go_api_jobs. The requesting
+// user and client are kept so the job can be audited when it finishes;
+// on_behalf_of is the caller's unverified user hint.
+type Job struct {
+	JobID           int64           `json:"job_id"`
+	JobType         string          `json:"job_type"`
+	Status          string          `json:"status"`
+	Params          json.RawMessage `json:"params,omitempty"`
+	Progress        int             `json:"progress"`
+	Total           int             `json:"total"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	User            string          `json:"user"`
+	UserGroup       string          `json:"user_group,omitempty"`
+	APIClient       string          `json:"api_client,omitempty"`
+	OnBehalfOf      string          `json:"on_behalf_of,omitempty"`
+	IPAddress       string          `json:"-"`
+	Owner           string          `json:"owner,omitempty"`
+	Attempts        int             `json:"attempts"`
+	CancelRequested bool            `json:"cancel_requested"`
+	Checkpoint      string          `json:"-"`
+	CreatedAt       time.Time       `json:"created_at"`
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	HeartbeatAt     *time.Time      `json:"heartbeat_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+}
+
+// LeadWithCustomFields is a lead with the values of its list's custom
+// fields from custom_<list_id>, keyed by field label
+type LeadWithCustomFields struct {
+	Lead
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+}